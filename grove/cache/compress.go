@@ -0,0 +1,218 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/compress"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// EncodingKeySep separates the cache key of an object from the content coding of its encoded or decoded copy.
+const EncodingKeySep = cacheobj.DerivedKeySeparator + "encoding:"
+
+// negotiateEncoding returns the headers and body to serve the given object with, encoded or decoded per the request's Accept-Encoding and the rule's compress config. The hdr is the headers which would otherwise be served, and is never modified. If the object isn't transformed, hdr and body are returned.
+//
+// Identity responses with an eligible Content-Type are encoded with the first of the rule's encodings the client accepts. Encoded responses are decoded for clients which don't accept their encoding, if the rule decompresses. Encoded and decoded copies are cached under the object's cache key, and reused as long as the object is unchanged.
+func (h *Handler) negotiateEncoding(r *http.Request, cfg *remapdata.Compress, cache icache.Cache, cacheKey string, obj *cacheobj.CacheObj, hdr http.Header, body cacheobj.Body, reqID uint64) (http.Header, cacheobj.Body) {
+	if cfg == nil || obj.Code != http.StatusOK || (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" || obj.RespCacheControl.Has("no-transform") {
+		return hdr, body
+	}
+
+	encoding := compress.ContentEncoding(obj.RespHeaders)
+	toEncoding := ""
+	if encoding == "" {
+		if !compress.MimeTypeMatches(obj.RespHeaders.Get("Content-Type"), cfg.ParsedMimeTypes) {
+			return hdr, body
+		}
+		for _, enc := range cfg.Encodings {
+			if compress.Accepts(r.Header, enc) {
+				toEncoding = enc
+				break
+			}
+		}
+		if toEncoding == "" {
+			return varyHeaders(hdr), body
+		}
+	} else {
+		if !cfg.Decompress || compress.Supported(encoding) != nil {
+			return hdr, body
+		}
+		if compress.Accepts(r.Header, encoding) {
+			return varyHeaders(hdr), body
+		}
+		toEncoding = compress.Identity
+	}
+
+	if r.Method == http.MethodHead {
+		return encodedHeaders(hdr, toEncoding, nil), body // the body isn't sent, so there's no need to encode it
+	}
+
+	log.Debugf("cache.Handler.ServeHTTP: '%v' transforming from '%v' to '%v' (reqid %v)\n", cacheKey, encoding, toEncoding, reqID)
+	encodedObj := h.getEncoded(cache, encodedKey(cacheKey, obj, toEncoding), obj, encoding, toEncoding, reqID)
+	return encodedHeaders(hdr, toEncoding, encodedObj), encodedObj.Body()
+}
+
+// encodedKey returns the cache key of the copy of the given object with the given encoding, or the empty string if the copy can't be cached, because the object varies on `*`.
+func encodedKey(cacheKey string, obj *cacheobj.CacheObj, encoding string) string {
+	varyHdrs, ok := cacheobj.VaryHeaders(obj.RespHeaders)
+	if !ok {
+		return ""
+	}
+	if len(varyHdrs) > 0 {
+		cacheKey = cacheobj.VaryKey(cacheKey, varyHdrs, obj.ReqHeaders)
+	}
+	return cacheKey + EncodingKeySep + encoding
+}
+
+// getEncoded returns a copy of the source object, transformed from the fromEncoding to the toEncoding. The copy is taken from the cache or from a concurrent request if possible, and otherwise created, streaming as the source body is read, and cached when complete if the source is cacheable. If key is empty, the copy is always created, and never cached.
+//
+// The returned copy's headers are the source's, and only used to determine whether the copy is still valid; the served headers are always computed from the source.
+func (h *Handler) getEncoded(cache icache.Cache, key string, src *cacheobj.CacheObj, fromEncoding string, toEncoding string, reqID uint64) *cacheobj.CacheObj {
+	if src.Released() {
+		key = "" // the source is only read by this request, so its copy can't be shared or cached either
+	}
+	if key != "" {
+		if obj, ok := cache.Get(key); ok && encodedMatches(obj, src) {
+			log.Debugf("cache.Handler getEncoded '%v' cache hit (reqid %v)\n", key, reqID)
+			return obj
+		}
+		h.encodingM.Lock()
+		if obj, ok := h.encoding[key]; ok && encodedMatches(obj, src) {
+			h.encodingM.Unlock()
+			log.Debugf("cache.Handler getEncoded '%v' already encoding (reqid %v)\n", key, reqID)
+			return obj
+		}
+	}
+
+	obj, stream := cacheobj.NewStreaming(src.ReqHeaders, src.Code, src.OriginCode, src.ProxyURL, src.RespHeaders, src.ReqTime, src.ReqRespTime, src.RespRespTime, src.LastModified)
+	if key == "" {
+		stream.Release()
+	}
+	if key != "" {
+		h.encoding[key] = obj
+		h.encodingM.Unlock()
+	}
+
+	go func() {
+		if key != "" {
+			defer func() {
+				h.encodingM.Lock()
+				if h.encoding[key] == obj {
+					delete(h.encoding, key)
+				}
+				h.encodingM.Unlock()
+			}()
+		}
+		err := transcode(stream, src.Body(), fromEncoding, toEncoding)
+		stream.Close(err)
+		if err != nil {
+			log.Errorf("encoding '%v' from '%v' to '%v': %v (reqid %v)\n", key, fromEncoding, toEncoding, err, reqID)
+			return
+		}
+		if key == "" || !rfc.CanCache(http.MethodGet, src.ReqHeaders, src.Code, src.RespHeaders, h.strictRFC) {
+			return
+		}
+		completeObj, err := obj.Completed()
+		if err != nil {
+			return // should never happen, the stream already succeeded
+		}
+		log.Debugf("h.cache.Add %v (reqid %v)\n", key, reqID)
+		cache.Add(key, completeObj)
+	}()
+	return obj
+}
+
+// encodedMatches returns whether the given encoded copy was made from the given source object. Because a revalidated source keeps its body, the copy is valid as long as the source's Last-Modified and ETag are unchanged.
+func encodedMatches(encoded *cacheobj.CacheObj, src *cacheobj.CacheObj) bool {
+	return encoded.LastModified.Equal(src.LastModified) && encoded.RespHeaders.Get("ETag") == src.RespHeaders.Get("ETag")
+}
+
+// transcode writes the body to w, decoded from the fromEncoding, and encoded with the toEncoding. Either may be identity or empty, meaning the body isn't decoded or encoded.
+func transcode(w io.Writer, body cacheobj.Body, fromEncoding string, toEncoding string) error {
+	if toEncoding != "" && toEncoding != compress.Identity {
+		encoder, err := compress.NewWriter(toEncoding, w)
+		if err != nil {
+			return err
+		}
+		if err := transcode(encoder, body, fromEncoding, ""); err != nil {
+			encoder.Close()
+			return err
+		}
+		return encoder.Close()
+	}
+
+	if fromEncoding == "" || fromEncoding == compress.Identity {
+		_, err := body.WriteTo(w)
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := body.WriteTo(pw)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close() // unblocks the body writer, if decoding fails
+	decoder, err := compress.NewReader(fromEncoding, pr)
+	if err != nil {
+		return err
+	}
+	defer decoder.Close()
+	_, err = io.Copy(w, decoder)
+	return err
+}
+
+// encodedHeaders returns a copy of the given headers for the given object encoded with the given encoding, which may be identity. If the encoded object isn't nil and has been completely encoded, its Content-Length is set, otherwise it's removed.
+// The ETag is made weak, because the encoded body isn't byte-for-byte the same as the source's, per RFC7232§2.1.
+func encodedHeaders(hdr http.Header, encoding string, encodedObj *cacheobj.CacheObj) http.Header {
+	hdr = varyHeaders(hdr)
+	if encoding == compress.Identity {
+		hdr.Del(rfc.ContentEncoding)
+	} else {
+		hdr.Set(rfc.ContentEncoding, encoding)
+	}
+	hdr.Del("Content-Length")
+	if encodedObj != nil && !encodedObj.Streaming() {
+		hdr.Set("Content-Length", strconv.FormatUint(encodedObj.Size, 10))
+	}
+	if etag := hdr.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		hdr.Set("ETag", "W/"+etag)
+	}
+	return hdr
+}
+
+// varyHeaders returns a copy of the given headers, with Accept-Encoding added to the Vary, because the response depends on the request's Accept-Encoding.
+func varyHeaders(hdr http.Header) http.Header {
+	hdr = web.CopyHeader(hdr)
+	for _, vary := range hdr["Vary"] {
+		for _, name := range strings.Split(vary, ",") {
+			if name = strings.TrimSpace(name); name == "*" || strings.EqualFold(name, rfc.AcceptEncoding) {
+				return hdr
+			}
+		}
+	}
+	hdr.Add("Vary", rfc.AcceptEncoding)
+	return hdr
+}
@@ -18,12 +18,15 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 
 	"github.com/apache/trafficcontrol/grove/cachedata"
+	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/purge"
 
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/stat"
@@ -48,6 +51,11 @@ func (h *HandlerPointer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	realHandler.ServeHTTP(w, r)
 }
 
+// Get returns the current Handler.
+func (h *HandlerPointer) Get() *Handler {
+	return (*Handler)(atomic.LoadPointer(h.realHandler))
+}
+
 func (h *HandlerPointer) Set(newHandler *Handler) {
 	p := (unsafe.Pointer)(newHandler)
 	atomic.StorePointer(h.realHandler, p)
@@ -69,20 +77,16 @@ type Handler struct {
 	httpConns       *web.ConnMap
 	httpsConns      *web.ConnMap
 	interfaceName   string
+	jobs            *purge.Jobs
+	revalidating    map[string]struct{} // keys being revalidated in the background, for stale-while-revalidate
+	revalidatingM   sync.Mutex
+	encoding        map[string]*cacheobj.CacheObj // encoded copies of objects being created, by key, for the rule compress config
+	encodingM       sync.Mutex
 	requestID       uint64 // Atomic - DO NOT access or modify without atomic operations
-	// keyThrottlers     Throttlers
+	inProgress      int64  // Atomic - the number of requests and background revalidations in progress, so a replaced handler can be drained
 	// nocacheThrottlers Throttlers
 }
 
-// func (h *cacheHandler) checkoutKeyThrottler(k string) Throttler {
-// 	keyThrottlersM.Lock()
-// 	defer keyThrottlersM.Unlock()
-// 	if t, ok := keyThrottlers[k]; !ok {
-// 		keyThrottlers[k] = NewThrottler
-// 	}
-// 	return keyThrottlers[k]
-// }
-
 // NewHandler returns an http.Handler object, which may be pipelined with other http.Handlers via `http.ListenAndServe`. If you prefer pipelining functions, use `GetHandlerFunc`.
 //
 // This needs rate-limited in 3 ways.
@@ -92,6 +96,8 @@ type Handler struct {
 //
 // Note these only apply to cache misses. Cache hits are not limited in any way, the origin is not hit and the cache value is immediately returned to the client.
 //
+// Currently, the keyLimit is always 1: concurrent cache misses for the same key are collapsed by the getter into a single parent request, whose object is given to all of them. Each remap rule may limit how long requests wait for the collapsed request with `collapse_timeout_ms`, after which they make their own parent request, or fail, per the rule's `collapse_fallthrough`.
+//
 // This prevents a large number of uncacheable requests for the same URL from timing out because they're required to proceed serially from the low simultaneous-requests-per-URL limit, while at the same time only hitting the origin with a very low limit for many simultaneous cacheable requests.
 //
 // Example: Origin limit is 10,000, key limit is 1, the uncacheable limit is 1,000.
@@ -112,6 +118,7 @@ func NewHandler(
 	httpConns *web.ConnMap,
 	httpsConns *web.ConnMap,
 	interfaceName string,
+	jobs *purge.Jobs,
 ) *Handler {
 	hostname, err := os.Hostname()
 	if err != nil {
@@ -134,7 +141,9 @@ func NewHandler(
 		httpConns:       httpConns,
 		httpsConns:      httpsConns,
 		interfaceName:   interfaceName,
-		// keyThrottlers:     NewThrottlers(keyLimit),
+		jobs:            jobs,
+		revalidating:    map[string]struct{}{},
+		encoding:        map[string]*cacheobj.CacheObj{},
 		// nocacheThrottlers: NewThrottlers(nocacheLimit),
 	}
 }
@@ -161,12 +170,28 @@ func copyPluginContext(context map[string]*interface{}) map[string]*interface{}
 	return new
 }
 
+// drainPollInterval is how often Drain checks whether requests in progress have finished.
+const drainPollInterval = 100 * time.Millisecond
+
+// Drain waits for the requests in progress, and their background revalidations, to finish, until the given deadline. Returns whether they finished. This is used after the handler is replaced, before closing resources its requests may be using.
+func (h *Handler) Drain(deadline time.Time) bool {
+	for atomic.LoadInt64(&h.inProgress) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return true
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&h.inProgress, 1)
+	defer atomic.AddInt64(&h.inProgress, -1)
 	reqTime := time.Now()
 	reqID := atomic.AddUint64(&h.requestID, 1)
 	pluginContext := copyPluginContext(h.pluginContext) // must give each request a copy, because they can modify in parallel
 	srvrData := cachedata.SrvrData{Hostname: h.hostname, Port: h.port, Scheme: h.scheme}
-	onReqData := plugin.OnRequestData{W: w, R: r, Stats: h.stats, StatRules: h.remapper.StatRules(), HTTPConns: h.httpConns, HTTPSConns: h.httpsConns, InterfaceName: h.interfaceName, SrvrData: srvrData, RequestID: reqID}
+	onReqData := plugin.OnRequestData{W: w, R: r, Stats: h.stats, StatRules: h.remapper.StatRules(), HTTPConns: h.httpConns, HTTPSConns: h.httpsConns, InterfaceName: h.interfaceName, SrvrData: srvrData, RequestID: reqID, Jobs: h.jobs}
 	stop := h.plugins.OnRequest(h.remapper.PluginCfg(), pluginContext, onReqData)
 	if stop {
 		return
@@ -229,10 +254,14 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	cacheKey := remappingProducer.CacheKey()
 	retrier := NewRetrier(h, reqHeader, reqTime, reqCacheControl, remappingProducer, reqID)
 
+	if h.serveSlices(r, remappingProducer, responder, cacheKey, reqTime, reqCacheControl, connectionClose, pluginContext, reqID) {
+		return
+	}
+
 	cache := remappingProducer.Cache()
 
 	var reqHost *string
-	cacheObj, ok := cache.Get(cacheKey)
+	cacheObj, ok := getVariant(cache, cacheKey, reqHeader)
 	if !ok {
 		log.Debugf("cache.Handler.ServeHTTP: '%v' not in cache (reqid %v)\n", cacheKey, reqID)
 		beforeParentRequestData := plugin.BeforeParentRequestData{Req: r, RemapRule: remappingProducer.Name()}
@@ -251,7 +280,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 		responder.OriginCode = cacheObj.OriginCode
 		// create new pointers, so plugins don't modify the cacheObj
-		codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body
+		codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body()
+		hdrsPtr, bodyPtr = h.negotiateEncoding(r, remappingProducer.Compress(), cache, cacheKey, cacheObj, hdrsPtr, bodyPtr, reqID)
 		responder.SetResponse(&codePtr, &hdrsPtr, &bodyPtr, connectionClose)
 		responder.OriginReqSuccess = true
 		responder.ProxyStr = cacheObj.ProxyURL
@@ -266,6 +296,23 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	reqHeaders := r.Header
 	canReuseStored := rfc.CanReuseStored(reqHeaders, cacheObj.RespHeaders, reqCacheControl, cacheObj.RespCacheControl, cacheObj.ReqHeaders, cacheObj.ReqRespTime, cacheObj.RespRespTime, h.strictRFC)
+	jobReuse, invalidated := h.jobs.Invalidated(remappingProducer.Name(), cacheKey, cacheObj.ReqRespTime, reqTime)
+	if invalidated && canReuseStored != rfc.ReuseCannot {
+		log.Debugf("cache.Handler.ServeHTTP: '%v' invalidated by job: %v (reqid %v)\n", cacheKey, jobReuse, reqID)
+		if jobReuse == rfc.ReuseCannot || canReuseStored == rfc.ReuseCan {
+			canReuseStored = jobReuse // a stale object may still be served if revalidation fails, as without the job
+		}
+	}
+
+	staleWarning := ""
+	if (canReuseStored == rfc.ReuseMustRevalidate || canReuseStored == rfc.ReuseMustRevalidateCanStale) && !invalidated {
+		if swr, ok := remappingProducer.StaleWhileRevalidate(); canStaleWhileRevalidate(cacheObj, reqCacheControl, swr, ok) {
+			log.Debugf("cache.Handler.ServeHTTP: '%v' stale, serving while revalidating (reqid %v)\n", cacheKey, reqID)
+			h.revalidateInBackground(retrier, r, cacheKey, cacheObj, reqID)
+			canReuseStored = rfc.ReuseCan
+			staleWarning = WarningStale
+		}
+	}
 
 	if canReuseStored != rfc.ReuseCan { // run the BeforeParentRequest hook for revalidations / ReuseCannot
 		beforeParentRequestData := plugin.BeforeParentRequestData{Req: r, RemapRule: remappingProducer.Name()}
@@ -285,8 +332,17 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	case rfc.ReuseMustRevalidate:
 		log.Debugf("cache.Handler.ServeHTTP: '%v' must revalidate (reqid %v)\n", cacheKey, reqID)
+		oldCacheObj := cacheObj
 		cacheObj, reqHost, err = retrier.Get(r, cacheObj)
-		if err != nil {
+		if sie, ok := remappingProducer.StaleIfError(); (err != nil || isErrorResponse(cacheObj)) && canStaleIfError(oldCacheObj, reqCacheControl, sie, ok) {
+			if err != nil {
+				log.Errorf("revalidating failed with error %v - serving stale-if-error (reqid %v)\n", err, reqID)
+			} else {
+				log.Errorf("revalidating failed with code %v - serving stale-if-error (reqid %v)\n", cacheObj.Code, reqID)
+			}
+			cacheObj = oldCacheObj
+			staleWarning = WarningRevalidationFailed
+		} else if err != nil {
 			log.Errorf("retrying get error: %v (reqid %v)\n", err, reqID)
 			responder.Do()
 			return
@@ -298,12 +354,21 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if err != nil {
 			log.Errorf("retrying get error - serving stale as allowed: %v (reqid %v)\n", err, reqID)
 			cacheObj = oldCacheObj
+			staleWarning = WarningRevalidationFailed
+		} else if sie, ok := remappingProducer.StaleIfError(); isErrorResponse(cacheObj) && canStaleIfError(oldCacheObj, reqCacheControl, sie, ok) {
+			log.Errorf("revalidating got error code %v - serving stale-if-error (reqid %v)\n", cacheObj.Code, reqID)
+			cacheObj = oldCacheObj
+			staleWarning = WarningRevalidationFailed
 		}
 	}
 	log.Debugf("cache.Handler.ServeHTTP: '%v' responding with %v (reqid %v)\n", cacheKey, cacheObj.Code, reqID)
 
 	// create new pointers, so plugins don't modify the cacheObj
-	codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body
+	codePtr, hdrsPtr, bodyPtr := cacheObj.Code, cacheObj.RespHeaders, cacheObj.Body()
+	if staleWarning != "" {
+		hdrsPtr = staleHeaders(cacheObj, staleWarning)
+	}
+	hdrsPtr, bodyPtr = h.negotiateEncoding(r, remappingProducer.Compress(), cache, cacheKey, cacheObj, hdrsPtr, bodyPtr, reqID)
 	responder.SetResponse(&codePtr, &hdrsPtr, &bodyPtr, connectionClose)
 	responder.OriginReqSuccess = true
 	responder.Reuse = canReuseStored
@@ -0,0 +1,373 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/compress"
+	"github.com/apache/trafficcontrol/grove/health"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/memcache"
+	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/purge"
+	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/web"
+)
+
+// newTestHandler returns a Handler for the given remap rules JSON, and its default cache.
+func newTestHandler(t *testing.T, rulesJSON string) (*Handler, icache.Cache) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "remap.json")
+	if err := ioutil.WriteFile(path, []byte(rulesJSON), 0644); err != nil {
+		t.Fatalf("writing remap rules: %v", err)
+	}
+	const cacheBytes = 1024 * 1024
+	caches := map[string]icache.Cache{"": memcache.New(cacheBytes)}
+	plugins := plugin.Get(nil)
+	transport := remap.NewRemappingTransport(time.Second, time.Second, 10, time.Second)
+	remapper, err := remap.LoadRemapper(path, plugins.LoadFuncs(), caches, transport, health.NewChecker())
+	if err != nil {
+		t.Fatalf("loading remap rules: %v", err)
+	}
+	conns := web.NewConnMap()
+	stats := stat.New(remapper.Rules(), caches, cacheBytes, conns, conns, "test")
+	h := NewHandler(remapper, 0, stats, "http", "80", conns, false, false, plugins, map[string]*interface{}{}, conns, conns, "", purge.NewJobs())
+	return h, caches[""]
+}
+
+// testRules returns remap rules JSON with a single rule from http://grove.test to the given parent. The ruleJSON is any additional rule properties, e.g. `"retry_num": 1`.
+func testRules(parent string, ruleJSON string) string {
+	if ruleJSON != "" {
+		ruleJSON = "," + ruleJSON
+	}
+	return `{"parent_selection": "consistent-hash", "retry_num": 0, "retry_codes": [], "timeout_ms": 5000, "rules": [{"name": "test", "from": "http://grove.test", "to": [{"url": "` + parent + `", "weight": 1}]` + ruleJSON + `}]}`
+}
+
+// newTestRequest returns a request for the given path of http://grove.test, as received by a server.
+func newTestRequest(method string, path string) *http.Request {
+	req := httptest.NewRequest(method, "http://grove.test"+path, nil)
+	req.RequestURI = path
+	return req
+}
+
+func TestHandlerCollapsesWhileStreaming(t *testing.T) {
+	originHits := uint64(0)
+	firstChunkSent := make(chan struct{})
+	firstChunkSentOnce := sync.Once{}
+	release := make(chan struct{})
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&originHits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("first chunk,"))
+		w.(http.Flusher).Flush()
+		firstChunkSentOnce.Do(func() { close(firstChunkSent) })
+		<-release
+		w.Write([]byte("second chunk"))
+	}))
+	defer origin.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	h, _ := newTestHandler(t, testRules(origin.URL, ""))
+	grove := httptest.NewServer(h)
+	defer grove.Close()
+
+	get := func() (string, error) {
+		req, err := http.NewRequest(http.MethodGet, grove.URL+"/obj", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Host = "grove.test"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	bodies := make([]string, 2)
+	errs := make([]error, 2)
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bodies[0], errs[0] = get()
+	}()
+	<-firstChunkSent
+	time.Sleep(50 * time.Millisecond) // let the first request receive its headers
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		bodies[1], errs[1] = get()
+	}()
+	time.Sleep(50 * time.Millisecond) // let the second request join the first while its body is being received
+	close(release)
+	wg.Wait()
+
+	for i := range bodies {
+		if errs[i] != nil {
+			t.Fatalf("request %v unexpected error: %v", i, errs[i])
+		}
+		if bodies[i] != "first chunk,second chunk" {
+			t.Errorf("request %v expected body 'first chunk,second chunk', actual '%v'", i, bodies[i])
+		}
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 1 {
+		t.Errorf("request arriving while the body was being received expected 1 origin request, actual %v", hits)
+	}
+}
+
+func TestHandlerStaleIfErrorParentDown(t *testing.T) {
+	origin := httptest.NewServer(http.NotFoundHandler())
+	downParent := origin.URL
+	origin.Close() // the parent is down, so revalidating fails to connect
+
+	tests := []struct {
+		name     string
+		ruleJSON string
+	}{
+		{"parent connect failure", `"stale_if_error": 60`},
+		{"no parent request", `"stale_if_error": 60, "retry_num": -1`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, cache := newTestHandler(t, testRules(downParent, test.ruleJSON))
+
+			req := newTestRequest(http.MethodGet, "/obj")
+			producer, err := h.remapper.RemappingProducer(req, "http")
+			if err != nil {
+				t.Fatalf("getting remapping: %v", err)
+			}
+			staleTime := time.Now().Add(-10 * time.Second)
+			respHdr := http.Header{}
+			respHdr.Set("Cache-Control", "max-age=1, max-stale=1") // stale beyond max-stale must be revalidated
+			respHdr.Set("Date", staleTime.UTC().Format(http.TimeFormat))
+			staleObj := cacheobj.New(http.Header{}, cacheobj.NewChunks([]byte("stale body")), http.StatusOK, http.StatusOK, "", respHdr, staleTime, staleTime, staleTime, staleTime)
+			cache.Add(producer.CacheKey(), staleObj)
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("expected stale code %v, actual %v", http.StatusOK, w.Code)
+			}
+			if body := w.Body.String(); body != "stale body" {
+				t.Errorf("expected stale body 'stale body', actual '%v'", body)
+			}
+			if warning := w.Header().Get(WarningHdr); warning != WarningRevalidationFailed {
+				t.Errorf("expected Warning '%v', actual '%v'", WarningRevalidationFailed, warning)
+			}
+		})
+	}
+}
+
+func TestHandlerNegotiatesEncoding(t *testing.T) {
+	body := bytes.Repeat([]byte("grove handler compression "), 100)
+	gzipBody := &bytes.Buffer{}
+	gzipWriter, err := compress.NewWriter(compress.Gzip, gzipBody)
+	if err != nil {
+		t.Fatalf("creating gzip writer: %v", err)
+	}
+	gzipWriter.Write(body)
+	gzipWriter.Close()
+
+	originHits := uint64(0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&originHits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+		w.Header().Set("Content-Type", "text/plain")
+		if r.URL.Path == "/gzipped" {
+			w.Header().Set("Content-Encoding", compress.Gzip)
+			w.Write(gzipBody.Bytes())
+			return
+		}
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	h, _ := newTestHandler(t, testRules(origin.URL, `"compress": {"encodings": ["br", "gzip"], "decompress": true}`))
+
+	tests := []struct {
+		name             string
+		path             string
+		acceptEncoding   string
+		expectedEncoding string
+	}{
+		{"brotli", "/identity", "br", compress.Brotli},
+		{"gzip", "/identity", "gzip", compress.Gzip},
+		{"rule preference", "/identity", "gzip, br", compress.Brotli},
+		{"not accepted", "/identity", "", ""},
+		{"encoded brotli cache hit", "/identity", "br", compress.Brotli},
+		{"parent encoding accepted", "/gzipped", "gzip", compress.Gzip},
+		{"parent encoding decompressed", "/gzipped", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodGet, test.path)
+			if test.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", test.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected code %v, actual %v", http.StatusOK, w.Code)
+			}
+			if encoding := w.Header().Get("Content-Encoding"); encoding != test.expectedEncoding {
+				t.Errorf("expected Content-Encoding '%v', actual '%v'", test.expectedEncoding, encoding)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("expected Vary 'Accept-Encoding', actual '%v'", vary)
+			}
+			actual := w.Body.Bytes()
+			if test.expectedEncoding != "" {
+				r, err := compress.NewReader(test.expectedEncoding, w.Body)
+				if err != nil {
+					t.Fatalf("creating %v reader: %v", test.expectedEncoding, err)
+				}
+				if actual, err = ioutil.ReadAll(r); err != nil {
+					t.Fatalf("decoding %v body: %v", test.expectedEncoding, err)
+				}
+			}
+			if !bytes.Equal(actual, body) {
+				t.Errorf("expected decoded body '%v', actual '%v'", string(body), string(actual))
+			}
+		})
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 2 {
+		t.Errorf("expected 1 origin request per path, actual %v", hits)
+	}
+}
+
+func TestHandlerServesRangeFromSlices(t *testing.T) {
+	body := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	originHits := uint64(0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&originHits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+	}))
+	defer origin.Close()
+
+	h, cache := newTestHandler(t, testRules(origin.URL, `"range_slice_bytes": 10`))
+	get := func(rangeHdr string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodGet, "/obj")
+		req.Header.Set("Range", rangeHdr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("bytes=5-14")
+	if w.Code != http.StatusPartialContent {
+		t.Fatalf("expected code %v, actual %v", http.StatusPartialContent, w.Code)
+	}
+	if contentRange := w.Header().Get("Content-Range"); contentRange != "bytes 5-14/36" {
+		t.Errorf("expected Content-Range 'bytes 5-14/36', actual '%v'", contentRange)
+	}
+	if !bytes.Equal(w.Body.Bytes(), body[5:15]) {
+		t.Errorf("expected body '%v', actual '%v'", string(body[5:15]), w.Body.String())
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 2 {
+		t.Errorf("expected 1 origin request for each of the 2 slices, actual %v", hits)
+	}
+
+	if w := get("bytes=12-19"); w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), body[12:20]) {
+		t.Errorf("expected cached slice to serve code %v body '%v', actual %v '%v'", http.StatusPartialContent, string(body[12:20]), w.Code, w.Body.String())
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 2 {
+		t.Errorf("expected range within a cached slice served from the cache, actual %v origin requests", hits)
+	}
+
+	purged, err := purge.Purge(cache, purge.MatchExact, origin.URL+"/obj")
+	if err != nil {
+		t.Fatalf("purging: %v", err)
+	}
+	if purged != 2 {
+		t.Errorf("expected exact purge of the object to remove its 2 slices, actual %v keys removed", purged)
+	}
+	if w := get("bytes=5-14"); !bytes.Equal(w.Body.Bytes(), body[5:15]) {
+		t.Errorf("expected body '%v' after purge, actual '%v'", string(body[5:15]), w.Body.String())
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 4 {
+		t.Errorf("expected purged slices fetched again from the origin, actual %v origin requests", hits)
+	}
+}
+
+func TestHandlerSlicesFromParentIgnoringRange(t *testing.T) {
+	body := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	originHits := uint64(0)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint64(&originHits, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.Write(body) // ignores Range, always returning the entire object
+	}))
+	defer origin.Close()
+
+	h, cache := newTestHandler(t, testRules(origin.URL, `"range_slice_bytes": 10`))
+	get := func(rangeHdr string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodGet, "/obj")
+		req.Header.Set("Range", rangeHdr)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, r := range []struct {
+		hdr   string
+		start int
+		end   int
+	}{{"bytes=5-7", 5, 7}, {"bytes=25-27", 25, 27}} {
+		w := get(r.hdr)
+		if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), body[r.start:r.end+1]) {
+			t.Errorf("range '%v' expected code %v body '%v', actual %v '%v'", r.hdr, http.StatusPartialContent, string(body[r.start:r.end+1]), w.Code, w.Body.String())
+		}
+	}
+	if hits := atomic.LoadUint64(&originHits); hits != 1 {
+		t.Errorf("expected ranges in different slices served from the one cached entire object, actual %v origin requests", hits)
+	}
+
+	keys := cache.Keys()
+	if len(keys) != 1 || strings.Contains(keys[0], SliceKeySep) {
+		t.Errorf("expected the entire object cached once under its own key, actual keys %v", keys)
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"net/http"
 
 	"github.com/apache/trafficcontrol/grove/cachedata"
+	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/stat"
 	"github.com/apache/trafficcontrol/grove/web"
@@ -78,12 +79,15 @@ func NewResponder(w http.ResponseWriter, pluginCfg map[string]interface{}, plugi
 }
 
 // SetResponse is a helper which sets the RespondFunc of r to `web.Respond` with the given code, headers, body, and connectionClose. Note it takes a pointer to the headers and body, which may be modified after calling this but before the Do() sends the response.
-func (r *Responder) SetResponse(code *int, hdrs *http.Header, body *[]byte, connectionClose bool) {
+func (r *Responder) SetResponse(code *int, hdrs *http.Header, body *cacheobj.Body, connectionClose bool) {
 	r.ResponseCode = code
 	r.F = func() (uint64, error) {
 		if r.Req.Method == http.MethodHead {
 			*body = nil
 		}
+		if *body == nil {
+			return web.Respond(r.W, *code, *hdrs, nil, connectionClose) // must pass an untyped nil, not a nil Body
+		}
 		return web.Respond(r.W, *code, *hdrs, *body, connectionClose)
 	}
 }
@@ -16,13 +16,16 @@ package cache
 
 import (
 	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/thread"
 	"github.com/apache/trafficcontrol/grove/web"
 
@@ -32,6 +35,9 @@ import (
 
 const CodeConnectFailure = http.StatusBadGateway
 
+// CodeCollapseTimeout is the code returned to clients which time out waiting for a concurrent parent request for the same object, if the remap rule's collapse fallthrough is "error".
+const CodeCollapseTimeout = http.StatusGatewayTimeout
+
 type Retrier struct {
 	H                 *Handler
 	ReqHdr            http.Header
@@ -59,13 +65,33 @@ func (r *Retrier) Get(req *http.Request, obj *cacheobj.CacheObj) (*cacheobj.Cach
 		canReuse := func(cacheObj *cacheobj.CacheObj) bool {
 			return cacheobj.CanReuse(r.ReqHdr, r.ReqCacheControl, cacheObj, r.H.strictRFC, true)
 		}
-		getAndCache := func() *cacheobj.CacheObj {
-			return GetAndCache(remapping.Request, remapping.ProxyURL, remapping.CacheKey, remapping.Name, remapping.Request.Header, r.ReqTime, r.H.strictRFC, remapping.Cache, r.H.ruleThrottlers[remapping.Name], obj, remapping.Timeout, retryFailures, remapping.RetryNum, remapping.RetryCodes, remapping.Transport, r.ReqID)
+		getAndCache := func() (*cacheobj.CacheObj, <-chan struct{}) {
+			start := time.Now()
+			gotObj, done := GetAndCache(remapping.Request, remapping.ProxyURL, remapping.CacheKey, remapping.FullCacheKey, remapping.Name, remapping.Request.Header, r.ReqTime, r.H.strictRFC, remapping.Cache, r.H.ruleThrottlers[remapping.Name], obj, remapping.Timeout, retryFailures, remapping.RetryNum, remapping.RetryCodes, remapping.Transport, remapping.MaxVariants, r.ReqID)
+			if ruleStats, ok := r.H.stats.Remap().Stats(req.Host); ok {
+				ruleStats.AddParentLatency(time.Since(start))
+			}
+			if isFailure(gotObj, remapping.RetryCodes) {
+				remapping.Health.Failed("request returned code " + strconv.Itoa(gotObj.Code))
+			} else {
+				remapping.Health.Succeeded()
+			}
+			return gotObj, done
+		}
+		collapseTimedOut := func() *cacheobj.CacheObj {
+			gotObj, _ := getAndCache()
+			return gotObj
 		}
-		gotObj, getReqID := r.H.getter.Get(remapping.CacheKey, getAndCache, canReuse, r.ReqID)
+		if remapping.CollapseFallthrough == remapdata.CollapseFallthroughError {
+			collapseTimedOut = func() *cacheobj.CacheObj {
+				log.Errorf("Retrier.Get timed out after %v waiting for concurrent request for %v rule %v (reqid %v)\n", remapping.CollapseTimeout, remapping.CacheKey, remapping.Name, r.ReqID)
+				return newErrorObj(CodeCollapseTimeout, r.ReqHdr)
+			}
+		}
+		gotObj, getReqID := r.H.getter.Get(remapping.CacheKey, getAndCache, canReuse, remapping.CollapseTimeout, collapseTimedOut, r.ReqID)
 
 		req := remapping.Request
-		log.Debugf("Retrier.Get Y URI %v %v %v remapping.CacheKey %v rule %v parent %v code %v headers %+v len(body) %v getterid %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), remapping.CacheKey, remapping.Name, remapping.ProxyURL, gotObj.Code, gotObj.RespHeaders, len(gotObj.Body), getReqID, r.ReqID)
+		log.Debugf("Retrier.Get Y URI %v %v %v remapping.CacheKey %v rule %v parent %v code %v headers %+v size %v getterid %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), remapping.CacheKey, remapping.Name, remapping.ProxyURL, gotObj.Code, gotObj.RespHeaders, gotObj.Size, getReqID, r.ReqID)
 
 		return gotObj
 	}
@@ -102,12 +128,15 @@ func isFailure(o *cacheobj.CacheObj, retryCodes map[int]struct{}) bool {
 
 const ModifiedSinceHdr = "If-Modified-Since"
 
-// GetAndCache makes a client request for the given `http.Request` and caches it if `CanCache`.
+// GetAndCache makes a client request for the given `http.Request` and caches it if `CanCache`. Responses with a Vary header are cached as variants of cacheKey, keeping at most maxVariants.
 // THe `ruleThrottler` may be nil, in which case the request will be unthrottled.
+//
+// The returned object is returned as soon as the parent's response headers are received. Its body is streamed from the parent, and may be read via its Body() while it's being received. Once the body is complete, the object is added to the cache, if it's cacheable, and the returned chan is closed. The ruleThrottler is held until the body is complete.
 func GetAndCache(
 	req *http.Request,
 	proxyURL *url.URL,
 	cacheKey string,
+	fullCacheKey string,
 	remapName string,
 	reqHeader http.Header,
 	reqTime time.Time,
@@ -120,10 +149,12 @@ func GetAndCache(
 	retryNum int,
 	retryCodes map[int]struct{},
 	transport *http.Transport,
+	maxVariants int,
 	reqID uint64,
-) *cacheobj.CacheObj {
+) (*cacheobj.CacheObj, <-chan struct{}) {
 	// TODO this is awkward, with 'revalidateObj' indicating whether the request is a Revalidate. Should Getting and Caching be split up? How?
-	get := func() *cacheobj.CacheObj {
+	// get sends the object to objChan as soon as it's created, and then returns when its body is complete.
+	get := func(objChan chan<- *cacheobj.CacheObj) {
 		// TODO figure out why respReqTime isn't used by rules
 		log.Debugf("GetAndCache calling request %v %v %v %v %v (reqid %v)\n", req.Method, req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), req.Header, reqID)
 		// TODO Verify overriding the passed reqTime is the right thing to do
@@ -137,16 +168,23 @@ func GetAndCache(
 			req.Header.Del(ModifiedSinceHdr)
 		}
 		respCode, respHeader, respBody, reqTime, reqRespTime, err := web.Request(transport, req)
-		log.Debugf("GetAndCache web.Request URI %v %v %v cacheKey %v rule %v parent %v error %v reval %v code %v len(body) %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, revalidateObj != nil, respCode, len(respBody), reqID)
+		log.Debugf("GetAndCache web.Request URI %v %v %v cacheKey %v rule %v parent %v error %v reval %v code %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, revalidateObj != nil, respCode, reqID)
 
 		if err != nil {
 			log.Errorf("Parent error for URI %v %v %v cacheKey %v rule %v parent %v error %v (reqid %v)\n", req.URL.Scheme, req.URL.Host, req.URL.EscapedPath(), cacheKey, remapName, proxyURLStr, err, reqID)
 			code := CodeConnectFailure
-			body := []byte(http.StatusText(code))
-			return cacheobj.New(reqHeader, body, code, code, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+			body := cacheobj.NewChunks([]byte(http.StatusText(code)))
+			objChan <- cacheobj.New(reqHeader, body, code, code, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+			return
 		}
+		defer respBody.Close()
+
 		if _, ok := retryCodes[respCode]; ok && !cacheFailure {
-			return cacheobj.New(reqHeader, respBody, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+			obj, stream := cacheobj.NewStreaming(reqHeader, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, reqRespTime, time.Time{})
+			stream.Release() // failures aren't cached
+			objChan <- obj
+			streamBody(stream, respBody, cacheKey, reqID)
+			return
 		}
 
 		log.Debugf("GetAndCache request returned %v headers %+v (reqid %v)\n", respCode, respHeader, reqID)
@@ -161,45 +199,88 @@ func GetAndCache(
 			lastModified = respRespTime
 		}
 
-		obj := (*cacheobj.CacheObj)(nil)
-		log.Debugf("h.cache.Add %v (reqid %v)\n", cacheKey, reqID)
 		log.Debugf("GetAndCache respCode %v (reqid %v)\n", respCode, reqID)
-		if revalidateObj == nil || respCode != http.StatusNotModified {
-			log.Debugf("GetAndCache new %v (reqid %v)\n", cacheKey, reqID)
-			obj = cacheobj.New(reqHeader, respBody, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
-			if !rfc.CanCache(req.Method, reqHeader, respCode, respHeader, strictRFC) {
-				return obj // return without caching
-			}
-		} else {
-			log.Debugf("GetAndCache revalidating %v len(revalidateObj.Body) %v (reqid %v)\n", cacheKey, len(revalidateObj.Body), reqID)
+		if revalidateObj != nil && respCode == http.StatusNotModified {
+			log.Debugf("GetAndCache revalidating %v size %v (reqid %v)\n", cacheKey, revalidateObj.Size, reqID)
 			// must copy, because this cache object may be concurrently read by other goroutines
 			newRespHeader := web.CopyHeader(revalidateObj.RespHeaders)
 			newRespHeader.Set("Date", respHeader.Get("Date"))
-			obj = &cacheobj.CacheObj{
-				Body:             revalidateObj.Body,
-				ReqHeaders:       revalidateObj.ReqHeaders,
-				RespHeaders:      newRespHeader,
-				RespCacheControl: revalidateObj.RespCacheControl,
-				Code:             revalidateObj.Code,
-				OriginCode:       respCode,
-				ProxyURL:         proxyURLStr,
-				ReqTime:          reqTime,
-				ReqRespTime:      reqRespTime,
-				RespRespTime:     respRespTime,
-				LastModified:     revalidateObj.LastModified,
-				Size:             revalidateObj.Size,
-				HitCount:         revalidateObj.HitCount, // no need to +1 here, the cache Get did that
-			}
+			revalidated := *revalidateObj // keeps the body, which may be read from storage, and the hit count, which the cache Get already incremented
+			obj := &revalidated
+			obj.RespHeaders = newRespHeader
+			obj.OriginCode = respCode
+			obj.ProxyURL = proxyURLStr
+			obj.ReqTime = reqTime
+			obj.ReqRespTime = reqRespTime
+			obj.RespRespTime = respRespTime
+			log.Debugf("h.cache.Add %v (reqid %v)\n", cacheKey, reqID)
+			addVariant(cache, cacheKey, obj, maxVariants) // TODO store pointer?
+			objChan <- obj
+			return
+		}
+
+		log.Debugf("GetAndCache new %v (reqid %v)\n", cacheKey, reqID)
+		obj, stream := cacheobj.NewStreaming(reqHeader, respCode, respCode, proxyURLStr, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
+		cacheable := canCacheResp(req.Method, reqHeader, respCode, respHeader, strictRFC, cache)
+		if revalidateObj != nil && respCode >= http.StatusInternalServerError {
+			log.Debugf("GetAndCache revalidating %v got %v, keeping the stored object (reqid %v)\n", cacheKey, respCode, reqID)
+			cacheable = false // don't replace the stored object with an error, so it may still be served stale-if-error
+		}
+		if !cacheable {
+			stream.Release() // the body is only needed until it's read, so don't hold it all in memory
 		}
-		cache.Add(cacheKey, obj) // TODO store pointer?
-		return obj
+		objChan <- obj
+		if !streamBody(stream, respBody, cacheKey, reqID) || !cacheable {
+			return
+		}
+		completeObj, err := obj.Completed()
+		if err != nil {
+			return // should never happen, streamBody already succeeded
+		}
+		addKey := cacheKey
+		if fullCacheKey != "" && respCode == http.StatusOK {
+			addKey = fullCacheKey // the parent ignored the range, so the entire object is cached once, under its own key
+		}
+		log.Debugf("h.cache.Add %v (reqid %v)\n", addKey, reqID)
+		addVariant(cache, addKey, completeObj, maxVariants) // TODO store pointer?
 	}
 
-	c := (*cacheobj.CacheObj)(nil)
 	if ruleThrottler == nil {
 		log.Errorf("rule %v not in ruleThrottlers map. Requesting with no origin limit! (reqid %v)\n", remapName, reqID)
 		ruleThrottler = thread.NewNoThrottler()
 	}
-	ruleThrottler.Throttle(func() { c = get() })
-	return c
+	objChan := make(chan *cacheobj.CacheObj, 1)
+	done := make(chan struct{})
+	go ruleThrottler.Throttle(func() {
+		defer close(done)
+		get(objChan)
+	})
+	return <-objChan, done
+}
+
+// canCacheResp returns whether the response with the given headers may be cached, and isn't known to be larger than the cache.
+func canCacheResp(method string, reqHeader http.Header, respCode int, respHeader http.Header, strictRFC bool, cache icache.Cache) bool {
+	if !rfc.CanCache(method, reqHeader, respCode, respHeader, strictRFC) {
+		return false
+	}
+	size, err := strconv.ParseUint(respHeader.Get("Content-Length"), 10, 64)
+	return err != nil || size <= cache.Capacity()
+}
+
+// streamBody copies the parent response body into the stream, and closes the stream. Returns whether the entire body was successfully received.
+func streamBody(stream *cacheobj.Stream, body io.Reader, cacheKey string, reqID uint64) bool {
+	_, err := io.Copy(stream, body)
+	stream.Close(err)
+	if err != nil {
+		log.Errorf("reading parent response body for cacheKey %v: %v (reqid %v)\n", cacheKey, err, reqID)
+		return false
+	}
+	return true
+}
+
+// newErrorObj returns an uncached object with the given code, and the code's status text as its body.
+func newErrorObj(code int, reqHeader http.Header) *cacheobj.CacheObj {
+	now := time.Now()
+	body := cacheobj.NewChunks([]byte(http.StatusText(code)))
+	return cacheobj.New(reqHeader, body, code, code, "", http.Header{}, now, now, now, time.Time{})
 }
@@ -0,0 +1,532 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/remap"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// SliceKeySep separates the cache key of an object from the slice size and index, in the cache key of a slice.
+const SliceKeySep = cacheobj.DerivedKeySeparator + "slice:"
+
+// errMixedSlices is returned when the slices of an object have different validators or lengths, because the object changed on the parent between slice requests.
+var errMixedSlices = errors.New("slices are from different versions of the object")
+
+// byteRange is a range of a Range request, per RFC7233§2.1. A Start of -1 is a suffix range of the last End bytes. An End of -1 is open, to the end of the object.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+// parseRange parses the given Range header. Returns false if it isn't a valid bytes range, in which case it must be ignored, per RFC7233§3.1.
+func parseRange(hdr string) ([]byteRange, bool) {
+	hdr = strings.TrimSpace(hdr)
+	if !strings.HasPrefix(hdr, "bytes=") {
+		return nil, false
+	}
+	ranges := []byteRange{}
+	for _, spec := range strings.Split(hdr[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		dash := strings.Index(spec, "-")
+		if dash == -1 {
+			return nil, false
+		}
+		startStr, endStr := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+		r := byteRange{Start: -1, End: -1}
+		err := error(nil)
+		if startStr != "" {
+			if r.Start, err = strconv.ParseInt(startStr, 10, 64); err != nil || r.Start < 0 {
+				return nil, false
+			}
+		}
+		if endStr != "" {
+			if r.End, err = strconv.ParseInt(endStr, 10, 64); err != nil || r.End < 0 {
+				return nil, false
+			}
+		}
+		if (r.Start == -1 && r.End == -1) || (r.Start != -1 && r.End != -1 && r.End < r.Start) {
+			return nil, false
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges, len(ranges) > 0
+}
+
+// resolveRanges returns the absolute, inclusive ranges of an object of the given length, omitting unsatisfiable ranges, per RFC7233§2.1.
+func resolveRanges(ranges []byteRange, length int64) []byteRange {
+	resolved := []byteRange{}
+	for _, r := range ranges {
+		if r.Start == -1 {
+			if r.End == 0 || length == 0 {
+				continue
+			}
+			r.Start = length - r.End
+			if r.Start < 0 {
+				r.Start = 0
+			}
+			r.End = length - 1
+		}
+		if r.Start >= length {
+			continue
+		}
+		if r.End == -1 || r.End >= length {
+			r.End = length - 1
+		}
+		resolved = append(resolved, r)
+	}
+	return resolved
+}
+
+// parseContentRange parses the given Content-Range of a 206, per RFC7233§4.2. Returns the first byte position, and the complete length, and false if it isn't a satisfied bytes range with a known length.
+func parseContentRange(hdr string) (int64, int64, bool) {
+	hdr = strings.TrimSpace(hdr)
+	if !strings.HasPrefix(hdr, "bytes ") {
+		return 0, 0, false
+	}
+	hdr = hdr[len("bytes "):]
+	slash := strings.Index(hdr, "/")
+	dash := strings.Index(hdr, "-")
+	if slash == -1 || dash == -1 || dash > slash {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(hdr[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	length, err := strconv.ParseInt(hdr[slash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return start, length, true
+}
+
+// validator returns the validator of the given object, which is its ETag, or its Last-Modified if it has no ETag. Returns the empty string if it has neither, in which case its slices can't be validated, and are never reused from the cache.
+func validator(obj *cacheobj.CacheObj) string {
+	if etag := obj.RespHeaders.Get("ETag"); etag != "" {
+		return etag
+	}
+	return obj.RespHeaders.Get("Last-Modified")
+}
+
+// slice is a slice of an object, or the entire object if the parent doesn't support ranges.
+type slice struct {
+	obj    *cacheobj.CacheObj
+	start  int64 // the position of the first byte of obj in the entire object
+	length int64 // the complete length of the entire object
+	cached bool  // whether the slice was served from the cache
+}
+
+// slicer serves Range requests from slices of objects, each of which is fetched from the parent with its own Range request and cached under its own key.
+type slicer struct {
+	h               *Handler
+	r               *http.Request
+	cache           icache.Cache
+	cacheKey        string
+	ruleName        string
+	size            int64
+	reqTime         time.Time
+	reqCacheControl rfc.CacheControlMap
+	reqID           uint64
+}
+
+// sliceKey returns the cache key of the slice with the given index. The slice size is included, so slices of different sizes are never mixed if the rule's size changes.
+func (s *slicer) sliceKey(i int64) string {
+	return s.cacheKey + SliceKeySep + strconv.FormatInt(s.size, 10) + ":" + strconv.FormatInt(i, 10)
+}
+
+// get returns the slice with the given index, from the cache if it's fresh and bypassCache is false, and otherwise from the parent.
+// If the returned object isn't a 206 or 200, it isn't a slice, and is returned with a nil error so it can be served to the client as-is.
+func (s *slicer) get(i int64, bypassCache bool) (slice, *cacheobj.CacheObj, *string, error) {
+	key := s.sliceKey(i)
+	req := s.r.Clone(s.r.Context())
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(i*s.size, 10)+"-"+strconv.FormatInt((i+1)*s.size-1, 10))
+	req.Header.Del("If-Range")
+
+	revalidateObj := (*cacheobj.CacheObj)(nil)
+	if !bypassCache {
+		if obj, ok := s.getFull(req.Header); ok {
+			if sl, ok := newSlice(obj, true); ok {
+				log.Debugf("cache slicer '%v' serving slice %v from the cached entire object (reqid %v)\n", s.cacheKey, i, s.reqID)
+				return sl, obj, nil, nil
+			}
+		}
+		if obj, ok := getVariant(s.cache, key, req.Header); ok && validator(obj) != "" {
+			reuse := rfc.CanReuseStored(req.Header, obj.RespHeaders, s.reqCacheControl, obj.RespCacheControl, obj.ReqHeaders, obj.ReqRespTime, obj.RespRespTime, s.h.strictRFC)
+			if jobReuse, invalidated := s.h.jobs.Invalidated(s.ruleName, key, obj.ReqRespTime, s.reqTime); invalidated && reuse != rfc.ReuseCannot {
+				reuse = jobReuse
+			}
+			if reuse == rfc.ReuseCan {
+				if sl, ok := newSlice(obj, true); ok {
+					log.Debugf("cache slicer '%v' cache hit (reqid %v)\n", key, s.reqID)
+					return sl, obj, nil, nil
+				}
+			} else if reuse != rfc.ReuseCannot {
+				revalidateObj = obj
+			}
+		}
+	}
+
+	producer, err := s.h.remapper.RemappingProducer(req, s.h.scheme)
+	if err != nil {
+		return slice{}, nil, nil, errors.New("creating remapping: " + err.Error())
+	}
+	producer.OverrideSliceCacheKey(key)
+	obj, reqHost, err := NewRetrier(s.h, req.Header, s.reqTime, s.reqCacheControl, producer, s.reqID).Get(req, revalidateObj)
+	if err != nil {
+		return slice{}, nil, nil, err
+	}
+	sl, ok := newSlice(obj, false)
+	if !ok {
+		log.Debugf("cache slicer '%v' parent returned %v, not a slice (reqid %v)\n", key, obj.Code, s.reqID)
+		return slice{}, obj, reqHost, nil
+	}
+	if sl.obj.Code == http.StatusPartialContent && sl.start != i*s.size {
+		return slice{}, nil, reqHost, fmt.Errorf("parent returned range starting at %v for slice starting at %v", sl.start, i*s.size)
+	}
+	return sl, obj, reqHost, nil
+}
+
+// getFull returns the entire object, cached under the object's own key, if it's fresh. Parents which ignore ranges return the entire object for slice requests, which is cached once under the object's key, and serves every slice.
+func (s *slicer) getFull(reqHdr http.Header) (*cacheobj.CacheObj, bool) {
+	obj, ok := getVariant(s.cache, s.cacheKey, reqHdr)
+	if !ok || obj.Code != http.StatusOK {
+		return nil, false
+	}
+	reuse := rfc.CanReuseStored(reqHdr, obj.RespHeaders, s.reqCacheControl, obj.RespCacheControl, obj.ReqHeaders, obj.ReqRespTime, obj.RespRespTime, s.h.strictRFC)
+	if jobReuse, invalidated := s.h.jobs.Invalidated(s.ruleName, s.cacheKey, obj.ReqRespTime, s.reqTime); invalidated && reuse != rfc.ReuseCannot {
+		reuse = jobReuse
+	}
+	return obj, reuse == rfc.ReuseCan
+}
+
+// newSlice returns the slice of the given object, which must be a 206 with a Content-Range, or a 200 with the entire object. Returns false if the object isn't a slice.
+func newSlice(obj *cacheobj.CacheObj, cached bool) (slice, bool) {
+	switch obj.Code {
+	case http.StatusPartialContent:
+		start, length, ok := parseContentRange(obj.RespHeaders.Get("Content-Range"))
+		if !ok {
+			return slice{}, false
+		}
+		return slice{obj: obj, start: start, length: length, cached: cached}, true
+	case http.StatusOK:
+		length, err := strconv.ParseInt(obj.RespHeaders.Get("Content-Length"), 10, 64)
+		if err != nil {
+			completeObj, err := obj.Completed() // without a Content-Length, the length isn't known until the body is received
+			if err != nil {
+				return slice{}, false
+			}
+			obj, length = completeObj, int64(completeObj.Size)
+		}
+		return slice{obj: obj, start: 0, length: length, cached: cached}, true
+	}
+	return slice{}, false
+}
+
+// completeReleased returns the slice with its object completed, if its body is released, so the body may be read more than once.
+func completeReleased(sl slice) (slice, error) {
+	if !sl.obj.Released() {
+		return sl, nil
+	}
+	obj, err := sl.obj.Completed()
+	if err != nil {
+		return slice{}, err
+	}
+	sl.obj = obj
+	return sl, nil
+}
+
+// slicesResponse is the response to a Range request assembled from slices.
+type slicesResponse struct {
+	code    int
+	hdr     http.Header
+	body    cacheobj.Body
+	first   *cacheobj.CacheObj // the first slice, for logging and plugins
+	reqHost *string
+	cached  bool // whether every slice was served from the cache
+}
+
+// serve returns the response to the given ranges, assembled from slices. If bypassCache is true, every slice is fetched from the parent.
+// If the parent returns a response which isn't a slice, such as an error, it's returned as-is. Returns errMixedSlices if the slices are from different versions of the object.
+func (s *slicer) serve(ranges []byteRange, bypassCache bool) (slicesResponse, error) {
+	firstIdx := int64(0)
+	for _, r := range ranges {
+		if r.Start != -1 {
+			firstIdx = r.Start / s.size // if every range is a suffix, the first slice is fetched to get the object length
+			break
+		}
+	}
+	first, obj, reqHost, err := s.get(firstIdx, bypassCache)
+	if err != nil {
+		return slicesResponse{}, err
+	}
+	if first.obj == nil {
+		return slicesResponse{code: obj.Code, hdr: obj.RespHeaders, body: obj.Body(), first: obj, reqHost: reqHost}, nil
+	}
+
+	resolved := resolveRanges(ranges, first.length)
+	if len(resolved) == 0 {
+		hdr := http.Header{}
+		hdr.Set("Content-Range", "bytes */"+strconv.FormatInt(first.length, 10))
+		return slicesResponse{code: http.StatusRequestedRangeNotSatisfiable, hdr: hdr, first: first.obj, reqHost: reqHost, cached: first.cached}, nil
+	}
+
+	rereadable := func(sl slice) (slice, error) { return sl, nil }
+	if len(resolved) > 1 {
+		rereadable = completeReleased // multiple ranges may read the same slice
+	}
+	if first, err = rereadable(first); err != nil {
+		return slicesResponse{}, err
+	}
+
+	slices := map[int64]slice{firstIdx: first}
+	if first.obj.Code == http.StatusOK {
+		slices = map[int64]slice{} // the parent doesn't support ranges, so the entire object serves every range
+	}
+	cached := first.cached
+	getSlice := func(pos int64) (slice, error) {
+		if first.obj.Code == http.StatusOK {
+			return first, nil
+		}
+		i := pos / s.size
+		if sl, ok := slices[i]; ok {
+			return sl, nil
+		}
+		sl, obj, _, err := s.get(i, bypassCache)
+		if err != nil {
+			return slice{}, err
+		}
+		if sl.obj == nil {
+			return slice{}, fmt.Errorf("parent returned %v for slice %v", obj.Code, i)
+		}
+		if sl.length != first.length || validator(sl.obj) != validator(first.obj) {
+			return slice{}, errMixedSlices
+		}
+		if sl, err = rereadable(sl); err != nil {
+			return slice{}, err
+		}
+		cached = cached && sl.cached
+		slices[i] = sl
+		return sl, nil
+	}
+
+	parts := [][]slicePart{}
+	for _, r := range resolved {
+		rangeParts := []slicePart{}
+		for pos := r.Start; pos <= r.End; {
+			sl, err := getSlice(pos)
+			if err != nil {
+				return slicesResponse{}, err
+			}
+			end := r.End
+			if sliceEnd := sl.start + s.size - 1; sl.obj.Code == http.StatusPartialContent && sliceEnd < end {
+				end = sliceEnd
+			}
+			rangeParts = append(rangeParts, slicePart{body: sl.obj.Body(), skip: pos - sl.start, n: end - pos + 1})
+			pos = end + 1
+		}
+		parts = append(parts, rangeParts)
+	}
+
+	hdr := web.CopyHeader(first.obj.RespHeaders)
+	hdr.Del("Content-Range")
+	lengthStr := strconv.FormatInt(first.length, 10)
+	body := slicesBody{}
+	if len(resolved) == 1 {
+		hdr.Set("Content-Range", "bytes "+strconv.FormatInt(resolved[0].Start, 10)+"-"+strconv.FormatInt(resolved[0].End, 10)+"/"+lengthStr)
+		body = parts[0]
+	} else {
+		boundary := multipartBoundary()
+		contentType := hdr.Get("Content-Type")
+		hdr.Set("Content-Type", "multipart/byteranges; boundary="+boundary)
+		for i, r := range resolved {
+			partHdr := "--" + boundary + "\r\n"
+			if i > 0 {
+				partHdr = "\r\n" + partHdr
+			}
+			if contentType != "" {
+				partHdr += "Content-Type: " + contentType + "\r\n"
+			}
+			partHdr += "Content-Range: bytes " + strconv.FormatInt(r.Start, 10) + "-" + strconv.FormatInt(r.End, 10) + "/" + lengthStr + "\r\n\r\n"
+			body = append(body, slicePart{prefix: []byte(partHdr)})
+			body = append(body, parts[i]...)
+		}
+		body = append(body, slicePart{prefix: []byte("\r\n--" + boundary + "--\r\n")})
+	}
+	hdr.Set("Content-Length", strconv.FormatInt(body.Len(), 10))
+	return slicesResponse{code: http.StatusPartialContent, hdr: hdr, body: body, first: first.obj, reqHost: reqHost, cached: cached}, nil
+}
+
+// multipartBoundary returns a random multipart boundary.
+func multipartBoundary() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Errorf("generating multipart boundary: %v\n", err)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+// slicePart is a part of a response assembled from slices: a prefix, followed by n bytes of the body after skipping skip bytes. The body may be nil, for parts which are only a prefix.
+type slicePart struct {
+	prefix []byte
+	body   cacheobj.Body
+	skip   int64
+	n      int64
+}
+
+// slicesBody is a body assembled from parts of slices. It fulfills cacheobj.Body, and streams slices which are still being received.
+type slicesBody []slicePart
+
+// Len returns the length of the body in bytes.
+func (b slicesBody) Len() int64 {
+	length := int64(0)
+	for _, part := range b {
+		length += int64(len(part.prefix)) + part.n
+	}
+	return length
+}
+
+func (b slicesBody) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for _, part := range b {
+		n, err := w.Write(part.prefix)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		if part.body == nil || part.n == 0 {
+			continue
+		}
+		rw := &rangeWriter{w: w, skip: part.skip, n: part.n}
+		_, err = part.body.WriteTo(rw)
+		written += rw.written
+		if err != nil && err != errRangeWritten {
+			return written, err
+		}
+		if rw.n > 0 {
+			return written, io.ErrUnexpectedEOF // the slice was shorter than its Content-Range
+		}
+	}
+	return written, nil
+}
+
+func (b slicesBody) Bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, b.Len()))
+	if _, err := b.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errRangeWritten is returned by rangeWriter.Write when the range has been written, to stop the body from writing more.
+var errRangeWritten = errors.New("range written")
+
+// rangeWriter writes n bytes to w after skipping skip bytes, and discards the rest.
+type rangeWriter struct {
+	w       io.Writer
+	skip    int64
+	n       int64
+	written int64
+}
+
+func (rw *rangeWriter) Write(b []byte) (int, error) {
+	l := len(b)
+	if rw.skip >= int64(len(b)) {
+		rw.skip -= int64(len(b))
+		return l, nil
+	}
+	b = b[rw.skip:]
+	rw.skip = 0
+	if int64(len(b)) > rw.n {
+		b = b[:rw.n]
+	}
+	n, err := rw.w.Write(b)
+	rw.n -= int64(n)
+	rw.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if rw.n == 0 {
+		return l, errRangeWritten
+	}
+	return l, nil
+}
+
+// serveSlices serves the given Range request from slices of the object, if the rule slices ranges. Returns false if the request isn't served, because the rule doesn't slice, or the request isn't a GET with a valid Range and no If-Range, in which case it must be handled as usual.
+// If the slices are from different versions of the object, because it changed on the parent, every slice is fetched again from the parent, so mixed versions are never served.
+func (h *Handler) serveSlices(r *http.Request, remappingProducer *remap.RemappingProducer, responder *Responder, cacheKey string, reqTime time.Time, reqCacheControl rfc.CacheControlMap, connectionClose bool, pluginContext map[string]*interface{}, reqID uint64) bool {
+	size := remappingProducer.RangeSliceBytes()
+	if size <= 0 || r.Method != http.MethodGet || r.Header.Get("If-Range") != "" {
+		return false
+	}
+	ranges, ok := parseRange(r.Header.Get("Range"))
+	if !ok {
+		return false
+	}
+
+	beforeParentRequestData := plugin.BeforeParentRequestData{Req: r, RemapRule: remappingProducer.Name()}
+	h.plugins.OnBeforeParentRequest(remappingProducer.PluginCfg(), pluginContext, beforeParentRequestData)
+
+	s := &slicer{h: h, r: r, cache: remappingProducer.Cache(), cacheKey: cacheKey, ruleName: remappingProducer.Name(), size: size, reqTime: reqTime, reqCacheControl: reqCacheControl, reqID: reqID}
+	resp, err := s.serve(ranges, false)
+	if err == errMixedSlices {
+		log.Infof("cache.Handler.ServeHTTP: '%v' cached slices are from different versions, fetching all slices (reqid %v)\n", cacheKey, reqID)
+		resp, err = s.serve(ranges, true)
+	}
+	if err != nil {
+		log.Errorf("serving slices of '%v': %v (reqid %v)\n", cacheKey, err, reqID)
+		*responder.ResponseCode = http.StatusBadGateway
+		responder.OriginConnectFailed = true
+		responder.Do()
+		return true
+	}
+	log.Debugf("cache.Handler.ServeHTTP: '%v' responding with %v from slices (reqid %v)\n", cacheKey, resp.code, reqID)
+
+	// create new pointers, so plugins don't modify the slices
+	codePtr, hdrsPtr, bodyPtr := resp.code, resp.hdr, resp.body
+	responder.SetResponse(&codePtr, &hdrsPtr, &bodyPtr, connectionClose)
+	responder.OriginReqSuccess = true
+	if resp.cached {
+		responder.Reuse = rfc.ReuseCan
+	}
+	responder.OriginCode = resp.first.OriginCode
+	responder.ProxyStr = resp.first.ProxyURL
+	if resp.reqHost != nil {
+		responder.ToFQDN = *resp.reqHost
+	}
+	beforeRespData := plugin.BeforeRespondData{Req: r, CacheObj: resp.first, Code: &codePtr, Hdr: &hdrsPtr, Body: &bodyPtr, RemapRule: remappingProducer.Name()}
+	h.plugins.OnBeforeRespond(remappingProducer.PluginCfg(), pluginContext, beforeRespData)
+	responder.Do()
+	return true
+}
@@ -0,0 +1,99 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		hdr      string
+		expected []byteRange
+		ok       bool
+	}{
+		{"bytes=0-99", []byteRange{{0, 99}}, true},
+		{"bytes=100-", []byteRange{{100, -1}}, true},
+		{"bytes=-500", []byteRange{{-1, 500}}, true},
+		{"bytes= 0-0, 10-19 ,-1", []byteRange{{0, 0}, {10, 19}, {-1, 1}}, true},
+		{"bytes=10-5", nil, false},
+		{"bytes=-", nil, false},
+		{"bytes=a-b", nil, false},
+		{"items=0-1", nil, false},
+		{"bytes=", nil, false},
+	}
+	for _, test := range tests {
+		actual, ok := parseRange(test.hdr)
+		if ok != test.ok || (ok && !reflect.DeepEqual(actual, test.expected)) {
+			t.Errorf("parseRange('%v') expected %v %v, actual %v %v", test.hdr, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestResolveRanges(t *testing.T) {
+	ranges := []byteRange{{0, 99}, {900, -1}, {-1, 50}, {-1, 5000}, {1000, 1010}, {990, 5000}}
+	expected := []byteRange{{0, 99}, {900, 999}, {950, 999}, {0, 999}, {990, 999}}
+	if actual := resolveRanges(ranges, 1000); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("resolveRanges expected %v, actual %v", expected, actual)
+	}
+	if actual := resolveRanges([]byteRange{{1000, -1}}, 1000); len(actual) != 0 {
+		t.Errorf("resolveRanges past the end expected no ranges, actual %v", actual)
+	}
+}
+
+func TestParseContentRange(t *testing.T) {
+	if start, length, ok := parseContentRange("bytes 1048576-2097151/5000000"); !ok || start != 1048576 || length != 5000000 {
+		t.Errorf("parseContentRange expected 1048576 5000000 true, actual %v %v %v", start, length, ok)
+	}
+	for _, hdr := range []string{"bytes */5000000", "bytes 0-99/*", "items 0-99/100", ""} {
+		if _, _, ok := parseContentRange(hdr); ok {
+			t.Errorf("parseContentRange('%v') expected not ok, actual ok", hdr)
+		}
+	}
+}
+
+func TestSlicesBody(t *testing.T) {
+	slice0 := cacheobj.NewChunks([]byte("0123456789"))
+	slice1 := cacheobj.NewStream()
+	go func() {
+		slice1.Write([]byte("abc"))
+		slice1.Write([]byte("def"))
+		slice1.Close(nil)
+	}()
+
+	body := slicesBody{
+		{prefix: []byte("<"), body: slice0, skip: 8, n: 2},
+		{body: slice1, skip: 0, n: 4},
+		{prefix: []byte(">")},
+	}
+	if body.Len() != 8 {
+		t.Errorf("slicesBody.Len expected 8, actual %v", body.Len())
+	}
+	actual, err := body.Bytes()
+	if err != nil {
+		t.Fatalf("slicesBody.Bytes expected nil error, actual %v", err)
+	}
+	if expected := "<89abcd>"; string(actual) != expected {
+		t.Errorf("slicesBody.Bytes expected '%v', actual '%v'", expected, string(actual))
+	}
+
+	short := slicesBody{{body: slice0, skip: 5, n: 10}}
+	if _, err := short.Bytes(); err == nil {
+		t.Errorf("slicesBody.Bytes with a slice shorter than its range expected error, actual nil")
+	}
+}
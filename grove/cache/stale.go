@@ -0,0 +1,126 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// WarningHdr is the RFC7234§5.5 Warning header, added to stale responses.
+const WarningHdr = "Warning"
+
+const WarningStale = `110 - "Response is Stale"`
+const WarningRevalidationFailed = `111 - "Revalidation Failed"`
+
+// staleness returns how long the given object has been stale. If the object is fresh, this is negative.
+func staleness(obj *cacheobj.CacheObj) time.Duration {
+	return -rfc.FreshFor(obj.RespHeaders, obj.RespCacheControl, obj.ReqRespTime, obj.RespRespTime)
+}
+
+// staleForbidden returns whether the parent forbids serving the object stale under any circumstances, per RFC7234§5.2.2.
+func staleForbidden(obj *cacheobj.CacheObj) bool {
+	return obj.RespCacheControl.Has("must-revalidate") || obj.RespCacheControl.Has("proxy-revalidate") || obj.RespCacheControl.Has("no-cache")
+}
+
+// canStaleWhileRevalidate returns whether the given stale object may be served while it's revalidated in the background, per RFC5861§3. Objects which are still fresh, but must be revalidated because of the client request, may not.
+// The ruleSWR is the remap rule's stale-while-revalidate, used if the response has none, and hasRuleSWR is whether the rule has one.
+func canStaleWhileRevalidate(obj *cacheobj.CacheObj, reqCC rfc.CacheControlMap, ruleSWR time.Duration, hasRuleSWR bool) bool {
+	if staleForbidden(obj) || reqCC.Has("no-cache") {
+		return false
+	}
+	swr, ok := rfc.StaleWhileRevalidate(obj.RespCacheControl)
+	if !ok {
+		if !hasRuleSWR {
+			return false
+		}
+		swr = ruleSWR
+	}
+	stale := staleness(obj)
+	return stale > 0 && stale <= swr
+}
+
+// canStaleIfError returns whether the given stale object may be served because revalidating it failed, per RFC5861§4.
+// The request stale-if-error is used if the response has none, and the ruleSIE is the remap rule's stale-if-error, used if neither has one, and hasRuleSIE is whether the rule has one.
+func canStaleIfError(obj *cacheobj.CacheObj, reqCC rfc.CacheControlMap, ruleSIE time.Duration, hasRuleSIE bool) bool {
+	if staleForbidden(obj) {
+		return false
+	}
+	sie, ok := rfc.StaleIfError(obj.RespCacheControl)
+	if !ok {
+		sie, ok = rfc.StaleIfError(reqCC)
+	}
+	if !ok {
+		if !hasRuleSIE {
+			return false
+		}
+		sie = ruleSIE
+	}
+	return staleness(obj) <= sie
+}
+
+// isErrorResponse returns whether the given response from a parent is an error, which stale-if-error permits serving a stale object in place of, per RFC5861§4.
+func isErrorResponse(obj *cacheobj.CacheObj) bool {
+	return obj == nil || obj.Code >= http.StatusInternalServerError
+}
+
+// staleHeaders returns a copy of the given object's response headers, with the given Warning added.
+func staleHeaders(obj *cacheobj.CacheObj, warning string) http.Header {
+	hdr := web.CopyHeader(obj.RespHeaders)
+	hdr.Add(WarningHdr, warning)
+	return hdr
+}
+
+// revalidateInBackground revalidates the given cached object with the parent, without blocking, for stale-while-revalidate. If the key is already being revalidated in the background, it does nothing.
+// The request is cloned, because it must not be used after the client request completes.
+func (h *Handler) revalidateInBackground(retrier *Retrier, r *http.Request, cacheKey string, cacheObj *cacheobj.CacheObj, reqID uint64) {
+	h.revalidatingM.Lock()
+	if _, ok := h.revalidating[cacheKey]; ok {
+		h.revalidatingM.Unlock()
+		log.Debugf("cache.Handler revalidateInBackground '%v' already revalidating (reqid %v)\n", cacheKey, reqID)
+		return
+	}
+	h.revalidating[cacheKey] = struct{}{}
+	h.revalidatingM.Unlock()
+
+	bgReq := r.Clone(context.Background())
+	atomic.AddInt64(&h.inProgress, 1)
+	go func() {
+		defer atomic.AddInt64(&h.inProgress, -1)
+		defer func() {
+			h.revalidatingM.Lock()
+			delete(h.revalidating, cacheKey)
+			h.revalidatingM.Unlock()
+		}()
+		obj, _, err := retrier.Get(bgReq, cacheObj)
+		if err != nil {
+			log.Errorf("revalidating '%v' in background: %v (reqid %v)\n", cacheKey, err, reqID)
+			return
+		}
+		if _, err := obj.Completed(); err != nil {
+			log.Errorf("revalidating '%v' in background: receiving body: %v (reqid %v)\n", cacheKey, err, reqID)
+			return
+		}
+		log.Debugf("cache.Handler revalidateInBackground '%v' revalidated, code %v (reqid %v)\n", cacheKey, obj.Code, reqID)
+	}()
+}
@@ -0,0 +1,117 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// variantIndexM serializes updates to variant indexes. Adding a variant requires a read-modify-write of the index, which the cache interface can't do atomically.
+// TODO lock per key, if this becomes contended
+var variantIndexM sync.Mutex
+
+// getVariant gets the cached object for the given primary cache key which is selected by the given request headers.
+// Responses with a Vary header are stored under a secondary key, with a variant index under the primary key; if the primary key holds an index, the variant selected by reqHeader is looked up. The returned object is never a variant index.
+func getVariant(cache icache.Cache, primaryKey string, reqHeader http.Header) (*cacheobj.CacheObj, bool) {
+	obj, ok := cache.Get(primaryKey)
+	if !ok {
+		return nil, false
+	}
+	if obj.IsVariantIndex() {
+		variantKey := cacheobj.VaryKey(primaryKey, obj.VaryHdrs, reqHeader)
+		if obj, ok = cache.Get(variantKey); !ok {
+			log.Debugf("cache getVariant '%v' variant '%v' not in cache\n", primaryKey, variantKey)
+			return nil, false
+		}
+	}
+	if !rfc.SelectedHeadersMatch(reqHeader, obj.RespHeaders, obj.ReqHeaders) {
+		log.Debugf("cache getVariant '%v' cached object not selected by request headers\n", primaryKey)
+		return nil, false
+	}
+	return obj, true
+}
+
+// addVariant adds the given object to the cache under the given primary cache key.
+// If the object has a Vary header, it's added under its secondary key, and the variant index under the primary key is updated, removing the oldest variant from the cache if there are more than maxVariants. Objects which vary on `*` are never added, because they can never be reused.
+// Returns whether adding the object evicted anything, as icache.Cache.Add.
+func addVariant(cache icache.Cache, primaryKey string, obj *cacheobj.CacheObj, maxVariants int) bool {
+	varyHdrs, ok := cacheobj.VaryHeaders(obj.RespHeaders)
+	if !ok {
+		log.Debugf("cache addVariant '%v' varies on '*', not caching\n", primaryKey)
+		return false
+	}
+	if len(varyHdrs) == 0 {
+		return cache.Add(primaryKey, obj)
+	}
+	if maxVariants <= 0 {
+		maxVariants = remapdata.DefaultMaxVariants
+	}
+
+	variantKey := cacheobj.VaryKey(primaryKey, varyHdrs, obj.ReqHeaders)
+	evicted := cache.Add(variantKey, obj)
+
+	variantIndexM.Lock()
+	defer variantIndexM.Unlock()
+
+	variants := []string{}
+	removed := []string{}
+	if index, ok := cache.Peek(primaryKey); ok && index.IsVariantIndex() {
+		sameVary := equalStrs(index.VaryHdrs, varyHdrs)
+		for _, key := range index.Variants {
+			if key == variantKey {
+				continue
+			}
+			if sameVary {
+				variants = append(variants, key)
+			} else {
+				removed = append(removed, key) // the parent changed what the object varies on, so the old variants can never be selected
+			}
+		}
+	}
+
+	variants = append(variants, variantKey)
+	if len(variants) > maxVariants {
+		log.Debugf("cache addVariant '%v' exceeded max variants %v, removing %v\n", primaryKey, maxVariants, variants[:len(variants)-maxVariants])
+		removed = append(removed, variants[:len(variants)-maxVariants]...)
+		variants = variants[len(variants)-maxVariants:]
+	}
+	for _, key := range removed {
+		cache.Remove(key)
+	}
+	if cache.Add(primaryKey, cacheobj.NewVariantIndex(varyHdrs, variants)) {
+		evicted = true
+	}
+	return evicted
+}
+
+func equalStrs(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
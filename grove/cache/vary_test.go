@@ -0,0 +1,47 @@
+package cache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/memcache"
+)
+
+func TestAddVariantRemovesExcessVariants(t *testing.T) {
+	cache := memcache.New(1024 * 1024)
+	variant := func(lang string, vary string) *cacheobj.CacheObj {
+		return cacheobj.New(http.Header{"Accept-Language": {lang}}, cacheobj.NewChunks([]byte(lang)), http.StatusOK, http.StatusOK, "", http.Header{"Vary": {vary}}, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+	}
+	for _, lang := range []string{"en", "fr", "de"} {
+		addVariant(cache, "key", variant(lang, "Accept-Language"), 2)
+	}
+	if _, ok := cache.Peek(cacheobj.VaryKey("key", []string{"Accept-Language"}, http.Header{"Accept-Language": {"en"}})); ok {
+		t.Errorf("addVariant exceeding max variants expected oldest variant removed from the cache, actual still cached")
+	}
+	for _, lang := range []string{"fr", "de"} {
+		if obj, ok := getVariant(cache, "key", http.Header{"Accept-Language": {lang}}); !ok || string(obj.Chunks[0]) != lang {
+			t.Errorf("getVariant '%v' expected cached variant, actual %v %+v", lang, ok, obj)
+		}
+	}
+
+	addVariant(cache, "key", variant("en", "Accept-Language, Accept-Encoding"), 2)
+	if keys := cache.DerivedKeys("key"); len(keys) != 1 {
+		t.Errorf("addVariant with different Vary expected old variants removed from the cache, actual keys %v", keys)
+	}
+}
@@ -0,0 +1,267 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// ChunkSize is the maximum size in bytes of each chunk of a cached body. Bodies are stored in chunks, so large objects never require a single contiguous allocation, and so a body being received can be appended to without copying what was already received.
+const ChunkSize = 64 * 1024
+
+// Body is the body of a cached object. It may be complete, or it may still be in the process of being received from a parent.
+type Body interface {
+	// WriteTo writes the entire body to w. If the body is still being received, it writes data as it arrives, and blocks until the body is complete.
+	WriteTo(w io.Writer) (int64, error)
+	// Bytes returns the entire body as a single slice. If the body is still being received, it blocks until the body is complete.
+	Bytes() ([]byte, error)
+}
+
+// Chunks is a complete body, stored as a list of chunks. Every chunk except the last is ChunkSize bytes.
+type Chunks [][]byte
+
+// NewChunks splits the given bytes into Chunks. The bytes are not copied, and must not be modified after calling.
+func NewChunks(b []byte) Chunks {
+	chunks := make(Chunks, 0, len(b)/ChunkSize+1)
+	for len(b) > ChunkSize {
+		chunks = append(chunks, b[:ChunkSize])
+		b = b[ChunkSize:]
+	}
+	if len(b) > 0 {
+		chunks = append(chunks, b)
+	}
+	return chunks
+}
+
+// Len returns the total size of all chunks, in bytes.
+func (c Chunks) Len() uint64 {
+	size := uint64(0)
+	for _, chunk := range c {
+		size += uint64(len(chunk))
+	}
+	return size
+}
+
+func (c Chunks) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for _, chunk := range c {
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c Chunks) Bytes() ([]byte, error) {
+	if len(c) == 1 {
+		return c[0], nil
+	}
+	b := make([]byte, 0, c.Len())
+	for _, chunk := range c {
+		b = append(b, chunk...)
+	}
+	return b, nil
+}
+
+// ErrStreamClosed is returned by Stream.Write if the stream has already been closed.
+var ErrStreamClosed = errors.New("stream closed")
+
+// ErrStreamReleased is returned when reading a released Stream whose data has already been freed.
+var ErrStreamReleased = errors.New("stream released")
+
+// Stream is a body which is being received from a parent. It is written by a single writer, and may be concurrently read by any number of readers, each of which receives the entire body from the beginning, as it arrives.
+//
+// Chunks are allocated with a capacity of ChunkSize, and are never reallocated, so readers may safely hold slices of data already written while the writer appends to the same chunk.
+//
+// If the stream is released, because its body won't be cached, chunks are freed as soon as every reader has read past them, and once every reader has finished, the rest of the body is discarded as it's written. Readers which start after data has been freed receive ErrStreamReleased.
+type Stream struct {
+	chunks   Chunks
+	size     uint64
+	done     bool
+	err      error
+	released bool
+	freed    int               // the number of leading chunks which have been freed. Only nonzero if released.
+	readers  map[uint64]uint64 // the position of each reader currently reading, by reader ID
+	readerID uint64            // the ID of the last reader
+	m        sync.Mutex
+	cond     *sync.Cond
+}
+
+// NewStream creates a new, empty Stream. The creator must Write the body to it, and then call Close.
+func NewStream() *Stream {
+	s := &Stream{readers: map[uint64]uint64{}}
+	s.cond = sync.NewCond(&s.m)
+	return s
+}
+
+// Release marks the stream's body as not needed after it's read, so its chunks are freed once every reader has read them. It must be called before the stream is given to any reader.
+func (s *Stream) Release() {
+	s.m.Lock()
+	s.released = true
+	s.m.Unlock()
+}
+
+// Released returns whether the stream has been released.
+func (s *Stream) Released() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.released
+}
+
+// Write appends b to the stream, and wakes any readers waiting for more data. It fulfills io.Writer.
+func (s *Stream) Write(b []byte) (int, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.done {
+		return 0, ErrStreamClosed
+	}
+	written := len(b)
+	if s.discarding() {
+		s.size += uint64(written)
+		return written, nil
+	}
+	for len(b) > 0 {
+		if len(s.chunks) == 0 || len(s.chunks[len(s.chunks)-1]) == ChunkSize {
+			s.chunks = append(s.chunks, make([]byte, 0, ChunkSize))
+		}
+		last := len(s.chunks) - 1
+		n := ChunkSize - len(s.chunks[last])
+		if n > len(b) {
+			n = len(b)
+		}
+		s.chunks[last] = append(s.chunks[last], b[:n]...)
+		b = b[n:]
+	}
+	s.size += uint64(written)
+	s.cond.Broadcast()
+	return written, nil
+}
+
+// Close marks the stream complete. If err is not nil, the body was not fully received, and readers will receive err after all data already written. Close must be called exactly once, after the final Write.
+func (s *Stream) Close(err error) {
+	s.m.Lock()
+	s.done = true
+	s.err = err
+	s.cond.Broadcast()
+	s.m.Unlock()
+}
+
+// Wait blocks until the stream is closed, and returns the chunks written and the error it was closed with, if any. Returns ErrStreamReleased if any chunks have been freed.
+func (s *Stream) Wait() (Chunks, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	for !s.done {
+		s.cond.Wait()
+	}
+	if s.freed > 0 {
+		return nil, ErrStreamReleased
+	}
+	return s.chunks, s.err
+}
+
+func (s *Stream) WriteTo(w io.Writer) (int64, error) {
+	id, err := s.addReader()
+	if err != nil {
+		return 0, err
+	}
+	defer s.removeReader(id)
+	pos := uint64(0)
+	for {
+		s.m.Lock()
+		s.readers[id] = pos
+		s.free()
+		for pos >= s.size && !s.done {
+			s.cond.Wait()
+		}
+		if pos >= s.size {
+			err := s.err
+			s.m.Unlock()
+			return int64(pos), err
+		}
+		chunk := s.chunks[pos/ChunkSize]
+		b := chunk[pos%ChunkSize : len(chunk)]
+		s.m.Unlock()
+
+		n, err := w.Write(b)
+		pos += uint64(n)
+		if err != nil {
+			return int64(pos), err
+		}
+	}
+}
+
+func (s *Stream) Bytes() ([]byte, error) {
+	id, err := s.addReader() // holds the chunks, if the stream is released
+	if err != nil {
+		return nil, err
+	}
+	defer s.removeReader(id)
+	chunks, err := s.Wait()
+	if err != nil {
+		return nil, err
+	}
+	return chunks.Bytes()
+}
+
+// addReader adds a reader at the beginning of the stream, and returns its ID. Returns ErrStreamReleased if the stream is released, and the beginning has already been freed.
+func (s *Stream) addReader() (uint64, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.freed > 0 || s.discarding() {
+		return 0, ErrStreamReleased
+	}
+	s.readerID++
+	s.readers[s.readerID] = 0
+	return s.readerID, nil
+}
+
+// removeReader removes the reader with the given ID, freeing any chunks no longer needed by other readers.
+func (s *Stream) removeReader(id uint64) {
+	s.m.Lock()
+	delete(s.readers, id)
+	s.free()
+	s.m.Unlock()
+}
+
+// discarding returns whether the stream is released, and every reader has finished, so nothing written will ever be read. Must be called with the lock held.
+func (s *Stream) discarding() bool {
+	return s.released && s.readerID > 0 && len(s.readers) == 0
+}
+
+// free frees the chunks every reader has read past, if the stream is released. Must be called with the lock held.
+func (s *Stream) free() {
+	if !s.released || s.readerID == 0 {
+		return // nothing may be freed before the first reader starts, or the data would be lost to it
+	}
+	if len(s.readers) == 0 {
+		for ; s.freed < len(s.chunks); s.freed++ {
+			s.chunks[s.freed] = nil
+		}
+		return
+	}
+	minPos := s.size
+	for _, pos := range s.readers {
+		if pos < minPos {
+			minPos = pos
+		}
+	}
+	for ; s.freed < len(s.chunks) && uint64(s.freed+1)*ChunkSize <= minPos; s.freed++ {
+		s.chunks[s.freed] = nil
+	}
+}
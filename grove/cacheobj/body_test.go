@@ -0,0 +1,187 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewChunks(t *testing.T) {
+	b := bytes.Repeat([]byte("a"), ChunkSize*2+42)
+	chunks := NewChunks(b)
+	if len(chunks) != 3 {
+		t.Fatalf("NewChunks expected 3 chunks, actual %v", len(chunks))
+	}
+	if len(chunks[2]) != 42 {
+		t.Errorf("NewChunks expected last chunk len 42, actual %v", len(chunks[2]))
+	}
+	if chunks.Len() != uint64(len(b)) {
+		t.Errorf("Chunks.Len expected %v, actual %v", len(b), chunks.Len())
+	}
+	actual, err := chunks.Bytes()
+	if err != nil {
+		t.Fatalf("Chunks.Bytes unexpected error: %v", err)
+	}
+	if !bytes.Equal(actual, b) {
+		t.Errorf("Chunks.Bytes expected original bytes, actual differs")
+	}
+	if len(NewChunks(nil)) != 0 {
+		t.Errorf("NewChunks(nil) expected no chunks, actual %v", len(NewChunks(nil)))
+	}
+}
+
+func TestStreamConcurrentReaders(t *testing.T) {
+	body := make([]byte, ChunkSize*3+1234)
+	for i := range body {
+		body[i] = byte(i)
+	}
+
+	s := NewStream()
+	numReaders := 10
+	results := make([]bytes.Buffer, numReaders)
+	wg := sync.WaitGroup{}
+	for i := 0; i < numReaders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := s.WriteTo(&results[i]); err != nil {
+				t.Errorf("Stream.WriteTo reader %v unexpected error: %v", i, err)
+			}
+		}(i)
+	}
+
+	for b := body; len(b) > 0; {
+		n := 1000
+		if n > len(b) {
+			n = len(b)
+		}
+		if _, err := s.Write(b[:n]); err != nil {
+			t.Fatalf("Stream.Write unexpected error: %v", err)
+		}
+		b = b[n:]
+	}
+	s.Close(nil)
+	wg.Wait()
+
+	for i, result := range results {
+		if !bytes.Equal(result.Bytes(), body) {
+			t.Errorf("Stream reader %v expected %v bytes, actual %v bytes or different content", i, len(body), result.Len())
+		}
+	}
+
+	// readers after the stream is closed must still get the entire body
+	late := bytes.Buffer{}
+	if _, err := s.WriteTo(&late); err != nil || !bytes.Equal(late.Bytes(), body) {
+		t.Errorf("Stream.WriteTo after close expected entire body, actual %v bytes err %v", late.Len(), err)
+	}
+
+	if _, err := s.Write([]byte("x")); err != ErrStreamClosed {
+		t.Errorf("Stream.Write after close expected ErrStreamClosed, actual %v", err)
+	}
+}
+
+func TestStreamError(t *testing.T) {
+	s := NewStream()
+	s.Write([]byte("partial"))
+	expectedErr := errors.New("parent hung up")
+	s.Close(expectedErr)
+
+	buf := bytes.Buffer{}
+	if _, err := s.WriteTo(&buf); err != expectedErr {
+		t.Errorf("Stream.WriteTo expected error '%v', actual '%v'", expectedErr, err)
+	}
+	if buf.String() != "partial" {
+		t.Errorf("Stream.WriteTo expected data written before the error 'partial', actual '%v'", buf.String())
+	}
+
+	obj, stream := NewStreaming(nil, 200, 200, "", nil, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+	stream.Close(expectedErr)
+	if _, err := obj.Completed(); err != expectedErr {
+		t.Errorf("CacheObj.Completed expected error '%v', actual '%v'", expectedErr, err)
+	}
+
+	obj, stream = NewStreaming(nil, 200, 200, "", nil, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+	stream.Write([]byte("complete"))
+	stream.Close(nil)
+	completed, err := obj.Completed()
+	if err != nil {
+		t.Fatalf("CacheObj.Completed unexpected error: %v", err)
+	}
+	if completed.Streaming() || completed.Size != uint64(len("complete")) {
+		t.Errorf("CacheObj.Completed expected non-streaming object of size %v, actual streaming %v size %v", len("complete"), completed.Streaming(), completed.Size)
+	}
+}
+
+// funcWriter is an io.Writer which calls its func for each Write.
+type funcWriter func(b []byte) (int, error)
+
+func (f funcWriter) Write(b []byte) (int, error) { return f(b) }
+
+func TestStreamRelease(t *testing.T) {
+	body := bytes.Repeat([]byte("a"), ChunkSize*3)
+	s := NewStream()
+	s.Release()
+	s.Write(body)
+	s.Close(nil)
+
+	buf := bytes.Buffer{}
+	writes := 0
+	freedWhileReading := false
+	w := funcWriter(func(b []byte) (int, error) {
+		if writes++; writes == 2 {
+			s.m.Lock()
+			freedWhileReading = s.chunks[0] == nil
+			s.m.Unlock()
+		}
+		return buf.Write(b)
+	})
+	if _, err := s.WriteTo(w); err != nil || !bytes.Equal(buf.Bytes(), body) {
+		t.Fatalf("Stream.WriteTo released stream expected entire body, actual %v bytes err %v", buf.Len(), err)
+	}
+	if !freedWhileReading {
+		t.Errorf("Stream.WriteTo released stream expected chunks freed once read, actual first chunk kept while reading the second")
+	}
+	for i, chunk := range s.chunks {
+		if chunk != nil {
+			t.Errorf("Stream released after every reader finished expected every chunk freed, actual chunk %v kept", i)
+		}
+	}
+	if _, err := s.WriteTo(&bytes.Buffer{}); err != ErrStreamReleased {
+		t.Errorf("Stream.WriteTo after a released stream was read expected ErrStreamReleased, actual %v", err)
+	}
+	if _, err := s.Wait(); err != ErrStreamReleased {
+		t.Errorf("Stream.Wait after a released stream was read expected ErrStreamReleased, actual %v", err)
+	}
+}
+
+func TestStreamReleaseDiscardsAfterReaders(t *testing.T) {
+	s := NewStream()
+	s.Release()
+	s.Write(bytes.Repeat([]byte("a"), ChunkSize))
+	clientErr := errors.New("client hung up")
+	if _, err := s.WriteTo(funcWriter(func(b []byte) (int, error) { return 0, clientErr })); err != clientErr {
+		t.Fatalf("Stream.WriteTo expected writer error '%v', actual '%v'", clientErr, err)
+	}
+	// the only reader is gone, so the rest of the body must not be held
+	s.Write(bytes.Repeat([]byte("b"), ChunkSize*2))
+	s.Close(nil)
+	if len(s.chunks) != 1 || s.chunks[0] != nil {
+		t.Errorf("Stream.Write after every reader of a released stream finished expected data discarded, actual %v chunks", len(s.chunks))
+	}
+}
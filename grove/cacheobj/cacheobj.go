@@ -22,7 +22,8 @@ import (
 )
 
 type CacheObj struct {
-	Body             []byte
+	// Chunks is the body of a complete object. If the object is still being received, or its body is read from storage, it is empty; use Body() to read the body.
+	Chunks           Chunks
 	ReqHeaders       http.Header
 	RespHeaders      http.Header
 	RespCacheControl rfc.CacheControlMap
@@ -34,18 +35,92 @@ type CacheObj struct {
 	RespRespTime     time.Time // the origin server's Date time when the object was sent
 	LastModified     time.Time // the origin LastModified if it exists, or Date if it doesn't
 	Size             uint64
-	HitCount         uint64 // the number of times this object was hit
+	HitCount         uint64   // the number of times this object was hit
+	VaryHdrs         []string // if this is a variant index, the canonical names of the request headers its variants vary on
+	Variants         []string // if this is a variant index, the secondary cache keys of its variants, oldest first. Nil if this is not a variant index.
+	stream           *Stream  // the body being received, if this object was created by NewStreaming. Never serialized.
+	stored           Body     // the body read from storage as it's written, if this object was gotten from a cache which doesn't hold bodies in memory. Never serialized.
 }
 
 // ComputeSize computes the size of the given CacheObj. This computation is expensive, as the headers must be iterated over. Thus, the size should be computed once and stored, not computed on-the-fly for every new request for the cached object.
 func (c CacheObj) ComputeSize() uint64 {
 	// TODO include headers size
-	return uint64(len(c.Body))
+	return c.Chunks.Len()
 }
 
-func New(reqHeader http.Header, bytes []byte, code int, originCode int, proxyURL string, respHeader http.Header, reqTime time.Time, reqRespTime time.Time, respRespTime time.Time, lastModified time.Time) *CacheObj {
+// Body returns the body of the object. If the object is still being received from the parent, the returned Body streams it as it arrives.
+// The returned Body must not be modified.
+func (c *CacheObj) Body() Body {
+	if c.stream != nil {
+		return c.stream
+	}
+	if c.stored != nil {
+		return c.stored
+	}
+	return c.Chunks
+}
+
+// SetStoredBody sets the body of an object gotten from a cache which stores bodies outside memory, such as on disk. The object's Chunks are left empty, and the body is read from storage when it's written.
+func (c *CacheObj) SetStoredBody(body Body) {
+	c.stored = body
+}
+
+// StoredBody returns the body set by SetStoredBody, or nil if the object's body is its Chunks or a stream.
+func (c *CacheObj) StoredBody() Body {
+	return c.stored
+}
+
+// Streaming returns whether this object was created with a Stream body, which may still be being received.
+func (c *CacheObj) Streaming() bool {
+	return c.stream != nil
+}
+
+// Released returns whether this object's body is being streamed, and freed as it's read, because it won't be cached. A released object may be read by the request it was created for, but must not be given to other requests.
+func (c *CacheObj) Released() bool {
+	return c.stream != nil && c.stream.Released()
+}
+
+// Completed waits for the object's body to be fully received, and returns a copy of the object with Chunks and Size populated, suitable for adding to a cache. Returns an error if the body failed to be received. If the object is not streaming, it is returned as-is.
+func (c *CacheObj) Completed() (*CacheObj, error) {
+	if c.stream == nil {
+		return c, nil
+	}
+	chunks, err := c.stream.Wait()
+	if err != nil {
+		return nil, err
+	}
+	obj := *c
+	obj.stream = nil
+	obj.Chunks = chunks
+	obj.Size = obj.ComputeSize()
+	return &obj, nil
+}
+
+// InMemory returns the object with its body in Chunks. If the object has a stored body, it returns a copy with the body read from storage. Otherwise, the object is returned as-is.
+func (c *CacheObj) InMemory() (*CacheObj, error) {
+	if c.stored == nil {
+		return c, nil
+	}
+	b, err := c.stored.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	obj := *c
+	obj.stored = nil
+	obj.Chunks = NewChunks(b)
+	return &obj, nil
+}
+
+// NewStreaming creates a new CacheObj whose body is not yet received. The body is written to the returned Stream, which must be closed when the body is complete. The object's Size is 0 until it is Completed.
+func NewStreaming(reqHeader http.Header, code int, originCode int, proxyURL string, respHeader http.Header, reqTime time.Time, reqRespTime time.Time, respRespTime time.Time, lastModified time.Time) (*CacheObj, *Stream) {
+	obj := New(reqHeader, nil, code, originCode, proxyURL, respHeader, reqTime, reqRespTime, respRespTime, lastModified)
+	obj.stream = NewStream()
+	return obj, obj.stream
+}
+
+func New(reqHeader http.Header, body Chunks, code int, originCode int, proxyURL string, respHeader http.Header, reqTime time.Time, reqRespTime time.Time, respRespTime time.Time, lastModified time.Time) *CacheObj {
 	obj := &CacheObj{
-		Body:             bytes,
+		Chunks:           body,
 		ReqHeaders:       reqHeader,
 		RespHeaders:      respHeader,
 		RespCacheControl: rfc.ParseCacheControl(respHeader),
@@ -75,6 +150,9 @@ func CanReuse(
 	strictRFC bool,
 	revalidateCanReuse bool,
 ) bool {
+	if cacheObj.IsVariantIndex() {
+		return false
+	}
 	canReuse := rfc.CanReuseStored(reqHeader, cacheObj.RespHeaders, reqCacheControl, cacheObj.RespCacheControl, cacheObj.ReqHeaders, cacheObj.ReqRespTime, cacheObj.RespRespTime, strictRFC)
 	return canReuse == rfc.ReuseCan || (canReuse == rfc.ReuseMustRevalidate && revalidateCanReuse)
 }
@@ -0,0 +1,90 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// DerivedKeySeparator separates the cache key of an object from the suffix of the keys of objects derived from it, such as its variants, encoded copies, and slices.
+const DerivedKeySeparator = "#"
+
+// DerivedKeyBase returns the key of the object the object with the given key is derived from, and true; or false if the key isn't a derived key.
+func DerivedKeyBase(key string) (string, bool) {
+	i := strings.Index(key, DerivedKeySeparator)
+	if i == -1 {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// VaryKeySeparator separates the primary cache key from the selecting header values, in the secondary key of a variant.
+const VaryKeySeparator = DerivedKeySeparator + "vary:"
+
+// NewVariantIndex creates a variant index object, to be stored under the primary cache key of responses with a Vary header.
+// The varyHdrs are the canonical header names the variants vary on, as returned by VaryHeaders. The variants are the secondary keys of the stored variants, oldest first.
+func NewVariantIndex(varyHdrs []string, variants []string) *CacheObj {
+	obj := &CacheObj{VaryHdrs: varyHdrs, Variants: variants}
+	for _, key := range variants {
+		obj.Size += uint64(len(key))
+	}
+	return obj
+}
+
+// IsVariantIndex returns whether this object is a variant index, rather than a response. A variant index must never be served to a client; instead, the variant for the request must be looked up via VaryKey.
+func (c *CacheObj) IsVariantIndex() bool {
+	return c.Variants != nil
+}
+
+// VaryHeaders returns the canonical names of the request headers the given response varies on, sorted. Returns false if the response varies on `*`, which per RFC7234§4.1 never matches any request.
+func VaryHeaders(respHeader http.Header) ([]string, bool) {
+	hdrs := []string{}
+	seen := map[string]struct{}{}
+	for _, varyVal := range respHeader[rfc.Vary] {
+		for _, name := range strings.Split(varyVal, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			name = http.CanonicalHeaderKey(name)
+			if _, ok := seen[name]; ok {
+				continue
+			}
+			seen[name] = struct{}{}
+			hdrs = append(hdrs, name)
+		}
+	}
+	sort.Strings(hdrs)
+	return hdrs, true
+}
+
+// VaryKey returns the secondary cache key for the variant of primaryKey selected by the given request headers, for a response varying on varyHdrs.
+func VaryKey(primaryKey string, varyHdrs []string, reqHeader http.Header) string {
+	key := primaryKey + VaryKeySeparator
+	for i, name := range varyHdrs {
+		if i > 0 {
+			key += "&"
+		}
+		key += name + "=" + rfc.NormalizeHeaderList(reqHeader[name])
+	}
+	return key
+}
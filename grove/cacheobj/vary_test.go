@@ -0,0 +1,50 @@
+package cacheobj
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestVaryHeaders(t *testing.T) {
+	hdrs, ok := VaryHeaders(http.Header{"Vary": {"accept-language, Accept-Encoding", "Accept-Encoding"}})
+	if !ok {
+		t.Fatalf("VaryHeaders expected ok, actual not ok")
+	}
+	if expected := []string{"Accept-Encoding", "Accept-Language"}; !reflect.DeepEqual(hdrs, expected) {
+		t.Errorf("VaryHeaders expected %v, actual %v", expected, hdrs)
+	}
+	if _, ok := VaryHeaders(http.Header{"Vary": {"Accept-Encoding, *"}}); ok {
+		t.Errorf("VaryHeaders with '*' expected not ok, actual ok")
+	}
+	if hdrs, ok := VaryHeaders(http.Header{}); !ok || len(hdrs) != 0 {
+		t.Errorf("VaryHeaders with no Vary expected ok and no headers, actual %v %v", ok, hdrs)
+	}
+}
+
+func TestVaryKey(t *testing.T) {
+	varyHdrs := []string{"Accept-Encoding", "Accept-Language"}
+	gzipKey := VaryKey("GET:http://example.net/", varyHdrs, http.Header{"Accept-Encoding": {"gzip, br"}, "Accept-Language": {"en"}})
+	gzipKey2 := VaryKey("GET:http://example.net/", varyHdrs, http.Header{"Accept-Encoding": {"gzip,br"}, "Accept-Language": {"en"}, "User-Agent": {"foo"}})
+	identityKey := VaryKey("GET:http://example.net/", varyHdrs, http.Header{"Accept-Language": {"en"}})
+	if gzipKey != gzipKey2 {
+		t.Errorf("VaryKey expected requests differing only in whitespace and unselected headers to have the same key, actual '%v' '%v'", gzipKey, gzipKey2)
+	}
+	if gzipKey == identityKey {
+		t.Errorf("VaryKey expected requests with different selected headers to have different keys, actual both '%v'", gzipKey)
+	}
+}
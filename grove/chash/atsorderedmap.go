@@ -21,6 +21,8 @@ import (
 	"sort"
 	"strconv"
 	"time"
+
+	"github.com/apache/trafficcontrol/grove/health"
 )
 
 // func NewATSHashRing(vals []string) HashRing {
@@ -46,6 +48,7 @@ type ATSConsistentHashNode struct {
 	Name      string
 	ProxyURL  *url.URL
 	Transport *http.Transport
+	Health    *health.Parent
 	// pRecord fields (ParentSelection.h)
 	Hostname  string
 	Port      int
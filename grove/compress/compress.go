@@ -0,0 +1,155 @@
+package compress
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content codings, per the IANA HTTP Content Coding Registry.
+const (
+	Gzip     = rfc.Gzip
+	Brotli   = "br"
+	Identity = "identity"
+)
+
+// encoder creates a writer which encodes everything written to it into w. Close must be called to flush the encoding.
+type encoder func(w io.Writer) io.WriteCloser
+
+// decoder creates a reader which decodes r.
+type decoder func(r io.Reader) (io.ReadCloser, error)
+
+var encoders = map[string]encoder{
+	Gzip:   func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	Brotli: func(w io.Writer) io.WriteCloser { return brotli.NewWriter(w) },
+}
+
+var decoders = map[string]decoder{
+	Gzip:   func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	Brotli: func(r io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(brotli.NewReader(r)), nil },
+}
+
+// Supported returns an error if the given content coding can't be both encoded and decoded.
+func Supported(encoding string) error {
+	encoding = strings.ToLower(encoding)
+	if _, ok := encoders[encoding]; !ok {
+		return errors.New("unknown encoding '" + encoding + "'")
+	}
+	if _, ok := decoders[encoding]; !ok {
+		return errors.New("unknown encoding '" + encoding + "'")
+	}
+	return nil
+}
+
+// NewWriter returns a writer which encodes everything written to it with the given content coding into w. The writer must be closed to flush the encoding.
+func NewWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	enc, ok := encoders[strings.ToLower(encoding)]
+	if !ok {
+		return nil, errors.New("unsupported encoding '" + encoding + "'")
+	}
+	return enc(w), nil
+}
+
+// NewReader returns a reader which decodes r with the given content coding.
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	dec, ok := decoders[strings.ToLower(encoding)]
+	if !ok {
+		return nil, errors.New("unsupported encoding '" + encoding + "'")
+	}
+	return dec(r)
+}
+
+// Accepts returns whether the given request accepts the given content coding, per the RFC7231§5.3.4 Accept-Encoding. Codings with a quality of 0 are not acceptable, and `*` matches any coding not otherwise listed.
+// Identity is acceptable unless it's explicitly excluded. A request without an Accept-Encoding accepts only identity, because while RFC7231§5.3.4 permits any coding, clients which don't send one typically can't decode any.
+func Accepts(reqHeader http.Header, encoding string) bool {
+	encoding = strings.ToLower(encoding)
+	if encoding == "" {
+		encoding = Identity
+	}
+	qualities := acceptEncodingQualities(reqHeader)
+	if q, ok := qualities[encoding]; ok {
+		return q > 0
+	}
+	if q, ok := qualities["*"]; ok {
+		return q > 0
+	}
+	return encoding == Identity
+}
+
+// acceptEncodingQualities returns the quality of each coding in the request's Accept-Encoding, by lowercase coding.
+func acceptEncodingQualities(reqHeader http.Header) map[string]float64 {
+	qualities := map[string]float64{}
+	for _, hdr := range reqHeader[rfc.AcceptEncoding] {
+		for _, val := range strings.Split(hdr, ",") {
+			params := strings.Split(val, ";")
+			coding := strings.ToLower(strings.TrimSpace(params[0]))
+			if coding == "" {
+				continue
+			}
+			q := 1.0
+			for _, param := range params[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "q=") && !strings.HasPrefix(param, "Q=") {
+					continue
+				}
+				if parsed, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = parsed
+				}
+			}
+			qualities[coding] = q
+		}
+	}
+	return qualities
+}
+
+// ContentEncoding returns the lowercase content coding of the given response, or the empty string if it has none or is identity. Multiple codings are returned comma-separated, and are never supported.
+func ContentEncoding(respHeader http.Header) string {
+	encodings := []string{}
+	for _, hdr := range respHeader[rfc.ContentEncoding] {
+		for _, val := range strings.Split(hdr, ",") {
+			if val = strings.ToLower(strings.TrimSpace(val)); val != "" && val != Identity {
+				encodings = append(encodings, val)
+			}
+		}
+	}
+	return strings.Join(encodings, ",")
+}
+
+// MimeTypeMatches returns whether the given Content-Type satisfies any of the given media types, which may include wildcards, e.g. `text/*`. Parameters of the Content-Type which the media type doesn't have, e.g. charset, are ignored.
+func MimeTypeMatches(contentType string, mimeTypes []rfc.MimeType) bool {
+	if contentType == "" {
+		return false
+	}
+	mimeType, err := rfc.NewMimeType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range mimeTypes {
+		if mimeType.Satisfy(allowed) {
+			return true
+		}
+	}
+	return false
+}
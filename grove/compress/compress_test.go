@@ -0,0 +1,143 @@
+package compress
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+func TestAccepts(t *testing.T) {
+	tests := []struct {
+		acceptEncoding []string
+		encoding       string
+		expected       bool
+	}{
+		{nil, Gzip, false},
+		{nil, Identity, true},
+		{nil, "", true},
+		{[]string{"gzip, deflate"}, Gzip, true},
+		{[]string{"deflate", "GZIP;q=0.5"}, "gzip", true},
+		{[]string{"gzip;q=0"}, Gzip, false},
+		{[]string{"gzip; q=0.0, *"}, Gzip, false},
+		{[]string{"*"}, Gzip, true},
+		{[]string{"*;q=0"}, Gzip, false},
+		{[]string{"deflate"}, Gzip, false},
+		{[]string{"gzip"}, Identity, true},
+		{[]string{"gzip, identity;q=0"}, Identity, false},
+		{[]string{"gzip, *;q=0"}, Identity, false},
+	}
+	for _, test := range tests {
+		hdr := http.Header{}
+		if test.acceptEncoding != nil {
+			hdr[rfc.AcceptEncoding] = test.acceptEncoding
+		}
+		if actual := Accepts(hdr, test.encoding); actual != test.expected {
+			t.Errorf("Accepts(%v, '%v') expected %v, actual %v", test.acceptEncoding, test.encoding, test.expected, actual)
+		}
+	}
+}
+
+func TestContentEncoding(t *testing.T) {
+	tests := map[string]http.Header{
+		"":        {},
+		"gzip":    {rfc.ContentEncoding: {"GZip"}},
+		"br":      {rfc.ContentEncoding: {" identity, br"}},
+		"gzip,br": {rfc.ContentEncoding: {"gzip", "br"}},
+	}
+	for expected, hdr := range tests {
+		if actual := ContentEncoding(hdr); actual != expected {
+			t.Errorf("ContentEncoding(%v) expected '%v', actual '%v'", hdr, expected, actual)
+		}
+	}
+}
+
+func TestSupported(t *testing.T) {
+	if err := Supported("GZIP"); err != nil {
+		t.Errorf("Supported gzip expected nil error, actual %v", err)
+	}
+	if err := Supported("BR"); err != nil {
+		t.Errorf("Supported brotli expected nil error, actual %v", err)
+	}
+	if err := Supported("compress"); err == nil {
+		t.Errorf("Supported unknown expected error, actual nil")
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, encoding := range []string{Gzip, Brotli} {
+		t.Run(encoding, func(t *testing.T) { testRoundTrip(t, encoding) })
+	}
+}
+
+func testRoundTrip(t *testing.T, encoding string) {
+	body := bytes.Repeat([]byte("grove compress round trip "), 100)
+
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(encoding, buf)
+	if err != nil {
+		t.Fatalf("NewWriter expected nil error, actual %v", err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatalf("writing expected nil error, actual %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("closing writer expected nil error, actual %v", err)
+	}
+	if buf.Len() >= len(body) {
+		t.Errorf("%v expected compressed length < %v, actual %v", encoding, len(body), buf.Len())
+	}
+
+	r, err := NewReader(encoding, buf)
+	if err != nil {
+		t.Fatalf("NewReader expected nil error, actual %v", err)
+	}
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("reading expected nil error, actual %v", err)
+	}
+	if !bytes.Equal(decoded, body) {
+		t.Errorf("%v round trip expected original body, actual '%v'", encoding, string(decoded))
+	}
+}
+
+func TestMimeTypeMatches(t *testing.T) {
+	mimeTypes := []rfc.MimeType{}
+	for _, s := range []string{"text/*", "application/json"} {
+		mimeType, err := rfc.NewMimeType(s)
+		if err != nil {
+			t.Fatalf("NewMimeType '%v' expected nil error, actual %v", s, err)
+		}
+		mimeTypes = append(mimeTypes, mimeType)
+	}
+	tests := map[string]bool{
+		"text/html":                       true,
+		"text/css; charset=utf-8":         true,
+		"application/json":                true,
+		"application/json; charset=utf-8": true,
+		"application/octet-stream":        false,
+		"image/png":                       false,
+		"":                                false,
+	}
+	for contentType, expected := range tests {
+		if actual := MimeTypeMatches(contentType, mimeTypes); actual != expected {
+			t.Errorf("MimeTypeMatches('%v') expected %v, actual %v", contentType, expected, actual)
+		}
+	}
+}
@@ -61,6 +61,16 @@ type Config struct {
 	CacheFiles           map[string][]CacheFile `json:"cache_files"`
 	// FileMemBytes is the amount of memory to use as an LRU in front of each name in CacheFiles, that is, each named group of files. E.g. if there are 10 files, the amount of memory used will be 10*FileMemBytes+CacheSizeBytes.
 	FileMemBytes int `json:"file_mem_bytes"`
+	// LRUCheckpointIntervalMS is how often each file in CacheFiles saves its LRU order and object sizes, so they can be restored on restart. The LRU is also saved on shutdown. If 0, it's only saved on shutdown.
+	LRUCheckpointIntervalMS int `json:"lru_checkpoint_interval_ms"`
+	// InvalidationJobsFile is the path of a file of Traffic Ops content invalidation jobs, in the format of the Traffic Ops /jobs API response. It's loaded on startup and on reload. If empty, no jobs are loaded from a file, but they may still be posted to the purge endpoint.
+	InvalidationJobsFile string `json:"invalidation_jobs_file"`
+	// OCSPRefreshMS is how often OCSP responses are fetched from the OCSP responders of HTTPS certificates, and stapled. If 0, OCSP responses aren't stapled.
+	OCSPRefreshMS int `json:"ocsp_refresh_ms"`
+	// TLSTicketKeyFile is the path of a file of TLS session ticket keys, in the ATS ssl_ticket_key_filename format, so sessions may be resumed across servers sharing the file. If empty, each server generates and rotates its own keys.
+	TLSTicketKeyFile string `json:"tls_ticket_key_file"`
+	// TLSTicketKeyReloadMS is how often TLSTicketKeyFile is reloaded, so keys may be rotated without reloading the config. If 0, it's only loaded on startup and reload.
+	TLSTicketKeyReloadMS int `json:"tls_ticket_key_reload_ms"`
 }
 
 type CacheFile struct {
@@ -88,27 +98,30 @@ const MSPerSec = 1000
 
 // DefaultConfig is the default configuration for the application, if no configuration file is given, or if a given config setting doesn't exist in the config file.
 var DefaultConfig = Config{
-	RFCCompliant:           true,
-	Port:                   80,
-	DisableHTTP2:           false,
-	HTTPSPort:              443,
-	CacheSizeBytes:         bytesPerGibibyte,
-	RemapRulesFile:         "remap.config",
-	ConcurrentRuleRequests: 100000,
-	ConnectionClose:        false,
-	LogLocationError:       log.LogLocationStderr,
-	LogLocationWarning:     log.LogLocationStdout,
-	LogLocationInfo:        log.LogLocationNull,
-	LogLocationDebug:       log.LogLocationNull,
-	LogLocationEvent:       log.LogLocationStdout,
-	ReqTimeoutMS:           30 * MSPerSec,
-	ReqKeepAliveMS:         30 * MSPerSec,
-	ReqMaxIdleConns:        100,
-	ReqIdleConnTimeoutMS:   90 * MSPerSec,
-	ServerIdleTimeoutMS:    10 * MSPerSec,
-	ServerWriteTimeoutMS:   3 * MSPerSec,
-	ServerReadTimeoutMS:    3 * MSPerSec,
-	FileMemBytes:           bytesPerMebibyte * 100,
+	RFCCompliant:            true,
+	Port:                    80,
+	DisableHTTP2:            false,
+	HTTPSPort:               443,
+	CacheSizeBytes:          bytesPerGibibyte,
+	RemapRulesFile:          "remap.config",
+	ConcurrentRuleRequests:  100000,
+	ConnectionClose:         false,
+	LogLocationError:        log.LogLocationStderr,
+	LogLocationWarning:      log.LogLocationStdout,
+	LogLocationInfo:         log.LogLocationNull,
+	LogLocationDebug:        log.LogLocationNull,
+	LogLocationEvent:        log.LogLocationStdout,
+	ReqTimeoutMS:            30 * MSPerSec,
+	ReqKeepAliveMS:          30 * MSPerSec,
+	ReqMaxIdleConns:         100,
+	ReqIdleConnTimeoutMS:    90 * MSPerSec,
+	ServerIdleTimeoutMS:     10 * MSPerSec,
+	ServerWriteTimeoutMS:    3 * MSPerSec,
+	ServerReadTimeoutMS:     3 * MSPerSec,
+	FileMemBytes:            bytesPerMebibyte * 100,
+	LRUCheckpointIntervalMS: 5 * 60 * MSPerSec,
+	OCSPRefreshMS:           60 * 60 * MSPerSec,
+	TLSTicketKeyReloadMS:    60 * MSPerSec,
 }
 
 // LoadConfig loads the given config file. If an empty string is passed, the default config is returned.
@@ -0,0 +1,83 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"errors"
+	"io"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// errBodyReplaced is returned when reading the body of an object which was replaced or removed after it was gotten.
+var errBodyReplaced = errors.New("object replaced or removed while its body was read")
+
+// diskBody is the body of an object stored in a DiskCache. Each chunk is read from the chunk bucket in its own transaction as it's written, so the body is never held in memory at once, and no transaction is held open while writing to a slow client.
+type diskBody struct {
+	db   *bolt.DB
+	key  string
+	id   []byte // the body ID when the object was gotten, or nil if it was stored without one. If it changes while the body is read, the object was replaced, and reading fails.
+	size uint64
+}
+
+func (b *diskBody) WriteTo(w io.Writer) (int64, error) {
+	written := int64(0)
+	for i := 0; ; i++ {
+		chunk, err := b.chunk(i)
+		if err != nil {
+			return written, err
+		}
+		if chunk == nil {
+			break
+		}
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if uint64(written) != b.size {
+		return written, errBodyReplaced // chunks were deleted, and the object was stored without a body ID
+	}
+	return written, nil
+}
+
+func (b *diskBody) Bytes() ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, b.size))
+	if _, err := b.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// chunk returns a copy of the given chunk, or nil if the body has no such chunk.
+func (b *diskBody) chunk(i int) ([]byte, error) {
+	chunk := []byte(nil)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		cb := tx.Bucket([]byte(ChunkBucketName))
+		if cb == nil {
+			return errors.New("chunk bucket does not exist")
+		}
+		if !bytes.Equal(cb.Get(chunkKeyPrefix(b.key)), b.id) {
+			return errBodyReplaced
+		}
+		if v := cb.Get(chunkKey(b.key, i)); v != nil {
+			chunk = append([]byte(nil), v...) // bolt values are only valid for the life of the transaction
+		}
+		return nil
+	})
+	return chunk, err
+}
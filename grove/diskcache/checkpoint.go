@@ -0,0 +1,112 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/lru"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// LRUBucketName is the name of the bucket holding the LRU checkpoint. Each LRU entry is stored under its position, from least to most recently used, as created by checkpointKey, with its value created by checkpointVal.
+const LRUBucketName = "l"
+
+// checkpointKey returns the key of the LRU entry at the given position. Keys sort in position order.
+func checkpointKey(i int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(i))
+	return k
+}
+
+// checkpointVal returns the value of the given LRU entry: its size, followed by its key.
+func checkpointVal(entry lru.Entry) []byte {
+	v := make([]byte, 8, 8+len(entry.Key))
+	binary.BigEndian.PutUint64(v, entry.Size)
+	return append(v, entry.Key...)
+}
+
+// Checkpoint saves the LRU order and sizes to the database, replacing any previous checkpoint, so they can be restored by ResetAfterRestart. If the LRU is still being restored, it waits until the restore finishes.
+func (c *DiskCache) Checkpoint() error {
+	<-c.restored
+	start := time.Now()
+	entries := c.lru.Entries()
+	err := c.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(LRUBucketName)) != nil {
+			if err := tx.DeleteBucket([]byte(LRUBucketName)); err != nil {
+				return errors.New("deleting old checkpoint: " + err.Error())
+			}
+		}
+		b, err := tx.CreateBucket([]byte(LRUBucketName))
+		if err != nil {
+			return errors.New("creating bucket: " + err.Error())
+		}
+		b.FillPercent = 1 // keys are always appended in order, so pages may be filled
+		for i, entry := range entries {
+			if err := b.Put(checkpointKey(i), checkpointVal(entry)); err != nil {
+				return errors.New("inserting entry: " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Infof("DiskCache checkpointed LRU for %s (%d objects) in %v\n", c.db.Path(), len(entries), time.Since(start))
+	return nil
+}
+
+// StartCheckpointing checkpoints the LRU every interval, in a goroutine, until the cache is closed. If interval is not positive, the LRU is only checkpointed on Close.
+func (c *DiskCache) StartCheckpointing(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stopCheckpointer:
+				return
+			case <-ticker.C:
+				if err := c.Checkpoint(); err != nil {
+					log.Errorln("DiskCache checkpointing LRU for '" + c.db.Path() + "': " + err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// loadCheckpoint returns the checkpointed LRU entries, from least to most recently used. If there is no checkpoint, returns no entries and no error.
+func loadCheckpoint(tx *bolt.Tx) ([]lru.Entry, error) {
+	b := tx.Bucket([]byte(LRUBucketName))
+	if b == nil {
+		return nil, nil
+	}
+	entries := []lru.Entry{}
+	cursor := b.Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		if len(v) < 8 {
+			return nil, errors.New("malformed entry: too short")
+		}
+		entries = append(entries, lru.Entry{Key: string(v[8:]), Size: binary.BigEndian.Uint64(v[:8])})
+	}
+	return entries, nil
+}
@@ -16,6 +16,7 @@ package diskcache
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"sync/atomic"
@@ -30,13 +31,39 @@ import (
 )
 
 type DiskCache struct {
-	db           *bolt.DB
-	sizeBytes    uint64
-	maxSizeBytes uint64
-	lru          *lru.LRU
+	db               *bolt.DB
+	sizeBytes        uint64
+	maxSizeBytes     uint64 // atomic: may be changed by SetCapacity
+	lru              *lru.LRU
+	stopCheckpointer chan struct{}
+	restored         chan struct{} // closed when ResetAfterRestart finishes restoring the LRU, or immediately if it's never called
+	bodyID           uint64        // atomic: the ID of the last body added
 }
 
-const BucketName = "b"
+// BucketName is the name of the bucket holding each object, serialized without its body.
+const BucketName = "o"
+
+// ChunkBucketName is the name of the bucket holding object bodies. Each chunk of an object body is stored under its own key, created by chunkKey, and the body's ID is stored under chunkKeyPrefix(key).
+const ChunkBucketName = "c"
+
+// LegacyBucketName is the bucket used by older versions, which stored entire objects including their bodies in a single value. It is deleted on open.
+const LegacyBucketName = "b"
+
+// chunkKeySeparator separates the object key from the chunk index in chunk keys. Object keys are URLs, which never contain it.
+const chunkKeySeparator = 0
+
+// chunkKey returns the key of the given chunk of the given object, in the chunk bucket. Chunk keys for an object sort in chunk order, and all begin with chunkKeyPrefix(key).
+func chunkKey(key string, i int) []byte {
+	k := chunkKeyPrefix(key)
+	idx := make([]byte, 4)
+	binary.BigEndian.PutUint32(idx, uint32(i))
+	return append(k, idx...)
+}
+
+// chunkKeyPrefix returns the prefix of all chunk keys of the given object.
+func chunkKeyPrefix(key string) []byte {
+	return append([]byte(key), chunkKeySeparator)
+}
 
 func New(path string, cacheSizeBytes uint64) (*DiskCache, error) {
 	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
@@ -45,102 +72,219 @@ func New(path string, cacheSizeBytes uint64) (*DiskCache, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(LegacyBucketName)) != nil {
+			log.Warnln("DiskCache.New '" + path + "' contains objects in the legacy unchunked format, deleting them")
+			if err := tx.DeleteBucket([]byte(LegacyBucketName)); err != nil {
+				return errors.New("deleting legacy bucket: " + err.Error())
+			}
+		}
 		if _, err := tx.CreateBucketIfNotExists([]byte(BucketName)); err != nil {
 			return errors.New("creating bucket: " + err.Error())
 		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(ChunkBucketName)); err != nil {
+			return errors.New("creating chunk bucket: " + err.Error())
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(LRUBucketName)); err != nil {
+			return errors.New("creating LRU bucket: " + err.Error())
+		}
 		return nil
 	})
 	if err != nil {
 		return nil, errors.New("creating bucket for database '" + path + "': " + err.Error())
 	}
 
-	return &DiskCache{db: db, maxSizeBytes: cacheSizeBytes, lru: lru.NewLRU(), sizeBytes: 0}, nil
+	restored := make(chan struct{})
+	close(restored)
+	// body IDs start at the current time, so they're never reused across restarts
+	bodyID := uint64(time.Now().UnixNano())
+	return &DiskCache{db: db, maxSizeBytes: cacheSizeBytes, lru: lru.NewLRU(), sizeBytes: 0, stopCheckpointer: make(chan struct{}), restored: restored, bodyID: bodyID}, nil
 }
 
-// ResetAfterRestart rebuilds the LRU with an arbirtrary order and sets sizeBytes. This seems crazy, but it is better than doing nothing, sice gc is based on the LRU and sizeBytes. In the future, we may want to periodically sync the LRU to disk, but we'll still need to iterate over all keys in the disk DB to avoid orphaning objects.
-// Note: this assumes the LRU is empty. Don't run twice
+// ResetAfterRestart rebuilds the LRU and sets sizeBytes, from the LRU checkpoint and the stored objects. This runs in a goroutine, and objects may be added and gotten while it runs.
+//
+// The LRU order and sizes are restored from the last checkpoint, so only the object metadata and checkpoint are read, not object bodies. Objects stored after the last checkpoint are missing from it, so their bodies are iterated to compute their sizes, and they're restored as the most recently used. Checkpointed objects which have since been deleted are skipped. If there is no checkpoint, e.g. after upgrading from a version without checkpoints, all objects are restored in an arbitrary order.
+//
+// Checkpoints wait until the restore finishes, so a partially restored LRU never replaces the last checkpoint.
+//
+// Note: objects used since the cache was opened keep their position in the LRU, ahead of all restored objects. Don't run twice, and call before StartCheckpointing.
 func (c *DiskCache) ResetAfterRestart() {
-	go c.db.View(func(tx *bolt.Tx) error {
-		log.Infof("Starting cache recovery from disk for: %s... ", c.db.Path())
-		size := 0
-		b := tx.Bucket([]byte(BucketName))
+	restored := make(chan struct{})
+	c.restored = restored
+	go func() {
+		defer close(restored)
+		c.db.View(c.restore)
+	}()
+}
 
-		cursor := b.Cursor()
+// restore rebuilds the LRU and sets sizeBytes, as ResetAfterRestart, in the given transaction.
+func (c *DiskCache) restore(tx *bolt.Tx) error {
+	log.Infof("Starting cache recovery from disk for: %s... ", c.db.Path())
+	start := time.Now()
 
-		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			c.lru.Add(string(k), uint64(len(v)))
-			size += len(v)
+	checkpoint, err := loadCheckpoint(tx)
+	if err != nil {
+		log.Errorln("DiskCache.ResetAfterRestart '" + c.db.Path() + "' loading LRU checkpoint, restoring in arbitrary order: " + err.Error())
+		checkpoint = nil
+	}
+	checkpointSizes := make(map[string]uint64, len(checkpoint))
+	for _, entry := range checkpoint {
+		checkpointSizes[entry.Key] = entry.Size
+	}
+
+	exists := map[string]struct{}{}
+	uncheckpointed := []lru.Entry{}
+	cb := tx.Bucket([]byte(ChunkBucketName))
+	cursor := tx.Bucket([]byte(BucketName)).Cursor()
+	for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+		key := string(k)
+		exists[key] = struct{}{}
+		if _, ok := checkpointSizes[key]; ok {
+			continue
+		}
+		size := uint64(len(v))
+		prefix := chunkKeyPrefix(key)
+		chunkCursor := cb.Cursor()
+		for ck, cv := chunkCursor.Seek(prefix); ck != nil && bytes.HasPrefix(ck, prefix); ck, cv = chunkCursor.Next() {
+			size += uint64(len(cv))
 		}
+		uncheckpointed = append(uncheckpointed, lru.Entry{Key: key, Size: size})
+	}
 
-		atomic.AddUint64(&c.sizeBytes, uint64(size))
-		log.Infof("Cache recovery from disk for %s done (%d bytes). ", c.db.Path(), c.sizeBytes)
-		return nil
-	})
+	size := uint64(0)
+	for _, entry := range uncheckpointed {
+		if c.lru.AddOldest(entry.Key, entry.Size) {
+			size += entry.Size
+		}
+	}
+	for i := len(checkpoint) - 1; i >= 0; i-- {
+		entry := checkpoint[i]
+		if _, ok := exists[entry.Key]; !ok {
+			continue
+		}
+		if c.lru.AddOldest(entry.Key, entry.Size) {
+			size += entry.Size
+		}
+	}
+
+	atomic.AddUint64(&c.sizeBytes, size)
+	log.Infof("Cache recovery from disk for %s done (%d bytes, %d objects, %d not in LRU checkpoint) in %v. ", c.db.Path(), c.sizeBytes, len(exists), len(uncheckpointed), time.Since(start))
+	return nil
 }
 
 // Add takes a key and value to add. Returns whether an eviction occurred
 // The size is taken to fulfill the Cache interface, but the DiskCache doesn't use it.
 // Instead, we compute size from the serialized bytes stored to disk.
+// The object is stored without its body, and each chunk of the body is stored separately, so large bodies never need to be copied into a single serialized value. Each body is stored with a unique ID, so bodies being read from the cache can tell if their object is replaced.
+// If the object was gotten from this cache under the same key, as when it's revalidated, only the object is stored, keeping its stored body. If the object was since replaced, it isn't stored.
 //
 // Note DiskCache.Add does garbage collection in a goroutine, and thus it is not possible to determine eviction without impacting performance. This always returns false.
 func (c *DiskCache) Add(key string, val *cacheobj.CacheObj) bool {
 	log.Debugf("DiskCache Add CALLED key '%+v' size '%+v'\n", key, val.Size)
 	eviction := false
 
+	meta := *val
+	meta.Chunks = nil
 	buf := bytes.Buffer{}
-	if err := gob.NewEncoder(&buf).Encode(val); err != nil {
+	if err := gob.NewEncoder(&buf).Encode(&meta); err != nil {
 		log.Errorln("DiskCache.Add encoding cache object: " + err.Error())
 		return eviction
 	}
 	valBytes := buf.Bytes()
 
+	chunks := val.Chunks
+	storedBody := (*diskBody)(nil)
+	if body := val.StoredBody(); body != nil {
+		if stored, ok := body.(*diskBody); ok && stored.db == c.db && stored.key == key {
+			storedBody = stored
+		} else {
+			b, err := body.Bytes()
+			if err != nil {
+				log.Errorln("DiskCache.Add reading '" + key + "' body: " + err.Error())
+				return eviction
+			}
+			chunks = cacheobj.NewChunks(b)
+		}
+	}
+	id := make([]byte, 8)
+	binary.BigEndian.PutUint64(id, atomic.AddUint64(&c.bodyID, 1))
+	sizeBytes := uint64(len(valBytes)) + uint64(len(id)) + chunks.Len()
+	if storedBody != nil {
+		sizeBytes = uint64(len(valBytes)) + uint64(len(storedBody.id)) + storedBody.size
+	}
+
 	err := c.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BucketName))
 		if b == nil {
 			return errors.New("bucket does not exist")
 		}
+		cb := tx.Bucket([]byte(ChunkBucketName))
+		if cb == nil {
+			return errors.New("chunk bucket does not exist")
+		}
+		if storedBody != nil {
+			if b.Get([]byte(key)) == nil || !bytes.Equal(cb.Get(chunkKeyPrefix(key)), storedBody.id) {
+				return errBodyReplaced
+			}
+			return b.Put([]byte(key), valBytes)
+		}
+		if err := deleteChunks(cb, key); err != nil {
+			return errors.New("deleting old chunks: " + err.Error())
+		}
+		if err := cb.Put(chunkKeyPrefix(key), id); err != nil {
+			return errors.New("inserting body ID: " + err.Error())
+		}
+		for i, chunk := range chunks {
+			if err := cb.Put(chunkKey(key, i), chunk); err != nil {
+				return errors.New("inserting chunk: " + err.Error())
+			}
+		}
 		return b.Put([]byte(key), valBytes)
 	})
-	if err != nil {
+	if err == errBodyReplaced {
+		log.Debugln("DiskCache.Add '" + key + "' was replaced or removed since its stored body was gotten, not storing")
+		return eviction
+	} else if err != nil {
 		log.Errorln("DiskCache.Add inserting '" + key + "' in database: " + err.Error())
 		return eviction
 	}
 
-	c.lru.Add(key, uint64(len(valBytes)))
-
-	newSizeBytes := atomic.AddUint64(&c.sizeBytes, uint64(len(valBytes)))
-	if newSizeBytes > c.maxSizeBytes {
+	oldSizeBytes := c.lru.Add(key, sizeBytes)
+	newSizeBytes := atomic.AddUint64(&c.sizeBytes, sizeBytes-oldSizeBytes)
+	if newSizeBytes > c.Capacity() {
 		go c.gc(newSizeBytes)
 	}
 
-	log.Debugf("DiskCache Add SUCCESS key '%+v' size '%+v' valBytes '%+v' c.sizeBytes '%+v'\n", key, val.Size, len(valBytes), c.sizeBytes)
+	log.Debugf("DiskCache Add SUCCESS key '%+v' size '%+v' sizeBytes '%+v' c.sizeBytes '%+v'\n", key, val.Size, sizeBytes, c.sizeBytes)
 	return eviction
 }
 
+// deleteChunks deletes all chunks of the given object key from the given chunk bucket.
+func deleteChunks(cb *bolt.Bucket, key string) error {
+	prefix := chunkKeyPrefix(key)
+	cursor := cb.Cursor()
+	for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Seek(prefix) {
+		if err := cursor.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // gc does garbage collection, deleting stored entries until the DiskCache's size is less than maxSizeBytes. This is threadsafe, and should be called in a goroutine to avoid blocking the caller.
 // The given cacheSizeBytes must be `c.Size()`; it's passed here, because gc should be called immediately after an insert updates the size, so it saves an atomic instruction to pass rather than calling Size() again.
 func (c *DiskCache) gc(cacheSizeBytes uint64) {
-	for cacheSizeBytes > c.maxSizeBytes {
-		log.Debugf("DiskCache.gc cacheSizeBytes %+v > c.maxSizeBytes %+v\n", cacheSizeBytes, c.maxSizeBytes)
+	for maxSizeBytes := c.Capacity(); cacheSizeBytes > maxSizeBytes; {
+		log.Debugf("DiskCache.gc cacheSizeBytes %+v > c.maxSizeBytes %+v\n", cacheSizeBytes, maxSizeBytes)
 		key, sizeBytes, exists := c.lru.RemoveOldest() // TODO change lru to use strings
 		if !exists {
 			// should never happen
-			log.Errorf("sizeBytes %v > %v maxSizeBytes, but LRU is empty!? Setting cache size to 0!\n", cacheSizeBytes, c.maxSizeBytes)
+			log.Errorf("sizeBytes %v > %v maxSizeBytes, but LRU is empty!? Setting cache size to 0!\n", cacheSizeBytes, maxSizeBytes)
 			atomic.StoreUint64(&c.sizeBytes, 0)
 			return
 		}
 
 		log.Debugf("DiskCache.gc deleting key '" + key + "'")
-		err := c.db.Update(func(tx *bolt.Tx) error {
-			b := tx.Bucket([]byte(BucketName))
-			if b == nil {
-				return errors.New("bucket does not exist")
-			}
-			b.Delete([]byte(key))
-
-			return b.Delete([]byte(key))
-		})
-		if err != nil {
+		if err := c.deleteKey(key); err != nil {
 			log.Errorln("removing '" + key + "' from cache: " + err.Error())
 		}
 
@@ -148,11 +292,42 @@ func (c *DiskCache) gc(cacheSizeBytes uint64) {
 	}
 }
 
+// deleteKey deletes the object and its chunks from the database. It does not change the LRU or size.
+func (c *DiskCache) deleteKey(key string) error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketName))
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		cb := tx.Bucket([]byte(ChunkBucketName))
+		if cb == nil {
+			return errors.New("chunk bucket does not exist")
+		}
+		if err := deleteChunks(cb, key); err != nil {
+			return err
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// Remove removes the key from the cache. Returns whether the key existed.
+func (c *DiskCache) Remove(key string) bool {
+	sizeBytes, exists := c.lru.Remove(key)
+	if !exists {
+		return false
+	}
+	if err := c.deleteKey(key); err != nil {
+		log.Errorln("DiskCache.Remove removing '" + key + "' from cache: " + err.Error())
+	}
+	atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
+	return true
+}
+
 // Get takes a key, and returns its value, and whether it was found, and updates the lru-ness and hitcount
 func (c *DiskCache) Get(key string) (*cacheobj.CacheObj, bool) {
 	val, found := c.Peek(key)
 	if found {
-		c.lru.Add(key, val.Size) // TODO directly call c.ll.MoveToFront
+		c.lru.Touch(key) // the LRU size is the size on disk, not val.Size, so it must not be changed here
 		log.Debugln("DiskCache.Get getting '" + key + "' from cache and updating LRU")
 		atomic.AddUint64(&val.HitCount, 1)
 		return val, true
@@ -161,17 +336,30 @@ func (c *DiskCache) Get(key string) (*cacheobj.CacheObj, bool) {
 
 }
 
-// Peek takes a key, and returns its value, and whether it was found, without changing the lru-ness or hitcount
+// Peek takes a key, and returns its value, and whether it was found, without changing the lru-ness or hitcount.
+// The returned object's body is read from disk as it's written, one chunk at a time, rather than read into its Chunks.
 func (c *DiskCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 	log.Debugln("DiskCache.Get key '" + key + "'")
 	valBytes := []byte(nil)
+	id := []byte(nil)
 
 	err := c.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(BucketName))
 		if b == nil {
 			return errors.New("bucket does not exist")
 		}
-		valBytes = b.Get([]byte(key))
+		cb := tx.Bucket([]byte(ChunkBucketName))
+		if cb == nil {
+			return errors.New("chunk bucket does not exist")
+		}
+		if valBytes = b.Get([]byte(key)); valBytes == nil {
+			return nil
+		}
+		// bolt values are only valid for the life of the transaction, so they must be copied
+		valBytes = append([]byte(nil), valBytes...)
+		if v := cb.Get(chunkKeyPrefix(key)); v != nil {
+			id = append([]byte(nil), v...)
+		}
 		return nil
 	})
 	if err != nil {
@@ -190,6 +378,7 @@ func (c *DiskCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 		log.Errorln("DiskCache.Peek decoding '" + key + "' from cache: " + err.Error())
 		return nil, false
 	}
+	val.SetStoredBody(&diskBody{db: c.db, key: key, id: id, size: val.Size})
 
 	log.Debugln("DiskCache.Peek key '" + key + "' CACHE HIT")
 	return &val, true
@@ -199,7 +388,12 @@ func (c *DiskCache) Size() uint64 {
 	return atomic.LoadUint64(&c.sizeBytes)
 }
 
+// Close stops checkpointing, checkpoints the LRU, and closes the database.
 func (c *DiskCache) Close() {
+	close(c.stopCheckpointer)
+	if err := c.Checkpoint(); err != nil {
+		log.Errorln("DiskCache.Close '" + c.db.Path() + "' checkpointing LRU: " + err.Error())
+	}
 	c.db.Close()
 }
 
@@ -208,6 +402,35 @@ func (c *DiskCache) Keys() []string {
 
 }
 
+// DerivedKeys returns the keys derived from the given key, by seeking to them in the database, whose keys are sorted.
+func (c *DiskCache) DerivedKeys(key string) []string {
+	keys := []string{}
+	err := c.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(BucketName))
+		if b == nil {
+			return errors.New("bucket does not exist")
+		}
+		prefix := []byte(key + cacheobj.DerivedKeySeparator)
+		cursor := b.Cursor()
+		for k, _ := cursor.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = cursor.Next() {
+			keys = append(keys, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorln("DiskCache.DerivedKeys getting keys derived from '" + key + "': " + err.Error())
+	}
+	return keys
+}
+
 func (c *DiskCache) Capacity() uint64 {
-	return c.maxSizeBytes
+	return atomic.LoadUint64(&c.maxSizeBytes)
+}
+
+// SetCapacity changes the maximum size of the cache. If the cache is larger than the new capacity, the least recently used objects are removed in a goroutine.
+func (c *DiskCache) SetCapacity(bytes uint64) {
+	atomic.StoreUint64(&c.maxSizeBytes, bytes)
+	if size := c.Size(); size > bytes {
+		go c.gc(size)
+	}
 }
@@ -0,0 +1,219 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/config"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func newTestObj(body string) *cacheobj.CacheObj {
+	return cacheobj.New(nil, cacheobj.NewChunks([]byte(body)), 200, 200, "", http.Header{}, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+}
+
+func TestCheckpointRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("New unexpected error: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Add(key, newTestObj("body of "+key))
+	}
+	c.Get("a")
+	if err := c.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint unexpected error: %v", err)
+	}
+	c.Add("e", newTestObj("body of e, added after the checkpoint"))
+	c.Remove("c")
+	expectedKeys := []string{"b", "d", "a", "e"}
+	expectedSize := c.Size()
+	c.db.Close() // close without checkpointing, as if the process were killed
+
+	c, err = New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("New reopening unexpected error: %v", err)
+	}
+	defer c.Close()
+	if err := c.db.View(c.restore); err != nil {
+		t.Fatalf("restore unexpected error: %v", err)
+	}
+	if keys := c.Keys(); !reflect.DeepEqual(keys, expectedKeys) {
+		t.Errorf("restore expected keys %v, actual %v", expectedKeys, keys)
+	}
+	if c.Size() != expectedSize {
+		t.Errorf("restore expected size %v, actual %v", expectedSize, c.Size())
+	}
+}
+
+func TestCloseDuringRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	c, err := New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("New unexpected error: %v", err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		c.Add(key, newTestObj("body of "+key))
+	}
+	c.Close()
+
+	// restarting and shutting down again immediately must not replace the checkpoint with the partially restored LRU
+	c, err = New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("New reopening unexpected error: %v", err)
+	}
+	c.ResetAfterRestart()
+	c.Close()
+
+	c, err = New(path, 1024*1024)
+	if err != nil {
+		t.Fatalf("New reopening unexpected error: %v", err)
+	}
+	defer c.Close()
+	if err := c.db.View(c.restore); err != nil {
+		t.Fatalf("restore unexpected error: %v", err)
+	}
+	if keys, expected := c.Keys(), []string{"a", "b", "c"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("restore after closing during restore expected keys %v, actual %v", expected, keys)
+	}
+}
+
+func TestFilesSetCapacities(t *testing.T) {
+	dir := t.TempDir()
+	oldFiles := map[string][]config.CacheFile{"disk": {{Path: filepath.Join(dir, "a.db"), Bytes: 1024}}}
+	newFiles := []config.CacheFile{{Path: filepath.Join(dir, "a.db"), Bytes: 2048}}
+
+	fs := NewFiles()
+	defer fs.Close()
+	if _, err := fs.Multi(oldFiles["disk"], time.Hour); err != nil {
+		t.Fatalf("Multi unexpected error: %v", err)
+	}
+	mdc, err := fs.Multi(newFiles, time.Hour)
+	if err != nil {
+		t.Fatalf("Multi unexpected error: %v", err)
+	}
+	if capacity := mdc.Capacity(); capacity != 2048 {
+		t.Errorf("Multi expected capacity 2048, actual %v", capacity)
+	}
+	fs.SetCapacities(oldFiles)
+	if capacity := mdc.Capacity(); capacity != 1024 {
+		t.Errorf("SetCapacities expected capacity restored to 1024, actual %v", capacity)
+	}
+}
+
+func TestDerivedKeys(t *testing.T) {
+	c, err := New(filepath.Join(t.TempDir(), "cache.db"), 1024*1024)
+	if err != nil {
+		t.Fatalf("New unexpected error: %v", err)
+	}
+	defer c.Close()
+	for _, key := range []string{"GET:http://a/x", "GET:http://a/x#slice:10:0", "GET:http://a/x#encoding:gzip", "GET:http://a/xy#slice:10:0", "GET:http://a/w#slice:10:0"} {
+		c.Add(key, newTestObj("body of "+key))
+	}
+	expected := []string{"GET:http://a/x#encoding:gzip", "GET:http://a/x#slice:10:0"}
+	if keys := c.DerivedKeys("GET:http://a/x"); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("DerivedKeys expected %v, actual %v", expected, keys)
+	}
+	c.Remove("GET:http://a/x#encoding:gzip")
+	if keys := c.DerivedKeys("GET:http://a/x"); !reflect.DeepEqual(keys, expected[1:]) {
+		t.Errorf("DerivedKeys after Remove expected %v, actual %v", expected[1:], keys)
+	}
+}
+
+func TestPeekReadsBodyFromDisk(t *testing.T) {
+	c, err := New(filepath.Join(t.TempDir(), "cache.db"), 1024*1024)
+	if err != nil {
+		t.Fatalf("New unexpected error: %v", err)
+	}
+	defer c.Close()
+	body := bytes.Repeat([]byte("0123456789"), cacheobj.ChunkSize/4)
+	c.Add("a", cacheobj.New(nil, cacheobj.NewChunks(body), 200, 200, "", http.Header{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}))
+
+	obj, ok := c.Get("a")
+	if !ok {
+		t.Fatalf("Get expected object, actual miss")
+	}
+	if len(obj.Chunks) != 0 {
+		t.Errorf("Get expected body read from disk as it's written, actual %v chunks read", len(obj.Chunks))
+	}
+	if actual, err := obj.Body().Bytes(); err != nil || !bytes.Equal(actual, body) {
+		t.Errorf("Get body expected %v bytes, actual %v bytes err %v", len(body), len(actual), err)
+	}
+
+	// revalidating stores the object again, keeping its body
+	obj.RespHeaders = http.Header{"Date": {"revalidated"}}
+	c.Add("a", obj)
+	revalidated, ok := c.Get("a")
+	if !ok || revalidated.RespHeaders.Get("Date") != "revalidated" {
+		t.Fatalf("Get after re-adding expected revalidated object, actual %+v", revalidated)
+	}
+	if actual, err := obj.Body().Bytes(); err != nil || !bytes.Equal(actual, body) {
+		t.Errorf("Get body after re-adding expected %v bytes, actual %v bytes err %v", len(body), len(actual), err)
+	}
+
+	c.Add("a", newTestObj("replaced"))
+	if _, err := revalidated.Body().WriteTo(&bytes.Buffer{}); err != errBodyReplaced {
+		t.Errorf("reading body of replaced object expected errBodyReplaced, actual %v", err)
+	}
+	c.Add("a", revalidated) // must not store the old object with the new body
+	if replaced, ok := c.Get("a"); !ok {
+		t.Errorf("Get after re-adding replaced object expected object, actual miss")
+	} else if actual, err := replaced.Body().Bytes(); err != nil || string(actual) != "replaced" {
+		t.Errorf("Get after re-adding replaced object expected body 'replaced', actual '%s' err %v", actual, err)
+	}
+}
+
+func TestFilesRetainClosesAfterWait(t *testing.T) {
+	dir := t.TempDir()
+	files := []config.CacheFile{{Path: filepath.Join(dir, "a.db"), Bytes: 1024}, {Path: filepath.Join(dir, "b.db"), Bytes: 1024}}
+	fs := NewFiles()
+	defer fs.Close()
+	mdc, err := fs.Multi(files, time.Hour)
+	if err != nil {
+		t.Fatalf("Multi unexpected error: %v", err)
+	}
+	a, b := (*mdc)[0], (*mdc)[1]
+	isOpen := func(c *DiskCache) bool {
+		return c.db.View(func(*bolt.Tx) error { return nil }) == nil
+	}
+
+	release := make(chan struct{})
+	fs.Retain(nil, func() { <-release })
+	if !isOpen(a) || !isOpen(b) {
+		t.Fatalf("Retain expected removed files open until requests finish, actual closed")
+	}
+	if _, err := fs.Multi(files[:1], time.Hour); err != nil {
+		t.Fatalf("Multi reusing a file waiting to be closed unexpected error: %v", err)
+	}
+	close(release)
+	for i := 0; isOpen(b); i++ {
+		if i > 100 {
+			t.Fatalf("Retain expected removed file closed after requests finish, actual open")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if !isOpen(a) {
+		t.Errorf("Retain expected file reused before requests finished kept open, actual closed")
+	}
+}
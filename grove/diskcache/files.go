@@ -0,0 +1,145 @@
+package diskcache
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/config"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// Files is the set of open disk cache files, by path. Because a database file is locked while it's open, it can't be opened again when the config is reloaded. Files keeps files open across reloads, so caches for unchanged files keep their objects, and only added files are opened and removed files closed.
+type Files struct {
+	caches  map[string]*DiskCache
+	closing map[string]*DiskCache // files no longer in the config, which are closed once requests using them finish, unless they're reused first
+	m       sync.Mutex
+}
+
+func NewFiles() *Files {
+	return &Files{caches: map[string]*DiskCache{}, closing: map[string]*DiskCache{}}
+}
+
+// Multi returns a MultiDiskCache of the given files. Files which aren't already open are opened, their LRUs restored, and checkpointed every checkpointInterval. Files which are already open are reused, and their capacity set to the given size.
+//
+// Note objects are distributed across the files by their index, so if the files of a MultiDiskCache change, most existing objects will be cache misses, and will be evicted as they become least recently used.
+func (fs *Files) Multi(files []config.CacheFile, checkpointInterval time.Duration) (*MultiDiskCache, error) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	caches := make([]*DiskCache, len(files), len(files))
+	for i, file := range files {
+		if cache, ok := fs.closing[file.Path]; ok {
+			log.Infoln("reusing disk cache '" + file.Path + "', which was waiting to be closed")
+			delete(fs.closing, file.Path)
+			fs.caches[file.Path] = cache
+		}
+		if cache, ok := fs.caches[file.Path]; ok {
+			if cache.Capacity() != file.Bytes {
+				log.Infof("disk cache '%v' capacity changed from %v to %v bytes\n", file.Path, cache.Capacity(), file.Bytes)
+				cache.SetCapacity(file.Bytes)
+			}
+			caches[i] = cache
+			continue
+		}
+		cache, err := New(file.Path, file.Bytes)
+		if err != nil {
+			return nil, errors.New("creating disk cache '" + file.Path + "': " + err.Error())
+		}
+		cache.ResetAfterRestart() // should this be optional?
+		cache.StartCheckpointing(checkpointInterval)
+		fs.caches[file.Path] = cache
+		caches[i] = cache
+	}
+
+	mdc := MultiDiskCache(caches)
+	return &mdc, nil
+}
+
+// Retain forgets all open files which aren't in the given files, which are typically all the cache files in the config, and closes them once wait returns. The wait is called in a goroutine, and should return once requests which may be using the files have finished. Files reused by Multi before then are kept open. If wait is nil, the files are closed immediately.
+func (fs *Files) Retain(nameFiles map[string][]config.CacheFile, wait func()) {
+	paths := map[string]struct{}{}
+	for _, files := range nameFiles {
+		for _, file := range files {
+			paths[file.Path] = struct{}{}
+		}
+	}
+
+	fs.m.Lock()
+	dropped := map[string]*DiskCache{}
+	for path, cache := range fs.caches {
+		if _, ok := paths[path]; ok {
+			continue
+		}
+		dropped[path] = cache
+		fs.closing[path] = cache
+		delete(fs.caches, path)
+	}
+	fs.m.Unlock()
+	if len(dropped) == 0 {
+		return
+	}
+
+	closeDropped := func() {
+		fs.m.Lock()
+		defer fs.m.Unlock()
+		for path, cache := range dropped {
+			if fs.closing[path] != cache {
+				continue // reused, or already closed by Close
+			}
+			log.Infoln("closing disk cache '" + path + "', which is no longer in the config")
+			cache.Close()
+			delete(fs.closing, path)
+		}
+	}
+	if wait == nil {
+		closeDropped()
+		return
+	}
+	go func() {
+		wait()
+		closeDropped()
+	}()
+}
+
+// SetCapacities sets the capacity of each open file to its size in the given files, which are typically all the cache files in the config. This is used to undo the capacity changes of Multi, when a reload fails and the existing config is kept.
+func (fs *Files) SetCapacities(nameFiles map[string][]config.CacheFile) {
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	for _, files := range nameFiles {
+		for _, file := range files {
+			cache, ok := fs.caches[file.Path]
+			if !ok || cache.Capacity() == file.Bytes {
+				continue
+			}
+			log.Infof("disk cache '%v' capacity restored from %v to %v bytes\n", file.Path, cache.Capacity(), file.Bytes)
+			cache.SetCapacity(file.Bytes)
+		}
+	}
+}
+
+// Close closes all open files, checkpointing their LRUs, including files waiting to be closed after being removed from the config.
+func (fs *Files) Close() {
+	fs.Retain(nil, nil)
+	fs.m.Lock()
+	defer fs.m.Unlock()
+	for path, cache := range fs.closing {
+		log.Infoln("closing disk cache '" + path + "', which is no longer in the config")
+		cache.Close()
+		delete(fs.closing, path)
+	}
+}
@@ -15,7 +15,7 @@ package diskcache
 */
 
 import (
-	"errors"
+	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/config"
@@ -28,19 +28,9 @@ import (
 // MultiDiskCache is a disk cache using multiple files. It exists primarily to allow caching across multiple physical disks, but may be used for other purposes. For example, it may be more performant to use multiple files, or it may be advantageous to keep each remap rule in its own file. Keys are evenly distributed across the given files via consistent hashing.
 type MultiDiskCache []*DiskCache
 
-func NewMulti(files []config.CacheFile) (*MultiDiskCache, error) {
-	caches := make([]*DiskCache, len(files), len(files))
-	for i, file := range files {
-		cache, err := New(file.Path, file.Bytes)
-		if err != nil {
-			return nil, errors.New("creating disk cache '" + file.Path + "': " + err.Error())
-		}
-		cache.ResetAfterRestart() // should this be optional?
-		caches[i] = cache
-	}
-
-	mdc := MultiDiskCache(caches)
-	return &mdc, nil
+// NewMulti creates a MultiDiskCache of the given files, restoring each file's LRU, and checkpointing it every checkpointInterval.
+func NewMulti(files []config.CacheFile, checkpointInterval time.Duration) (*MultiDiskCache, error) {
+	return NewFiles().Multi(files, checkpointInterval)
 }
 
 // KeyIdx gets the consistent-hashed index of which DiskCache the key is mapped to.
@@ -66,6 +56,12 @@ func (c *MultiDiskCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 	return (*c)[i].Peek(key)
 }
 
+func (c *MultiDiskCache) Remove(key string) bool {
+	i := c.keyIdx(key)
+	log.Debugf("MultiDiskCache.Remove key '%+v' mapped to %+v\n", key, i)
+	return (*c)[i].Remove(key)
+}
+
 func (c *MultiDiskCache) Size() uint64 {
 	sum := uint64(0)
 	for _, cache := range *c {
@@ -89,6 +85,15 @@ func (c *MultiDiskCache) Keys() []string {
 	return arr
 }
 
+// DerivedKeys returns the keys derived from the given key in every file. Derived keys are hashed independently of the key they're derived from, so they may be in any file.
+func (c *MultiDiskCache) DerivedKeys(key string) []string {
+	arr := make([]string, 0)
+	for _, cache := range *c {
+		arr = append(arr, cache.DerivedKeys(key)...)
+	}
+	return arr
+}
+
 func (c *MultiDiskCache) Capacity() uint64 {
 	sum := uint64(0)
 	for _, cache := range *c {
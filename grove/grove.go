@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"reflect"
@@ -29,6 +30,7 @@ import (
 	"runtime/pprof"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/net/http2"
@@ -39,9 +41,11 @@ import (
 	"github.com/apache/trafficcontrol/grove/cache"
 	"github.com/apache/trafficcontrol/grove/config"
 	"github.com/apache/trafficcontrol/grove/diskcache"
+	"github.com/apache/trafficcontrol/grove/health"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/memcache"
 	"github.com/apache/trafficcontrol/grove/plugin"
+	"github.com/apache/trafficcontrol/grove/purge"
 	"github.com/apache/trafficcontrol/grove/remap"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/stat"
@@ -81,7 +85,8 @@ func main() {
 	}
 	log.Init(eventW, errW, warnW, infoW, debugW)
 
-	caches, err := createCaches(cfg.CacheFiles, uint64(cfg.FileMemBytes), uint64(cfg.CacheSizeBytes))
+	diskFiles := diskcache.NewFiles()
+	caches, err := createCaches(diskFiles, cfg, config.Config{}, nil)
 	if err != nil {
 		log.Errorln("starting service: creating caches: " + err.Error())
 		os.Exit(1)
@@ -93,24 +98,29 @@ func main() {
 	reqIdleConnTimeout := time.Duration(cfg.ReqIdleConnTimeoutMS) * time.Millisecond
 	baseTransport := remap.NewRemappingTransport(reqTimeout, reqKeepAlive, reqMaxIdleConns, reqIdleConnTimeout)
 
+	parentHealth := health.NewChecker()
 	plugins := plugin.Get(cfg.Plugins)
-	remapper, err := remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport)
+	remapper, err := remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport, parentHealth)
 	if err != nil {
 		log.Errorf("starting service: loading remap rules: %v\n", err)
 		os.Exit(1)
 	}
 
-	certs, err := loadCerts(remapper.Rules())
+	ruleCerts, defaultCert, err := loadCerts(remapper.Rules(), cfg)
 	if err != nil {
 		log.Errorf("starting service: loading certificates: %v\n", err)
 		os.Exit(1)
 	}
-	defaultCert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	certs, err := web.NewCerts(ruleCerts, defaultCert)
 	if err != nil {
-		log.Errorf("starting service: loading default certificate: %v\n", err)
+		log.Errorf("starting service: loading certificates: %v\n", err)
+		os.Exit(1)
+	}
+	certs.SetOCSPRefresh(time.Duration(cfg.OCSPRefreshMS) * time.Millisecond)
+	if err := certs.SetTicketKeyFile(cfg.TLSTicketKeyFile, time.Duration(cfg.TLSTicketKeyReloadMS)*time.Millisecond); err != nil {
+		log.Errorf("starting service: loading TLS session ticket keys: %v\n", err)
 		os.Exit(1)
 	}
-	certs = append(certs, defaultCert)
 
 	httpListener, httpConns, httpConnStateCallback, err := web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port))
 	if err != nil {
@@ -130,16 +140,21 @@ func main() {
 		}
 	}
 
+	jobs := purge.NewJobs()
+	loadJobs(cfg.InvalidationJobsFile, jobs)
+
 	// TODO pass total size for all file groups?
 	stats := stat.New(remapper.Rules(), caches, uint64(cfg.CacheSizeBytes), httpConns, httpsConns, Version)
 
-	buildHandler := func(scheme string, port string, conns *web.ConnMap, stats stat.Stats, pluginContext map[string]*interface{}) *cache.HandlerPointer {
-		return cache.NewHandlerPointer(cache.NewHandler(
+	pluginContext := map[string]*interface{}{}
+
+	buildHandler := func(scheme string, port int, conns *web.ConnMap) *cache.Handler {
+		return cache.NewHandler(
 			remapper,
 			uint64(cfg.ConcurrentRuleRequests),
 			stats,
 			scheme,
-			port,
+			strconv.Itoa(port),
 			conns,
 			cfg.RFCCompliant,
 			cfg.ConnectionClose,
@@ -148,13 +163,12 @@ func main() {
 			httpConns,
 			httpsConns,
 			cfg.InterfaceName,
-		))
+			jobs,
+		)
 	}
 
-	pluginContext := map[string]*interface{}{}
-
-	httpHandler := buildHandler("http", strconv.Itoa(cfg.Port), httpConns, stats, pluginContext)
-	httpsHandler := buildHandler("https", strconv.Itoa(cfg.HTTPSPort), httpsConns, stats, pluginContext)
+	httpHandler := cache.NewHandlerPointer(buildHandler("http", cfg.Port, httpConns))
+	httpsHandler := cache.NewHandlerPointer(buildHandler("https", cfg.HTTPSPort, httpsConns))
 
 	idleTimeout := time.Duration(cfg.ServerIdleTimeoutMS) * time.Millisecond
 	readTimeout := time.Duration(cfg.ServerReadTimeoutMS) * time.Millisecond
@@ -169,6 +183,7 @@ func main() {
 		httpsServer = startServer(httpsHandler, httpsListener, httpsConnStateCallback, tlsConfig, cfg.HTTPSPort, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "https")
 	}
 
+	// reloadConfig reloads the config file, remap rules, caches, certificates, and plugins, without dropping connections. Requests in progress finish with the old config. If anything fails to load, the existing config is kept for it.
 	reloadConfig := func() {
 		log.Infoln("reloading config")
 		err := error(nil)
@@ -186,114 +201,181 @@ func main() {
 			log.Init(eventW, errW, warnW, infoW, debugW)
 		}
 
-		// TODO add cache file reloading
-		// The problem is, the disk db needs file locks, so there's no way to close and create new files without making all requests cache miss in the meantime.
-		// Thus, the file paths must be kept, diffed, only removed paths' dbs closed, only new paths opened, and dbs for existing paths passed into the new caches object.
-		if cachesChanged(oldCfg, cfg) {
-			log.Warnln("reloading config: caches changed in new config! Dynamic cache reloading is not supported! Old cache files and sizes will be used, and new cache config will NOT be loaded! Restart service to apply cache changes!")
+		// Disk cache files are locked while open, so they can't be closed and reopened without all requests missing the cache in the meantime. Instead, files which are still in the config are kept open and reused, only new files are opened, and removed files are closed once requests using the old remap rules finish.
+		oldCaches := caches
+		if caches, err = createCaches(diskFiles, cfg, oldCfg, oldCaches); err != nil {
+			log.Errorln("reloading config: failed to create caches, keeping existing caches: " + err.Error())
+			diskFiles.Retain(oldCfg.CacheFiles, waitShutdownTimeout)
+			diskFiles.SetCapacities(oldCfg.CacheFiles)
+			caches = oldCaches
+			cfg.CacheFiles, cfg.CacheSizeBytes, cfg.FileMemBytes = oldCfg.CacheFiles, oldCfg.CacheSizeBytes, oldCfg.FileMemBytes
 		}
 
+		oldPlugins := plugins
 		plugins = plugin.Get(cfg.Plugins)
 		oldRemapper := remapper
-		remapper, err = remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport)
+		remapper, err = remap.LoadRemapper(cfg.RemapRulesFile, plugins.LoadFuncs(), caches, baseTransport, parentHealth)
 		if err != nil {
 			log.Errorln("reloading config: failed to load remap rules, keeping existing rules: " + err.Error())
 			remapper = oldRemapper
+			plugins = oldPlugins
+			diskFiles.Retain(oldCfg.CacheFiles, waitShutdownTimeout)
+			diskFiles.SetCapacities(oldCfg.CacheFiles)
+			caches = oldCaches
+			cfg = oldCfg
 			return
 		}
 
-		if cfg.Port != oldCfg.Port {
-			if httpListener, httpConns, httpConnStateCallback, err = web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
-				log.Errorf("reloading config: creating HTTP listener %v: %v\n", cfg.Port, err)
-				return
-			}
+		if ruleCerts, defaultCert, err := loadCerts(remapper.Rules(), cfg); err != nil {
+			log.Errorln("reloading config: failed to load certificates, keeping existing certificates: " + err.Error())
+		} else if err := certs.Set(ruleCerts, defaultCert); err != nil {
+			log.Errorln("reloading config: failed to load certificates, keeping existing certificates: " + err.Error())
+		}
+		certs.SetOCSPRefresh(time.Duration(cfg.OCSPRefreshMS) * time.Millisecond)
+		if err := certs.SetTicketKeyFile(cfg.TLSTicketKeyFile, time.Duration(cfg.TLSTicketKeyReloadMS)*time.Millisecond); err != nil {
+			log.Errorln("reloading config: failed to load TLS session ticket keys, keeping existing keys: " + err.Error())
 		}
 
-		if (cfg.CertFile != oldCfg.CertFile || cfg.KeyFile != oldCfg.KeyFile) && cfg.HTTPSPort != oldCfg.HTTPSPort {
-			log.Warnln("config certificate changed, but port did not. Cannot recreate listener on same port without stopping the service. Restart the service to load the new certificate.")
+		// The new listeners are created into temporaries, and only replace the existing ones on success, so a failed rebind keeps serving on the existing ports.
+		if cfg.Port != oldCfg.Port {
+			if listener, conns, connStateCallback, err := web.InterceptListen("tcp", fmt.Sprintf(":%d", cfg.Port)); err != nil {
+				log.Errorf("reloading config: creating HTTP listener %v, keeping existing port %v: %v\n", cfg.Port, oldCfg.Port, err)
+				cfg.Port = oldCfg.Port
+			} else {
+				httpListener, httpConns, httpConnStateCallback = listener, conns, connStateCallback
+			}
 		}
 
-		if cfg.HTTPSPort != oldCfg.HTTPSPort {
-			if httpsListener, httpsConns, httpsConnStateCallback, tlsConfig, err = web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", cfg.HTTPSPort), certs, cfg.DisableHTTP2); err != nil {
-				log.Errorf("creating HTTPS listener %v: %v\n", cfg.HTTPSPort, err)
+		newHTTPSListener := false
+		if (httpsServer == nil || cfg.HTTPSPort != oldCfg.HTTPSPort) && cfg.CertFile != "" && cfg.KeyFile != "" {
+			if listener, conns, connStateCallback, newTLSConfig, err := web.InterceptListenTLS("tcp", fmt.Sprintf(":%d", cfg.HTTPSPort), certs, cfg.DisableHTTP2); err != nil {
+				log.Errorf("reloading config: creating HTTPS listener %v, keeping existing port %v: %v\n", cfg.HTTPSPort, oldCfg.HTTPSPort, err)
+				cfg.HTTPSPort = oldCfg.HTTPSPort
+			} else {
+				httpsListener, httpsConns, httpsConnStateCallback, tlsConfig = listener, conns, connStateCallback, newTLSConfig
+				newHTTPSListener = true
 			}
 		}
 
+		loadJobs(cfg.InvalidationJobsFile, jobs)
+
 		stats = stat.New(remapper.Rules(), caches, uint64(cfg.CacheSizeBytes), httpConns, httpsConns, Version) // TODO copy stats from old stats object?
 
-		httpCacheHandler := cache.NewHandler(
-			remapper,
-			uint64(cfg.ConcurrentRuleRequests),
-			stats,
-			"http",
-			strconv.Itoa(cfg.Port),
-			httpConns,
-			cfg.RFCCompliant,
-			cfg.ConnectionClose,
-			plugins,
-			pluginContext,
-			httpConns,
-			httpsConns,
-			cfg.InterfaceName,
-		)
-		httpHandler.Set(httpCacheHandler)
+		// Plugins are started with a new context before the new handlers are set, so requests in progress keep the old context, and new requests never see an uninitialized one.
+		pluginContext = map[string]*interface{}{}
+		plugins.OnStartup(remapper.PluginCfg(), pluginContext, plugin.StartupData{Config: cfg, Shared: remapper.PluginSharedCfg()})
 
-		httpsCacheHandler := cache.NewHandler(
-			remapper,
-			uint64(cfg.ConcurrentRuleRequests),
-			stats,
-			"https",
-			strconv.Itoa(cfg.HTTPSPort),
-			httpsConns,
-			cfg.RFCCompliant,
-			cfg.ConnectionClose,
-			plugins,
-			pluginContext,
-			httpConns,
-			httpsConns,
-			cfg.InterfaceName,
-		)
-		httpsHandler.Set(httpsCacheHandler)
+		oldHTTPHandler, oldHTTPSHandler := httpHandler.Get(), httpsHandler.Get()
+		httpHandler.Set(buildHandler("http", cfg.Port, httpConns))
+		httpsHandler.Set(buildHandler("https", cfg.HTTPSPort, httpsConns))
 
-		plugins.OnStartup(remapper.PluginCfg(), pluginContext, plugin.StartupData{Config: cfg, Shared: remapper.PluginSharedCfg()})
+		// removed disk cache files are closed once the old handlers' requests finish, or after ShutdownTimeout, as when shutting down
+		diskFiles.Retain(cfg.CacheFiles, func() {
+			deadline := time.Now().Add(ShutdownTimeout)
+			oldHTTPHandler.Drain(deadline)
+			oldHTTPSHandler.Drain(deadline)
+		})
 
-		if cfg.Port != oldCfg.Port {
-			ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
-			defer cancel()
-			if err := httpServer.Shutdown(ctx); err != nil {
-				if err == context.DeadlineExceeded {
-					log.Errorf("closing http server: connections didn't close gracefully in %v, forcefully closing.\n", ShutdownTimeout)
-					httpServer.Close()
-				} else {
-					log.Errorf("closing http server: %v\n", err)
-				}
+		idleTimeout = time.Duration(cfg.ServerIdleTimeoutMS) * time.Millisecond
+		readTimeout = time.Duration(cfg.ServerReadTimeoutMS) * time.Millisecond
+		writeTimeout = time.Duration(cfg.ServerWriteTimeoutMS) * time.Millisecond
 
-			}
+		if cfg.Port != oldCfg.Port {
+			oldServer := httpServer
 			httpServer = startServer(httpHandler, httpListener, httpConnStateCallback, nil, cfg.Port, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "http")
+			go shutdownServer(oldServer, "http", oldCfg.Port)
 		}
 
-		if (httpsServer == nil || cfg.HTTPSPort != oldCfg.HTTPSPort) && cfg.CertFile != "" && cfg.KeyFile != "" {
-			if httpsServer != nil {
-				ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
-				defer cancel()
-				if err := httpsServer.Shutdown(ctx); err != nil {
-					if err == context.DeadlineExceeded {
-						log.Errorf("closing https server: connections didn't close gracefully in %v, forcefully closing.\n", ShutdownTimeout)
-						httpServer.Close()
-					} else {
-						log.Errorf("closing https server: %v\n", err)
-					}
-				}
-			}
-
+		if newHTTPSListener {
+			oldServer := httpsServer
 			httpsServer = startServer(httpsHandler, httpsListener, httpsConnStateCallback, tlsConfig, cfg.HTTPSPort, idleTimeout, readTimeout, writeTimeout, cfg.DisableHTTP2, "https")
+			if oldServer != nil {
+				go func() {
+					shutdownServer(oldServer, "https", oldCfg.HTTPSPort)
+					certs.ReleaseTLSConfig(oldServer.TLSConfig)
+				}()
+			}
 		}
+		log.Infoln("reloaded config")
 	}
 
 	if *pprof {
 		profile()
 	}
-	signalReloader(unix.SIGHUP, reloadConfig)
+	// shutdown stops the servers, waits for requests in progress to finish, and then closes the disk cache files. Closing disk caches checkpoints their LRUs, so they can be restored on the next start.
+	shutdown := func() {
+		wg := sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shutdownServer(httpServer, "http", cfg.Port)
+		}()
+		if httpsServer != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				shutdownServer(httpsServer, "https", cfg.HTTPSPort)
+			}()
+		}
+		wg.Wait()
+		diskFiles.Close()
+	}
+
+	signalHandler(unix.SIGHUP, reloadConfig, shutdown, unix.SIGTERM, unix.SIGINT)
+}
+
+// signalHandler calls reload whenever reloadSig is received, and calls shutdown and exits when any of shutdownSigs is received. Signals are handled one at a time, so shutdown never runs concurrently with reload.
+func signalHandler(reloadSig os.Signal, reload func(), shutdown func(), shutdownSigs ...os.Signal) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, append(shutdownSigs, reloadSig)...)
+	for sig := range c {
+		if sig == reloadSig {
+			reload()
+			continue
+		}
+		log.Infof("received %v, shutting down\n", sig)
+		shutdown()
+		os.Exit(0)
+	}
+}
+
+// waitShutdownTimeout sleeps for ShutdownTimeout. It's used to close disk cache files opened by a failed reload, which may have been reused from an earlier reload whose requests are still finishing.
+func waitShutdownTimeout() {
+	time.Sleep(ShutdownTimeout)
+}
+
+// shutdownServer stops the given server from accepting connections, and waits for its open connections to finish, for up to ShutdownTimeout, after which they're closed.
+func shutdownServer(server *http.Server, protocol string, port int) {
+	log.Infof("closing %s server on port %v, waiting for connections to finish\n", protocol, port)
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		if err == context.DeadlineExceeded {
+			log.Errorf("closing %s server: connections didn't close gracefully in %v, forcefully closing.\n", protocol, ShutdownTimeout)
+			server.Close()
+		} else {
+			log.Errorf("closing %s server: %v\n", protocol, err)
+		}
+		return
+	}
+	log.Infof("closed %s server on port %v\n", protocol, port)
+}
+
+// loadJobs loads the invalidation jobs file, if any, into jobs. On error, the existing jobs are kept.
+func loadJobs(path string, jobs *purge.Jobs) {
+	if path == "" {
+		return
+	}
+	newJobs, warnings, err := purge.LoadJobsFile(path, time.Now())
+	if err != nil {
+		log.Errorln("loading invalidation jobs file '" + path + "', keeping existing jobs: " + err.Error())
+		return
+	}
+	for _, warning := range warnings {
+		log.Warnln("loading invalidation jobs file '" + path + "': " + warning)
+	}
+	jobs.Set(newJobs)
+	log.Infof("loaded %v invalidation jobs from '%v'\n", len(newJobs), path)
 }
 
 func profile() {
@@ -315,14 +397,6 @@ func profile() {
 	}()
 }
 
-func signalReloader(sig os.Signal, f func()) {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, sig)
-	for range c {
-		f()
-	}
-}
-
 // startServer starts an HTTP or HTTPS server on the given port, and returns it.
 func startServer(handler http.Handler, listener net.Listener, connState func(net.Conn, http.ConnState), tlsConfig *tls.Config, port int, idleTimeout time.Duration, readTimeout time.Duration, writeTimeout time.Duration, h2Disabled bool, protocol string) *http.Server {
 
@@ -351,53 +425,76 @@ func startServer(handler http.Handler, listener net.Listener, connState func(net
 
 	go func() {
 		log.Infof("listening on %s://%d\n", protocol, port)
-		if err := server.Serve(listener); err != nil {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			log.Errorf("serving %s port %v: %v\n", strings.ToUpper(protocol), port, err)
 		}
 	}()
 	return server
 }
 
-func loadCerts(rules []remapdata.RemapRule) ([]tls.Certificate, error) {
-	certs := []tls.Certificate{}
+// loadCerts loads the certificates and TLS settings of the given rules, and the default certificate from the config.
+// Rules with TLS settings, or a certificate, serve them for the host of their From; rules with TLS settings but no certificate serve the certificate matching the host, or the default certificate.
+func loadCerts(rules []remapdata.RemapRule, cfg config.Config) ([]web.CertConfig, tls.Certificate, error) {
+	certs := []web.CertConfig{}
 	for _, rule := range rules {
-		if rule.CertificateFile == "" && rule.CertificateKeyFile == "" {
-			continue
+		certCfg := web.CertConfig{}
+		err := error(nil)
+		if certCfg.MinVersion, certCfg.MaxVersion, err = web.ParseTLSVersions(rule.TLSVersions); err != nil {
+			return nil, tls.Certificate{}, errors.New("rule " + rule.Name + " tls_versions: " + err.Error())
 		}
-		if rule.CertificateFile == "" {
-			return nil, errors.New("rule " + rule.Name + " has a certificate but no key, using default certificate\n")
+		if certCfg.CipherSuites, err = web.ParseCipherSuites(rule.TLSCipherSuites); err != nil {
+			return nil, tls.Certificate{}, errors.New("rule " + rule.Name + " tls_cipher_suites: " + err.Error())
 		}
-		if rule.CertificateKeyFile == "" {
-			return nil, errors.New("rule " + rule.Name + " has a key but no certificate, using default certificate\n")
+
+		if rule.CertificateFile != "" || rule.CertificateKeyFile != "" {
+			if rule.CertificateFile == "" {
+				return nil, tls.Certificate{}, errors.New("rule " + rule.Name + " has a certificate but no key, using default certificate\n")
+			}
+			if rule.CertificateKeyFile == "" {
+				return nil, tls.Certificate{}, errors.New("rule " + rule.Name + " has a key but no certificate, using default certificate\n")
+			}
+			cert, err := tls.LoadX509KeyPair(rule.CertificateFile, rule.CertificateKeyFile)
+			if err != nil {
+				return nil, tls.Certificate{}, errors.New("loading rule " + rule.Name + " certificate: " + err.Error() + "\n")
+			}
+			certCfg.Cert = &cert
+		} else if certCfg.MinVersion == 0 && certCfg.MaxVersion == 0 && len(certCfg.CipherSuites) == 0 {
+			continue
 		}
 
-		cert, err := tls.LoadX509KeyPair(rule.CertificateFile, rule.CertificateKeyFile)
-		if err != nil {
-			return nil, errors.New("loading rule " + rule.Name + " certificate: " + err.Error() + "\n")
+		if fromURL, err := url.Parse(rule.From); err == nil && fromURL.Scheme == "https" && fromURL.Hostname() != "" {
+			certCfg.Names = []string{fromURL.Hostname()}
 		}
-		certs = append(certs, cert)
+		certs = append(certs, certCfg)
+	}
+	defaultCert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, tls.Certificate{}, errors.New("loading default certificate: " + err.Error())
 	}
-	return certs, nil
+	return certs, defaultCert, nil
 }
 
-// createCaches creates the caches specified in the config. The nameFiles is the map of names to groups of files, nameMemBytes is the amount of memory to use for each named group, and memCacheBytes is the amount of memory to use for the default memory cache.
-func createCaches(nameFiles map[string][]config.CacheFile, nameMemBytes uint64, memCacheBytes uint64) (map[string]icache.Cache, error) {
+// createCaches creates the caches specified in the config, opening disk cache files via diskFiles. The oldCfg and oldCaches are the config and caches being reloaded, or empty on startup. Caches whose config didn't change are reused, so their objects aren't lost.
+func createCaches(diskFiles *diskcache.Files, cfg config.Config, oldCfg config.Config, oldCaches map[string]icache.Cache) (map[string]icache.Cache, error) {
 	caches := map[string]icache.Cache{}
-	caches[""] = memcache.New(memCacheBytes) // default empty names to the mem cache
+	if oldCache, ok := oldCaches[""]; ok && cfg.CacheSizeBytes == oldCfg.CacheSizeBytes {
+		caches[""] = oldCache
+	} else {
+		caches[""] = memcache.New(uint64(cfg.CacheSizeBytes)) // default empty names to the mem cache
+	}
 
-	for name, files := range nameFiles {
-		multiDiskCache, err := diskcache.NewMulti(files)
+	checkpointInterval := time.Duration(cfg.LRUCheckpointIntervalMS) * time.Millisecond
+	for name, files := range cfg.CacheFiles {
+		if oldCache, ok := oldCaches[name]; ok && cfg.FileMemBytes == oldCfg.FileMemBytes && reflect.DeepEqual(files, oldCfg.CacheFiles[name]) {
+			caches[name] = oldCache
+			continue
+		}
+		multiDiskCache, err := diskFiles.Multi(files, checkpointInterval)
 		if err != nil {
 			return nil, errors.New("creating cache '" + name + "': " + err.Error())
 		}
-		caches[name] = tiercache.New(memcache.New(nameMemBytes), multiDiskCache)
+		caches[name] = tiercache.New(memcache.New(uint64(cfg.FileMemBytes)), multiDiskCache)
 	}
 
 	return caches, nil
 }
-
-func cachesChanged(oldCfg, newCfg config.Config) bool {
-	return oldCfg.FileMemBytes == newCfg.FileMemBytes &&
-		oldCfg.CacheSizeBytes != newCfg.CacheSizeBytes &&
-		!reflect.DeepEqual(oldCfg.CacheFiles, newCfg.CacheFiles)
-}
@@ -34,8 +34,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/apache/trafficcontrol/lib/go-atscfg"
 	"github.com/apache/trafficcontrol/lib/go-tc"
-	to "github.com/apache/trafficcontrol/traffic_ops/v2-client"
+	toclient "github.com/apache/trafficcontrol/traffic_ops/v4-client"
 
 	"github.com/apache/trafficcontrol/grove/config"
 	"github.com/apache/trafficcontrol/grove/remap"
@@ -157,28 +158,20 @@ func WriteAndBackup(path string, backupDirectory string, bts []byte) error {
 }
 
 // hasUpdatePending returns whether an update is pending, the revalPending status (which will be needed later in the clear update POST), and any error.
-func hasUpdatePending(toc *to.Session, hostname string) (bool, bool, error) {
-	upd, _, err := toc.GetServerByHostName(hostname)
+func hasUpdatePending(toc *toclient.Session, hostname string) (bool, bool, error) {
+	upd, _, err := toc.GetServerUpdateStatus(hostname, toclient.RequestOptions{})
 	if err != nil {
 		return false, false, errors.New("getting update from Traffic Ops: " + err.Error())
-	} else if len(upd) != 1 {
-		return false, false, fmt.Errorf("Want exactly one server with hostname '%s', got %d", hostname, len(upd))
+	} else if len(upd.Response) != 1 {
+		return false, false, fmt.Errorf("Want exactly one server with hostname '%s', got %d", hostname, len(upd.Response))
 	}
-	return upd[0].UpdPending, upd[0].RevalPending, nil
+	return upd.Response[0].UpdatePending, upd.Response[0].RevalPending, nil
 }
 
 // clearUpdatePending clears the given host's update pending flag in Traffic Ops. It takes the host to clear, and the old revalPending flag to send.
-func clearUpdatePending(toc *to.Session, hostname string, revalPending bool) error {
-	srv, _, err := toc.GetServerByHostName(hostname)
-	if err != nil {
-		return fmt.Errorf("Failed to update reval_pending: %v", err)
-	} else if len(srv) != 1 {
-		return fmt.Errorf("Want exactly one server with hostname '%s', got '%d'", hostname, len(srv))
-	}
-
-	srv[0].RevalPending = revalPending
-	srv[0].UpdPending = false
-	alerts, _, err := toc.UpdateServerByID(srv[0].ID, srv[0])
+func clearUpdatePending(toc *toclient.Session, hostname string, revalPending bool) error {
+	updPending := false
+	alerts, _, err := toc.SetUpdateServerStatuses(hostname, &updPending, &revalPending, toclient.RequestOptions{})
 	if err != nil {
 		return fmt.Errorf("setting update pending on Traffic Ops: %v (Alerts: %+v)", err, alerts.Alerts)
 	}
@@ -192,7 +185,6 @@ func main() {
 	pretty := flag.Bool("pretty", false, "Whether to pretty-print output")
 	ignoreUpdateFlag := flag.Bool("ignore-update-flag", false, "Whether to fetch and apply the config, without checking or updating the Traffic Ops Update Pending flag")
 	host := flag.String("host", "", "The hostname of the server whose config to generate")
-	// api := flag.String("api", "1.2", "API version. Determines whether to use /api/1.3/configs/ or older, less efficient 1.2 APIs")
 	toInsecure := flag.Bool("insecure", false, "Whether to allow invalid certificates with Traffic Ops")
 	certDir := flag.String("certdir", DefaultCertificateDir, "Directory to save certificates to")
 	noServiceReload := flag.Bool("no-service-reload", false, "Whether to avoid trying to reload the Grove service")
@@ -210,7 +202,7 @@ func main() {
 	}
 
 	useCache := false
-	toc, _, err := to.LoginWithAgent(*toURL, *toUser, *toPass, *toInsecure, UserAgent, useCache, TrafficOpsTimeout)
+	toc, _, err := toclient.LoginWithAgent(*toURL, *toUser, *toPass, *toInsecure, UserAgent, useCache, TrafficOpsTimeout)
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error connecting to Traffic Ops: " + err.Error())
 		os.Exit(ExitError)
@@ -229,43 +221,27 @@ func main() {
 		}
 	}
 
-	// TODO remove this once converted to 1.3 API
-	// using the 1.2 API
-	var hostServer tc.Server
-	var hostProfile tc.Profile
-	var ok bool
-	var profiles map[string]tc.Profile
-	var servers map[string]tc.Server
-
-	serversArr, _, err := toc.GetServers()
+	data, err := getTOData(toc, *host)
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Servers: " + err.Error())
-		os.Exit(ExitError)
-	}
-	servers = makeServersHostnameMap(serversArr)
-
-	hostServer, ok = servers[*host]
-	if !ok {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error: host '" + *host + "' not in Servers\n")
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops data: " + err.Error())
 		os.Exit(ExitError)
 	}
 
-	profilesArr, _, err := toc.GetProfiles()
+	profileOpts := toclient.NewRequestOptions()
+	profileOpts.QueryParameters.Set("name", *data.Server.Profile)
+	profiles, _, err := toc.GetProfiles(profileOpts)
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Profiles: " + err.Error())
 		os.Exit(ExitError)
-	}
-	profiles = makeProfileNameMap(profilesArr)
-
-	hostProfile, ok = profiles[hostServer.Profile]
-	if !ok {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error: profile '" + hostServer.Profile + "' not in Profiles\n")
+	} else if len(profiles.Response) != 1 {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error: profile '" + *data.Server.Profile + "' not in Profiles\n")
 		os.Exit(ExitError)
 	}
-	// end of API 1.2 stuff
+	hostProfile := profiles.Response[0]
 
+	groveCfg := config.Config{}
 	if hostProfile.Type == GroveProfileType {
-		updateRequired, cfg, err := createGroveCfg(toc, hostServer)
+		updateRequired, cfg, err := createGroveCfg(data)
 		if err != nil {
 			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting config rules for '" + GroveConfigPath + "' :" + err.Error())
 			os.Exit(ExitError)
@@ -286,16 +262,12 @@ func main() {
 				os.Exit(ExitError)
 			}
 		}
+		groveCfg = cfg
 	} else {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: the profile '" + hostServer.Profile + "' is not a '" + GroveProfileType + "', will not build a config from it.")
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: the profile '" + *data.Server.Profile + "' is not a '" + GroveProfileType + "', will not build a config from it.")
 	}
 
-	rules := remap.RemapRules{}
-	// if *api == "1.3" {
-	// 	rules, err = createRulesNewAPI(toc, *host, *certDir)
-	// } else {
-	rules, err = createRulesOldAPI(toc, *host, *certDir, servers) // TODO remove once 1.3 / traffic_ops_golang is deployed to production.
-	// }
+	rules, err := createRules(data, *certDir)
 	if err != nil {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error creating rules: " + err.Error())
 		os.Exit(ExitError)
@@ -332,6 +304,13 @@ func main() {
 		os.Exit(ExitError)
 	}
 
+	if groveCfg.InvalidationJobsFile != "" {
+		if err := writeInvalidationJobs(toc, groveCfg.InvalidationJobsFile); err != nil {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error writing invalidation jobs file: " + err.Error())
+			os.Exit(ExitError)
+		}
+	}
+
 	if !*noServiceReload {
 		if err := exec.Command("service", "grove", "reload").Run(); err != nil {
 			fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error restarting grove service (but successfully updated config file): " + err.Error())
@@ -349,7 +328,26 @@ func main() {
 	os.Exit(ExitSuccess)
 }
 
-func createGroveCfg(toc *to.Session, server tc.Server) (bool, config.Config, error) {
+// writeInvalidationJobs gets the content invalidation jobs from Traffic Ops, and writes them to the given path, in the format of the Traffic Ops /jobs response, which Grove loads on reload.
+func writeInvalidationJobs(toc *toclient.Session, path string) error {
+	jobs, _, err := toc.GetInvalidationJobs(toclient.RequestOptions{})
+	if err != nil {
+		return errors.New("getting invalidation jobs from Traffic Ops: " + err.Error())
+	}
+	bts, err := json.Marshal(tc.InvalidationJobsResponse{Response: jobs.Response})
+	if err != nil {
+		return errors.New("marshalling invalidation jobs: " + err.Error())
+	}
+	if err := WriteNewFile(path, bts); err != nil {
+		return errors.New("writing new file: " + err.Error())
+	}
+	if err := os.Rename(NewFilename(path), path); err != nil {
+		return errors.New("copying new file to real location: " + err.Error())
+	}
+	return nil
+}
+
+func createGroveCfg(data *TOData) (bool, config.Config, error) {
 	var newCfg config.Config
 	var currCfg config.Config
 	var pluginParams = []string{}
@@ -366,28 +364,22 @@ func createGroveCfg(toc *to.Session, server tc.Server) (bool, config.Config, err
 		}
 	}
 
-	serverParameters, _, err := toc.GetParametersByProfileName(server.Profile)
-	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Parameters for host '" + server.HostName + "' profile '" + server.Profile + "': " + err.Error())
-		return false, currCfg, err
-	} else {
-		// load config parameters from the servers profile
-		for _, p := range serverParameters {
-			if p.ConfigFile == GroveConfigFile {
-				if p.Name == "plugins" {
-					pluginParams = append(pluginParams, p.Value)
-				} else {
-					err := setConfigParameter(&newCfg, p.Name, p.Value)
-					if err != nil {
-						fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error setting config parameter '" + p.Name + "' :" + err.Error())
-						return false, currCfg, err
-					}
+	// load config parameters from the servers profile
+	for _, p := range data.ServerParams {
+		if p.ConfigFile == GroveConfigFile {
+			if p.Name == "plugins" {
+				pluginParams = append(pluginParams, p.Value)
+			} else {
+				err := setConfigParameter(&newCfg, p.Name, p.Value)
+				if err != nil {
+					fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error setting config parameter '" + p.Name + "' :" + err.Error())
+					return false, currCfg, err
 				}
 			}
 		}
-		sort.Strings(pluginParams)
-		newCfg.Plugins = pluginParams
 	}
+	sort.Strings(pluginParams)
+	newCfg.Plugins = pluginParams
 	// no update is required if the configs are the same
 	areEqual := reflect.DeepEqual(newCfg, currCfg)
 	if areEqual == true {
@@ -449,244 +441,172 @@ func setConfigParameter(cfg *config.Config, name string, value string) error {
 		cfg.ServerReadTimeoutMS, err = strconv.Atoi(value)
 	case "file_mem_bytes":
 		cfg.FileMemBytes, err = strconv.Atoi(value)
+	case "invalidation_jobs_file":
+		cfg.InvalidationJobsFile = value
 	default:
 		err = fmt.Errorf(time.Now().Format(time.RFC3339Nano) + "No such config parameter '" + name + "', parameter ignored")
 	}
 	return err
 }
 
-func createRulesOldAPI(toc *to.Session, host string, certDir string, servers map[string]tc.Server) (remap.RemapRules, error) {
-	cachegroupsArr, _, err := toc.GetCacheGroupsNullable()
-	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Cachegroups: " + err.Error())
-		os.Exit(1)
-	}
-	cachegroups := makeCachegroupsNameMap(cachegroupsArr)
-
-	hostServer, ok := servers[host]
-	if !ok {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error: host '" + host + "' not in Servers\n")
-		os.Exit(1)
+// createRules creates the remap rules for the given server's Delivery Services. The Delivery Services, and their parents, are the same as those of an ATS cache with the same Traffic Ops data, including Topologies and Server Capabilities.
+func createRules(data *TOData, certDir string) (remap.RemapRules, error) {
+	remapDSes, warnings, err := atscfg.MakeRemapDeliveryServices(
+		data.Server,
+		data.DeliveryServices,
+		data.DeliveryServiceServers,
+		data.DeliveryServiceRegexes,
+		&data.CDN,
+		data.Topologies,
+		data.ServerCapabilities,
+		data.DSRequiredCapabilities,
+	)
+	for _, warning := range warnings {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: " + warning)
 	}
-
-	deliveryservices, _, err := toc.GetDeliveryServicesByServer(hostServer.ID)
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservices: " + err.Error())
-		os.Exit(1)
+		return remap.RemapRules{}, errors.New("getting delivery services: " + err.Error())
 	}
+	sort.Slice(remapDSes, func(i, j int) bool {
+		return *remapDSes[i].DeliveryService.XMLID < *remapDSes[j].DeliveryService.XMLID
+	})
 
-	deliveryserviceRegexArr, _, err := toc.GetDeliveryServiceRegexes()
-	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Deliveryservice Regexes: " + err.Error())
-		os.Exit(1)
+	parents, warnings, err := makeParents(data)
+	for _, warning := range warnings {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: " + warning)
 	}
-	deliveryserviceRegexes := makeDeliveryserviceRegexMap(deliveryserviceRegexArr)
-
-	cdnsArr, _, err := toc.GetCDNs()
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops CDNs: " + err.Error())
-		os.Exit(1)
+		return remap.RemapRules{}, errors.New("getting parents: " + err.Error())
 	}
-	cdns := makeCDNMap(cdnsArr)
 
-	serverParameters, _, err := toc.GetParametersByProfileName(hostServer.Profile)
+	allowedIPs, err := getAllowIP(data.ServerParams)
 	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting Traffic Ops Parameters for host '" + host + "' profile '" + hostServer.Profile + "': " + err.Error())
-		os.Exit(1)
+		return remap.RemapRules{}, fmt.Errorf("getting allowed IPs: %v", err)
 	}
 
-	parents, err := getParents(host, servers, cachegroups)
-	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + host + "' parents: " + err.Error())
-		os.Exit(1)
+	isMid := tc.CacheTypeFromString(data.Server.Type) == tc.CacheTypeMid
+	dsCerts := makeDSCertMap(data.SSLKeys)
+	dsTLSVersions, warnings, err := makeDSTLSVersions(data)
+	for _, warning := range warnings {
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: " + warning)
 	}
-
-	sameCDN := func(s tc.Server) bool {
-		return s.CDNName == hostServer.CDNName
+	if err != nil {
+		return remap.RemapRules{}, errors.New("getting delivery service TLS versions: " + err.Error())
 	}
+	retryNum := DefaultRetryNum
+	timeout := DefaultTimeout
+	parentSelection := DefaultRuleParentSelection
 
-	serverAvailable := func(s tc.Server) bool {
-		status := strings.ToLower(s.Status)
-		statuses := AvailableStatuses()
-		_, ok := statuses[status]
-		return ok
-	}
+	rules := []remapdata.RemapRule{}
+	froms := map[string]struct{}{}
+	for _, remapDS := range remapDSes {
+		ds := remapDS.DeliveryService
+		queryStringRule, err := getQueryStringRule(ds.QStringIgnore)
+		if err != nil {
+			return remap.RemapRules{}, fmt.Errorf("getting deliveryservice %v Query String Rule: %v", *ds.XMLID, err)
+		}
 
-	parents = filterParents(parents, sameCDN)
-	parents = filterParents(parents, serverAvailable)
+		cert, hasCert := dsCerts[*ds.XMLID]
+		if !isMid && ds.Protocol != nil && *ds.Protocol != tc.DSProtocolHTTP {
+			if !hasCert {
+				fmt.Fprint(os.Stderr, time.Now().Format(time.RFC3339Nano)+" HTTPS delivery service: "+*ds.XMLID+" has no certificate!\n")
+			} else if err := createCertificateFiles(cert, certDir); err != nil {
+				fmt.Fprint(os.Stderr, time.Now().Format(time.RFC3339Nano)+" HTTPS delivery service "+*ds.XMLID+" failed to create certificate: "+err.Error()+"\n")
+			}
+		}
 
-	cdnSSLKeys, _, err := toc.GetCDNSSLKeys(hostServer.CDNName)
-	if err != nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Error getting '" + hostServer.CDNName + "' SSL keys: " + err.Error())
-		os.Exit(1)
-	}
-	dsCerts := makeDSCertMap(cdnSSLKeys)
+		// mids don't apply the edge remap text or header rewrites, the same as ATS
+		hdrRewrite := ds.EdgeHeaderRewrite
+		remapText := ds.RemapText
+		if isMid {
+			hdrRewrite = ds.MidHeaderRewrite
+			remapText = nil
+		}
+		toClientHeaders, toOriginHeaders, err := makeModHdrs(hdrRewrite, remapText)
+		if err != nil {
+			return remap.RemapRules{}, errors.New("Making headers for delivery service '" + *ds.XMLID + "':" + err.Error())
+		}
+		dsRemap := ""
+		if remapText != nil {
+			dsRemap = *remapText
+		}
+		acl, err := makeACL(dsRemap)
+		if err != nil {
+			fmt.Println(time.Now().Format(time.RFC3339Nano) + " createRules skipping deliveryservice '" + *ds.XMLID + "' - unsupported ACL " + dsRemap)
+			continue
+		}
+		remapTextJSON, err := json.Marshal(dsRemap)
+		if err != nil {
+			return remap.RemapRules{}, fmt.Errorf("parsing deliveryservice '%v' remap text '%v' marshalling JSON: %v", *ds.XMLID, dsRemap, err)
+		}
 
-	return createRulesOld(host, deliveryservices, parents, deliveryserviceRegexes, cdns, serverParameters, dsCerts, certDir)
-}
+		for _, line := range remapDS.Lines {
+			if _, ok := froms[line.From]; ok {
+				fmt.Println(time.Now().Format(time.RFC3339Nano) + " Warning: deliveryservice '" + *ds.XMLID + "' remap from '" + line.From + "' duplicates another rule, skipping!")
+				continue
+			}
+			froms[line.From] = struct{}{}
 
-// func createRulesNewAPI(toc *to.Session, host string, certDir string) (remap.RemapRules, error) {
-// 	cacheCfg, err := toc.CacheConfig(host)
-// 	if err != nil {
-// 		fmt.Printf("Error getting Traffic Ops Cache Config: %v\n", err)
-// 		os.Exit(1)
-// 	}
-
-// 	rules := []remapdata.RemapRule{}
-
-// 	allowedIPs, err := makeAllowIP(cacheCfg.AllowIP)
-// 	if err != nil {
-// 		return remap.RemapRules{}, fmt.Errorf("creating allowed IPs: %v", err)
-// 	}
-
-// 	cdnSSLKeys, err := toc.CDNSSLKeys(cacheCfg.CDN)
-// 	if err != nil {
-// 		fmt.Printf("Error getting %v SSL keys: %v\n", cacheCfg.CDN, err)
-// 		os.Exit(1)
-// 	}
-// 	dsCerts := makeDSCertMap(cdnSSLKeys)
-
-// 	weight := DefaultRuleWeight
-// 	retryNum := DefaultRetryNum
-// 	timeout := DefaultTimeout
-// 	parentSelection := DefaultRuleParentSelection
-
-// 	for _, ds := range cacheCfg.DeliveryServices {
-// 		protocol := ds.Protocol
-// 		queryStringRule, err := getQueryStringRule(ds.QueryStringIgnore)
-// 		if err != nil {
-// 			return remap.RemapRules{}, fmt.Errorf("getting deliveryservice %v Query String Rule: %v", ds.XMLID, err)
-// 		}
-
-// 		protocolStrs := []ProtocolStr{}
-// 		switch protocol {
-// 		case ProtocolHTTP:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-// 		case ProtocolHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		case ProtocolHTTPAndHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		case ProtocolHTTPToHTTPS:
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "https"})
-// 			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-// 		}
-
-// 		cert, hasCert := dsCerts[ds.XMLID]
-// 		// DEBUG
-// 		// if protocol != ProtocolHTTP {
-// 		// 	if !hasCert {
-// 		// 		fmt.Fprint(os.Stderr, "HTTPS delivery service: "+ds.XMLID+" has no certificate!\n")
-// 		// 	} else if err := createCertificateFiles(cert, certDir); err != nil {
-// 		// 		fmt.Fprint(os.Stderr, "HTTPS delivery service "+ds.XMLID+" failed to create certificate: "+err.Error()+"\n")
-// 		// 	}
-// 		// }
-
-// 		dsType := strings.ToLower(ds.Type)
-// 		if !strings.HasPrefix(dsType, "http") && !strings.HasPrefix(dsType, "dns") {
-// 			fmt.Printf("createRules skipping deliveryservice %v - unknown type %v", ds.XMLID, ds.Type)
-// 			continue
-// 		}
-
-// 		for _, protocolStr := range protocolStrs {
-// 			for _, dsRegex := range ds.Regexes {
-// 				rule := remapdata.RemapRule{}
-// 				pattern, patternLiteralRegex := trimLiteralRegex(dsRegex)
-// 				rule.Name = fmt.Sprintf("%s.%s.%s.%s", ds.XMLID, protocolStr.From, protocolStr.To, pattern)
-// 				rule.From = buildFrom(protocolStr.From, pattern, patternLiteralRegex, host, dsType, cacheCfg.Domain)
-
-// 				if protocolStr.From == "https" && hasCert {
-// 					rule.CertificateFile = getCertFileName(cert, certDir)
-// 					rule.CertificateKeyFile = getCertKeyFileName(cert, certDir)
-// 					// fmt.Fprintf(os.Stderr, "HTTPS delivery service: "+ds.XMLID+" certificate %+v\n", cert)
-// 				}
-
-// 				for _, parent := range cacheCfg.Parents {
-// 					to, proxyURLStr := buildToNew(parent, protocolStr.To, ds.OriginFQDN, dsType)
-// 					proxyURL, err := url.Parse(proxyURLStr)
-// 					if err != nil {
-// 						return remap.RemapRules{}, fmt.Errorf("error parsing deliveryservice %v parent %v proxy_url: %v", ds.XMLID, parent.Host, proxyURLStr)
-// 					}
-
-// 					ruleTo := remapdata.RemapRuleTo{
-// 						RemapRuleToBase: remapdata.RemapRuleToBase{
-// 							URL:      to,
-// 							Weight:   &weight,
-// 							RetryNum: &retryNum,
-// 						},
-// 						ProxyURL:   proxyURL,
-// 						RetryCodes: DefaultRetryCodes(),
-// 						Timeout:    &timeout,
-// 					}
-// 					rule.To = append(rule.To, ruleTo)
-// 					// TODO get from TO?
-// 					rule.RetryNum = &retryNum
-// 					rule.Timeout = &timeout
-// 					rule.RetryCodes = DefaultRetryCodes()
-// 					rule.QueryString = queryStringRule
-// 					rule.DSCP = ds.DSCP
-// 					if err != nil {
-// 						return remap.RemapRules{}, err
-// 					}
-// 					rule.ConnectionClose = DefaultRuleConnectionClose
-// 					rule.ParentSelection = &parentSelection
-// 				}
-// 				rules = append(rules, rule)
-// 			}
-// 		}
-// 	}
-
-// 	remapRules := remap.RemapRules{
-// 		Rules:           rules,
-// 		RetryCodes:      DefaultRetryCodes(),
-// 		Timeout:         &timeout,
-// 		ParentSelection: &parentSelection,
-// 		Stats:           remap.RemapRulesStats{Allow: allowedIPs},
-// 	}
-
-// 	return remapRules, nil
-// }
-
-func makeProfileNameMap(profiles []tc.Profile) map[string]tc.Profile {
-	m := map[string]tc.Profile{}
-	for _, profile := range profiles {
-		m[profile.Name] = profile
-	}
-	return m
-}
+			origin, err := url.Parse(line.To)
+			if err != nil {
+				return remap.RemapRules{}, fmt.Errorf("parsing deliveryservice '%v' origin '%v': %v", *ds.XMLID, line.To, err)
+			}
+			parentLine, hasParentLine := parentLineFor(parents, origin)
+			ruleTos, ruleParentSelection, err := makeRuleTos(origin, parentLine, hasParentLine)
+			if err != nil {
+				return remap.RemapRules{}, fmt.Errorf("making deliveryservice '%v' parents: %v", *ds.XMLID, err)
+			}
 
-func makeServersHostnameMap(servers []tc.Server) map[string]tc.Server {
-	m := map[string]tc.Server{}
-	for _, server := range servers {
-		m[server.HostName] = server
-	}
-	return m
-}
+			from, err := url.Parse(line.From)
+			if err != nil {
+				return remap.RemapRules{}, fmt.Errorf("parsing deliveryservice '%v' remap from '%v': %v", *ds.XMLID, line.From, err)
+			}
 
-func makeCachegroupsNameMap(cgs []tc.CacheGroupNullable) map[string]tc.CacheGroupNullable {
-	m := map[string]tc.CacheGroupNullable{}
-	for _, cg := range cgs {
-		if cg.Name != nil {
-			m[*cg.Name] = cg
+			rule := remapdata.RemapRule{}
+			rule.Name = fmt.Sprintf("%s.%s.%s", *ds.XMLID, from.Scheme, from.Host)
+			rule.From = line.From
+			if from.Scheme == "https" && hasCert {
+				rule.CertificateFile = getCertFileName(cert, certDir)
+				rule.CertificateKeyFile = getCertKeyFileName(cert, certDir)
+			}
+			if from.Scheme == "https" {
+				rule.TLSVersions = dsTLSVersions[*ds.XMLID]
+			}
+			rule.To = ruleTos
+			rule.RetryNum = &retryNum
+			rule.Timeout = &timeout
+			rule.RetryCodes = DefaultRetryCodes()
+			rule.QueryString = queryStringRule
+			if ds.DSCP != nil {
+				rule.DSCP = *ds.DSCP
+			}
+			rule.ConnectionClose = DefaultRuleConnectionClose
+			rule.ParentSelection = &ruleParentSelection
+			rule.Allow = acl
+			rule.Plugins = map[string]interface{}{}
+			rule.Plugins["modify_headers"] = toClientHeaders
+			rule.Plugins["modify_parent_request_headers"] = toOriginHeaders
+			rule.PluginsShared = map[string]json.RawMessage{}
+			rule.PluginsShared[web.RemapTextKey] = remapTextJSON
+			rules = append(rules, rule)
 		}
 	}
-	return m
-}
-
-func makeDeliveryserviceRegexMap(dsrs []tc.DeliveryServiceRegexes) map[string][]tc.DeliveryServiceRegex {
-	m := map[string][]tc.DeliveryServiceRegex{}
-	for _, dsr := range dsrs {
-		m[dsr.DSName] = dsr.Regexes
-	}
-	return m
-}
 
-func makeCDNMap(cdns []tc.CDN) map[string]tc.CDN {
-	m := map[string]tc.CDN{}
-	for _, cdn := range cdns {
-		m[cdn.Name] = cdn
+	globalPlugins := map[string]interface{}{}
+	serverHeader := web.Hdr{Name: "Server", Value: "Grove/0.33"}
+	setHeaders := []web.Hdr{}
+	setHeaders = append(setHeaders, serverHeader)
+	globalHeaders := web.ModHdrs{Set: setHeaders}
+	globalPlugins["modify_response_headers_global"] = globalHeaders
+	remapRules := remap.RemapRules{
+		Rules:           rules,
+		RetryCodes:      DefaultRetryCodes(),
+		Timeout:         &timeout,
+		ParentSelection: &parentSelection,
+		Stats:           remapdata.RemapRulesStats{Allow: allowedIPs},
+		Plugins:         globalPlugins,
 	}
-	return m
+	return remapRules, nil
 }
 
 func makeDSCertMap(sslKeys []tc.CDNSSLKeys) map[string]tc.CDNSSLKeys {
@@ -697,102 +617,36 @@ func makeDSCertMap(sslKeys []tc.CDNSSLKeys) map[string]tc.CDNSSLKeys {
 	return m
 }
 
-func getParents(hostname string, servers map[string]tc.Server, cachegroups map[string]tc.CacheGroupNullable) ([]tc.Server, error) {
-	server, ok := servers[hostname]
-	if !ok {
-		return nil, fmt.Errorf("hostname not found in Servers")
-	}
-
-	cachegroup, ok := cachegroups[server.Cachegroup]
-	if !ok {
-		return nil, fmt.Errorf("server cachegroup '%v' not found in Cachegroups", server.Cachegroup)
-	}
-
-	parents := []tc.Server{}
-	for _, server := range servers {
-		if cachegroup.ParentName != nil && server.Cachegroup == *cachegroup.ParentName {
-			parents = append(parents, server)
-		}
+// makeDSTLSVersions returns the TLS versions of the server's Delivery Services, by XMLID. Delivery Services with no TLS versions aren't included.
+//
+// The versions are taken from the same Delivery Service Profile tls_versions parameter lib/go-atscfg uses for the ssl_server_name.yaml of ATS caches, so Grove and ATS caches allow the same versions.
+func makeDSTLSVersions(data *TOData) (map[string][]string, []string, error) {
+	sslDatas, warnings, err := atscfg.GetServerSSLData(
+		data.Server,
+		data.DeliveryServices,
+		data.DeliveryServiceServers,
+		data.DeliveryServiceRegexes,
+		data.ParentConfigParams,
+		&data.CDN,
+		data.Topologies,
+		data.CacheGroups,
+		data.ServerCapabilities,
+		data.DSRequiredCapabilities,
+		nil,
+		false,
+	)
+	if err != nil {
+		return nil, warnings, err
 	}
-	return parents, nil
-}
-
-func filterParents(parents []tc.Server, include func(tc.Server) bool) []tc.Server {
-	newParents := []tc.Server{}
-	for _, parent := range parents {
-		if include(parent) {
-			newParents = append(newParents, parent)
+	versions := map[string][]string{}
+	for _, sslData := range sslDatas {
+		for _, version := range sslData.TLSVersions {
+			versions[sslData.DSName] = append(versions[sslData.DSName], string(version))
 		}
 	}
-	return newParents
-}
-
-const ProtocolHTTP = 0
-const ProtocolHTTPS = 1
-const ProtocolHTTPAndHTTPS = 2
-const ProtocolHTTPToHTTPS = 3
-
-type ProtocolStr struct {
-	From string
-	To   string
-}
-
-// trimLiteralRegex removes the prefix and suffix in .*\.foo\.* delivery service regexes. Traffic Ops Delivery Services have regexes of this form, which aren't really regexes, and the .*\ and \.* need stripped to construct the "to" FQDN. Returns the trimmed string, and whether it was of the form `.*\.foo\.*`
-func trimLiteralRegex(s string) (string, bool) {
-	prefix := `.*\.`
-	suffix := `\..*`
-	if strings.HasPrefix(s, prefix) && strings.HasSuffix(s, suffix) {
-		return s[len(prefix) : len(s)-len(suffix)], true
-	}
-	return s, false
-}
-
-// buildFrom builds the remap "from" URI prefix. It assumes ttype is a delivery service type HTTP or DNS, behavior is undefined for any other ttype.
-func buildFrom(protocol string, pattern string, patternLiteralRegex bool, host string, dsType string, cdnDomain string) string {
-	if !patternLiteralRegex {
-		return protocol + "://" + pattern
-	}
-
-	if isHTTP := strings.HasPrefix(dsType, "http"); isHTTP {
-		return protocol + "://" + host + "." + pattern + "." + cdnDomain
-	}
-
-	return protocol + "://" + "edge." + pattern + "." + cdnDomain
-}
-
-func dsTypeSkipsMid(ttype string) bool {
-	ttype = strings.ToLower(ttype)
-	if ttype == "http_no_cache" || ttype == "http_live" || ttype == "dns_live" {
-		return true
-	}
-	if strings.Contains(ttype, "live") && !strings.Contains(ttype, "natnl") {
-		return true
-	}
-	return false
+	return versions, warnings, nil
 }
 
-// buildTo returns the to URL, and the Proxy URL (if any)
-func buildTo(parentServer tc.Server, protocol string, originURI string, dsType string) (string, string) {
-	// TODO add port?
-	to := originURI
-	proxy := ""
-	if !dsTypeSkipsMid(dsType) {
-		proxy = "http://" + parentServer.HostName + "." + parentServer.DomainName + ":" + strconv.Itoa(parentServer.TCPPort)
-	}
-	return to, proxy
-}
-
-// // buildToNew returns the to URL, and the Proxy URL (if any)
-// func buildToNew(parent tc.CacheConfigParent, protocol string, originURI string, dsType string) (string, string) {
-// 	// TODO add port?
-// 	to := originURI
-// 	proxy := ""
-// 	if !dsTypeSkipsMid(dsType) {
-// 		proxy = "http://" + parent.Host + "." + parent.Domain + ":" + strconv.FormatUint(uint64(parent.Port), 10)
-// 	}
-// 	return to, proxy
-// }
-
 const DeliveryServiceQueryStringCacheAndRemap = 0
 const DeliveryServiceQueryStringNoCacheRemap = 1
 const DeliveryServiceQueryStringNoCacheNoRemap = 2
@@ -854,201 +708,6 @@ func makeAllowIP(ips []string) ([]*net.IPNet, error) {
 	return cidrs, nil
 }
 
-func createRulesOld(
-	hostname string,
-	dses []tc.DeliveryServiceNullable,
-	parents []tc.Server,
-	dsRegexes map[string][]tc.DeliveryServiceRegex,
-	cdns map[string]tc.CDN,
-	hostParams []tc.Parameter,
-	dsCerts map[string]tc.CDNSSLKeys,
-	certDir string,
-) (remap.RemapRules, error) {
-	rules := []remapdata.RemapRule{}
-	allowedIPs, err := getAllowIP(hostParams)
-	if err != nil {
-		return remap.RemapRules{}, fmt.Errorf("getting allowed IPs: %v", err)
-	}
-
-	weight := DefaultRuleWeight
-	retryNum := DefaultRetryNum
-	timeout := DefaultTimeout
-	parentSelection := DefaultRuleParentSelection
-
-	for _, ds := range dses {
-		protocol := *ds.Protocol
-		queryStringRule, err := getQueryStringRule(ds.QStringIgnore)
-		if err != nil {
-			return remap.RemapRules{}, fmt.Errorf("getting deliveryservice %v Query String Rule: %v", ds.XMLID, err)
-		}
-
-		cdn, ok := cdns[*ds.CDNName]
-		if !ok {
-			return remap.RemapRules{}, fmt.Errorf("deliveryservice '%v' CDN '%v' not found", *ds.XMLID, *ds.CDNName)
-		}
-
-		protocolStrs := []ProtocolStr{}
-		switch protocol {
-		case ProtocolHTTP:
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-		case ProtocolHTTPS:
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-		case ProtocolHTTPAndHTTPS:
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "http"})
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-		case ProtocolHTTPToHTTPS:
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "http", To: "https"})
-			protocolStrs = append(protocolStrs, ProtocolStr{From: "https", To: "https"})
-		}
-
-		cert, hasCert := dsCerts[*ds.XMLID]
-		if protocol != ProtocolHTTP {
-			if !hasCert {
-				fmt.Fprint(os.Stderr, time.Now().Format(time.RFC3339Nano)+" HTTPS delivery service: "+*ds.XMLID+" has no certificate!\n")
-			} else if err := createCertificateFiles(cert, certDir); err != nil {
-				fmt.Fprint(os.Stderr, time.Now().Format(time.RFC3339Nano)+" HTTPS delivery service "+*ds.XMLID+" failed to create certificate: "+err.Error()+"\n")
-			}
-		}
-
-		dsType := strings.ToLower(string(*ds.Type))
-		if !strings.HasPrefix(dsType, "http") && !strings.HasPrefix(dsType, "dns") {
-			fmt.Printf(time.Now().Format(time.RFC3339Nano)+" createRules skipping deliveryservice %v - unknown type %v", *ds.XMLID, *ds.Type)
-			continue
-		}
-
-		toClientHeaders, toOriginHeaders, err := makeModHdrs(ds.EdgeHeaderRewrite, ds.RemapText)
-		if err != nil {
-			return remap.RemapRules{}, errors.New("Making headers for delivery service '" + *ds.XMLID + "':" + err.Error())
-		}
-		dsRemap := ""
-		if ds.RemapText != nil {
-			dsRemap = *ds.RemapText
-		}
-		acl, err := makeACL(dsRemap)
-		if err != nil {
-			fmt.Println(time.Now().Format(time.RFC3339Nano) + " createRules skipping deliveryservice '" + *ds.XMLID + "' - unsupported ACL " + dsRemap)
-			continue
-		}
-
-		orgServerFQDN := ""
-		if ds.OrgServerFQDN != nil {
-			orgServerFQDN = *ds.OrgServerFQDN
-		}
-
-		for _, protocolStr := range protocolStrs {
-			regexes, ok := dsRegexes[*ds.XMLID]
-			if !ok {
-				return remap.RemapRules{}, fmt.Errorf("deliveryservice '%v' has no regexes", *ds.XMLID)
-			}
-
-			for _, dsRegex := range regexes {
-				rule := remapdata.RemapRule{}
-				pattern, patternLiteralRegex := trimLiteralRegex(dsRegex.Pattern)
-				rule.Name = fmt.Sprintf("%s.%s.%s.%s", *ds.XMLID, protocolStr.From, protocolStr.To, pattern)
-				rule.From = buildFrom(protocolStr.From, pattern, patternLiteralRegex, hostname, dsType, cdn.DomainName)
-
-				if protocolStr.From == "https" && hasCert {
-					rule.CertificateFile = getCertFileName(cert, certDir)
-					rule.CertificateKeyFile = getCertKeyFileName(cert, certDir)
-					// fmt.Fprintf(os.Stderr, "HTTPS delivery service: "+ds.XMLID+" certificate %+v\n", cert)
-				}
-
-				rule.PluginsShared = map[string]json.RawMessage{}
-				// if the delivery service skips the mid's ie, http_no_cache, http_live, and dns_live
-				// only add the url rule to the origin.
-				if dsTypeSkipsMid(dsType) {
-					var proxyURLStr = ""
-					proxyURL, err := url.Parse(proxyURLStr)
-					if err != nil {
-						return remap.RemapRules{}, fmt.Errorf("error parsing deliveryservice %v proxy_url: %v", *ds.XMLID, proxyURLStr)
-					}
-					ruleTo := remapdata.RemapRuleTo{
-						RemapRuleToBase: remapdata.RemapRuleToBase{
-							URL:      orgServerFQDN,
-							Weight:   &weight,
-							RetryNum: &retryNum,
-						},
-						RetryCodes: DefaultRetryCodes(),
-						ProxyURL:   proxyURL,
-						Timeout:    &timeout,
-					}
-					rule.To = append(rule.To, ruleTo)
-					rule.RetryNum = &retryNum
-					rule.Timeout = &timeout
-					rule.RetryCodes = DefaultRetryCodes()
-					rule.QueryString = queryStringRule
-					rule.DSCP = *ds.DSCP
-					rule.ConnectionClose = DefaultRuleConnectionClose
-					rule.Allow = acl
-					rule.Plugins = map[string]interface{}{}
-					rule.Plugins["modify_headers"] = toClientHeaders
-					rule.Plugins["modify_parent_request_headers"] = toOriginHeaders
-					remapTextJSON, err := json.Marshal(dsRemap)
-					if err != nil {
-						return remap.RemapRules{}, fmt.Errorf("parsing deliveryservice '%v' remap text '%v' marshalling JSON: %v", *ds.XMLID, dsRemap, err)
-					}
-					rule.PluginsShared[web.RemapTextKey] = remapTextJSON
-				} else {
-					for _, parent := range parents {
-						to, proxyURLStr := buildTo(parent, protocolStr.To, orgServerFQDN, dsType)
-						proxyURL, err := url.Parse(proxyURLStr)
-						if err != nil {
-							return remap.RemapRules{}, fmt.Errorf("error parsing deliveryservice %v parent %v proxy_url: %v", *ds.XMLID, parent.HostName, proxyURLStr)
-						}
-
-						ruleTo := remapdata.RemapRuleTo{
-							RemapRuleToBase: remapdata.RemapRuleToBase{
-								URL:      to,
-								Weight:   &weight,
-								RetryNum: &retryNum,
-							},
-							ProxyURL:   proxyURL,
-							RetryCodes: DefaultRetryCodes(),
-							Timeout:    &timeout,
-						}
-						rule.To = append(rule.To, ruleTo)
-						// TODO get from TO?
-						rule.RetryNum = &retryNum
-						rule.Timeout = &timeout
-						rule.RetryCodes = DefaultRetryCodes()
-						rule.QueryString = queryStringRule
-						rule.DSCP = *ds.DSCP
-						rule.ConnectionClose = DefaultRuleConnectionClose
-						rule.ParentSelection = &parentSelection
-						rule.Allow = acl
-						rule.Plugins = map[string]interface{}{}
-						rule.Plugins["modify_headers"] = toClientHeaders
-						rule.Plugins["modify_parent_request_headers"] = toOriginHeaders
-						remapTextJSON, err := json.Marshal(dsRemap)
-						if err != nil {
-							return remap.RemapRules{}, fmt.Errorf("parsing deliveryservice '%v' remap text '%v' marshalling JSON: %v", *ds.XMLID, dsRemap, err)
-						}
-						rule.PluginsShared[web.RemapTextKey] = remapTextJSON
-					}
-				}
-				rules = append(rules, rule)
-			}
-		}
-	}
-
-	globalPlugins := map[string]interface{}{}
-	serverHeader := web.Hdr{Name: "Server", Value: "Grove/0.33"}
-	setHeaders := []web.Hdr{}
-	setHeaders = append(setHeaders, serverHeader)
-	globalHeaders := web.ModHdrs{Set: setHeaders}
-	globalPlugins["modify_response_headers_global"] = globalHeaders
-	remapRules := remap.RemapRules{
-		Rules:           rules,
-		RetryCodes:      DefaultRetryCodes(),
-		Timeout:         &timeout,
-		ParentSelection: &parentSelection,
-		Stats:           remapdata.RemapRulesStats{Allow: allowedIPs},
-		Plugins:         globalPlugins,
-	}
-
-	return remapRules, nil
-}
-
 func getCertFileName(cert tc.CDNSSLKeys, dir string) string {
 	return dir + string(os.PathSeparator) + strings.Replace(cert.Hostname, "*.", "", -1) + ".crt"
 }
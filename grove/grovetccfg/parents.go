@@ -0,0 +1,153 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+
+	"github.com/apache/trafficcontrol/lib/go-atscfg"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+)
+
+// makeParents returns the parent.config lines ATS would be given for the server, by the dest_domain host and port of the origins they apply to, or atscfg.ParentConfigDestDomainDefault for the default line.
+//
+// Grove parents are taken from the parent.config data lib/go-atscfg generates from the Traffic Ops data, the same as ATS caches get from t3c, so Grove and ATS caches select the same parents, per Topologies, Cache Groups, Server Capabilities, and parent.config Parameters.
+func makeParents(data *TOData) (map[string]atscfg.ParentConfigLine, []string, error) {
+	lines, warnings, err := atscfg.MakeParentDotConfigData(
+		data.DeliveryServices,
+		data.Server,
+		data.Servers,
+		data.Topologies,
+		data.ServerParams,
+		data.ParentConfigParams,
+		data.ServerCapabilities,
+		data.DSRequiredCapabilities,
+		data.CacheGroups,
+		data.DeliveryServiceServers,
+		&data.CDN,
+	)
+	if err != nil {
+		return nil, warnings, errors.New("making parent.config: " + err.Error())
+	}
+	parents := make(map[string]atscfg.ParentConfigLine, len(lines))
+	for _, line := range lines {
+		destDomain := line.DestDomain
+		if destDomain != atscfg.ParentConfigDestDomainDefault {
+			destDomain += ":" + line.Port
+		}
+		parents[destDomain] = line
+	}
+	return parents, warnings, nil
+}
+
+// parentLineFor returns the parent.config line for the given origin, which is the line for its host and port, or the default line. Returns false if there's no line for the origin.
+func parentLineFor(parents map[string]atscfg.ParentConfigLine, origin *url.URL) (atscfg.ParentConfigLine, bool) {
+	port := origin.Port()
+	if port == "" {
+		port = "80"
+		if origin.Scheme == "https" {
+			port = "443"
+		}
+	}
+	if pl, ok := parents[origin.Hostname()+":"+port]; ok {
+		return pl, true
+	}
+	pl, ok := parents[atscfg.ParentConfigDestDomainDefault]
+	return pl, ok
+}
+
+// roundRobinParentSelection returns the parent selection for the given parent.config round_robin.
+//
+// ATS selects round_robin=true parents by a hash of the client IP, which Grove doesn't have, so they're selected round-robin, the same as round_robin=strict. Without round_robin, ATS uses round_robin=false, which uses the first available parent, in order, as does round_robin=latched, until that parent fails.
+func roundRobinParentSelection(roundRobin string) (remapdata.ParentSelectionType, error) {
+	switch roundRobin {
+	case "consistent_hash":
+		return remapdata.ParentSelectionTypeConsistentHash, nil
+	case "true", "strict":
+		return remapdata.ParentSelectionTypeRoundRobin, nil
+	case "", "false", "latched":
+		return remapdata.ParentSelectionTypeOrdered, nil
+	}
+	return remapdata.ParentSelectionTypeInvalid, errors.New("unknown round_robin '" + roundRobin + "'")
+}
+
+// makeRuleTos returns the rule's to URLs for the given origin and parent.config line, and the parent selection to use.
+//
+// Proxy parents are used as the rule's proxy URLs. Parents which aren't proxies, such as Multi-Site Origins and the origin itself, are used as the rule's URLs. Secondary parents are the rule's secondary tos. If there are no parents, the origin is requested directly.
+func makeRuleTos(origin *url.URL, pl atscfg.ParentConfigLine, hasLine bool) ([]remapdata.RemapRuleTo, remapdata.ParentSelectionType, error) {
+	weight := DefaultRuleWeight
+	retryNum := DefaultRetryNum
+	timeout := DefaultTimeout
+	originStr := origin.String()
+
+	newTo := func(u string, w float64, proxyURL *url.URL, secondary bool) remapdata.RemapRuleTo {
+		return remapdata.RemapRuleTo{
+			RemapRuleToBase: remapdata.RemapRuleToBase{
+				URL:       u,
+				Weight:    &w,
+				RetryNum:  &retryNum,
+				Secondary: secondary,
+			},
+			ProxyURL:   proxyURL,
+			RetryCodes: DefaultRetryCodes(),
+			Timeout:    &timeout,
+		}
+	}
+
+	if !hasLine || len(pl.Parents) == 0 {
+		return []remapdata.RemapRuleTo{newTo(originStr, weight, nil, false)}, DefaultRuleParentSelection, nil
+	}
+
+	parentSelection, err := roundRobinParentSelection(pl.RoundRobin)
+	if err != nil {
+		return nil, remapdata.ParentSelectionTypeInvalid, err
+	}
+
+	tos := []remapdata.RemapRuleTo{}
+	addTos := func(parents []atscfg.ParentConfigParent, secondary bool) error {
+		for _, parent := range parents {
+			parentWeight := weight
+			if parent.Weight != "" {
+				w, err := strconv.ParseFloat(parent.Weight, 64)
+				if err != nil {
+					return errors.New("parent '" + parent.Host + "' weight '" + parent.Weight + "' is not a number")
+				}
+				parentWeight = w
+			}
+			if !pl.ParentIsProxy {
+				parentURL := *origin
+				parentURL.Host = parent.Host
+				tos = append(tos, newTo(parentURL.String(), parentWeight, nil, secondary))
+				continue
+			}
+			proxyURL, err := url.Parse("http://" + parent.Host)
+			if err != nil {
+				return errors.New("parsing parent '" + parent.Host + "': " + err.Error())
+			}
+			tos = append(tos, newTo(originStr, parentWeight, proxyURL, secondary))
+		}
+		return nil
+	}
+	if err := addTos(pl.Parents, false); err != nil {
+		return nil, remapdata.ParentSelectionTypeInvalid, err
+	}
+	if err := addTos(pl.SecondaryParents, true); err != nil {
+		return nil, remapdata.ParentSelectionTypeInvalid, err
+	}
+	return tos, parentSelection, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-atscfg"
+
+	"github.com/apache/trafficcontrol/grove/remapdata"
+)
+
+func TestParentLineFor(t *testing.T) {
+	parents := map[string]atscfg.ParentConfigLine{
+		"origin.example.test:443":            {RoundRobin: "true"},
+		atscfg.ParentConfigDestDomainDefault: {RoundRobin: "consistent_hash"},
+	}
+	tests := map[string]string{
+		"https://origin.example.test/":     "true",
+		"http://origin.example.test:443/":  "true",
+		"http://origin.example.test/":      "consistent_hash",
+		"https://other.example.test:8443/": "consistent_hash",
+	}
+	for originStr, expected := range tests {
+		origin, err := url.Parse(originStr)
+		if err != nil {
+			t.Fatalf("parsing '%v' expected nil error, actual %v", originStr, err)
+		}
+		if pl, ok := parentLineFor(parents, origin); !ok {
+			t.Errorf("parentLineFor '%v' expected line, actual none", originStr)
+		} else if pl.RoundRobin != expected {
+			t.Errorf("parentLineFor '%v' expected round_robin '%v', actual '%v'", originStr, expected, pl.RoundRobin)
+		}
+	}
+
+	origin, _ := url.Parse("http://origin.example.test/")
+	if _, ok := parentLineFor(map[string]atscfg.ParentConfigLine{}, origin); ok {
+		t.Errorf("parentLineFor with no lines expected no line, actual line")
+	}
+}
+
+func TestRoundRobinParentSelection(t *testing.T) {
+	tests := map[string]remapdata.ParentSelectionType{
+		"consistent_hash": remapdata.ParentSelectionTypeConsistentHash,
+		"true":            remapdata.ParentSelectionTypeRoundRobin,
+		"strict":          remapdata.ParentSelectionTypeRoundRobin,
+		"false":           remapdata.ParentSelectionTypeOrdered,
+		"latched":         remapdata.ParentSelectionTypeOrdered,
+		"":                remapdata.ParentSelectionTypeOrdered,
+	}
+	for roundRobin, expected := range tests {
+		if actual, err := roundRobinParentSelection(roundRobin); err != nil {
+			t.Errorf("roundRobinParentSelection '%v' expected nil error, actual %v", roundRobin, err)
+		} else if actual != expected {
+			t.Errorf("roundRobinParentSelection '%v' expected %v, actual %v", roundRobin, expected, actual)
+		}
+	}
+	if _, err := roundRobinParentSelection("bogus"); err == nil {
+		t.Errorf("roundRobinParentSelection unknown expected error, actual nil")
+	}
+}
+
+func TestMakeRuleTos(t *testing.T) {
+	origin, err := url.Parse("http://origin.example.test/")
+	if err != nil {
+		t.Fatalf("parsing origin expected nil error, actual %v", err)
+	}
+
+	tos, parentSelection, err := makeRuleTos(origin, atscfg.ParentConfigLine{}, false)
+	if err != nil {
+		t.Fatalf("makeRuleTos no line expected nil error, actual %v", err)
+	} else if len(tos) != 1 || tos[0].URL != "http://origin.example.test/" || tos[0].ProxyURL != nil {
+		t.Errorf("makeRuleTos no line expected origin without proxy, actual %+v", tos)
+	} else if parentSelection != DefaultRuleParentSelection {
+		t.Errorf("makeRuleTos no line expected parent selection %v, actual %v", DefaultRuleParentSelection, parentSelection)
+	}
+
+	proxies := atscfg.ParentConfigLine{
+		Parents:          []atscfg.ParentConfigParent{{Host: "mid0.example.test:80", Weight: "0.5"}, {Host: "mid1.example.test:8080", Weight: "1"}},
+		SecondaryParents: []atscfg.ParentConfigParent{{Host: "mid2.example.test:80", Weight: "0.999"}},
+		RoundRobin:       "consistent_hash",
+		ParentIsProxy:    true,
+	}
+	tos, parentSelection, err = makeRuleTos(origin, proxies, true)
+	if err != nil {
+		t.Fatalf("makeRuleTos proxies expected nil error, actual %v", err)
+	} else if parentSelection != remapdata.ParentSelectionTypeConsistentHash {
+		t.Errorf("makeRuleTos proxies expected parent selection %v, actual %v", remapdata.ParentSelectionTypeConsistentHash, parentSelection)
+	} else if len(tos) != 3 {
+		t.Fatalf("makeRuleTos proxies expected 3 tos, actual %+v", tos)
+	}
+	expectedProxies := []struct {
+		host      string
+		weight    float64
+		secondary bool
+	}{
+		{"mid0.example.test:80", 0.5, false},
+		{"mid1.example.test:8080", 1, false},
+		{"mid2.example.test:80", 0.999, true},
+	}
+	for i, expected := range expectedProxies {
+		if tos[i].URL != "http://origin.example.test/" {
+			t.Errorf("makeRuleTos proxy %v expected URL 'http://origin.example.test/', actual '%v'", i, tos[i].URL)
+		}
+		if tos[i].ProxyURL == nil || tos[i].ProxyURL.Host != expected.host {
+			t.Errorf("makeRuleTos proxy %v expected proxy '%v', actual %v", i, expected.host, tos[i].ProxyURL)
+		}
+		if *tos[i].Weight != expected.weight {
+			t.Errorf("makeRuleTos proxy %v expected weight %v, actual %v", i, expected.weight, *tos[i].Weight)
+		}
+		if tos[i].Secondary != expected.secondary {
+			t.Errorf("makeRuleTos proxy %v expected secondary %v, actual %v", i, expected.secondary, tos[i].Secondary)
+		}
+	}
+
+	origins := atscfg.ParentConfigLine{
+		Parents:       []atscfg.ParentConfigParent{{Host: "mso0.example.test:8080", Weight: "1"}},
+		RoundRobin:    "false",
+		ParentIsProxy: false,
+	}
+	tos, parentSelection, err = makeRuleTos(origin, origins, true)
+	if err != nil {
+		t.Fatalf("makeRuleTos origins expected nil error, actual %v", err)
+	} else if parentSelection != remapdata.ParentSelectionTypeOrdered {
+		t.Errorf("makeRuleTos origins expected parent selection %v, actual %v", remapdata.ParentSelectionTypeOrdered, parentSelection)
+	} else if len(tos) != 1 || tos[0].URL != "http://mso0.example.test:8080/" || tos[0].ProxyURL != nil {
+		t.Errorf("makeRuleTos origins expected 'http://mso0.example.test:8080/' without proxy, actual %+v", tos)
+	}
+
+	lastTier := atscfg.ParentConfigLine{
+		Parents:       []atscfg.ParentConfigParent{{Host: "origin.example.test:80"}},
+		RoundRobin:    "consistent_hash",
+		ParentIsProxy: false,
+	}
+	tos, _, err = makeRuleTos(origin, lastTier, true)
+	if err != nil {
+		t.Fatalf("makeRuleTos last tier expected nil error, actual %v", err)
+	} else if len(tos) != 1 || tos[0].URL != "http://origin.example.test:80/" || *tos[0].Weight != DefaultRuleWeight {
+		t.Errorf("makeRuleTos last tier expected origin with default weight, actual %+v", tos)
+	}
+
+	if _, _, err := makeRuleTos(origin, atscfg.ParentConfigLine{Parents: origins.Parents, RoundRobin: "bogus"}, true); err == nil {
+		t.Errorf("makeRuleTos unknown round_robin expected error, actual nil")
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/apache/trafficcontrol/lib/go-atscfg"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	toclient "github.com/apache/trafficcontrol/traffic_ops/v4-client"
+)
+
+// DeliveryServiceServersNoLimit is the limit requested for Delivery Service Servers, which Traffic Ops otherwise pages.
+const DeliveryServiceServersNoLimit = "999999"
+
+// TOData is the Traffic Ops data needed to generate a server's Grove config, in the lib/go-atscfg data model used to generate ATS config.
+type TOData struct {
+	Server                 *atscfg.Server
+	Servers                []atscfg.Server
+	CacheGroups            []tc.CacheGroupNullable
+	Topologies             []tc.Topology
+	DeliveryServices       []atscfg.DeliveryService
+	DeliveryServiceServers []atscfg.DeliveryServiceServer
+	DeliveryServiceRegexes []tc.DeliveryServiceRegexes
+	CDN                    tc.CDN
+	ServerParams           []tc.Parameter
+	ParentConfigParams     []tc.Parameter
+	ServerCapabilities     map[int]map[atscfg.ServerCapability]struct{}
+	DSRequiredCapabilities map[int]map[atscfg.ServerCapability]struct{}
+	SSLKeys                []tc.CDNSSLKeys
+}
+
+// getTOData gets the data needed to generate the given host's Grove config from Traffic Ops.
+func getTOData(toc *toclient.Session, host string) (*TOData, error) {
+	data := &TOData{}
+
+	servers, err := getServers(toc)
+	if err != nil {
+		return nil, errors.New("getting servers: " + err.Error())
+	}
+	data.Servers = servers
+	for i, sv := range servers {
+		if sv.HostName != nil && *sv.HostName == host {
+			data.Server = &servers[i]
+			break
+		}
+	}
+	if data.Server == nil {
+		return nil, errors.New("host '" + host + "' not in Servers")
+	} else if data.Server.ID == nil || data.Server.CDNID == nil || data.Server.CDNName == nil || data.Server.Profile == nil {
+		return nil, errors.New("host '" + host + "' missing ID, CDN, or Profile")
+	}
+
+	cgs, _, err := toc.GetCacheGroups(toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting cachegroups: " + err.Error())
+	}
+	data.CacheGroups = cgs.Response
+
+	topologies, _, err := toc.GetTopologies(toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting topologies: " + err.Error())
+	}
+	data.Topologies = topologies.Response
+
+	dsOpts := toclient.NewRequestOptions()
+	dsOpts.QueryParameters.Set("cdn", strconv.Itoa(*data.Server.CDNID))
+	dses, _, err := toc.GetDeliveryServices(dsOpts)
+	if err != nil {
+		return nil, errors.New("getting delivery services: " + err.Error())
+	}
+	for _, ds := range dses.Response {
+		data.DeliveryServices = append(data.DeliveryServices, atscfg.DeliveryService(ds.DowngradeToV3()))
+	}
+
+	dssOpts := toclient.NewRequestOptions()
+	dssOpts.QueryParameters.Set("limit", DeliveryServiceServersNoLimit)
+	dss, _, err := toc.GetDeliveryServiceServers(dssOpts)
+	if err != nil {
+		return nil, errors.New("getting delivery service servers: " + err.Error())
+	}
+	for _, ds := range dss.Response {
+		if ds.Server == nil || ds.DeliveryService == nil {
+			continue
+		}
+		data.DeliveryServiceServers = append(data.DeliveryServiceServers, atscfg.DeliveryServiceServer{Server: *ds.Server, DeliveryService: *ds.DeliveryService})
+	}
+
+	regexes, _, err := toc.GetDeliveryServiceRegexes(toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting delivery service regexes: " + err.Error())
+	}
+	data.DeliveryServiceRegexes = regexes.Response
+
+	cdnOpts := toclient.NewRequestOptions()
+	cdnOpts.QueryParameters.Set("name", *data.Server.CDNName)
+	cdns, _, err := toc.GetCDNs(cdnOpts)
+	if err != nil {
+		return nil, errors.New("getting cdn '" + *data.Server.CDNName + "': " + err.Error())
+	} else if len(cdns.Response) != 1 {
+		return nil, errors.New("getting cdn '" + *data.Server.CDNName + "': expected 1, got " + strconv.Itoa(len(cdns.Response)))
+	}
+	data.CDN = cdns.Response[0]
+
+	serverParams, _, err := toc.GetParametersByProfileName(*data.Server.Profile, toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting profile '" + *data.Server.Profile + "' parameters: " + err.Error())
+	}
+	data.ServerParams = serverParams.Response
+
+	parentOpts := toclient.NewRequestOptions()
+	parentOpts.QueryParameters.Set("configFile", "parent.config")
+	parentParams, _, err := toc.GetParameters(parentOpts)
+	if err != nil {
+		return nil, errors.New("getting parent.config parameters: " + err.Error())
+	}
+	data.ParentConfigParams = parentParams.Response
+
+	serverCaps, _, err := toc.GetServerServerCapabilities(toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting server capabilities: " + err.Error())
+	}
+	data.ServerCapabilities = map[int]map[atscfg.ServerCapability]struct{}{}
+	for _, sc := range serverCaps.Response {
+		if sc.ServerID == nil || sc.ServerCapability == nil {
+			continue
+		}
+		if data.ServerCapabilities[*sc.ServerID] == nil {
+			data.ServerCapabilities[*sc.ServerID] = map[atscfg.ServerCapability]struct{}{}
+		}
+		data.ServerCapabilities[*sc.ServerID][atscfg.ServerCapability(*sc.ServerCapability)] = struct{}{}
+	}
+
+	dsCaps, _, err := toc.GetDeliveryServicesRequiredCapabilities(toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting delivery service required capabilities: " + err.Error())
+	}
+	data.DSRequiredCapabilities = map[int]map[atscfg.ServerCapability]struct{}{}
+	for _, dc := range dsCaps.Response {
+		if dc.DeliveryServiceID == nil || dc.RequiredCapability == nil {
+			continue
+		}
+		if data.DSRequiredCapabilities[*dc.DeliveryServiceID] == nil {
+			data.DSRequiredCapabilities[*dc.DeliveryServiceID] = map[atscfg.ServerCapability]struct{}{}
+		}
+		data.DSRequiredCapabilities[*dc.DeliveryServiceID][atscfg.ServerCapability(*dc.RequiredCapability)] = struct{}{}
+	}
+
+	sslKeys, _, err := toc.GetCDNSSLKeys(*data.Server.CDNName, toclient.RequestOptions{})
+	if err != nil {
+		return nil, errors.New("getting cdn '" + *data.Server.CDNName + "' ssl keys: " + err.Error())
+	}
+	data.SSLKeys = sslKeys.Response
+
+	return data, nil
+}
+
+// getServers gets all servers from Traffic Ops, converted to the lib/go-atscfg Server, which keeps all of each server's interfaces.
+func getServers(toc *toclient.Session) ([]atscfg.Server, error) {
+	toServers, _, err := toc.GetServers(toclient.RequestOptions{})
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]atscfg.Server, 0, len(toServers.Response))
+	for _, sv := range toServers.Response {
+		svV30, err := sv.ToServerV3FromV4()
+		if err != nil {
+			return nil, errors.New("converting server: " + err.Error())
+		}
+		servers = append(servers, atscfg.Server(svV30))
+	}
+	return servers, nil
+}
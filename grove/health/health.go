@@ -0,0 +1,299 @@
+package health
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// health tracks the health of parents, so unhealthy parents can be skipped by parent selection.
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// Config is the parent health configuration, from the remap rules file.
+type Config struct {
+	// MaxFailures is the number of consecutive failures of a parent, after which it's marked down. Failures are connection errors, timeouts, and responses with the remap rule's retry codes. If 0, parents are never marked down.
+	MaxFailures int `json:"max_failures"`
+	// MarkdownMS is how long a parent is marked down, after which requests are sent to it again. If the next request fails, it's marked down again.
+	MarkdownMS int `json:"markdown_ms"`
+	// ProbePath is the path to request from each parent every ProbeIntervalMS, to check its health actively. A probe failure counts the same as a request failure, and a probe success marks the parent up. If empty, parents aren't probed.
+	ProbePath       string `json:"probe_path"`
+	ProbeIntervalMS int    `json:"probe_interval_ms"`
+	ProbeTimeoutMS  int    `json:"probe_timeout_ms"`
+}
+
+// DefaultConfig is the parent health configuration, for remap rules files which don't specify it, and for any fields not specified.
+var DefaultConfig = Config{
+	MaxFailures:     5,
+	MarkdownMS:      30 * 1000,
+	ProbeIntervalMS: 10 * 1000,
+	ProbeTimeoutMS:  5 * 1000,
+}
+
+func (c Config) markdown() time.Duration { return time.Duration(c.MarkdownMS) * time.Millisecond }
+func (c Config) probeInterval() time.Duration {
+	return time.Duration(c.ProbeIntervalMS) * time.Millisecond
+}
+func (c Config) probeTimeout() time.Duration {
+	return time.Duration(c.ProbeTimeoutMS) * time.Millisecond
+}
+
+// Status is the health of a parent at a point in time, for reporting.
+type Status struct {
+	URL string `json:"url"`
+	// ProxyURL is the proxy requests to the parent are sent through, e.g. the mid of an edge, or empty if requests go to the URL directly.
+	ProxyURL  string `json:"proxy_url,omitempty"`
+	Available bool   `json:"available"`
+	// Failures is the number of consecutive failures.
+	Failures int `json:"failures"`
+	// Markdowns is the number of times the parent has been marked down.
+	Markdowns   uint64    `json:"markdowns"`
+	DownUntil   time.Time `json:"down_until"`
+	LastFailure string    `json:"last_failure"`
+}
+
+// Name returns the name of the parent, which is its URL, and its proxy if it has one.
+func (s Status) Name() string {
+	return parentName(s.URL, s.ProxyURL)
+}
+
+// parentKey is the key of a parent in the checker. Parents are the URL and the proxy requests are sent through, because proxy parents, such as the mids of an edge, all have the origin URL.
+type parentKey struct {
+	url      string
+	proxyURL string
+}
+
+func parentName(url string, proxyURL string) string {
+	if proxyURL == "" {
+		return url
+	}
+	return url + " via " + proxyURL
+}
+
+// Parent is the health of a single parent. A nil *Parent is always available, and ignores successes and failures.
+type Parent struct {
+	url       string
+	proxyURL  string
+	checker   *Checker
+	transport *http.Transport
+
+	m           sync.Mutex
+	failures    int
+	markdowns   uint64
+	downUntil   time.Time
+	lastFailure string
+}
+
+func (p *Parent) URL() string      { return p.url }
+func (p *Parent) ProxyURL() string { return p.proxyURL }
+func (p *Parent) name() string     { return parentName(p.url, p.proxyURL) }
+
+// Available returns whether the parent isn't marked down at the given time.
+func (p *Parent) Available(now time.Time) bool {
+	if p == nil {
+		return true
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+	return !now.Before(p.downUntil)
+}
+
+// Succeeded records a successful request to the parent, which resets its failures and marks it up.
+func (p *Parent) Succeeded() {
+	if p == nil {
+		return
+	}
+	cfg := p.checker.config() // must not be called while holding p.m, because Checker.Parent locks p.m while holding the checker lock
+	p.m.Lock()
+	defer p.m.Unlock()
+	if cfg.MaxFailures > 0 && p.failures >= cfg.MaxFailures {
+		log.Infof("parent %v marked up\n", p.name())
+	}
+	p.failures = 0
+	p.downUntil = time.Time{}
+}
+
+// Failed records a failed request to the parent, with the given reason, marking it down if it has failed too many consecutive times.
+func (p *Parent) Failed(reason string) {
+	if p == nil {
+		return
+	}
+	cfg := p.checker.config()
+	now := time.Now()
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.failures++
+	p.lastFailure = now.Format(time.RFC3339) + " " + reason
+	if cfg.MaxFailures <= 0 || p.failures < cfg.MaxFailures || now.Before(p.downUntil) {
+		return
+	}
+	p.downUntil = now.Add(cfg.markdown())
+	p.markdowns++
+	log.Warnf("parent %v marked down for %v after %v consecutive failures, last: %v\n", p.name(), cfg.markdown(), p.failures, reason)
+}
+
+// Status returns the current health of the parent.
+func (p *Parent) Status() Status {
+	now := time.Now()
+	p.m.Lock()
+	defer p.m.Unlock()
+	return Status{
+		URL:         p.url,
+		ProxyURL:    p.proxyURL,
+		Available:   !now.Before(p.downUntil),
+		Failures:    p.failures,
+		Markdowns:   p.markdowns,
+		DownUntil:   p.downUntil,
+		LastFailure: p.lastFailure,
+	}
+}
+
+// Checker tracks the health of all parents, by URL and proxy. Parents are shared by all remap rules, so a parent used by multiple rules is marked down for all of them, and are kept across remap rule reloads, so their health isn't lost.
+type Checker struct {
+	m          sync.Mutex
+	cfg        Config
+	parents    map[parentKey]*Parent
+	stopProbes chan struct{}
+}
+
+func NewChecker() *Checker {
+	return &Checker{cfg: DefaultConfig, parents: map[parentKey]*Parent{}}
+}
+
+func (c *Checker) config() Config {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.cfg
+}
+
+// Parent returns the health of the parent with the given URL and proxy URL, creating it if it doesn't exist. The proxy URL is empty for parents requested directly. The transport is used for active probes, and must send requests through the proxy. If the checker is nil, returns nil, which is always available.
+func (c *Checker) Parent(url string, proxyURL string, transport *http.Transport) *Parent {
+	if c == nil {
+		return nil
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	key := parentKey{url: url, proxyURL: proxyURL}
+	p, ok := c.parents[key]
+	if !ok {
+		p = &Parent{url: url, proxyURL: proxyURL, checker: c}
+		c.parents[key] = p
+	}
+	p.m.Lock()
+	p.transport = transport
+	p.m.Unlock()
+	return p
+}
+
+// Configure sets the health config, forgets all parents not in the given parents, and restarts active probes. This should be called after the remap rules are loaded, with all their parents.
+func (c *Checker) Configure(cfg Config, parents map[*Parent]struct{}) {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.cfg = cfg
+	for key, p := range c.parents {
+		if _, ok := parents[p]; !ok {
+			delete(c.parents, key)
+		}
+	}
+
+	if c.stopProbes != nil {
+		close(c.stopProbes)
+		c.stopProbes = nil
+	}
+	if cfg.ProbePath == "" || cfg.ProbeIntervalMS <= 0 {
+		return
+	}
+	c.stopProbes = make(chan struct{})
+	for _, p := range c.parents {
+		go probe(p, cfg, c.stopProbes)
+	}
+}
+
+// Statuses returns the current health of all parents, sorted by URL and proxy URL.
+func (c *Checker) Statuses() []Status {
+	c.m.Lock()
+	parents := make([]*Parent, 0, len(c.parents))
+	for _, p := range c.parents {
+		parents = append(parents, p)
+	}
+	c.m.Unlock()
+
+	statuses := make([]Status, 0, len(parents))
+	for _, p := range parents {
+		statuses = append(statuses, p.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if statuses[i].URL != statuses[j].URL {
+			return statuses[i].URL < statuses[j].URL
+		}
+		return statuses[i].ProxyURL < statuses[j].ProxyURL
+	})
+	return statuses
+}
+
+// probe requests the config probe path from the parent every probe interval, recording the result, until stop is closed.
+func probe(p *Parent, cfg Config, stop <-chan struct{}) {
+	p.m.Lock()
+	client := &http.Client{Transport: p.transport, Timeout: cfg.probeTimeout()}
+	p.m.Unlock()
+	url := p.url + cfg.ProbePath
+
+	ticker := time.NewTicker(cfg.probeInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			p.Failed("probe: " + err.Error())
+			continue
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			p.Failed("probe: returned code " + strconv.Itoa(resp.StatusCode))
+			continue
+		}
+		p.Succeeded()
+	}
+}
+
+// Prefer returns the index of the parent to use, from the given parents in order of preference. Available parents are used first, and the nth available parent is returned, where n is the number of parents which have already failed for this request. Unavailable parents are only used after all available parents have failed, so requests are still made if every parent is marked down.
+func Prefer(parents []*Parent, failures int) int {
+	now := time.Now()
+	order := make([]int, 0, len(parents))
+	down := []int(nil)
+	for i, p := range parents {
+		if p.Available(now) {
+			order = append(order, i)
+		} else {
+			down = append(down, i)
+		}
+	}
+	order = append(order, down...)
+	return order[failures%len(order)]
+}
@@ -0,0 +1,109 @@
+package health
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParentMarkdown(t *testing.T) {
+	c := NewChecker()
+	p := c.Parent("http://parent.example.net", "", nil)
+	c.Configure(Config{MaxFailures: 2, MarkdownMS: 60 * 1000}, map[*Parent]struct{}{p: {}})
+
+	p.Failed("test")
+	if !p.Available(time.Now()) {
+		t.Errorf("Parent.Available after 1 of 2 max failures expected true, actual false")
+	}
+	p.Failed("test")
+	if p.Available(time.Now()) {
+		t.Errorf("Parent.Available after 2 of 2 max failures expected false, actual true")
+	}
+	if !p.Available(time.Now().Add(2 * time.Minute)) {
+		t.Errorf("Parent.Available after markdown expired expected true, actual false")
+	}
+	if status := p.Status(); status.Markdowns != 1 || status.Failures != 2 {
+		t.Errorf("Parent.Status expected 1 markdown 2 failures, actual %+v", status)
+	}
+
+	p.Succeeded()
+	if !p.Available(time.Now()) {
+		t.Errorf("Parent.Available after success expected true, actual false")
+	}
+	p.Failed("test")
+	if !p.Available(time.Now()) {
+		t.Errorf("Parent.Available after success and 1 failure expected true, actual false")
+	}
+
+	c.Configure(Config{MaxFailures: 2, MarkdownMS: 60 * 1000}, map[*Parent]struct{}{})
+	if statuses := c.Statuses(); len(statuses) != 0 {
+		t.Errorf("Checker.Configure without the parent expected it forgotten, actual %+v", statuses)
+	}
+}
+
+func TestParentsByProxy(t *testing.T) {
+	c := NewChecker()
+	mid0 := c.Parent("http://origin.example.net", "http://mid0.example.net:80", nil)
+	mid1 := c.Parent("http://origin.example.net", "http://mid1.example.net:80", nil)
+	c.Configure(Config{MaxFailures: 1, MarkdownMS: 60 * 1000}, map[*Parent]struct{}{mid0: {}, mid1: {}})
+	if mid0 == mid1 {
+		t.Fatalf("Checker.Parent with the same URL and different proxies expected distinct parents, actual the same")
+	}
+	if again := c.Parent("http://origin.example.net", "http://mid0.example.net:80", nil); again != mid0 {
+		t.Errorf("Checker.Parent with the same URL and proxy expected the same parent, actual a new one")
+	}
+
+	mid0.Failed("test")
+	if mid0.Available(time.Now()) {
+		t.Errorf("Parent.Available of the failed proxy parent expected false, actual true")
+	}
+	if !mid1.Available(time.Now()) {
+		t.Errorf("Parent.Available of the other proxy parent with the same URL expected true, actual false")
+	}
+	if actual := Prefer([]*Parent{mid0, mid1}, 0); actual != 1 {
+		t.Errorf("Prefer with the first proxy parent down expected 1, actual %v", actual)
+	}
+
+	statuses := c.Statuses()
+	if len(statuses) != 2 || statuses[0].ProxyURL != "http://mid0.example.net:80" || statuses[1].ProxyURL != "http://mid1.example.net:80" {
+		t.Errorf("Checker.Statuses expected both proxy parents, actual %+v", statuses)
+	} else if name := statuses[0].Name(); name != "http://origin.example.net via http://mid0.example.net:80" {
+		t.Errorf("Status.Name expected URL via proxy, actual '%v'", name)
+	}
+}
+
+func TestPrefer(t *testing.T) {
+	c := NewChecker()
+	c.Configure(Config{MaxFailures: 1, MarkdownMS: 60 * 1000}, nil)
+	up0, down, up1 := c.Parent("up0", "", nil), c.Parent("down", "", nil), c.Parent("up1", "", nil)
+	down.Failed("test")
+	parents := []*Parent{up0, down, up1}
+
+	for failures, expected := range []int{0, 2, 1, 0} {
+		if actual := Prefer(parents, failures); actual != expected {
+			t.Errorf("Prefer with %v failures expected %v, actual %v", failures, expected, actual)
+		}
+	}
+	if actual := Prefer([]*Parent{nil, nil}, 1); actual != 1 {
+		t.Errorf("Prefer with nil parents expected 1, actual %v", actual)
+	}
+
+	up0.Failed("test")
+	up1.Failed("test")
+	if actual := Prefer(parents, 0); actual != 0 {
+		t.Errorf("Prefer with all parents down expected 0, actual %v", actual)
+	}
+}
@@ -25,7 +25,11 @@ type Cache interface {
 	Capacity() uint64
 	Get(key string) (*cacheobj.CacheObj, bool)
 	Peek(key string) (*cacheobj.CacheObj, bool)
+	// Remove removes the key from the cache. Returns whether the key existed.
+	Remove(key string) bool
 	Keys() []string
+	// DerivedKeys returns the keys of the objects derived from the object with the given key, such as its variants, encoded copies, and slices, whose keys begin with the key and cacheobj.DerivedKeySeparator. It doesn't iterate over every key in the cache.
+	DerivedKeys(key string) []string
 	Size() uint64
 	Close()
 }
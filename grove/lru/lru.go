@@ -48,6 +48,17 @@ func (c *LRU) Add(key string, size uint64) uint64 {
 	return 0
 }
 
+// Touch moves the key to the front of the LRU, without changing its size. Returns whether the key existed.
+func (c *LRU) Touch(key string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	elem, ok := c.lElems[key]
+	if ok {
+		c.l.MoveToFront(elem)
+	}
+	return ok
+}
+
 // RemoveOldest returns the key, size, and true if the LRU is nonempty; else false.
 func (c *LRU) RemoveOldest() (string, uint64, bool) {
 	c.m.Lock()
@@ -74,3 +85,46 @@ func (c *LRU) Keys() []string {
 	}
 	return arr
 }
+
+// Remove removes the key from the LRU. Returns the size of the removed key, and whether it existed.
+func (c *LRU) Remove(key string) (uint64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	elem, ok := c.lElems[key]
+	if !ok {
+		return 0, false
+	}
+	c.l.Remove(elem)
+	delete(c.lElems, key)
+	return elem.Value.(*listObj).size, true
+}
+
+// Entry is a key in the LRU, and its size.
+type Entry struct {
+	Key  string
+	Size uint64
+}
+
+// Entries returns the keys and sizes in the LRU, from least to most recently used.
+func (c *LRU) Entries() []Entry {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	entries := make([]Entry, 0, len(c.lElems))
+	for e := c.l.Back(); e != nil; e = e.Prev() {
+		object := e.Value.(*listObj)
+		entries = append(entries, Entry{Key: object.key, Size: object.size})
+	}
+	return entries
+}
+
+// AddOldest adds the key to the LRU as the least recently used, with the given size. If the key already exists, it isn't changed. Returns whether the key was added.
+// This is designed for restoring a saved LRU while it's concurrently in use, without moving keys which were used since it was saved.
+func (c *LRU) AddOldest(key string, size uint64) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.lElems[key]; ok {
+		return false
+	}
+	c.lElems[key] = c.l.PushBack(&listObj{key, size})
+	return true
+}
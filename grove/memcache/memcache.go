@@ -26,11 +26,12 @@ import (
 
 // MemCache is a threadsafe memory cache with a soft byte limit, enforced via LRU.
 type MemCache struct {
-	lru          *lru.LRU                      // threadsafe.
-	cache        map[string]*cacheobj.CacheObj // mutexed: MUST NOT access without locking cacheM. TODO test performance of sync.Map
-	cacheM       sync.RWMutex                  // TODO test performance of one mutex for lru+cache
-	sizeBytes    uint64                        // atomic: MUST NOT access without sync.atomic
-	maxSizeBytes uint64                        // constant: MUST NOT be modified after creation
+	lru          *lru.LRU                       // threadsafe.
+	cache        map[string]*cacheobj.CacheObj  // mutexed: MUST NOT access without locking cacheM. TODO test performance of sync.Map
+	derived      map[string]map[string]struct{} // mutexed: the derived keys in cache, by the key they're derived from.
+	cacheM       sync.RWMutex                   // TODO test performance of one mutex for lru+cache
+	sizeBytes    uint64                         // atomic: MUST NOT access without sync.atomic
+	maxSizeBytes uint64                         // constant: MUST NOT be modified after creation
 	gcChan       chan<- uint64
 }
 
@@ -40,6 +41,7 @@ func New(bytes uint64) *MemCache {
 	c := &MemCache{
 		lru:          lru.NewLRU(),
 		cache:        map[string]*cacheobj.CacheObj{},
+		derived:      map[string]map[string]struct{}{},
 		maxSizeBytes: bytes,
 		gcChan:       gcChan,
 	}
@@ -65,9 +67,21 @@ func (c *MemCache) Peek(key string) (*cacheobj.CacheObj, bool) {
 	return obj, ok
 }
 
+// Add adds the object to the cache. If the object's body is stored elsewhere, such as in a disk cache tier, it's read into memory first.
 func (c *MemCache) Add(key string, val *cacheobj.CacheObj) bool {
+	val, err := val.InMemory()
+	if err != nil {
+		log.Errorln("MemCache.Add reading '" + key + "' body: " + err.Error())
+		return false
+	}
 	c.cacheM.Lock()
 	c.cache[key] = val
+	if base, ok := cacheobj.DerivedKeyBase(key); ok {
+		if c.derived[base] == nil {
+			c.derived[base] = map[string]struct{}{}
+		}
+		c.derived[base][key] = struct{}{}
+	}
 	c.cacheM.Unlock()
 	oldSize := c.lru.Add(key, val.Size)
 	sizeChange := val.Size - oldSize
@@ -82,6 +96,21 @@ func (c *MemCache) Add(key string, val *cacheobj.CacheObj) bool {
 	return false // TODO remove eviction from interface; it's unnecessary and expensive
 }
 
+// Remove removes the key from the cache. Returns whether the key existed.
+func (c *MemCache) Remove(key string) bool {
+	c.cacheM.Lock()
+	_, ok := c.cache[key]
+	c.delete(key)
+	c.cacheM.Unlock()
+	if !ok {
+		return false
+	}
+	if sizeBytes, ok := c.lru.Remove(key); ok {
+		atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
+	}
+	return true
+}
+
 func (c *MemCache) Size() uint64 { return atomic.LoadUint64(&c.sizeBytes) }
 func (c *MemCache) Close()       {}
 
@@ -114,17 +143,39 @@ func (c *MemCache) gc(cacheSizeBytes uint64) {
 
 		log.Debugf("MemCache.gc deleting key '" + key + "'")
 		c.cacheM.Lock()
-		delete(c.cache, key)
+		c.delete(key)
 		c.cacheM.Unlock()
 
 		cacheSizeBytes = atomic.AddUint64(&c.sizeBytes, ^uint64(sizeBytes-1)) // subtract sizeBytes
 	}
 }
 
+// delete deletes the key from the cache and the derived key index. It does not change the LRU or size. The cacheM lock must be held.
+func (c *MemCache) delete(key string) {
+	delete(c.cache, key)
+	if base, ok := cacheobj.DerivedKeyBase(key); ok {
+		delete(c.derived[base], key)
+		if len(c.derived[base]) == 0 {
+			delete(c.derived, base)
+		}
+	}
+}
+
 func (c *MemCache) Keys() []string {
 	return c.lru.Keys()
 }
 
+// DerivedKeys returns the keys derived from the given key, from the index of derived keys.
+func (c *MemCache) DerivedKeys(key string) []string {
+	c.cacheM.RLock()
+	defer c.cacheM.RUnlock()
+	keys := make([]string, 0, len(c.derived[key]))
+	for derivedKey := range c.derived[key] {
+		keys = append(keys, derivedKey)
+	}
+	return keys
+}
+
 func (c *MemCache) Capacity() uint64 {
 	return c.maxSizeBytes
 }
@@ -0,0 +1,487 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(20000, Funcs{load: accessLogLoad, startup: accessLogStartup, afterRespond: accessLog})
+}
+
+// AccessLogDefaultFormat is the format used by the access_log plugin if none is configured. It's the same line the ats_log plugin writes.
+const AccessLogDefaultFormat = `%<cqtq> chi=%<chi> phn=%<phn> php=%<php> shn=%<shn> url=%<cquuc> cqhm=%<cqhm> cqhv=%<cqhv> pssc=%<pssc> ttms=%<ttms> b=%<pscl> sssc=%<sssc> sscl=%<sscl> cfsc=%<cfsc> pfsc=%<pfsc> crc=%<crc> phr=%<phr> pqsn=%<pqsn> uas="%<{User-Agent}cqh>" xmt="%<{X-Money-Trace}cqh>" reqid=%<reqid>`
+
+// AccessLogEmptyValue is logged for fields with no value, such as missing headers.
+const AccessLogEmptyValue = "-"
+
+const accessLogFieldStart = "%<"
+const accessLogFieldEnd = ">"
+
+type accessLogConfigJSON struct {
+	// Format is the log line format, in the style of ATS logging.yaml custom formats, e.g. `%<chi> %<cqhm> %<{User-Agent}cqh>`.
+	Format string `json:"format"`
+	// JSON is whether to write each line as a JSON object of the format's fields, rather than the format text.
+	JSON bool `json:"json"`
+	// File is the path of the file to log to. If empty, lines are written to the event log.
+	File string `json:"file"`
+	// MaxBytes is the size at which the file is rotated. If 0, the file is never rotated.
+	MaxBytes int64 `json:"max_bytes"`
+	// MaxBackups is the number of rotated files to keep.
+	MaxBackups int `json:"max_backups"`
+	// SampleRate is the fraction of requests to log, between 0 and 1. Defaults to 1, logging every request.
+	SampleRate *float64 `json:"sample_rate"`
+}
+
+type accessLogConfig struct {
+	fields     []accessLogField
+	json       bool
+	file       *rotatingFile
+	sampleRate float64
+}
+
+// accessLogField is a part of a log format: either literal text, or a named field whose value is computed for each request.
+type accessLogField struct {
+	literal string
+	name    string
+	value   func(r *accessLogRecord) string
+}
+
+// accessLogRecord is the data about a request needed to compute its log fields.
+type accessLogRecord struct {
+	AfterRespondData
+	Now       time.Time
+	BytesSent uint64
+}
+
+func accessLogLoad(b json.RawMessage) interface{} {
+	cfgJSON := accessLogConfigJSON{}
+	if err := json.Unmarshal(b, &cfgJSON); err != nil {
+		log.Errorln("access_log loading config, unmarshalling JSON: " + err.Error())
+		return nil
+	}
+	cfg, err := makeAccessLogConfig(cfgJSON)
+	if err != nil {
+		log.Errorln("access_log loading config: " + err.Error())
+		return nil
+	}
+	log.Debugf("access_log load success: %+v\n", cfgJSON)
+	return cfg
+}
+
+// accessLogStartup is called after the remap rules are loaded, and closes the files of the previous rules which the new rules don't log to.
+func accessLogStartup(icfg interface{}, d StartupData) {
+	closeUnloadedRotatingFiles()
+}
+
+func makeAccessLogConfig(cfgJSON accessLogConfigJSON) (*accessLogConfig, error) {
+	if cfgJSON.Format == "" {
+		cfgJSON.Format = AccessLogDefaultFormat
+	}
+	fields, err := parseAccessLogFormat(cfgJSON.Format)
+	if err != nil {
+		return nil, errors.New("parsing format: " + err.Error())
+	}
+
+	cfg := &accessLogConfig{fields: fields, json: cfgJSON.JSON, sampleRate: 1}
+	if cfgJSON.SampleRate != nil {
+		if *cfgJSON.SampleRate < 0 || *cfgJSON.SampleRate > 1 {
+			return nil, errors.New("sample_rate must be between 0 and 1")
+		}
+		cfg.sampleRate = *cfgJSON.SampleRate
+	}
+	if cfgJSON.MaxBytes < 0 || cfgJSON.MaxBackups < 0 {
+		return nil, errors.New("max_bytes and max_backups may not be negative")
+	}
+	if cfgJSON.File != "" {
+		cfg.file = getRotatingFile(cfgJSON.File, cfgJSON.MaxBytes, cfgJSON.MaxBackups)
+	}
+	return cfg, nil
+}
+
+func accessLog(icfg interface{}, d AfterRespondData) {
+	if icfg == nil {
+		return
+	}
+	cfg, ok := icfg.(*accessLogConfig)
+	if !ok {
+		log.Errorf("access_log config '%v' type '%T' expected *accessLogConfig\n", icfg, icfg)
+		return
+	}
+	if cfg.sampleRate < 1 && rand.Float64() >= cfg.sampleRate {
+		return
+	}
+
+	r := &accessLogRecord{
+		AfterRespondData: d,
+		Now:              time.Now(),
+		BytesSent:        web.TryGetBytesWritten(d.W, d.Conn, d.BytesWritten),
+	}
+	line := ""
+	if cfg.json {
+		line = accessLogJSON(cfg.fields, r)
+	} else {
+		line = accessLogText(cfg.fields, r)
+	}
+
+	if cfg.file == nil {
+		log.EventRaw(line)
+		return
+	}
+	if _, err := cfg.file.Write([]byte(line)); err != nil {
+		log.Errorln("access_log writing to '" + cfg.file.path + "': " + err.Error())
+	}
+}
+
+// accessLogText returns the log line for the given record, with the fields' values in the format text.
+func accessLogText(fields []accessLogField, r *accessLogRecord) string {
+	sb := strings.Builder{}
+	for _, field := range fields {
+		if field.value == nil {
+			sb.WriteString(field.literal)
+			continue
+		}
+		sb.WriteString(accessLogEscaper.Replace(field.value(r)))
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// accessLogJSON returns the log line for the given record, as a JSON object of the format's fields, in order. Literal text in the format is omitted.
+func accessLogJSON(fields []accessLogField, r *accessLogRecord) string {
+	sb := strings.Builder{}
+	sb.WriteString("{")
+	first := true
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+		if !first {
+			sb.WriteString(",")
+		}
+		first = false
+		key, _ := json.Marshal(field.name) // strings always marshal
+		val, _ := json.Marshal(field.value(r))
+		sb.Write(key)
+		sb.WriteString(":")
+		sb.Write(val)
+	}
+	sb.WriteString("}\n")
+	return sb.String()
+}
+
+// accessLogEscaper escapes characters in text log field values which would otherwise allow clients to break or forge log lines, e.g. with quotes or newlines in headers.
+var accessLogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`)
+
+// parseAccessLogFormat parses the given format into its literal text and fields.
+func parseAccessLogFormat(format string) ([]accessLogField, error) {
+	fields := []accessLogField{}
+	for format != "" {
+		start := strings.Index(format, accessLogFieldStart)
+		if start < 0 {
+			fields = append(fields, accessLogField{literal: format})
+			break
+		}
+		if start > 0 {
+			fields = append(fields, accessLogField{literal: format[:start]})
+		}
+		format = format[start+len(accessLogFieldStart):]
+		end := strings.Index(format, accessLogFieldEnd)
+		if end < 0 {
+			return nil, errors.New("unterminated field '" + accessLogFieldStart + format + "'")
+		}
+		name := format[:end]
+		format = format[end+len(accessLogFieldEnd):]
+		value, err := accessLogFieldValue(name)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, accessLogField{name: name, value: value})
+	}
+	return fields, nil
+}
+
+// accessLogFieldValue returns the function computing the value of the field with the given name. Header fields are of the form `{Header-Name}cqh` for client request headers, and `{Header-Name}psh` for response headers.
+func accessLogFieldValue(name string) (func(r *accessLogRecord) string, error) {
+	if strings.HasPrefix(name, "{") {
+		end := strings.Index(name, "}")
+		if end < 2 {
+			return nil, errors.New("malformed header field '" + name + "'")
+		}
+		hdrName := name[1:end]
+		switch name[end+1:] {
+		case "cqh":
+			return func(r *accessLogRecord) string { return accessLogValue(r.Req.Header.Get(hdrName)) }, nil
+		case "psh":
+			return func(r *accessLogRecord) string { return accessLogValue(r.W.Header().Get(hdrName)) }, nil
+		}
+		return nil, errors.New("unknown header field '" + name + "', must be cqh or psh")
+	}
+	value, ok := accessLogFields[name]
+	if !ok {
+		return nil, errors.New("unknown field '" + name + "'")
+	}
+	return value, nil
+}
+
+// accessLogFields is the functions computing the value of each field, by name. Field names are the same as those of ATS where possible.
+var accessLogFields = map[string]func(r *accessLogRecord) string{
+	"cqtq": func(r *accessLogRecord) string { return accessLogUnixMS(r.ReqTime) },
+	"cqts": func(r *accessLogRecord) string { return strconv.FormatInt(r.ReqTime.Unix(), 10) },
+	"cqtn": func(r *accessLogRecord) string { return r.ReqTime.Format("02/Jan/2006:15:04:05 -0700") },
+	"cqtd": func(r *accessLogRecord) string { return r.ReqTime.Format("2006-01-02") },
+	"cqtt": func(r *accessLogRecord) string { return r.ReqTime.Format("15:04:05") },
+	"ttms": func(r *accessLogRecord) string {
+		return strconv.FormatInt(int64(r.Now.Sub(r.ReqTime)/time.Millisecond), 10)
+	},
+	"ttmsf": func(r *accessLogRecord) string {
+		return strconv.FormatFloat(float64(r.Now.Sub(r.ReqTime))/float64(time.Millisecond), 'f', 3, 64)
+	},
+	"tts": func(r *accessLogRecord) string { return strconv.FormatInt(int64(r.Now.Sub(r.ReqTime)/time.Second), 10) },
+	"chi": func(r *accessLogRecord) string { return accessLogValue(r.ClientIP) },
+	"chp": func(r *accessLogRecord) string {
+		_, port, err := net.SplitHostPort(r.Req.RemoteAddr)
+		if err != nil {
+			return AccessLogEmptyValue
+		}
+		return port
+	},
+	"phn":   func(r *accessLogRecord) string { return accessLogValue(r.Hostname) },
+	"php":   func(r *accessLogRecord) string { return accessLogValue(r.Port) },
+	"shn":   func(r *accessLogRecord) string { return accessLogValue(r.ToFQDN) },
+	"cqhm":  func(r *accessLogRecord) string { return r.Req.Method },
+	"cqhv":  func(r *accessLogRecord) string { return r.Req.Proto },
+	"cquuc": func(r *accessLogRecord) string { return r.Scheme + "://" + r.Req.Host + r.Req.URL.String() },
+	"cqup":  func(r *accessLogRecord) string { return r.Req.URL.Path },
+	"cquq":  func(r *accessLogRecord) string { return accessLogValue(r.Req.URL.RawQuery) },
+	"cqtx":  func(r *accessLogRecord) string { return r.Req.Method + " " + r.Req.URL.String() + " " + r.Req.Proto },
+	"pssc":  func(r *accessLogRecord) string { return strconv.Itoa(r.RespCode) },
+	"pscl":  func(r *accessLogRecord) string { return strconv.FormatUint(r.BytesSent, 10) },
+	"sssc":  func(r *accessLogRecord) string { return strconv.Itoa(r.OriginCode) },
+	"sscl":  func(r *accessLogRecord) string { return strconv.FormatUint(r.OriginBytes, 10) },
+	"crc":   func(r *accessLogRecord) string { return getCacheHitStr(r.CacheHit, r.OriginConnectFailed) },
+	"phr": func(r *accessLogRecord) string {
+		phr, _ := getParentStrings(r.RespCode, r.CacheHit, r.ProxyStr, r.ToFQDN)
+		return phr
+	},
+	"pqsn": func(r *accessLogRecord) string {
+		_, pqsn := getParentStrings(r.RespCode, r.CacheHit, r.ProxyStr, r.ToFQDN)
+		return pqsn
+	},
+	"cfsc": func(r *accessLogRecord) string { return accessLogFinStr(r.RespSuccess) },
+	"pfsc": func(r *accessLogRecord) string { return accessLogFinStr(r.OriginReqSuccess) },
+	"cqssl": func(r *accessLogRecord) string {
+		if r.Req.TLS == nil {
+			return "0"
+		}
+		return "1"
+	},
+	"cqssv": func(r *accessLogRecord) string {
+		if r.Req.TLS == nil {
+			return AccessLogEmptyValue
+		}
+		return tlsVersionStr(r.Req.TLS.Version)
+	},
+	"cqssc": func(r *accessLogRecord) string {
+		if r.Req.TLS == nil {
+			return AccessLogEmptyValue
+		}
+		return tls.CipherSuiteName(r.Req.TLS.CipherSuite)
+	},
+	"cqssn": func(r *accessLogRecord) string {
+		if r.Req.TLS == nil {
+			return AccessLogEmptyValue
+		}
+		return accessLogValue(r.Req.TLS.ServerName)
+	},
+	"reqid": func(r *accessLogRecord) string { return strconv.FormatUint(r.RequestID, 10) },
+}
+
+// accessLogValue returns s, or AccessLogEmptyValue if s is empty.
+func accessLogValue(s string) string {
+	if s == "" {
+		return AccessLogEmptyValue
+	}
+	return s
+}
+
+// accessLogUnixMS returns the given time as Unix seconds, with three decimal places, like the ATS logs.
+func accessLogUnixMS(t time.Time) string {
+	ms := t.UnixNano() / int64(time.Millisecond)
+	frac := strconv.FormatInt(ms%1000, 10)
+	for len(frac) < 3 {
+		frac = "0" + frac
+	}
+	return strconv.FormatInt(ms/1000, 10) + "." + frac
+}
+
+func accessLogFinStr(success bool) string {
+	if success {
+		return "FIN"
+	}
+	return "INTR"
+}
+
+func tlsVersionStr(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLSv1"
+	case tls.VersionTLS11:
+		return "TLSv1.1"
+	case tls.VersionTLS12:
+		return "TLSv1.2"
+	case tls.VersionTLS13:
+		return "TLSv1.3"
+	}
+	return "0x" + strconv.FormatUint(uint64(version), 16)
+}
+
+// rotatingFiles is the log files of all access_log configs, by path. Files are shared by configs with the same path, so rules may log to the same file, and files are kept open across config reloads.
+var rotatingFiles = map[string]*rotatingFile{}
+
+// rotatingFilesLoaded is the paths of the files of the configs loaded since the last startup, i.e. the files of the rules being loaded.
+var rotatingFilesLoaded = map[string]struct{}{}
+var rotatingFilesM sync.Mutex
+
+// getRotatingFile returns the log file for the given path, creating it if it doesn't exist. If it exists, it's given the new rotation config, and reopened on its next write, so files rotated externally, e.g. by logrotate, are reopened when the remap rules are reloaded.
+func getRotatingFile(path string, maxBytes int64, maxBackups int) *rotatingFile {
+	rotatingFilesM.Lock()
+	defer rotatingFilesM.Unlock()
+	f, ok := rotatingFiles[path]
+	if !ok {
+		f = &rotatingFile{path: path}
+		rotatingFiles[path] = f
+	}
+	rotatingFilesLoaded[path] = struct{}{}
+	f.m.Lock()
+	f.maxBytes = maxBytes
+	f.maxBackups = maxBackups
+	f.reopen = true
+	f.m.Unlock()
+	return f
+}
+
+// closeUnloadedRotatingFiles closes and forgets the files which no config loaded since the last call logs to, so files removed from the remap rules aren't held open.
+func closeUnloadedRotatingFiles() {
+	rotatingFilesM.Lock()
+	defer rotatingFilesM.Unlock()
+	for path, f := range rotatingFiles {
+		if _, ok := rotatingFilesLoaded[path]; ok {
+			continue
+		}
+		f.close()
+		delete(rotatingFiles, path)
+	}
+	rotatingFilesLoaded = map[string]struct{}{}
+}
+
+// rotatingFile is a log file, which is rotated when it exceeds maxBytes. Rotated files are renamed with the suffixes .1 through .maxBackups, .1 being the newest.
+type rotatingFile struct {
+	m          sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	reopen     bool
+	// closed is whether the file was removed from the remap rules. Closed files aren't reopened, so requests still using the old rules don't leak them.
+	closed bool
+}
+
+// Write writes b to the file, opening or rotating it first if necessary. It is safe for multiple goroutines.
+func (f *rotatingFile) Write(b []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.closed {
+		return 0, errors.New("file closed, no longer in the remap rules")
+	}
+	if f.reopen && f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.reopen = false
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.maxBytes > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxBytes {
+		if err := f.rotate(); err != nil {
+			return 0, errors.New("rotating: " + err.Error())
+		}
+	}
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	return n, err
+}
+
+// close closes the file, after which writes fail. It is safe for multiple goroutines.
+func (f *rotatingFile) close() {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.file != nil {
+		f.file.Close()
+		f.file = nil
+	}
+	f.closed = true
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate closes the file, renames it and its backups, and opens a new file. Must be called with f.m locked.
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	f.file = nil
+	for i := f.maxBackups; i > 1; i-- {
+		if err := os.Rename(f.path+"."+strconv.Itoa(i-1), f.path+"."+strconv.Itoa(i)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if f.maxBackups > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return f.open()
+}
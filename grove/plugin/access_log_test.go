@@ -0,0 +1,190 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cachedata"
+)
+
+func testAccessLogRecord() *accessLogRecord {
+	req := httptest.NewRequest(http.MethodGet, "http://ds.example.test/foo?bar=baz", nil)
+	req.RemoteAddr = "192.0.2.1:54321"
+	req.Header.Set("User-Agent", `evil"agent`+"\nline")
+	w := httptest.NewRecorder()
+	w.Header().Set("Content-Type", "text/plain")
+	reqTime := time.Unix(1563936732, 42000000)
+	return &accessLogRecord{
+		AfterRespondData: AfterRespondData{
+			W:              w,
+			RequestID:      7,
+			ReqData:        cachedata.ReqData{Req: req, ClientIP: "192.0.2.1", ReqTime: reqTime, ToFQDN: "origin.example.test"},
+			SrvrData:       cachedata.SrvrData{Hostname: "grove0", Port: "80", Scheme: "http"},
+			ParentRespData: cachedata.ParentRespData{OriginCode: 200, OriginBytes: 100, OriginReqSuccess: true, ProxyStr: "mid0.example.test:80"},
+			RespData:       cachedata.RespData{RespCode: 200, BytesWritten: 123, RespSuccess: true},
+		},
+		Now:       reqTime.Add(1500 * time.Millisecond),
+		BytesSent: 123,
+	}
+}
+
+func TestAccessLogText(t *testing.T) {
+	fields, err := parseAccessLogFormat(`%<cqtq> %<chi>:%<chp> "%<cqtx>" %<pssc> %<pscl> %<ttms> %<crc>/%<phr> %<pqsn> uas="%<{User-Agent}cqh>" ct=%<{Content-Type}psh> x=%<{X-Missing}cqh> ssl=%<cqssl>`)
+	if err != nil {
+		t.Fatalf("parseAccessLogFormat expected nil error, actual %v", err)
+	}
+	expected := `1563936732.042 192.0.2.1:54321 "GET http://ds.example.test/foo?bar=baz HTTP/1.1" 200 123 1500 TCP_MISS/PARENT_HIT mid0.example.test uas="evil\"agent\nline" ct=text/plain x=- ssl=0` + "\n"
+	if actual := accessLogText(fields, testAccessLogRecord()); actual != expected {
+		t.Errorf("accessLogText expected '%v', actual '%v'", expected, actual)
+	}
+}
+
+func TestAccessLogJSON(t *testing.T) {
+	fields, err := parseAccessLogFormat(`%<chi> %<cqhm> %<{User-Agent}cqh> %<reqid>`)
+	if err != nil {
+		t.Fatalf("parseAccessLogFormat expected nil error, actual %v", err)
+	}
+	line := accessLogJSON(fields, testAccessLogRecord())
+	expected := `{"chi":"192.0.2.1","cqhm":"GET","{User-Agent}cqh":"evil\"agent\nline","reqid":"7"}` + "\n"
+	if line != expected {
+		t.Errorf("accessLogJSON expected '%v', actual '%v'", expected, line)
+	}
+	obj := map[string]string{}
+	if err := json.Unmarshal([]byte(line), &obj); err != nil {
+		t.Errorf("accessLogJSON expected valid JSON, actual error %v", err)
+	}
+}
+
+func TestParseAccessLogFormatErrors(t *testing.T) {
+	for _, format := range []string{`%<chi`, `%<nosuchfield>`, `%<{User-Agent}xyz>`, `%<{}cqh>`} {
+		if _, err := parseAccessLogFormat(format); err == nil {
+			t.Errorf("parseAccessLogFormat '%v' expected error, actual nil", format)
+		}
+	}
+	if _, err := parseAccessLogFormat(AccessLogDefaultFormat); err != nil {
+		t.Errorf("parseAccessLogFormat default format expected nil error, actual %v", err)
+	}
+}
+
+func TestAccessLogFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	sampleRate := 1.0
+	cfg, err := makeAccessLogConfig(accessLogConfigJSON{Format: `%<reqid>`, File: path, MaxBytes: 4, MaxBackups: 2, SampleRate: &sampleRate})
+	if err != nil {
+		t.Fatalf("makeAccessLogConfig expected nil error, actual %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		d := testAccessLogRecord().AfterRespondData
+		d.RequestID = uint64(i)
+		accessLog(cfg, d)
+	}
+
+	// each line is 2 bytes, so each file holds 2 lines.
+	expected := map[string]string{path: "4\n5\n", path + ".1": "2\n3\n", path + ".2": "0\n1\n"}
+	for p, expectedContent := range expected {
+		content, err := ioutil.ReadFile(p)
+		if err != nil {
+			t.Errorf("reading '%v' expected nil error, actual %v", p, err)
+		} else if string(content) != expectedContent {
+			t.Errorf("file '%v' expected '%v', actual '%v'", p, expectedContent, string(content))
+		}
+	}
+}
+
+func TestAccessLogStartupClosesUnloadedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	keptPath := filepath.Join(dir, "kept.log")
+	removedPath := filepath.Join(dir, "removed.log")
+
+	keptCfg, err := makeAccessLogConfig(accessLogConfigJSON{Format: `%<reqid>`, File: keptPath})
+	if err != nil {
+		t.Fatalf("makeAccessLogConfig expected nil error, actual %v", err)
+	}
+	removedCfg, err := makeAccessLogConfig(accessLogConfigJSON{Format: `%<reqid>`, File: removedPath})
+	if err != nil {
+		t.Fatalf("makeAccessLogConfig expected nil error, actual %v", err)
+	}
+	accessLogStartup(nil, StartupData{})
+	accessLog(keptCfg, testAccessLogRecord().AfterRespondData)
+	accessLog(removedCfg, testAccessLogRecord().AfterRespondData)
+
+	// reload with only the kept file
+	if _, err := makeAccessLogConfig(accessLogConfigJSON{Format: `%<reqid>`, File: keptPath}); err != nil {
+		t.Fatalf("makeAccessLogConfig expected nil error, actual %v", err)
+	}
+	accessLogStartup(nil, StartupData{})
+
+	rotatingFilesM.Lock()
+	_, keptOK := rotatingFiles[keptPath]
+	_, removedOK := rotatingFiles[removedPath]
+	rotatingFilesM.Unlock()
+	if !keptOK {
+		t.Errorf("expected file still in the rules to be kept")
+	}
+	if removedOK {
+		t.Errorf("expected file no longer in the rules to be removed")
+	}
+	if removedCfg.file.file != nil {
+		t.Errorf("expected file no longer in the rules to be closed")
+	}
+	if _, err := removedCfg.file.Write([]byte("x\n")); err == nil {
+		t.Errorf("expected writing a closed file to fail")
+	}
+	if _, err := keptCfg.file.Write([]byte("x\n")); err != nil {
+		t.Errorf("expected writing a kept file to succeed, actual %v", err)
+	}
+}
+
+func TestAccessLogSampling(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grove-access-log")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "access.log")
+
+	sampleRate := 0.0
+	cfg, err := makeAccessLogConfig(accessLogConfigJSON{File: path, SampleRate: &sampleRate})
+	if err != nil {
+		t.Fatalf("makeAccessLogConfig expected nil error, actual %v", err)
+	}
+	accessLog(cfg, testAccessLogRecord().AfterRespondData)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("sample_rate 0 expected no log file, actual stat error %v", err)
+	}
+
+	invalidRate := 1.5
+	if _, err := makeAccessLogConfig(accessLogConfigJSON{SampleRate: &invalidRate}); err == nil {
+		t.Errorf("makeAccessLogConfig sample_rate 1.5 expected error, actual nil")
+	}
+}
@@ -122,6 +122,12 @@ func cacheinspect(icfg interface{}, d OnRequestData) bool {
 			w.Write([]byte(fmt.Sprintf("  RespRespTime:                 %v\n", cacheObject.RespRespTime)))
 			w.Write([]byte(fmt.Sprintf("  LastModified:                 %v\n", cacheObject.LastModified)))
 			w.Write([]byte(fmt.Sprintf("  HitCount:                     %v\n", cacheObject.HitCount)))
+			if cacheObject.IsVariantIndex() {
+				w.Write([]byte(fmt.Sprintf("  Vary:                         %s\n", strings.Join(cacheObject.VaryHdrs, ", "))))
+				for _, variantKey := range cacheObject.Variants {
+					w.Write([]byte(fmt.Sprintf("  Variant:                      %s\n", variantKey)))
+				}
+			}
 		} else {
 			w.Write([]byte("Not Found"))
 		}
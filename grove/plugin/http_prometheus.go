@@ -0,0 +1,236 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(10000, Funcs{onRequest: prometheusStats})
+}
+
+const PrometheusEndpoint = "/_metrics"
+
+const ContentTypeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+const ContentTypePrometheusText = "text/plain; version=0.0.4; charset=utf-8"
+
+// prometheusStats serves the stats in the Prometheus text format, or the OpenMetrics text format if the client accepts it, with the same access rules as the http_stats plugin.
+func prometheusStats(icfg interface{}, d OnRequestData) bool {
+	if !strings.HasPrefix(d.R.URL.Path, PrometheusEndpoint) {
+		log.Debugf("plugin onrequest http_prometheus returning, not in path '" + d.R.URL.Path + "'\n")
+		return false
+	}
+
+	log.Debugf("plugin onrequest http_prometheus calling\n")
+
+	w := d.W
+	req := d.R
+
+	ip, err := web.GetIP(req)
+	if err != nil {
+		code := http.StatusInternalServerError
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Errorln("http_prometheus failed to get IP: " + ip.String())
+		return true
+	}
+	if !d.StatRules.Allowed(ip) {
+		code := http.StatusForbidden
+		w.WriteHeader(code)
+		w.Write([]byte(http.StatusText(code)))
+		log.Debugln("http_prometheus IP " + ip.String() + " FORBIDDEN")
+		return true
+	}
+
+	openMetrics := strings.Contains(req.Header.Get("Accept"), "application/openmetrics-text")
+	contentType := ContentTypePrometheusText
+	if openMetrics {
+		contentType = ContentTypeOpenMetrics
+	}
+
+	buf := bytes.Buffer{}
+	WritePrometheusStats(&buf, d.Stats, d.HTTPConns, d.HTTPSConns, openMetrics)
+	respondStats(w, req, contentType, buf.Bytes())
+	return true
+}
+
+// WritePrometheusStats writes the remap rule, cache, parent, and connection stats to w, in the Prometheus text format, or the OpenMetrics text format if openMetrics is true.
+func WritePrometheusStats(w io.Writer, stats stat.Stats, httpConns *web.ConnMap, httpsConns *web.ConnMap, openMetrics bool) {
+	mw := metricsWriter{w: w, openMetrics: openMetrics}
+
+	mw.family("grove_info", "gauge", "Grove version information.")
+	mw.sample("grove_info", 1, "version", stats.System().Version())
+
+	mw.family("grove_client_connections", "gauge", "Current client connections.")
+	for _, c := range []struct {
+		protocol string
+		conns    *web.ConnMap
+	}{{"http", httpConns}, {"https", httpsConns}} {
+		if c.conns != nil {
+			mw.sample("grove_client_connections", c.conns.Len(), "protocol", c.protocol)
+		}
+	}
+
+	mw.family("grove_cache_hits_total", "counter", "Requests served from the cache.")
+	mw.sample("grove_cache_hits_total", stats.CacheHits())
+	mw.family("grove_cache_misses_total", "counter", "Requests not served from the cache.")
+	mw.sample("grove_cache_misses_total", stats.CacheMisses())
+
+	cacheNames := stats.CacheNames()
+	sort.Strings(cacheNames)
+	mw.family("grove_cache_size_bytes", "gauge", "Size of each cache. The memory cache is named with the empty string.")
+	for _, name := range cacheNames {
+		if size, ok := stats.CacheSizeByName(name); ok {
+			mw.sample("grove_cache_size_bytes", size, "cache", name)
+		}
+	}
+	mw.family("grove_cache_capacity_bytes", "gauge", "Capacity of each cache. The memory cache is named with the empty string.")
+	for _, name := range cacheNames {
+		if capacity, ok := stats.CacheCapacityByName(name); ok {
+			mw.sample("grove_cache_capacity_bytes", capacity, "cache", name)
+		}
+	}
+
+	statsRemaps := stats.Remap()
+	rules := statsRemaps.Rules()
+	sort.Strings(rules)
+	ruleStats := make([]stat.StatsRemap, 0, len(rules))
+	ruleNames := make([]string, 0, len(rules))
+	for _, rule := range rules {
+		if statsRemap, ok := statsRemaps.Stats(rule); ok {
+			ruleStats = append(ruleStats, statsRemap)
+			ruleNames = append(ruleNames, rule)
+		}
+	}
+
+	ruleCounters := []struct {
+		name string
+		help string
+		get  func(stat.StatsRemap) uint64
+	}{
+		{"grove_remap_in_bytes_total", "Bytes received from clients, per remap rule.", stat.StatsRemap.InBytes},
+		{"grove_remap_out_bytes_total", "Bytes sent to clients, per remap rule.", stat.StatsRemap.OutBytes},
+		{"grove_remap_cache_hits_total", "Requests served from the cache, per remap rule.", stat.StatsRemap.CacheHits},
+		{"grove_remap_cache_misses_total", "Requests not served from the cache, per remap rule.", stat.StatsRemap.CacheMisses},
+	}
+	for _, counter := range ruleCounters {
+		mw.family(counter.name, "counter", counter.help)
+		for i, statsRemap := range ruleStats {
+			mw.sample(counter.name, counter.get(statsRemap), "rule", ruleNames[i])
+		}
+	}
+
+	mw.family("grove_remap_responses_total", "counter", "Responses to clients, per remap rule and status code class.")
+	for i, statsRemap := range ruleStats {
+		mw.sample("grove_remap_responses_total", statsRemap.Status2xx(), "rule", ruleNames[i], "class", "2xx")
+		mw.sample("grove_remap_responses_total", statsRemap.Status3xx(), "rule", ruleNames[i], "class", "3xx")
+		mw.sample("grove_remap_responses_total", statsRemap.Status4xx(), "rule", ruleNames[i], "class", "4xx")
+		mw.sample("grove_remap_responses_total", statsRemap.Status5xx(), "rule", ruleNames[i], "class", "5xx")
+	}
+
+	mw.family("grove_remap_parent_latency_seconds", "histogram", "Time parent requests took to return response headers, per remap rule.")
+	for i, statsRemap := range ruleStats {
+		mw.histogram("grove_remap_parent_latency_seconds", statsRemap.ParentLatency(), "rule", ruleNames[i])
+	}
+
+	parents := stats.ParentHealth()
+	mw.family("grove_parent_available", "gauge", "Whether each parent is available, or marked down.")
+	for _, parent := range parents {
+		mw.sample("grove_parent_available", parent.Available, "parent", parent.URL, "proxy", parent.ProxyURL)
+	}
+	mw.family("grove_parent_consecutive_failures", "gauge", "Consecutive failed requests to each parent.")
+	for _, parent := range parents {
+		mw.sample("grove_parent_consecutive_failures", parent.Failures, "parent", parent.URL, "proxy", parent.ProxyURL)
+	}
+	mw.family("grove_parent_markdowns_total", "counter", "Times each parent has been marked down.")
+	for _, parent := range parents {
+		mw.sample("grove_parent_markdowns_total", parent.Markdowns, "parent", parent.URL, "proxy", parent.ProxyURL)
+	}
+
+	if openMetrics {
+		fmt.Fprint(w, "# EOF\n")
+	}
+}
+
+// metricsWriter writes metrics in the Prometheus or OpenMetrics text format.
+type metricsWriter struct {
+	w           io.Writer
+	openMetrics bool
+}
+
+// family writes the help and type of a metric family. In OpenMetrics, the family name of a counter doesn't include the _total suffix of its samples.
+func (mw metricsWriter) family(name string, typ string, help string) {
+	if mw.openMetrics && typ == "counter" {
+		name = strings.TrimSuffix(name, "_total")
+	}
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a sample of the given name and value, with the given label names and values, which must be pairs.
+func (mw metricsWriter) sample(name string, val interface{}, labels ...string) {
+	valStr := ""
+	switch v := val.(type) {
+	case bool:
+		valStr = "0"
+		if v {
+			valStr = "1"
+		}
+	case float64:
+		valStr = strconv.FormatFloat(v, 'g', -1, 64)
+	default:
+		valStr = fmt.Sprint(v)
+	}
+
+	if len(labels) == 0 {
+		fmt.Fprintf(mw.w, "%s %s\n", name, valStr)
+		return
+	}
+	labelStrs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		labelStrs = append(labelStrs, labels[i]+`="`+escapeLabelValue(labels[i+1])+`"`)
+	}
+	fmt.Fprintf(mw.w, "%s{%s} %s\n", name, strings.Join(labelStrs, ","), valStr)
+}
+
+// histogram writes the bucket, sum, and count samples of the given histogram.
+func (mw metricsWriter) histogram(name string, h *stat.Histogram, labels ...string) {
+	buckets := h.Buckets()
+	bucketLabels := append(append(make([]string, 0, len(labels)+2), labels...), "le", "")
+	for i, bound := range stat.LatencyBuckets {
+		bucketLabels[len(bucketLabels)-1] = strconv.FormatFloat(bound.Seconds(), 'g', -1, 64)
+		mw.sample(name+"_bucket", buckets[i], bucketLabels...)
+	}
+	bucketLabels[len(bucketLabels)-1] = "+Inf"
+	mw.sample(name+"_bucket", buckets[len(buckets)-1], bucketLabels...)
+	mw.sample(name+"_sum", h.Sum().Seconds(), labels...)
+	mw.sample(name+"_count", buckets[len(buckets)-1], labels...)
+}
+
+// escapeLabelValue escapes backslashes, double quotes, and newlines, per the Prometheus text format.
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
@@ -0,0 +1,89 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/memcache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/stat"
+	"github.com/apache/trafficcontrol/grove/web"
+)
+
+func TestWritePrometheusStats(t *testing.T) {
+	rules := []remapdata.RemapRule{{RemapRuleBase: remapdata.RemapRuleBase{Name: "foo", From: "http://foo.example.net/path"}}}
+	caches := map[string]icache.Cache{"": memcache.New(1000)}
+	stats := stat.New(rules, caches, 1000, web.NewConnMap(), nil, `1.0 "test"`)
+
+	ruleStats, ok := stats.Remap().Stats("foo.example.net")
+	if !ok {
+		t.Fatalf("stats for remap rule foo.example.net expected, actual missing")
+	}
+	ruleStats.AddStatus2xx(3)
+	ruleStats.AddOutBytes(42)
+	ruleStats.AddCacheHit()
+	ruleStats.AddParentLatency(7 * time.Millisecond)
+	ruleStats.AddParentLatency(time.Minute)
+
+	buf := bytes.Buffer{}
+	WritePrometheusStats(&buf, stats, web.NewConnMap(), nil, false)
+	text := buf.String()
+
+	expectedLines := []string{
+		`# TYPE grove_remap_out_bytes_total counter`,
+		`grove_info{version="1.0 \"test\""} 1`,
+		`grove_client_connections{protocol="http"} 0`,
+		`grove_cache_capacity_bytes{cache=""} 1000`,
+		`grove_remap_out_bytes_total{rule="foo.example.net"} 42`,
+		`grove_remap_cache_hits_total{rule="foo.example.net"} 1`,
+		`grove_remap_responses_total{rule="foo.example.net",class="2xx"} 3`,
+		`grove_remap_responses_total{rule="foo.example.net",class="5xx"} 0`,
+		`grove_remap_parent_latency_seconds_bucket{rule="foo.example.net",le="0.005"} 0`,
+		`grove_remap_parent_latency_seconds_bucket{rule="foo.example.net",le="0.01"} 1`,
+		`grove_remap_parent_latency_seconds_bucket{rule="foo.example.net",le="10"} 1`,
+		`grove_remap_parent_latency_seconds_bucket{rule="foo.example.net",le="+Inf"} 2`,
+		`grove_remap_parent_latency_seconds_sum{rule="foo.example.net"} 60.007`,
+		`grove_remap_parent_latency_seconds_count{rule="foo.example.net"} 2`,
+	}
+	for _, line := range expectedLines {
+		if !strings.Contains(text, line+"\n") {
+			t.Errorf("WritePrometheusStats expected line '%v', actual missing from:\n%v", line, text)
+		}
+	}
+	if strings.Contains(text, "https") {
+		t.Errorf("WritePrometheusStats with nil HTTPS conns expected no https connections, actual:\n%v", text)
+	}
+	if strings.Contains(text, "# EOF") {
+		t.Errorf("WritePrometheusStats Prometheus format expected no EOF, actual:\n%v", text)
+	}
+
+	buf.Reset()
+	WritePrometheusStats(&buf, stats, web.NewConnMap(), nil, true)
+	text = buf.String()
+	if !strings.Contains(text, "# TYPE grove_remap_out_bytes counter\n") {
+		t.Errorf("WritePrometheusStats OpenMetrics expected counter family without _total suffix, actual:\n%v", text)
+	}
+	if !strings.Contains(text, `grove_remap_out_bytes_total{rule="foo.example.net"} 42`+"\n") {
+		t.Errorf("WritePrometheusStats OpenMetrics expected counter sample with _total suffix, actual:\n%v", text)
+	}
+	if !strings.HasSuffix(text, "\n# EOF\n") {
+		t.Errorf("WritePrometheusStats OpenMetrics expected EOF, actual:\n%v", text)
+	}
+}
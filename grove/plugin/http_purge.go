@@ -0,0 +1,173 @@
+package plugin
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/purge"
+	"github.com/apache/trafficcontrol/grove/web"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+func init() {
+	AddPlugin(10000, Funcs{onRequest: purgeRequest})
+}
+
+const PurgeEndpoint = "/_purge"
+const PurgeJobsEndpoint = PurgeEndpoint + "/jobs"
+
+// MethodPurge is the conventional HTTP method for purging cached objects. POST is also accepted, for clients which can't send arbitrary methods.
+const MethodPurge = "PURGE"
+
+// MaxPurgeJobsBodyBytes is the maximum size of a posted jobs body.
+const MaxPurgeJobsBodyBytes = 10 * 1024 * 1024
+
+// PurgeResp is the response to a purge request, with the number of keys removed from each cache.
+type PurgeResp struct {
+	Purged map[string]int `json:"purged"`
+}
+
+// PurgeJobsResp is the response to posting invalidation jobs.
+type PurgeJobsResp struct {
+	Jobs     int      `json:"jobs"`
+	Warnings []string `json:"warnings"`
+}
+
+func purgeRequest(icfg interface{}, d OnRequestData) bool {
+	if !strings.HasPrefix(d.R.URL.Path, PurgeEndpoint) {
+		log.Debugf("plugin onrequest http_purge returning, not in path '" + d.R.URL.Path + "'\n")
+		return false
+	}
+
+	log.Debugf("plugin onrequest http_purge calling\n")
+
+	w := d.W
+	req := d.R
+
+	ip, err := web.GetIP(req)
+	if err != nil {
+		writePurgeErr(w, http.StatusInternalServerError, "")
+		log.Errorln("http_purge failed to get IP: " + ip.String())
+		return true
+	}
+	if !d.StatRules.Allowed(ip) {
+		writePurgeErr(w, http.StatusForbidden, "")
+		log.Debugln("http_purge IP " + ip.String() + " FORBIDDEN")
+		return true
+	}
+
+	if strings.HasPrefix(req.URL.Path, PurgeJobsEndpoint) {
+		purgeJobs(w, req, d)
+		return true
+	}
+
+	if req.Method != MethodPurge && req.Method != http.MethodPost {
+		w.Header().Set("Allow", MethodPurge+", "+http.MethodPost)
+		writePurgeErr(w, http.StatusMethodNotAllowed, "")
+		return true
+	}
+
+	params := req.URL.Query()
+	pattern := params.Get("pattern")
+	if pattern == "" {
+		writePurgeErr(w, http.StatusBadRequest, "missing pattern")
+		return true
+	}
+	match := purge.MatchExact
+	if matchStr := params.Get("match"); matchStr != "" {
+		if match = purge.MatchFromStr(matchStr); match == purge.MatchInvalid {
+			writePurgeErr(w, http.StatusBadRequest, "unknown match '"+matchStr+"', must be one of exact, prefix, regex")
+			return true
+		}
+	}
+
+	cacheNames := d.Stats.CacheNames()
+	if _, ok := params["cache"]; ok {
+		cacheNames = []string{params.Get("cache")} // the default memory cache is named "", so "cache=" is valid
+	}
+
+	resp := PurgeResp{Purged: map[string]int{}}
+	for _, cacheName := range cacheNames {
+		cache, ok := d.Stats.CacheByName(cacheName)
+		if !ok {
+			writePurgeErr(w, http.StatusBadRequest, "no cache named '"+cacheName+"'")
+			return true
+		}
+		purged, err := purge.Purge(cache, match, pattern)
+		if err != nil {
+			writePurgeErr(w, http.StatusBadRequest, err.Error())
+			return true
+		}
+		resp.Purged[cacheName] = purged
+	}
+	log.Infof("http_purge %v purged %v '%v': %+v\n", ip, match, pattern, resp.Purged)
+	writePurgeJSON(w, resp)
+	return true
+}
+
+// purgeJobs gets or replaces the content invalidation jobs. Posted jobs are in the format of the Traffic Ops /jobs API response, or an array of jobs.
+func purgeJobs(w http.ResponseWriter, req *http.Request, d OnRequestData) {
+	if d.Jobs == nil {
+		writePurgeErr(w, http.StatusServiceUnavailable, "invalidation jobs not enabled")
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		writePurgeJSON(w, d.Jobs.Get())
+	case http.MethodPost, http.MethodPut:
+		bts, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, MaxPurgeJobsBodyBytes))
+		if err != nil {
+			writePurgeErr(w, http.StatusBadRequest, "reading body: "+err.Error())
+			return
+		}
+		jobs, warnings, err := purge.ParseJobs(bts, time.Now())
+		if err != nil {
+			writePurgeErr(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		d.Jobs.Set(jobs)
+		log.Infof("http_purge set %v invalidation jobs, %v warnings\n", len(jobs), len(warnings))
+		writePurgeJSON(w, PurgeJobsResp{Jobs: len(jobs), Warnings: warnings})
+	default:
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodPost+", "+http.MethodPut)
+		writePurgeErr(w, http.StatusMethodNotAllowed, "")
+	}
+}
+
+func writePurgeJSON(w http.ResponseWriter, v interface{}) {
+	bts, err := json.Marshal(v)
+	if err != nil {
+		log.Errorln("http_purge marshalling response: " + err.Error())
+		writePurgeErr(w, http.StatusInternalServerError, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bts)
+}
+
+// writePurgeErr writes the given code, and the given message, or the code's status text if the message is empty.
+func writePurgeErr(w http.ResponseWriter, code int, msg string) {
+	if msg == "" {
+		msg = http.StatusText(code)
+	}
+	w.WriteHeader(code)
+	w.Write([]byte(msg))
+}
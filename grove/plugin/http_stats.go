@@ -16,6 +16,7 @@ package plugin
 
 import (
 	"bufio"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -29,6 +30,7 @@ import (
 	"github.com/apache/trafficcontrol/grove/web"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
 )
 
 func init() {
@@ -65,7 +67,6 @@ func stats(icfg interface{}, d OnRequestData) bool {
 		return true
 	}
 
-	// TODO gzip
 	system := LoadSystemStats(d.Stats, d.InterfaceName) // TODO goroutine on a timer?
 	ats := map[string]interface{}{"server": "6.2.1"}
 	if req.URL.Query().Get("application") != "system" {
@@ -78,12 +79,30 @@ func stats(icfg interface{}, d OnRequestData) bool {
 		code := http.StatusInternalServerError
 		w.WriteHeader(code)
 		w.Write([]byte(http.StatusText(code)))
+		return true
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(bytes)
+	respondStats(w, req, rfc.ApplicationJSON, bytes)
 	return true
 }
 
+// respondStats writes the given stats body, gzipped if the client accepts it.
+func respondStats(w http.ResponseWriter, req *http.Request, contentType string, body []byte) {
+	w.Header().Set(rfc.ContentType, contentType)
+	if !rfc.AcceptsGzip(req) {
+		w.Write(body)
+		return
+	}
+	w.Header().Set(rfc.ContentEncoding, rfc.Gzip)
+	w.Header().Add(rfc.Vary, rfc.AcceptEncoding)
+	gzw := gzip.NewWriter(w)
+	if _, err := gzw.Write(body); err != nil {
+		log.Errorln("writing gzipped stats: " + err.Error())
+	}
+	if err := gzw.Close(); err != nil {
+		log.Errorln("closing gzipped stats: " + err.Error())
+	}
+}
+
 func LoadSystemStats(stats stat.Stats, interfaceName string) stat.StatsSystemJSON {
 	s := stat.StatsSystemJSON{}
 	s.InterfaceName = interfaceName
@@ -121,6 +140,13 @@ func LoadRemapStats(stats stat.Stats, httpConns *web.ConnMap, httpsConns *web.Co
 		jsonStats["plugin.remap_stats."+ruleName+".cache_misses"] = statsRemap.CacheMisses()
 	}
 
+	for _, parent := range stats.ParentHealth() {
+		jsonStats["plugin.parent_health."+parent.Name()+".available"] = parent.Available
+		jsonStats["plugin.parent_health."+parent.Name()+".failures"] = parent.Failures
+		jsonStats["plugin.parent_health."+parent.Name()+".markdowns"] = parent.Markdowns
+		jsonStats["plugin.parent_health."+parent.Name()+".last_failure"] = parent.LastFailure
+	}
+
 	jsonStats["proxy.process.http.current_client_connections"] = httpConns.Len() + httpsConns.Len()
 	jsonStats["proxy.process.http.cache_hits"] = stats.CacheHits()
 	jsonStats["proxy.process.http.cache_misses"] = stats.CacheMisses()
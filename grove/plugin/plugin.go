@@ -28,6 +28,7 @@ import (
 	"github.com/apache/trafficcontrol/grove/cachedata"
 	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/config"
+	"github.com/apache/trafficcontrol/grove/purge"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/stat"
 	"github.com/apache/trafficcontrol/grove/web"
@@ -70,6 +71,8 @@ type OnRequestData struct {
 	HTTPSConns    *web.ConnMap
 	RequestID     uint64
 	Context       *interface{}
+	// Jobs is the set of content invalidation jobs applied to cache lookups. Plugins may replace the jobs.
+	Jobs *purge.Jobs
 	cachedata.SrvrData
 }
 
@@ -81,13 +84,14 @@ type BeforeParentRequestData struct {
 
 // BeforeRespondData holds the data passed to plugins. The objects pointed to MAY NOT be modified, however, the location pointed to may be changed for the Code, Hdr, and Body. That iss, `*d.Hdr = myHdr` is ok, but `d.Hdr.Add("a", "b") is not.
 // If that's confusing, recall `http.Header` is a map, therefore Hdr and Body are both pointers-to-pointers.
+// The Body may still be streaming from the parent. Plugins which need the entire body may call Bytes(), which blocks until it's received; plugins which don't need the body should avoid doing so, so the client receives data as it arrives. To replace the body, set it to a new cacheobj.Chunks; to send no body, set it to nil.
 type BeforeRespondData struct {
 	Req *http.Request
 	// CacheObj is the object to be cached, containing information about the origin request. The code, headers, and body should not be considered authoritative. Look at Code, Hdr, and Body instead, as the actual values about to be sent. Note CacheObj may be nil, if an error occurred (e.g. the Origin failed to respond).
 	CacheObj  *cacheobj.CacheObj
 	Code      *int
 	Hdr       *http.Header
-	Body      *[]byte
+	Body      *cacheobj.Body
 	RemapRule string
 	Context   *interface{}
 }
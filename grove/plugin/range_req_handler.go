@@ -23,6 +23,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/apache/trafficcontrol/grove/cacheobj"
 	"github.com/apache/trafficcontrol/grove/web"
 	"github.com/apache/trafficcontrol/lib/go-log"
 )
@@ -149,6 +150,9 @@ func rangeReqHandleBeforeRespond(icfg interface{}, d BeforeRespondData) {
 	if cfg.Mode == "store_ranges" {
 		return // no need to do anything here.
 	}
+	if *d.Code != http.StatusOK {
+		return // only complete objects can be ranged, e.g. not errors, or responses the remap rule already built from slices.
+	}
 
 	// mode != store_ranges
 	multipartBoundaryString := cfg.MultiPartBoundary
@@ -164,6 +168,14 @@ func rangeReqHandleBeforeRespond(icfg interface{}, d BeforeRespondData) {
 	if err != nil {
 		log.Errorf("Invalid Content-Length header: %v\n", d.Hdr.Get("Content-Length"))
 	}
+	if *d.Body == nil {
+		return
+	}
+	fullBody, err := (*d.Body).Bytes() // ranges need the full object, so this waits for the body to be received.
+	if err != nil {
+		log.Errorf("range_req_handler getting body: %v\n", err)
+		return
+	}
 	body := make([]byte, 0)
 	for _, thisRange := range ctx {
 		if thisRange.End == MAXINT64 || thisRange.End >= totalContentLength { // if the end range is "", or too large serve until the end
@@ -183,14 +195,14 @@ func rangeReqHandleBeforeRespond(icfg interface{}, d BeforeRespondData) {
 		} else {
 			d.Hdr.Add("Content-Range", rangeString+"/"+strconv.FormatInt(totalContentLength, 10))
 		}
-		bSlice := (*d.Body)[thisRange.Start : thisRange.End+1]
+		bSlice := fullBody[thisRange.Start : thisRange.End+1]
 		body = append(body, bSlice...)
 	}
 	if multipart {
 		body = append(body, []byte("\r\n--"+multipartBoundaryString+"--\r\n")...)
 	}
 	d.Hdr.Set("Content-Length", strconv.Itoa(len(body)))
-	*d.Body = body
+	*d.Body = cacheobj.NewChunks(body)
 	*d.Code = http.StatusPartialContent
 	return
 }
@@ -0,0 +1,189 @@
+package purge
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-atscfg"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+// Job is a content invalidation job, as created in Traffic Ops. Objects of the job's delivery service whose URL matches the job's regex, and which were cached before the job's start time, are invalidated until the job's end time. This is the same behavior as the ATS regex_revalidate plugin.
+//
+// Traffic Ops job URLs are for the delivery service's origin, but Grove cache keys use the remap rule's parent, which may be a mid-tier cache rather than the origin. Therefore, jobs are matched against the object's path on the job's origin, and only apply to the remap rules of the job's delivery service.
+type Job struct {
+	ID              uint64         `json:"id"`
+	DeliveryService string         `json:"deliveryService"`
+	Regex           *regexp.Regexp `json:"-"`
+	// Pattern is the regex string, kept for serialization.
+	Pattern string `json:"pattern"`
+	// Origin is the scheme and host of the job's URL, which replaces the scheme and host of cache keys when matching.
+	Origin string    `json:"origin"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	// Refetch is whether matching objects must be fetched anew, rather than revalidated with the parent.
+	Refetch bool `json:"refetch"`
+}
+
+// Jobs is a threadsafe set of invalidation jobs.
+type Jobs struct {
+	jobs []Job
+	m    sync.RWMutex
+}
+
+func NewJobs() *Jobs {
+	return &Jobs{}
+}
+
+// Set replaces all jobs with the given jobs.
+func (j *Jobs) Set(jobs []Job) {
+	j.m.Lock()
+	defer j.m.Unlock()
+	j.jobs = jobs
+}
+
+// Get returns the current jobs. The returned slice must not be modified.
+func (j *Jobs) Get() []Job {
+	j.m.RLock()
+	defer j.m.RUnlock()
+	return j.jobs
+}
+
+// Invalidated returns whether the object with the given cache key of the given remap rule, which was cached at the given time, is invalidated by any job at the given time. If it is, returns how the object may be reused: rfc.ReuseCannot for refetch jobs, or rfc.ReuseMustRevalidate for refresh jobs. If multiple jobs match, refetch takes precedence.
+func (j *Jobs) Invalidated(ruleName string, key string, cachedTime time.Time, now time.Time) (rfc.Reuse, bool) {
+	j.m.RLock()
+	defer j.m.RUnlock()
+	if len(j.jobs) == 0 {
+		return rfc.ReuseCan, false
+	}
+	path := urlPath(KeyURL(key))
+	reuse, invalidated := rfc.ReuseCan, false
+	for _, job := range j.jobs {
+		if now.Before(job.Start) || !now.Before(job.End) || !cachedTime.Before(job.Start) {
+			continue
+		}
+		if !job.AppliesToRule(ruleName) || !job.Regex.MatchString(job.Origin+path) {
+			continue
+		}
+		if job.Refetch {
+			return rfc.ReuseCannot, true
+		}
+		reuse, invalidated = rfc.ReuseMustRevalidate, true
+	}
+	return reuse, invalidated
+}
+
+// AppliesToRule returns whether the job applies to the given remap rule. Rules generated by grovetccfg are named with the delivery service XMLID, followed by a period.
+func (job Job) AppliesToRule(ruleName string) bool {
+	return ruleName == job.DeliveryService || strings.HasPrefix(ruleName, job.DeliveryService+".")
+}
+
+// urlPath returns the path and query of the given absolute URL. If the URL has no path, returns "/".
+func urlPath(url string) string {
+	if i := strings.Index(url, "://"); i != -1 {
+		url = url[i+len("://"):]
+	}
+	if i := strings.Index(url, "/"); i != -1 {
+		return url[i:]
+	}
+	return "/"
+}
+
+// urlOrigin returns the scheme and host of the given absolute URL, i.e. the URL without its path.
+func urlOrigin(url string) string {
+	return strings.TrimSuffix(url, urlPath(url))
+}
+
+// JobsFromTO converts Traffic Ops invalidation jobs into Jobs, in the same way Traffic Ops generates the ATS regex_revalidate.config. Jobs which aren't PURGE jobs, or which have already expired at the given time, are skipped.
+// Returns the jobs, and warnings for any jobs which were malformed and skipped.
+func JobsFromTO(toJobs []tc.InvalidationJob, now time.Time) ([]Job, []string) {
+	jobs := []Job{}
+	warnings := []string{}
+	for _, toJob := range toJobs {
+		if toJob.ID == nil || toJob.AssetURL == nil || toJob.DeliveryService == nil || toJob.Keyword == nil || toJob.StartTime == nil {
+			warnings = append(warnings, fmt.Sprintf("job %+v missing required fields, skipping", toJob))
+			continue
+		}
+		if *toJob.Keyword != atscfg.JobKeywordPurge {
+			continue
+		}
+		ttlHours := toJob.TTLHours()
+		if ttlHours == 0 {
+			warnings = append(warnings, fmt.Sprintf("job %v has malformed parameters, skipping", *toJob.ID))
+			continue
+		}
+		job := Job{ID: *toJob.ID, DeliveryService: *toJob.DeliveryService, Start: toJob.StartTime.Time}
+		job.End = job.Start.Add(time.Duration(ttlHours) * time.Hour)
+		if !now.Before(job.End) {
+			continue
+		}
+
+		job.Pattern = *toJob.AssetURL
+		if strings.HasSuffix(job.Pattern, atscfg.RefetchSuffix) {
+			job.Pattern = strings.TrimSuffix(job.Pattern, atscfg.RefetchSuffix)
+			job.Refetch = true
+		} else {
+			job.Pattern = strings.TrimSuffix(job.Pattern, atscfg.RefreshSuffix)
+		}
+		job.Origin = urlOrigin(job.Pattern)
+		regex, err := regexp.Compile(job.Pattern)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("job %v has malformed asset URL regex, skipping: %v", *toJob.ID, err))
+			continue
+		}
+		job.Regex = regex
+		jobs = append(jobs, job)
+	}
+	return jobs, warnings
+}
+
+// ParseJobs parses the given JSON bytes as a Traffic Ops /jobs response, or as an array of Traffic Ops invalidation jobs, and returns the Jobs, as JobsFromTO.
+func ParseJobs(bts []byte, now time.Time) ([]Job, []string, error) {
+	toJobs := []tc.InvalidationJob{}
+	if strings.HasPrefix(strings.TrimSpace(string(bts)), "[") {
+		if err := json.Unmarshal(bts, &toJobs); err != nil {
+			return nil, nil, errors.New("decoding jobs: " + err.Error())
+		}
+	} else {
+		resp := tc.InvalidationJobsResponse{}
+		if err := json.Unmarshal(bts, &resp); err != nil {
+			return nil, nil, errors.New("decoding jobs response: " + err.Error())
+		}
+		toJobs = resp.Response
+	}
+	jobs, warnings := JobsFromTO(toJobs, now)
+	return jobs, warnings, nil
+}
+
+// LoadJobsFile loads the Traffic Ops jobs in the given file, as ParseJobs. If the file doesn't exist, no jobs and no error are returned.
+func LoadJobsFile(path string, now time.Time) ([]Job, []string, error) {
+	bts, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return []Job{}, nil, nil
+	} else if err != nil {
+		return nil, nil, errors.New("reading jobs file: " + err.Error())
+	}
+	return ParseJobs(bts, now)
+}
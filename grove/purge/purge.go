@@ -0,0 +1,133 @@
+package purge
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/icache"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// Match is how a purge pattern is matched against cached object URLs.
+type Match string
+
+const (
+	// MatchExact purges the object with exactly the given URL, and all its variants.
+	MatchExact = Match("exact")
+	// MatchPrefix purges all objects whose URL begins with the given pattern.
+	MatchPrefix = Match("prefix")
+	// MatchRegex purges all objects whose URL matches the given regular expression.
+	MatchRegex   = Match("regex")
+	MatchInvalid = Match("")
+)
+
+func (m Match) String() string { return string(m) }
+
+// MatchFromStr returns the Match for the given string, or MatchInvalid if it isn't a known Match.
+func MatchFromStr(s string) Match {
+	switch m := Match(strings.ToLower(s)); m {
+	case MatchExact, MatchPrefix, MatchRegex:
+		return m
+	}
+	return MatchInvalid
+}
+
+// KeyURL returns the URL of the given cache key. This is the key without the method, and without any variant, encoding, or slice suffix. Purges and invalidation jobs match against this URL, so they apply to all methods, variants, encodings, and slices of an object.
+//
+// Note the URL is the parent URL the object was requested from, not the client request URL.
+func KeyURL(key string) string {
+	if i := strings.Index(key, ":"); i != -1 && !strings.HasPrefix(key[i:], "://") {
+		key = key[i+1:]
+	}
+	if i := strings.Index(key, cacheobj.DerivedKeySeparator); i != -1 {
+		key = key[:i]
+	}
+	return key
+}
+
+// Purge removes all objects matching the given pattern from the cache. Returns the number of cache keys removed, including variant indexes and variants, or any error parsing the pattern.
+//
+// Prefix and regex purges iterate over every key in the cache. Exact purges only look up the object's keys, and the keys derived from them.
+func Purge(cache icache.Cache, match Match, pattern string) (int, error) {
+	switch match {
+	case MatchExact:
+		return purgeExact(cache, pattern), nil
+	case MatchPrefix:
+		return purgeKeys(cache, func(url string) bool { return strings.HasPrefix(url, pattern) }), nil
+	case MatchRegex:
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return 0, errors.New("parsing regex: " + err.Error())
+		}
+		return purgeKeys(cache, re.MatchString), nil
+	}
+	return 0, errors.New("unknown match type '" + match.String() + "'")
+}
+
+// purgeExact purges the object with the given URL, including its variants, encoded copies, and slices.
+// Encoded copies and slices may be cached without the object itself, and their keys can't be known, so they're found by the cache's DerivedKeys.
+func purgeExact(cache icache.Cache, url string) int {
+	removed := 0
+	for _, key := range exactKeys(url) {
+		if cache.Remove(key) {
+			removed++
+		}
+		for _, derivedKey := range cache.DerivedKeys(key) {
+			if cache.Remove(derivedKey) {
+				removed++
+			}
+		}
+	}
+	log.Debugf("purge exact '%v' removed %v keys\n", url, removed)
+	return removed
+}
+
+// exactKeys returns the cache keys of the object with the given URL, for each cacheable method. HEAD requests use the GET key, as RemapRule.CacheKey.
+func exactKeys(url string) []string {
+	keys := []string{}
+	seen := map[string]struct{}{}
+	for method := range rfc.CacheableRequestMethods {
+		if method == http.MethodHead {
+			method = http.MethodGet
+		}
+		if _, ok := seen[method]; ok {
+			continue
+		}
+		seen[method] = struct{}{}
+		keys = append(keys, method+":"+url)
+	}
+	return keys
+}
+
+// purgeKeys removes every key in the cache whose URL, as returned by KeyURL, matches.
+func purgeKeys(cache icache.Cache, matches func(url string) bool) int {
+	removed := 0
+	for _, key := range cache.Keys() {
+		if !matches(KeyURL(key)) {
+			continue
+		}
+		if cache.Remove(key) {
+			removed++
+		}
+	}
+	return removed
+}
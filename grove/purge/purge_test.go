@@ -0,0 +1,176 @@
+package purge
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/memcache"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+func newTestCache() *memcache.MemCache {
+	c := memcache.New(1024 * 1024)
+	for _, key := range []string{
+		"GET:http://origin.example.net/a.jpg",
+		"GET:http://origin.example.net/a.png",
+		"GET:http://origin.example.net/b/c.jpg",
+		"GET:http://other.example.net/a.jpg",
+		"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=gzip",
+		"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=",
+	} {
+		c.Add(key, cacheobj.New(nil, cacheobj.NewChunks([]byte("body")), 200, 200, "", http.Header{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}))
+	}
+	c.Add("GET:http://origin.example.net/v.txt", cacheobj.NewVariantIndex([]string{"Accept-Encoding"}, []string{
+		"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=gzip",
+		"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=",
+	}))
+	return c
+}
+
+func TestPurge(t *testing.T) {
+	type testCase struct {
+		match     Match
+		pattern   string
+		purged    int
+		remaining []string
+	}
+	testCases := []testCase{
+		{MatchExact, "http://origin.example.net/a.jpg", 1, []string{
+			"GET:http://origin.example.net/a.png",
+			"GET:http://origin.example.net/b/c.jpg",
+			"GET:http://other.example.net/a.jpg",
+			"GET:http://origin.example.net/v.txt",
+			"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=",
+			"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=gzip",
+		}},
+		{MatchExact, "http://origin.example.net/v.txt", 3, []string{
+			"GET:http://origin.example.net/a.jpg",
+			"GET:http://origin.example.net/a.png",
+			"GET:http://origin.example.net/b/c.jpg",
+			"GET:http://other.example.net/a.jpg",
+		}},
+		{MatchPrefix, "http://origin.example.net/", 6, []string{
+			"GET:http://other.example.net/a.jpg",
+		}},
+		{MatchRegex, `\.jpg$`, 3, []string{
+			"GET:http://origin.example.net/a.png",
+			"GET:http://origin.example.net/v.txt",
+			"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=",
+			"GET:http://origin.example.net/v.txt#vary:Accept-Encoding=gzip",
+		}},
+	}
+	for _, tc := range testCases {
+		c := newTestCache()
+		oldSize := c.Size()
+		purged, err := Purge(c, tc.match, tc.pattern)
+		if err != nil {
+			t.Fatalf("Purge %v '%v' unexpected error: %v", tc.match, tc.pattern, err)
+		}
+		if purged != tc.purged {
+			t.Errorf("Purge %v '%v' expected %v purged, actual %v", tc.match, tc.pattern, tc.purged, purged)
+		}
+		if c.Size() >= oldSize {
+			t.Errorf("Purge %v '%v' expected cache size to decrease from %v, actual %v", tc.match, tc.pattern, oldSize, c.Size())
+		}
+		remaining := c.Keys()
+		sort.Strings(remaining)
+		sort.Strings(tc.remaining)
+		if len(remaining) != len(tc.remaining) {
+			t.Errorf("Purge %v '%v' expected remaining keys %v, actual %v", tc.match, tc.pattern, tc.remaining, remaining)
+			continue
+		}
+		for i := range remaining {
+			if remaining[i] != tc.remaining[i] {
+				t.Errorf("Purge %v '%v' expected remaining keys %v, actual %v", tc.match, tc.pattern, tc.remaining, remaining)
+				break
+			}
+		}
+	}
+
+	if _, err := Purge(newTestCache(), MatchRegex, "("); err == nil {
+		t.Errorf("Purge with invalid regex expected error, actual nil")
+	}
+}
+
+func TestPurgeExactDerived(t *testing.T) {
+	c := newTestCache()
+	for _, key := range []string{
+		"GET:http://origin.example.net/a.jpg#encoding:gzip",
+		"GET:http://origin.example.net/a.jpg#slice:1048576:0",
+		"GET:http://origin.example.net/a.jpg#slice:1048576:1",
+		"GET:http://origin.example.net/a.jpgx#slice:1048576:0",
+	} {
+		c.Add(key, cacheobj.New(nil, cacheobj.NewChunks([]byte("body")), 200, 200, "", http.Header{}, time.Time{}, time.Time{}, time.Time{}, time.Time{}))
+	}
+	purged, err := Purge(c, MatchExact, "http://origin.example.net/a.jpg")
+	if err != nil {
+		t.Fatalf("Purge exact unexpected error: %v", err)
+	}
+	if purged != 4 {
+		t.Errorf("Purge exact expected the object, its encoded copy, and its 2 slices purged, actual %v purged", purged)
+	}
+	if _, ok := c.Peek("GET:http://origin.example.net/a.jpgx#slice:1048576:0"); !ok {
+		t.Errorf("Purge exact expected slices of other objects to remain, actual purged")
+	}
+}
+
+func TestJobsFromTO(t *testing.T) {
+	now := time.Now()
+	str := func(s string) *string { return &s }
+	id := func(i uint64) *uint64 { return &i }
+	start := tc.Time{Time: now.Add(-time.Hour), Valid: true}
+	toJobs := []tc.InvalidationJob{
+		{ID: id(1), DeliveryService: str("ds1"), Keyword: str("PURGE"), Parameters: str("TTL:24h"), StartTime: &start, AssetURL: str(`http://origin.example.net/a/.*\.jpg`)},
+		{ID: id(2), DeliveryService: str("ds1"), Keyword: str("PURGE"), Parameters: str("TTL:24h"), StartTime: &start, AssetURL: str(`http://origin.example.net/b/.*##REFETCH##`)},
+		{ID: id(3), DeliveryService: str("ds1"), Keyword: str("PURGE"), Parameters: str("TTL:1h"), StartTime: &tc.Time{Time: now.Add(-2 * time.Hour), Valid: true}, AssetURL: str(`http://origin.example.net/expired`)},
+		{ID: id(4), DeliveryService: str("ds1"), Keyword: str("PURGE"), Parameters: str("bad"), StartTime: &start, AssetURL: str(`http://origin.example.net/malformed`)},
+	}
+	jobs, warnings := JobsFromTO(toJobs, now)
+	if len(jobs) != 2 {
+		t.Fatalf("JobsFromTO expected 2 jobs, actual %v: %+v", len(jobs), jobs)
+	}
+	if len(warnings) != 1 {
+		t.Errorf("JobsFromTO expected 1 warning, actual %v: %v", len(warnings), warnings)
+	}
+
+	j := NewJobs()
+	j.Set(jobs)
+	before := now.Add(-2 * time.Hour)
+	after := now.Add(-time.Minute)
+
+	// the parent in the cache key is a mid, not the origin; the job should still match the path
+	if reuse, ok := j.Invalidated("ds1.http.http.0", "GET:http://mid.example.net/a/x.jpg", before, now); !ok || reuse != rfc.ReuseMustRevalidate {
+		t.Errorf("Jobs.Invalidated refresh job expected ReuseMustRevalidate, actual %v %v", reuse, ok)
+	}
+	if reuse, ok := j.Invalidated("ds1.http.http.0", "GET:http://mid.example.net/b/y.txt#vary:Accept-Encoding=gzip", before, now); !ok || reuse != rfc.ReuseCannot {
+		t.Errorf("Jobs.Invalidated refetch job expected ReuseCannot, actual %v %v", reuse, ok)
+	}
+	if _, ok := j.Invalidated("ds1.http.http.0", "GET:http://mid.example.net/a/x.jpg", after, now); ok {
+		t.Errorf("Jobs.Invalidated object cached after job start expected not invalidated, actual invalidated")
+	}
+	if _, ok := j.Invalidated("ds2.http.http.0", "GET:http://mid.example.net/a/x.jpg", before, now); ok {
+		t.Errorf("Jobs.Invalidated object of another delivery service expected not invalidated, actual invalidated")
+	}
+	if _, ok := j.Invalidated("ds1.http.http.0", "GET:http://mid.example.net/a/x.png", before, now); ok {
+		t.Errorf("Jobs.Invalidated object not matching regex expected not invalidated, actual invalidated")
+	}
+}
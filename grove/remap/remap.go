@@ -26,6 +26,8 @@ import (
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/chash"
+	"github.com/apache/trafficcontrol/grove/compress"
+	"github.com/apache/trafficcontrol/grove/health"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/plugin"
 	"github.com/apache/trafficcontrol/grove/remapdata"
@@ -108,15 +110,24 @@ type Remapping struct {
 	RetryCodes      map[int]struct{}
 	Cache           icache.Cache
 	Transport       *http.Transport
+	MaxVariants     int
+	// FullCacheKey is the cache key of 200 responses with the entire object, if it differs from CacheKey, as for range slices. If empty, every response is cached under CacheKey.
+	FullCacheKey string
+	// CollapseTimeout is how long to wait for a concurrent parent request for the same cache key. If 0, wait indefinitely.
+	CollapseTimeout     time.Duration
+	CollapseFallthrough remapdata.CollapseFallthrough
+	// Health is the health of the parent the Request is to, which must be told whether the request succeeds.
+	Health *health.Parent
 }
 
 // RemappingProducer takes an HTTP Request and returns a Remapping to be used for that request.
 // TODO rename? interface?
 type RemappingProducer struct {
-	oldURI   string
-	rule     remapdata.RemapRule
-	cacheKey string
-	failures int
+	oldURI       string
+	rule         remapdata.RemapRule
+	cacheKey     string
+	fullCacheKey string
+	failures     int
 }
 
 func (p *RemappingProducer) CacheKey() string                  { return p.cacheKey }
@@ -126,6 +137,39 @@ func (p *RemappingProducer) Name() string                      { return p.rule.N
 func (p *RemappingProducer) DSCP() int                         { return p.rule.DSCP }
 func (p *RemappingProducer) PluginCfg() map[string]interface{} { return p.rule.Plugins }
 func (p *RemappingProducer) Cache() icache.Cache               { return p.rule.Cache }
+
+// OverrideSliceCacheKey sets the cache key of a request for a range slice of the object. Responses with the entire object, from parents which ignore the range, are still cached under the object's cache key, so the object is only cached once, rather than once per slice.
+func (p *RemappingProducer) OverrideSliceCacheKey(sliceKey string) {
+	p.fullCacheKey = p.cacheKey
+	p.cacheKey = sliceKey
+}
+
+// StaleWhileRevalidate returns the rule's stale-while-revalidate, for responses without the directive, and whether the rule has one.
+func (p *RemappingProducer) StaleWhileRevalidate() (time.Duration, bool) {
+	if p.rule.StaleWhileRevalidate == nil {
+		return 0, false
+	}
+	return time.Duration(*p.rule.StaleWhileRevalidate) * time.Second, true
+}
+
+// RangeSliceBytes returns the size of the slices the rule fetches and caches Range requests in, or 0 if it doesn't slice.
+func (p *RemappingProducer) RangeSliceBytes() int64 {
+	return p.rule.RangeSliceBytes
+}
+
+// Compress returns the rule's compression config, or nil if it doesn't compress.
+func (p *RemappingProducer) Compress() *remapdata.Compress {
+	return p.rule.Compress
+}
+
+// StaleIfError returns the rule's stale-if-error, for responses without the directive, and whether the rule has one.
+func (p *RemappingProducer) StaleIfError() (time.Duration, bool) {
+	if p.rule.StaleIfError == nil {
+		return 0, false
+	}
+	return time.Duration(*p.rule.StaleIfError) * time.Second, true
+}
+
 func (p *RemappingProducer) FirstFQDN() string {
 	// TODO verify To is not allowed to be constructed with < 1 element
 	return strings.TrimPrefix(strings.TrimPrefix(p.rule.To[0].URL, "http://"), "https://")
@@ -175,7 +219,7 @@ func (p *RemappingProducer) GetNext(r *http.Request) (Remapping, bool, error) {
 		return Remapping{}, false, ErrNoMoreRetries
 	}
 
-	newURI, proxyURL, transport := p.rule.URI(p.oldURI, r.URL.Path, r.URL.RawQuery, p.failures)
+	newURI, proxyURL, transport, parentHealth := p.rule.URI(p.oldURI, r.URL.Path, r.URL.RawQuery, p.failures)
 	p.failures++
 	newReq, err := http.NewRequest(r.Method, newURI, nil)
 	if err != nil {
@@ -191,16 +235,21 @@ func (p *RemappingProducer) GetNext(r *http.Request) (Remapping, bool, error) {
 
 	retryAllowed := *p.rule.RetryNum < p.failures
 	return Remapping{
-		Request:         newReq,
-		ProxyURL:        proxyURL,
-		Name:            p.rule.Name,
-		CacheKey:        p.cacheKey,
-		ConnectionClose: p.rule.ConnectionClose,
-		Timeout:         *p.rule.Timeout,
-		RetryNum:        *p.rule.RetryNum,
-		RetryCodes:      p.rule.RetryCodes,
-		Cache:           p.rule.Cache,
-		Transport:       transport,
+		Request:             newReq,
+		ProxyURL:            proxyURL,
+		Name:                p.rule.Name,
+		CacheKey:            p.cacheKey,
+		FullCacheKey:        p.fullCacheKey,
+		ConnectionClose:     p.rule.ConnectionClose,
+		Timeout:             *p.rule.Timeout,
+		RetryNum:            *p.rule.RetryNum,
+		RetryCodes:          p.rule.RetryCodes,
+		Cache:               p.rule.Cache,
+		Transport:           transport,
+		MaxVariants:         p.rule.MaxVariants,
+		CollapseTimeout:     p.rule.CollapseTimeout(),
+		CollapseFallthrough: *p.rule.CollapseFallthrough,
+		Health:              parentHealth,
 	}, retryAllowed, nil
 }
 
@@ -253,7 +302,7 @@ func (r literalPrefixRemapper) Remap(s string) (remapdata.RemapRule, bool) {
 }
 
 func (r literalPrefixRemapper) Rules() []remapdata.RemapRule {
-	rules := make([]remapdata.RemapRule, len(r.remap))
+	rules := make([]remapdata.RemapRule, 0, len(r.remap))
 	for _, rule := range r.remap {
 		rules = append(rules, rule)
 	}
@@ -270,8 +319,14 @@ type RemapRulesStatsJSON struct {
 }
 
 type RemapRulesBase struct {
-	RetryNum      *int                       `json:"retry_num"`
-	PluginsShared map[string]json.RawMessage `json:"plugins_shared"`
+	RetryNum             *int                           `json:"retry_num"`
+	PluginsShared        map[string]json.RawMessage     `json:"plugins_shared"`
+	StaleWhileRevalidate *int                           `json:"stale_while_revalidate"`
+	StaleIfError         *int                           `json:"stale_if_error"`
+	CollapseTimeoutMS    *int                           `json:"collapse_timeout_ms"`
+	CollapseFallthrough  *remapdata.CollapseFallthrough `json:"collapse_fallthrough"`
+	Compress             *remapdata.Compress            `json:"compress"`
+	RangeSliceBytes      *int64                         `json:"range_slice_bytes"`
 }
 
 type RemapRulesJSON struct {
@@ -282,6 +337,8 @@ type RemapRulesJSON struct {
 	ParentSelection *string                    `json:"parent_selection"`
 	Stats           RemapRulesStatsJSON        `json:"stats"`
 	Plugins         map[string]json.RawMessage `json:"plugins"`
+	// ParentHealth is the parent health config. It's global, because parents may be shared by multiple rules. Fields not specified are taken from health.DefaultConfig.
+	ParentHealth *health.Config `json:"parent_health,omitempty"`
 }
 
 type RemapRules struct {
@@ -319,7 +376,8 @@ type RemapRuleJSON struct {
 }
 
 // LoadRemapRules returns the loaded rules, the global plugins, the Stats remap rules, and any error
-func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc, caches map[string]icache.Cache, baseTransport *http.Transport) ([]remapdata.RemapRule, map[string]interface{}, *remapdata.RemapRulesStats, error) {
+// The parentHealth tracks the health of the rules' parents, and is configured with the rules' parent health config. It may be nil, in which case parents are never marked down.
+func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc, caches map[string]icache.Cache, baseTransport *http.Transport, parentHealth *health.Checker) ([]remapdata.RemapRule, map[string]interface{}, *remapdata.RemapRulesStats, error) {
 	fmt.Println(time.Now().Format(time.RFC3339Nano) + " Loading Remap Rules")
 	defer func() {
 		fmt.Println(time.Now().Format(time.RFC3339Nano) + " Loaded Remap Rules")
@@ -330,7 +388,8 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 	}
 	defer file.Close()
 
-	remapRulesJSON := RemapRulesJSON{}
+	defaultHealthCfg := health.DefaultConfig
+	remapRulesJSON := RemapRulesJSON{ParentHealth: &defaultHealthCfg} // decoding into the existing pointer keeps defaults for fields not in the file
 	if err := json.NewDecoder(file).Decode(&remapRulesJSON); err != nil {
 		return nil, nil, nil, fmt.Errorf("decoding JSON: %s", err)
 	}
@@ -349,7 +408,7 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 	if remapRulesJSON.TimeoutMS != nil {
 		t := time.Duration(*remapRulesJSON.TimeoutMS) * time.Millisecond
 		if remapRules.Timeout = &t; *remapRules.Timeout < 0 {
-			return nil, nil, nil, fmt.Errorf("error parsing rules: timeout must be positive: %v", remapRules.Timeout)
+			return nil, nil, nil, fmt.Errorf("error parsing rules: timeout must not be negative: %v", *remapRules.Timeout)
 		}
 	}
 	if remapRulesJSON.ParentSelection != nil {
@@ -408,7 +467,7 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 		if jsonRule.TimeoutMS != nil {
 			t := time.Duration(*jsonRule.TimeoutMS) * time.Millisecond
 			if rule.Timeout = &t; *rule.Timeout < 0 {
-				return nil, nil, nil, fmt.Errorf("error parsing rule %v timeout must be positive: %v", rule.Name, rule.Timeout)
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v timeout must not be negative: %v", rule.Name, *rule.Timeout)
 			}
 		} else {
 			rule.Timeout = remapRules.Timeout
@@ -422,6 +481,60 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 			rule.PluginsShared = remapRules.PluginsShared
 		}
 
+		if rule.StaleWhileRevalidate == nil {
+			rule.StaleWhileRevalidate = remapRules.StaleWhileRevalidate
+		}
+
+		if rule.StaleIfError == nil {
+			rule.StaleIfError = remapRules.StaleIfError
+		}
+
+		if rule.CollapseTimeoutMS == nil {
+			rule.CollapseTimeoutMS = remapRules.CollapseTimeoutMS
+		}
+		if rule.CollapseTimeoutMS != nil && *rule.CollapseTimeoutMS < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v collapse timeout must not be negative: %v", rule.Name, *rule.CollapseTimeoutMS)
+		}
+
+		if rule.CollapseFallthrough == nil {
+			rule.CollapseFallthrough = remapRules.CollapseFallthrough
+		}
+		collapseFallthrough := remapdata.CollapseFallthroughParent
+		if rule.CollapseFallthrough != nil {
+			if collapseFallthrough = remapdata.CollapseFallthroughFromString(rule.CollapseFallthrough.String()); collapseFallthrough == remapdata.CollapseFallthroughInvalid {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v collapse fallthrough invalid: '%v'", rule.Name, *rule.CollapseFallthrough)
+			}
+		}
+		rule.CollapseFallthrough = &collapseFallthrough
+
+		if rule.MaxVariants <= 0 {
+			rule.MaxVariants = remapdata.DefaultMaxVariants
+		}
+
+		if rule.RangeSliceBytes == 0 && remapRules.RangeSliceBytes != nil {
+			rule.RangeSliceBytes = *remapRules.RangeSliceBytes
+		}
+		if rule.RangeSliceBytes < 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v range_slice_bytes: must not be negative", rule.Name)
+		}
+
+		if rule.Compress == nil && remapRules.Compress != nil {
+			ruleCompress := *remapRules.Compress // copy, because ParsedMimeTypes is set per rule
+			rule.Compress = &ruleCompress
+		}
+		if rule.Compress != nil {
+			if err := parseCompress(rule.Compress); err != nil {
+				return nil, nil, nil, fmt.Errorf("error parsing rule %v compress: %v", rule.Name, err)
+			}
+		}
+
+		if _, _, err := web.ParseTLSVersions(rule.TLSVersions); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v tls_versions: %v", rule.Name, err)
+		}
+		if _, err := web.ParseCipherSuites(rule.TLSCipherSuites); err != nil {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v tls_cipher_suites: %v", rule.Name, err)
+		}
+
 		cacheName := "" // default string is the default cache
 		if jsonRule.CacheName != nil {
 			cacheName = *jsonRule.CacheName
@@ -437,7 +550,7 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 		if rule.Deny, err = makeIPNets(jsonRule.Deny); err != nil {
 			return nil, nil, nil, fmt.Errorf("error parsing rule %v denys: %v", rule.Name, err)
 		}
-		if rule.To, err = makeTo(jsonRule.To, rule, baseTransport); err != nil {
+		if rule.To, err = makeTo(jsonRule.To, rule, baseTransport, parentHealth); err != nil {
 			return nil, nil, nil, fmt.Errorf("error parsing rule %v to: %v", rule.Name, err)
 		}
 		if jsonRule.ParentSelection != nil {
@@ -453,35 +566,70 @@ func LoadRemapRules(path string, pluginConfigLoaders map[string]plugin.LoadFunc,
 			return nil, nil, nil, fmt.Errorf("error parsing rule %v - no parent_selection - must be set at rules or rule level", rule.Name)
 		}
 
-		if len(rule.To) == 0 {
-			return nil, nil, nil, fmt.Errorf("error parsing rule %v - no to - must have at least one parent", rule.Name)
+		primaries, secondaries := splitSecondaryTo(rule.To)
+		if len(primaries) == 0 {
+			return nil, nil, nil, fmt.Errorf("error parsing rule %v - no to - must have at least one primary parent", rule.Name)
 		}
 
-		if *rule.ParentSelection == remapdata.ParentSelectionTypeConsistentHash {
-			rule.ConsistentHash = makeRuleHash(rule)
-		} else {
+		switch *rule.ParentSelection {
+		case remapdata.ParentSelectionTypeConsistentHash:
+			rule.ConsistentHash = makeRuleHash(rule.Name, primaries)
+			if len(secondaries) > 0 {
+				rule.SecondaryConsistentHash = makeRuleHash(rule.Name, secondaries)
+			}
+		case remapdata.ParentSelectionTypeRoundRobin:
+			rule.RoundRobinCounter = new(uint64)
 		}
 		rules[i] = rule
 	}
 
+	healthCfg := health.DefaultConfig
+	if remapRulesJSON.ParentHealth != nil {
+		healthCfg = *remapRulesJSON.ParentHealth
+	}
+	if healthCfg.MarkdownMS < 0 || healthCfg.ProbeIntervalMS < 0 || healthCfg.ProbeTimeoutMS < 0 {
+		return nil, nil, nil, fmt.Errorf("error parsing rules: parent health times must not be negative: %+v", healthCfg)
+	}
+	parents := map[*health.Parent]struct{}{}
+	for _, rule := range rules {
+		for _, to := range rule.To {
+			parents[to.Health] = struct{}{}
+		}
+	}
+	parentHealth.Configure(healthCfg, parents)
+
 	return rules, remapRules.Plugins, &remapRules.Stats, nil
 }
 
 const DefaultReplicas = 1024
 
-func makeRuleHash(rule remapdata.RemapRule) chash.ATSConsistentHash {
+func makeRuleHash(ruleName string, tos []remapdata.RemapRuleTo) chash.ATSConsistentHash {
 	h := chash.NewSimpleATSConsistentHash(DefaultReplicas)
-	for _, to := range rule.To {
-		h.Insert(&chash.ATSConsistentHashNode{Name: to.URL, ProxyURL: to.ProxyURL, Transport: to.Transport}, *to.Weight)
+	for _, to := range tos {
+		h.Insert(&chash.ATSConsistentHashNode{Name: to.URL, ProxyURL: to.ProxyURL, Transport: to.Transport, Health: to.Health}, *to.Weight)
 	}
 	if h.First() == nil {
-		fmt.Println(time.Now().Format(time.RFC3339Nano) + " ERROR  makeRuleHash " + rule.Name + " NodeMap empty!")
+		fmt.Println(time.Now().Format(time.RFC3339Nano) + " ERROR  makeRuleHash " + ruleName + " NodeMap empty!")
 	}
 
 	return h
 }
 
-func makeTo(tosJSON []RemapRuleToJSON, rule remapdata.RemapRule, baseTransport *http.Transport) ([]remapdata.RemapRuleTo, error) {
+// splitSecondaryTo returns the given tos which are primary parents, and those which are secondary parents.
+func splitSecondaryTo(tos []remapdata.RemapRuleTo) ([]remapdata.RemapRuleTo, []remapdata.RemapRuleTo) {
+	primaries := []remapdata.RemapRuleTo{}
+	secondaries := []remapdata.RemapRuleTo{}
+	for _, to := range tos {
+		if to.Secondary {
+			secondaries = append(secondaries, to)
+		} else {
+			primaries = append(primaries, to)
+		}
+	}
+	return primaries, secondaries
+}
+
+func makeTo(tosJSON []RemapRuleToJSON, rule remapdata.RemapRule, baseTransport *http.Transport, parentHealth *health.Checker) ([]remapdata.RemapRuleTo, error) {
 	tos := make([]remapdata.RemapRuleTo, len(tosJSON))
 	for i, toJSON := range tosJSON {
 		if toJSON.Weight == nil {
@@ -507,7 +655,7 @@ func makeTo(tosJSON []RemapRuleToJSON, rule remapdata.RemapRule, baseTransport *
 		if toJSON.TimeoutMS != nil {
 			t := time.Duration(*toJSON.TimeoutMS) * time.Millisecond
 			if to.Timeout = &t; *to.Timeout < 0 {
-				return nil, fmt.Errorf("error parsing to %v timeout must be positive: %v", to.URL, to.Timeout)
+				return nil, fmt.Errorf("error parsing to %v timeout must not be negative: %v", to.URL, *to.Timeout)
 			}
 		} else {
 			to.Timeout = rule.Timeout
@@ -533,11 +681,39 @@ func makeTo(tosJSON []RemapRuleToJSON, rule remapdata.RemapRule, baseTransport *
 		} else if to.RetryCodes == nil {
 			return nil, fmt.Errorf("error parsing to %v - no retry_codes - must be set at rules, rule, or to level", to.URL)
 		}
+		proxyURLStr := ""
+		if to.ProxyURL != nil && to.ProxyURL.Host != "" {
+			proxyURLStr = to.ProxyURL.String()
+		}
+		to.Health = parentHealth.Parent(to.URL, proxyURLStr, to.Transport)
 		tos[i] = to
 	}
 	return tos, nil
 }
 
+// parseCompress validates the given compression config, and sets its ParsedMimeTypes.
+func parseCompress(c *remapdata.Compress) error {
+	for i, encoding := range c.Encodings {
+		if err := compress.Supported(encoding); err != nil {
+			return err
+		}
+		c.Encodings[i] = strings.ToLower(encoding)
+	}
+	mimeTypes := c.MimeTypes
+	if len(mimeTypes) == 0 {
+		mimeTypes = remapdata.DefaultCompressMimeTypes
+	}
+	c.ParsedMimeTypes = make([]rfc.MimeType, 0, len(mimeTypes))
+	for _, mimeTypeStr := range mimeTypes {
+		mimeType, err := rfc.NewMimeType(mimeTypeStr)
+		if err != nil {
+			return errors.New("parsing mime type '" + mimeTypeStr + "': " + err.Error())
+		}
+		c.ParsedMimeTypes = append(c.ParsedMimeTypes, mimeType)
+	}
+	return nil
+}
+
 func makeIPNets(netStrs []string) ([]*net.IPNet, error) {
 	nets := make([]*net.IPNet, 0, len(netStrs))
 	for _, netStr := range netStrs {
@@ -562,8 +738,8 @@ func makeIPNet(cidr string) (*net.IPNet, error) {
 	return cidrnet, nil
 }
 
-func LoadRemapper(path string, pluginConfigLoaders map[string]plugin.LoadFunc, caches map[string]icache.Cache, baseTransport *http.Transport) (HTTPRequestRemapper, error) {
-	rules, plugins, statRules, err := LoadRemapRules(path, pluginConfigLoaders, caches, baseTransport)
+func LoadRemapper(path string, pluginConfigLoaders map[string]plugin.LoadFunc, caches map[string]icache.Cache, baseTransport *http.Transport, parentHealth *health.Checker) (HTTPRequestRemapper, error) {
+	rules, plugins, statRules, err := LoadRemapRules(path, pluginConfigLoaders, caches, baseTransport, parentHealth)
 	if err != nil {
 		return nil, err
 	}
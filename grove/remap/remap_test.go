@@ -0,0 +1,141 @@
+package remap
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/health"
+	"github.com/apache/trafficcontrol/grove/icache"
+	"github.com/apache/trafficcontrol/grove/memcache"
+	"github.com/apache/trafficcontrol/grove/remapdata"
+	"github.com/apache/trafficcontrol/grove/stat"
+)
+
+func TestSecondaryParents(t *testing.T) {
+	for _, parentSelection := range []string{"consistent-hash", "round-robin", "ordered"} {
+		t.Run(parentSelection, func(t *testing.T) {
+			rulesJSON := `{"parent_selection": "` + parentSelection + `", "retry_num": 2, "retry_codes": [], "timeout_ms": 5000, "parent_health": {"max_failures": 1, "markdown_ms": 60000}, "rules": [{"name": "test", "from": "http://grove.test", "to": [
+				{"url": "http://primary0.test", "weight": 1},
+				{"url": "http://secondary.test", "weight": 1, "secondary": true},
+				{"url": "http://primary1.test", "weight": 1}
+			]}]}`
+			checker := health.NewChecker()
+			rules := loadTestRules(t, rulesJSON, checker)
+			rule := rules[0]
+
+			for i := 0; i < 10; i++ {
+				if uri, _, _, _ := rule.URI("http://grove.test/obj", "/obj", "", 0); !strings.HasPrefix(uri, "http://primary") {
+					t.Errorf("URI with primaries up expected a primary parent, actual '%v'", uri)
+				}
+			}
+			if uri, _, _, _ := rule.URI("http://grove.test/obj", "/obj", "", 2); uri != "http://secondary.test/obj" {
+				t.Errorf("URI after every primary failed expected secondary parent, actual '%v'", uri)
+			}
+
+			for _, to := range rule.To {
+				if !to.Secondary {
+					to.Health.Failed("test")
+				}
+			}
+			if uri, _, _, _ := rule.URI("http://grove.test/obj", "/obj", "", 0); uri != "http://secondary.test/obj" {
+				t.Errorf("URI with every primary marked down expected secondary parent, actual '%v'", uri)
+			}
+		})
+	}
+}
+
+func TestOrderedParentSelection(t *testing.T) {
+	rulesJSON := `{"parent_selection": "ordered", "retry_num": 2, "retry_codes": [], "timeout_ms": 5000, "parent_health": {"max_failures": 1, "markdown_ms": 60000}, "rules": [{"name": "test", "from": "http://grove.test", "to": [
+		{"url": "http://parent0.test", "weight": 1},
+		{"url": "http://parent1.test", "weight": 1}
+	]}]}`
+	rule := loadTestRules(t, rulesJSON, health.NewChecker())[0]
+
+	for failures, expected := range []string{"http://parent0.test/obj", "http://parent1.test/obj"} {
+		for i := 0; i < 3; i++ {
+			if uri, _, _, _ := rule.URI("http://grove.test/obj", "/obj", "", failures); uri != expected {
+				t.Errorf("URI after %v failures expected '%v', actual '%v'", failures, expected, uri)
+			}
+		}
+	}
+
+	rule.To[0].Health.Failed("test")
+	if uri, _, _, _ := rule.URI("http://grove.test/obj", "/obj", "", 0); uri != "http://parent1.test/obj" {
+		t.Errorf("URI with the first parent marked down expected 'http://parent1.test/obj', actual '%v'", uri)
+	}
+}
+
+func TestProxyParentsHealth(t *testing.T) {
+	rulesJSON := `{"parent_selection": "ordered", "retry_num": 2, "retry_codes": [], "timeout_ms": 5000, "parent_health": {"max_failures": 1, "markdown_ms": 60000}, "rules": [{"name": "test", "from": "http://grove.test", "to": [
+		{"url": "http://origin.test", "proxy_url": "http://mid0.test:80", "weight": 1},
+		{"url": "http://origin.test", "proxy_url": "http://mid1.test:80", "weight": 1}
+	]}]}`
+	checker := health.NewChecker()
+	rules := loadTestRules(t, rulesJSON, checker)
+	rule := rules[0]
+	if rule.To[0].Health == rule.To[1].Health {
+		t.Fatalf("LoadRemapRules with proxy parents of the same URL expected distinct parent health, actual shared")
+	}
+
+	rule.To[0].Health.Failed("test")
+	if _, proxyURL, _, _ := rule.URI("http://grove.test/obj", "/obj", "", 0); proxyURL == nil || proxyURL.Host != "mid1.test:80" {
+		t.Errorf("URI with the first proxy parent marked down expected proxy mid1.test:80, actual %v", proxyURL)
+	}
+	if !rule.To[1].Health.Available(time.Now()) {
+		t.Errorf("proxy parent with the same URL as a failed parent expected available, actual marked down")
+	}
+
+	if statuses := stat.New(rules, nil, 0, nil, nil, "").ParentHealth(); len(statuses) != 2 {
+		t.Errorf("Stats.ParentHealth with 2 proxy parents of the same URL expected 2, actual %+v", statuses)
+	} else if statuses[0].Available || !statuses[1].Available {
+		t.Errorf("Stats.ParentHealth expected only the failed proxy parent unavailable, actual %+v", statuses)
+	}
+}
+
+func TestSecondaryParentsOnly(t *testing.T) {
+	rulesJSON := `{"parent_selection": "ordered", "retry_num": 2, "retry_codes": [], "timeout_ms": 5000, "rules": [{"name": "test", "from": "http://grove.test", "to": [
+		{"url": "http://secondary.test", "weight": 1, "secondary": true}
+	]}]}`
+	path := writeTestRules(t, rulesJSON)
+	if _, _, _, err := LoadRemapRules(path, nil, map[string]icache.Cache{"": memcache.New(1024)}, NewRemappingTransport(time.Second, time.Second, 10, time.Second), health.NewChecker()); err == nil {
+		t.Errorf("LoadRemapRules with only secondary parents expected error, actual nil")
+	}
+}
+
+// loadTestRules returns the rules loaded from the given remap rules JSON, with the given parent health.
+func loadTestRules(t *testing.T, rulesJSON string, checker *health.Checker) []remapdata.RemapRule {
+	t.Helper()
+	path := writeTestRules(t, rulesJSON)
+	rules, _, _, err := LoadRemapRules(path, nil, map[string]icache.Cache{"": memcache.New(1024)}, NewRemappingTransport(time.Second, time.Second, 10, time.Second), checker)
+	if err != nil {
+		t.Fatalf("loading remap rules: %v", err)
+	}
+	return rules
+}
+
+// writeTestRules writes the given remap rules JSON to a temp file, and returns its path.
+func writeTestRules(t *testing.T, rulesJSON string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "remap.json")
+	if err := ioutil.WriteFile(path, []byte(rulesJSON), 0644); err != nil {
+		t.Fatalf("writing remap rules: %v", err)
+	}
+	return path
+}
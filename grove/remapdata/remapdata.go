@@ -22,12 +22,15 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/chash"
+	"github.com/apache/trafficcontrol/grove/health"
 	"github.com/apache/trafficcontrol/grove/icache"
 
 	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-rfc"
 )
 
 // ParentSelectionType is the algorithm to use for selecting parents.
@@ -36,7 +39,9 @@ type ParentSelectionType string
 const (
 	ParentSelectionTypeConsistentHash = ParentSelectionType("consistent-hash")
 	ParentSelectionTypeRoundRobin     = ParentSelectionType("round-robin")
-	ParentSelectionTypeInvalid        = ParentSelectionType("")
+	// ParentSelectionTypeOrdered uses the parents in the order they're given, only using later parents when earlier ones are marked down or fail, like ATS parent.config round_robin=false.
+	ParentSelectionTypeOrdered = ParentSelectionType("ordered")
+	ParentSelectionTypeInvalid = ParentSelectionType("")
 )
 
 func (t ParentSelectionType) String() string {
@@ -45,6 +50,8 @@ func (t ParentSelectionType) String() string {
 		return "consistent-hash"
 	case ParentSelectionTypeRoundRobin:
 		return "round-robin"
+	case ParentSelectionTypeOrdered:
+		return "ordered"
 	default:
 		return "invalid"
 	}
@@ -58,9 +65,34 @@ func ParentSelectionTypeFromString(s string) ParentSelectionType {
 	if s == "round-robin" {
 		return ParentSelectionTypeRoundRobin
 	}
+	if s == "ordered" {
+		return ParentSelectionTypeOrdered
+	}
 	return ParentSelectionTypeInvalid
 }
 
+// CollapseFallthrough is what a request does when it times out waiting for a concurrent parent request for the same cache key.
+type CollapseFallthrough string
+
+const (
+	// CollapseFallthroughParent makes the request's own parent request.
+	CollapseFallthroughParent = CollapseFallthrough("parent")
+	// CollapseFallthroughError responds with a 504 Gateway Timeout.
+	CollapseFallthroughError   = CollapseFallthrough("error")
+	CollapseFallthroughInvalid = CollapseFallthrough("")
+)
+
+func (f CollapseFallthrough) String() string { return string(f) }
+
+// CollapseFallthroughFromString returns the CollapseFallthrough for the given string, or CollapseFallthroughInvalid if it isn't a known CollapseFallthrough.
+func CollapseFallthroughFromString(s string) CollapseFallthrough {
+	switch f := CollapseFallthrough(strings.ToLower(s)); f {
+	case CollapseFallthroughParent, CollapseFallthroughError:
+		return f
+	}
+	return CollapseFallthroughInvalid
+}
+
 type RemapRulesStats struct {
 	Allow []*net.IPNet
 	Deny  []*net.IPNet
@@ -98,8 +130,50 @@ type RemapRuleBase struct {
 	RetryNum               *int                       `json:"retry_num"`
 	DSCP                   int                        `json:"dscp"`
 	PluginsShared          map[string]json.RawMessage `json:"plugins_shared"`
+	// StaleWhileRevalidate is the number of seconds a stale object may be served while it's revalidated in the background, for responses with no stale-while-revalidate directive, per RFC5861§3. If nil, stale objects are only served while revalidating if the parent permits it.
+	StaleWhileRevalidate *int `json:"stale_while_revalidate"`
+	// StaleIfError is the number of seconds a stale object may be served if revalidating it fails, for responses with no stale-if-error directive, per RFC5861§4. If nil, stale objects are only served on error if the parent permits it.
+	StaleIfError *int `json:"stale_if_error"`
+	// CollapseTimeoutMS is how long a request waits for a concurrent parent request for the same cache key, before CollapseFallthrough applies. If nil or 0, requests wait for the concurrent request indefinitely.
+	CollapseTimeoutMS *int `json:"collapse_timeout_ms"`
+	// CollapseFallthrough is what a request does when it times out waiting for a concurrent parent request for the same cache key. If nil, CollapseFallthroughParent is used.
+	CollapseFallthrough *CollapseFallthrough `json:"collapse_fallthrough"`
+	// MaxVariants is the maximum number of variants of a single object to cache, for responses with a Vary header. When exceeded, the oldest variant is forgotten. If this is 0, DefaultMaxVariants is used.
+	MaxVariants int `json:"max_variants"`
+	// RangeSliceBytes is the size of the slices Range requests are fetched and cached in. If 0, Range requests are sent to the parent as-is.
+	RangeSliceBytes int64 `json:"range_slice_bytes"`
+	// Compress is how to compress and decompress responses for clients, per their Accept-Encoding. If nil, responses are served as the parent sent them.
+	Compress *Compress `json:"compress"`
+	// TLSVersions are the TLS versions HTTPS clients of the rule's From host may use, of "1.0", "1.1", "1.2", and "1.3". Versions between the lowest and highest are also allowed. If empty, the Go defaults are used.
+	TLSVersions []string `json:"tls_versions"`
+	// TLSCipherSuites are the names of the TLS 1.0-1.2 cipher suites HTTPS clients of the rule's From host may use. If empty, the Go defaults are used.
+	TLSCipherSuites []string `json:"tls_cipher_suites"`
+}
+
+// Compress is the compression config of a remap rule.
+type Compress struct {
+	// Encodings are the content codings to compress responses with, most preferred first. The first the client accepts is used.
+	Encodings []string `json:"encodings"`
+	// MimeTypes are the media types of responses to compress, which may include wildcards, e.g. `text/*`. If empty, DefaultCompressMimeTypes are used.
+	MimeTypes []string `json:"mime_types"`
+	// Decompress is whether to decompress responses the parent sent with a content coding the client doesn't accept.
+	Decompress bool `json:"decompress"`
+	// ParsedMimeTypes are the parsed MimeTypes, set when the rules are loaded.
+	ParsedMimeTypes []rfc.MimeType `json:"-"`
 }
 
+// DefaultCompressMimeTypes are the media types compressed by rules which compress, but don't specify mime_types.
+var DefaultCompressMimeTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// DefaultMaxVariants is the maximum number of variants of a single object cached for a remap rule which doesn't specify max_variants.
+const DefaultMaxVariants = 16
+
 type RemapRule struct {
 	RemapRuleBase
 	Timeout         *time.Duration
@@ -109,8 +183,12 @@ type RemapRule struct {
 	Deny            []*net.IPNet
 	RetryCodes      map[int]struct{}
 	ConsistentHash  chash.ATSConsistentHash
-	Cache           icache.Cache
-	Plugins         map[string]interface{}
+	// SecondaryConsistentHash is the hash of the rule's secondary parents, used for consistent hash parent selection. It's nil if the rule has no secondary parents.
+	SecondaryConsistentHash chash.ATSConsistentHash
+	// RoundRobinCounter is the number of requests made with round-robin parent selection. It's shared by all copies of the rule.
+	RoundRobinCounter *uint64
+	Cache             icache.Cache
+	Plugins           map[string]interface{}
 }
 
 func (r *RemapRule) Allowed(ip net.IP) bool {
@@ -133,41 +211,55 @@ func (r *RemapRule) Allowed(ip net.IP) bool {
 	return false
 }
 
-// URI takes a request URI and maps it to the real URI to proxy-and-cache. The `failures` parameter indicates how many parents have tried and failed, indicating to skip to the nth hashed parent. Returns the URI to request, and the proxy URL (if any)
-func (r RemapRule) URI(fromURI string, path string, query string, failures int) (string, *url.URL, *http.Transport) {
+// CollapseTimeout returns how long a request waits for a concurrent parent request for the same cache key. If 0, it waits indefinitely.
+func (r RemapRule) CollapseTimeout() time.Duration {
+	if r.CollapseTimeoutMS == nil {
+		return 0
+	}
+	return time.Duration(*r.CollapseTimeoutMS) * time.Millisecond
+}
+
+// URI takes a request URI and maps it to the real URI to proxy-and-cache. The `failures` parameter indicates how many parents have tried and failed, indicating to skip to the nth parent. Parents marked down are skipped, unless all parents are down. Returns the URI to request, the proxy URL (if any), the transport, and the parent's health.
+func (r RemapRule) URI(fromURI string, path string, query string, failures int) (string, *url.URL, *http.Transport, *health.Parent) {
 	fromHash := path
 	if r.QueryString.Remap && query != "" {
 		fromHash += "?" + query
 	}
 
 	// fmt.Println("RemapRule.URI fromURI " + fromHash)
-	to, proxyURI, transport := r.uriGetTo(fromHash, failures)
+	to, proxyURI, transport, parentHealth := r.uriGetTo(fromHash, failures)
 	uri := to + fromURI[len(r.From):]
 	if !r.QueryString.Remap {
 		if i := strings.Index(uri, "?"); i != -1 {
 			uri = uri[:i]
 		}
 	}
-	return uri, proxyURI, transport
+	return uri, proxyURI, transport, parentHealth
 }
 
-// uriGetTo is a helper func for URI. It returns the To URL, based on the Parent Selection type. In the event of failure, it logs the error and returns the first parent. Also returns the URL's Proxy URI (if any).
-func (r RemapRule) uriGetTo(fromURI string, failures int) (string, *url.URL, *http.Transport) {
+// uriGetTo is a helper func for URI. It returns the To URL, based on the Parent Selection type. In the event of failure, it logs the error and returns the first parent. Also returns the URL's Proxy URI (if any), transport, and health.
+// Secondary parents are only used when every primary parent is marked down, or has failed this request.
+func (r RemapRule) uriGetTo(fromURI string, failures int) (string, *url.URL, *http.Transport, *health.Parent) {
 	switch *r.ParentSelection {
 	case ParentSelectionTypeConsistentHash:
 		return r.uriGetToConsistentHash(fromURI, failures)
+	case ParentSelectionTypeRoundRobin:
+		return r.uriGetToRoundRobin(failures)
+	case ParentSelectionTypeOrdered:
+		return r.uriGetToOrdered(failures)
 	default:
 		log.Errorf("RemapRule.URI: Rule '%v': Unknown Parent Selection type %v - using first URI in rule\n", r.Name, r.ParentSelection)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health
 	}
 }
 
-// uriGetToConsistentHash is a helper func for URI, uriGetTo. It returns the To URL using Consistent Hashing. In the event of failure, it logs the error and returns the first parent. Also returns the Proxy URI (if any).
-func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string, *url.URL, *http.Transport) {
+// uriGetToConsistentHash is a helper func for URI, uriGetTo. It returns the To URL using Consistent Hashing. In the event of failure, it logs the error and returns the first parent. Also returns the Proxy URI (if any), transport, and health.
+// Each failure skips to the next distinct parent on the hash ring, after skipping parents marked down.
+func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string, *url.URL, *http.Transport, *health.Parent) {
 	// fmt.Printf("DEBUGL uriGetToConsistentHash RemapRule %+v\n", r)
 	if r.ConsistentHash == nil {
 		log.Errorf("RemapRule.URI: Rule '%v': Parent Selection Type ConsistentHash, but rule.ConsistentHash is nil! Using first parent\n", r.Name)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health
 	}
 
 	// fmt.Printf("DEBUGL uriGetToConsistentHash\n")
@@ -178,14 +270,104 @@ func (r RemapRule) uriGetToConsistentHash(fromURI string, failures int) (string,
 		// }
 		// fmt.Printf("DEBUGL uriGetToConsistentHash fromURI '%v' err %v returning '%v'\n", fromURI, err, r.To[0].URL)
 		log.Errorf("RemapRule.URI: Rule '%v': Error looking up Consistent Hash! Using first parent\n", r.Name)
-		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport
+		return r.To[0].URL, r.To[0].ProxyURL, r.To[0].Transport, r.To[0].Health
+	}
+
+	primaries, secondaries := r.toIndexes()
+	nodes := consistentHashParents(iter, len(primaries))
+	if r.SecondaryConsistentHash != nil {
+		if secondaryIter, _, err := r.SecondaryConsistentHash.Lookup(fromURI); err != nil {
+			log.Errorf("RemapRule.URI: Rule '%v': Error looking up secondary Consistent Hash! Using primary parents\n", r.Name)
+		} else {
+			nodes = append(nodes, consistentHashParents(secondaryIter, len(secondaries))...)
+		}
 	}
+	healths := make([]*health.Parent, len(nodes))
+	for i, node := range nodes {
+		healths[i] = node.Health
+	}
+	node := nodes[health.Prefer(healths, failures)]
+	return node.Name, node.ProxyURL, node.Transport, node.Health
+}
 
-	for i := 0; i < failures; i++ {
-		iter = iter.NextWrap()
+// consistentHashParents returns the distinct parents on the hash ring, in ring order, beginning with iter. The numParents is the number of distinct parents in the ring, at which the search stops; the search also stops if the entire ring is traversed.
+// Parents are distinguished by node, not name, because parent caches of the same rule share the rule's origin URL as their name.
+func consistentHashParents(iter chash.OrderedMapUint64NodeIterator, numParents int) []*chash.ATSConsistentHashNode {
+	nodes := make([]*chash.ATSConsistentHashNode, 0, numParents)
+	startIndex := iter.Index()
+	for {
+		seen := false
+		for _, node := range nodes {
+			if node == iter.Val() {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			nodes = append(nodes, iter.Val())
+		}
+		if len(nodes) >= numParents {
+			break
+		}
+		if iter = iter.NextWrap(); iter.Index() == startIndex {
+			break
+		}
 	}
+	return nodes
+}
+
+// uriGetToRoundRobin is a helper func for URI, uriGetTo. It returns the next To URL in turn, skipping parents marked down, unless all are down. Also returns the Proxy URI (if any), transport, and health.
+// Retries are also given the next parent in turn, so failures are only counted once there have been as many as there are primary parents, to move on to the secondary parents.
+func (r RemapRule) uriGetToRoundRobin(failures int) (string, *url.URL, *http.Transport, *health.Parent) {
+	start := 0
+	if r.RoundRobinCounter != nil {
+		start = int(atomic.AddUint64(r.RoundRobinCounter, 1) % uint64(len(r.To)))
+	}
+	primaries, secondaries := r.toIndexes()
+	order := append(rotate(primaries, start), rotate(secondaries, start)...)
+	if len(secondaries) == 0 || failures < len(primaries) {
+		failures = 0
+	}
+	return r.preferTo(order, failures)
+}
 
-	return iter.Val().Name, iter.Val().ProxyURL, iter.Val().Transport
+// uriGetToOrdered is a helper func for URI, uriGetTo. It returns the first To URL which isn't marked down, skipping one for each failure, primary parents first. Also returns the Proxy URI (if any), transport, and health.
+func (r RemapRule) uriGetToOrdered(failures int) (string, *url.URL, *http.Transport, *health.Parent) {
+	primaries, secondaries := r.toIndexes()
+	return r.preferTo(append(primaries, secondaries...), failures)
+}
+
+// preferTo returns the To of the given indexes health.Prefer selects, with the given failures.
+func (r RemapRule) preferTo(order []int, failures int) (string, *url.URL, *http.Transport, *health.Parent) {
+	healths := make([]*health.Parent, len(order))
+	for i, toIndex := range order {
+		healths[i] = r.To[toIndex].Health
+	}
+	to := r.To[order[health.Prefer(healths, failures)]]
+	return to.URL, to.ProxyURL, to.Transport, to.Health
+}
+
+// toIndexes returns the indexes in To of the primary and secondary parents, in order.
+func (r RemapRule) toIndexes() ([]int, []int) {
+	primaries := make([]int, 0, len(r.To))
+	secondaries := []int(nil)
+	for i, to := range r.To {
+		if to.Secondary {
+			secondaries = append(secondaries, i)
+		} else {
+			primaries = append(primaries, i)
+		}
+	}
+	return primaries, secondaries
+}
+
+// rotate returns a copy of the given indexes, beginning with the one at start, modulo their length.
+func rotate(indexes []int, start int) []int {
+	rotated := make([]int, 0, len(indexes))
+	for i := range indexes {
+		rotated = append(rotated, indexes[(start+i)%len(indexes)])
+	}
+	return rotated
 }
 
 func (r RemapRule) CacheKey(method string, fromURI string) string {
@@ -209,6 +391,8 @@ type RemapRuleToBase struct {
 	URL      string   `json:"url"`
 	Weight   *float64 `json:"weight"`
 	RetryNum *int     `json:"retry_num"`
+	// Secondary is whether the parent is only used when every primary parent is marked down, or has failed the request, like an ATS parent.config secondary_parent.
+	Secondary bool `json:"secondary"`
 }
 
 type RemapRuleTo struct {
@@ -217,6 +401,7 @@ type RemapRuleTo struct {
 	Timeout    *time.Duration
 	RetryCodes map[int]struct{}
 	Transport  *http.Transport
+	Health     *health.Parent
 }
 
 type QueryStringRule struct {
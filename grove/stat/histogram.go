@@ -0,0 +1,74 @@
+package stat
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// LatencyBuckets are the upper bounds of the buckets of latency histograms. These are the Prometheus client default buckets.
+var LatencyBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// Histogram is a threadsafe histogram of durations, in the LatencyBuckets.
+type Histogram struct {
+	counts   []uint64 // atomic: the number of observations in each bucket, not cumulative, and the final bucket for observations over the largest bound
+	sumNanos uint64   // atomic
+}
+
+func NewHistogram() *Histogram {
+	return &Histogram{counts: make([]uint64, len(LatencyBuckets)+1)}
+}
+
+// Observe adds the given duration to the histogram.
+func (h *Histogram) Observe(d time.Duration) {
+	i := 0
+	for i < len(LatencyBuckets) && d > LatencyBuckets[i] {
+		i++
+	}
+	atomic.AddUint64(&h.counts[i], 1)
+	if d > 0 {
+		atomic.AddUint64(&h.sumNanos, uint64(d))
+	}
+}
+
+// Buckets returns the cumulative number of observations less than or equal to each of the LatencyBuckets, followed by the total number of observations.
+// Observations may be added while the buckets are read, so the buckets, and the Sum, may not be exactly consistent.
+func (h *Histogram) Buckets() []uint64 {
+	buckets := make([]uint64, len(h.counts))
+	sum := uint64(0)
+	for i := range h.counts {
+		sum += atomic.LoadUint64(&h.counts[i])
+		buckets[i] = sum
+	}
+	return buckets
+}
+
+// Sum returns the sum of all observations.
+func (h *Histogram) Sum() time.Duration {
+	return time.Duration(atomic.LoadUint64(&h.sumNanos))
+}
@@ -16,11 +16,13 @@ package stat
 
 import (
 	"net/http"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/apache/trafficcontrol/grove/cacheobj"
+	"github.com/apache/trafficcontrol/grove/health"
 	"github.com/apache/trafficcontrol/grove/icache"
 	"github.com/apache/trafficcontrol/grove/remapdata"
 	"github.com/apache/trafficcontrol/grove/web"
@@ -65,6 +67,10 @@ type Stats interface {
 	CacheCapacityByName(string) (uint64, bool)
 	CacheNames() []string
 	CachePeek(string, string) (*cacheobj.CacheObj, bool)
+	CacheByName(string) (icache.Cache, bool)
+
+	// ParentHealth returns the health of all parents of all remap rules, sorted by URL.
+	ParentHealth() []health.Status
 }
 
 func New(remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cacheCapacityBytes uint64, httpConns *web.ConnMap, httpsConns *web.ConnMap, version string) Stats {
@@ -73,6 +79,7 @@ func New(remapRules []remapdata.RemapRule, caches map[string]icache.Cache, cache
 	return &stats{
 		system:             NewStatsSystem(version),
 		remap:              NewStatsRemaps(remapRules),
+		parents:            ruleParents(remapRules),
 		cacheHits:          &cacheHits,
 		cacheMisses:        &cacheMisses,
 		caches:             caches,
@@ -142,6 +149,29 @@ type stats struct {
 	cacheCapacityBytes uint64
 	httpConns          *web.ConnMap
 	httpsConns         *web.ConnMap
+	parents            []*health.Parent
+}
+
+// ruleParents returns the distinct parent healths of the given rules, sorted by URL and proxy URL. Parents with the same URL through different proxies, such as the mids of an edge, are distinct.
+func ruleParents(remapRules []remapdata.RemapRule) []*health.Parent {
+	parents := []*health.Parent{}
+	seen := map[*health.Parent]struct{}{}
+	for _, rule := range remapRules {
+		for _, to := range rule.To {
+			if _, ok := seen[to.Health]; ok || to.Health == nil {
+				continue
+			}
+			seen[to.Health] = struct{}{}
+			parents = append(parents, to.Health)
+		}
+	}
+	sort.Slice(parents, func(i, j int) bool {
+		if parents[i].URL() != parents[j].URL() {
+			return parents[i].URL() < parents[j].URL()
+		}
+		return parents[i].ProxyURL() < parents[j].ProxyURL()
+	})
+	return parents
 }
 
 func (s stats) Connections() uint64 {
@@ -197,6 +227,12 @@ func (s stats) CachePeek(key, cacheName string) (*cacheobj.CacheObj, bool) {
 	return s.caches[cacheName].Peek(key)
 }
 
+// CacheByName returns the cache with the given name, for operations such as purging which modify the cache.
+func (s stats) CacheByName(cacheName string) (icache.Cache, bool) {
+	cache, ok := s.caches[cacheName]
+	return cache, ok
+}
+
 func (s stats) CacheCapacityByName(cName string) (uint64, bool) {
 	if cache, ok := s.caches[cName]; ok {
 		return cache.Capacity(), true
@@ -204,6 +240,14 @@ func (s stats) CacheCapacityByName(cName string) (uint64, bool) {
 	return 0, false
 }
 
+func (s stats) ParentHealth() []health.Status {
+	statuses := make([]health.Status, 0, len(s.parents))
+	for _, parent := range s.parents {
+		statuses = append(statuses, parent.Status())
+	}
+	return statuses
+}
+
 func (s stats) CacheCapacity() uint64 { return s.cacheCapacityBytes }
 
 type StatsRemaps interface {
@@ -229,6 +273,10 @@ type StatsRemap interface {
 	AddCacheHit()
 	CacheMisses() uint64
 	AddCacheMiss()
+
+	// ParentLatency is the histogram of the time parent requests took to return response headers.
+	ParentLatency() *Histogram
+	AddParentLatency(time.Duration)
 }
 
 func getFromFQDN(r remapdata.RemapRule) string {
@@ -261,7 +309,7 @@ func (s statsRemaps) Stats(rule string) (StatsRemap, bool) {
 }
 
 func (s statsRemaps) Rules() []string {
-	rules := make([]string, len(s))
+	rules := make([]string, 0, len(s))
 	for rule := range s {
 		rules = append(rules, rule)
 	}
@@ -269,7 +317,7 @@ func (s statsRemaps) Rules() []string {
 }
 
 func NewStatsRemap() StatsRemap {
-	return &statsRemap{}
+	return &statsRemap{parentLatency: NewHistogram()}
 }
 
 type statsRemap struct {
@@ -281,6 +329,8 @@ type statsRemap struct {
 	status5xx   uint64
 	cacheHits   uint64
 	cacheMisses uint64
+
+	parentLatency *Histogram
 }
 
 func (r *statsRemap) InBytes() uint64       { return atomic.LoadUint64(&r.inBytes) }
@@ -302,6 +352,9 @@ func (r *statsRemap) AddCacheHit()      { atomic.AddUint64(&r.cacheHits, 1) }
 func (r *statsRemap) CacheMisses() uint64 { return atomic.LoadUint64(&r.cacheMisses) }
 func (r *statsRemap) AddCacheMiss()       { atomic.AddUint64(&r.cacheMisses, 1) }
 
+func (r *statsRemap) ParentLatency() *Histogram        { return r.parentLatency }
+func (r *statsRemap) AddParentLatency(d time.Duration) { r.parentLatency.Observe(d) }
+
 func NewStatsSystem(version string) StatsSystem {
 	return &statsSystem{version: version}
 }
@@ -16,12 +16,16 @@ package thread
 
 import (
 	"sync"
+	"time"
 
 	cacheobj "github.com/apache/trafficcontrol/grove/cacheobj"
 )
 
+// Getter gets objects from parents, collapsing concurrent requests for the same key into a single parent request.
+//
+// The actualGet makes the parent request, and returns its object as soon as its headers are received, along with a chan which is closed once the object's body is complete, and it's cached if it's cacheable. The chan may be nil if the object is already complete. The canUse returns whether another request's object may be used for this request. If timeout is positive, and another request for the same key doesn't get its object within timeout, timedOut is called instead, and its object is returned. The timedOut may make its own parent request, to fall through to the parent.
 type Getter interface {
-	Get(key string, actualGet func() *cacheobj.CacheObj, canUse func(*cacheobj.CacheObj) bool, reqID uint64) (*cacheobj.CacheObj, uint64)
+	Get(key string, actualGet func() (*cacheobj.CacheObj, <-chan struct{}), canUse func(*cacheobj.CacheObj) bool, timeout time.Duration, timedOut func() *cacheobj.CacheObj, reqID uint64) (*cacheobj.CacheObj, uint64)
 }
 
 type GetterResp struct {
@@ -30,58 +34,100 @@ type GetterResp struct {
 }
 
 func NewGetter() Getter {
-	return &getter{waiters: map[string][]chan GetterResp{}}
+	return &getter{inflight: map[string]*inflightGet{}}
 }
 
 // getter implements Getter, and does a fan-in so only one real request is made to the parent at any given time, and then that object is given to all concurrent requesters.
 //
 // When a request for a key with no-one currently processing it comes in, that requestor becomes the Author. Subsequent requests become Waiters.
-// The initial Author inserts a new constructed (but empty) slice into the waiters map.
-// Then, when other requests come in, they see that waiters[key] exists, and add themselves to it, and block reading from their chan.
-// Then, when the Author gets its response, it iterates over the Waiters and sends the response to all of them, at the same time (with the same lock, atomically) clearing the waiters for the next request that comes in.
+// The initial Author inserts a new constructed (but empty) inflightGet into the inflight map.
+// Then, when other requests come in, they see that inflight[key] exists, and add themselves to its waiters, and block reading from their chan.
+// Then, when the Author gets its response headers, it iterates over the Waiters and sends the response to all of them, at the same time (with the same lock, atomically) storing the response in the inflightGet.
+// Requests which come in after the headers, while the body is still being received, are given the stored response immediately, and read the body as it arrives. Once the body is complete and cached, the inflightGet is removed, and subsequent requests are served from the cache, or make a new parent request.
 //
-// If the Author response can't be used, all Waiters make their own requests.
+// If the Author response can't be used, all Waiters make their own requests. Likewise if the Author response is released, because it won't be cached, and its body is freed as the Author reads it.
+// If the Author response takes longer than the timeout, each Waiter which times out calls its timedOut func instead, and the Author response is discarded for that Waiter when it arrives. Because the Author response is returned as soon as its headers are received, the timeout applies to the parent's time to first byte, not to the entire body.
 // Note this assumes an uncacheable response for one request is likely uncacheable for all, and it's faster and less load on the origin if so.
 // If it's likely the author request is uncacheable, but a different waiter is cacheable for all other waiters, this will be more network, more origin load, and more work. If that's the case for you, consider creating another type that fulfills the Getter interface, and making the Getter configurable.
 type getter struct {
-	// waiters is a map of cache keys to chans for getters.
-	waiters  map[string][]chan GetterResp
-	waitersM sync.Mutex
+	// inflight is a map of cache keys to the parent requests in progress for them.
+	inflight  map[string]*inflightGet
+	inflightM sync.Mutex
+}
+
+// inflightGet is a parent request in progress. Before its headers are received, resp is nil, and requests wait on their chans in waiters. After, resp is the response, whose body may still be being received.
+type inflightGet struct {
+	waiters []chan GetterResp
+	resp    *GetterResp
 }
 
-func (g *getter) Get(key string, actualGet func() *cacheobj.CacheObj, canUse func(*cacheobj.CacheObj) bool, reqID uint64) (*cacheobj.CacheObj, uint64) {
+func (g *getter) Get(key string, actualGet func() (*cacheobj.CacheObj, <-chan struct{}), canUse func(*cacheobj.CacheObj) bool, timeout time.Duration, timedOut func() *cacheobj.CacheObj, reqID uint64) (*cacheobj.CacheObj, uint64) {
 	isAuthor := false
 	// Buffered for performance, so the author can iterate over all wait chans without blocking.
 	// Note this is unused if isAuthor becomes true.
 	getChan := make(chan GetterResp, 1)
 
-	g.waitersM.Lock()
-	if _, ok := g.waiters[key]; !ok {
+	g.inflightM.Lock()
+	inflight, ok := g.inflight[key]
+	if !ok {
 		isAuthor = true
-		g.waiters[key] = []chan GetterResp{}
+		inflight = &inflightGet{}
+		g.inflight[key] = inflight
+	} else if inflight.resp != nil {
+		getChan <- *inflight.resp
 	} else {
-		g.waiters[key] = append(g.waiters[key], getChan)
+		inflight.waiters = append(inflight.waiters, getChan)
 	}
-	g.waitersM.Unlock()
+	g.inflightM.Unlock()
 
 	if isAuthor {
-		obj := actualGet()
+		obj, done := actualGet()
 		waitResp := GetterResp{CacheObj: obj, GetReqID: reqID}
 
-		g.waitersM.Lock()
-		for _, waitChan := range g.waiters[key] {
+		g.inflightM.Lock()
+		for _, waitChan := range inflight.waiters {
 			waitChan <- waitResp
 		}
-		delete(g.waiters, key)
-		g.waitersM.Unlock()
-
+		inflight.waiters = nil
+		if done == nil || obj.Released() {
+			delete(g.inflight, key) // a released object's body is freed as it's read, so later requests can't join it
+		} else {
+			inflight.resp = &waitResp
+		}
+		g.inflightM.Unlock()
+
+		if done != nil {
+			go func() {
+				<-done
+				g.inflightM.Lock()
+				if g.inflight[key] == inflight {
+					delete(g.inflight, key)
+				}
+				g.inflightM.Unlock()
+			}()
+		}
 		return obj, reqID
 	}
 
-	if waitResp := <-getChan; canUse(waitResp.CacheObj) {
+	waitResp := GetterResp{}
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		select {
+		case waitResp = <-getChan:
+			timer.Stop()
+		case <-timer.C:
+			// the chan is buffered, so the Author won't block sending to it after we stop waiting
+			return timedOut(), reqID
+		}
+	} else {
+		waitResp = <-getChan
+	}
+
+	if !waitResp.CacheObj.Released() && canUse(waitResp.CacheObj) {
 		return waitResp.CacheObj, waitResp.GetReqID
 	}
 
 	// if the Author response can't be used, all Waiters make their own requests
-	return actualGet(), reqID
+	obj, _ := actualGet()
+	return obj, reqID
 }
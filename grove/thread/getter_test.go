@@ -0,0 +1,147 @@
+package thread
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/grove/cacheobj"
+)
+
+func TestGetterCollapses(t *testing.T) {
+	g := NewGetter()
+	gets := uint64(0)
+	release := make(chan struct{})
+	actualGet := func() (*cacheobj.CacheObj, <-chan struct{}) {
+		atomic.AddUint64(&gets, 1)
+		<-release
+		return &cacheobj.CacheObj{Code: http.StatusOK}, nil
+	}
+	canUse := func(*cacheobj.CacheObj) bool { return true }
+	timedOut := func() *cacheobj.CacheObj { return &cacheobj.CacheObj{Code: http.StatusGatewayTimeout} }
+
+	const requests = 10
+	objs := make([]*cacheobj.CacheObj, requests)
+	wg := sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			objs[i], _ = g.Get("key", actualGet, canUse, time.Minute, timedOut, uint64(i))
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond) // let all requests start waiting
+	close(release)
+	wg.Wait()
+
+	if gets := atomic.LoadUint64(&gets); gets != 1 {
+		t.Errorf("Getter.Get concurrent requests for the same key expected 1 parent request, actual %v", gets)
+	}
+	for i, obj := range objs {
+		if obj != objs[0] {
+			t.Errorf("Getter.Get concurrent requests for the same key expected the same object, actual request %v got %+v", i, obj)
+		}
+	}
+}
+
+func TestGetterTimeout(t *testing.T) {
+	g := NewGetter()
+	release := make(chan struct{})
+	authorStarted := make(chan struct{})
+	slowGet := func() (*cacheobj.CacheObj, <-chan struct{}) {
+		close(authorStarted)
+		<-release
+		return &cacheobj.CacheObj{Code: http.StatusOK}, nil
+	}
+	canUse := func(*cacheobj.CacheObj) bool { return true }
+	timedOut := func() *cacheobj.CacheObj { return &cacheobj.CacheObj{Code: http.StatusGatewayTimeout} }
+
+	authorDone := make(chan struct{})
+	go func() {
+		g.Get("key", slowGet, canUse, 0, timedOut, 1)
+		close(authorDone)
+	}()
+	<-authorStarted
+
+	obj, _ := g.Get("key", slowGet, canUse, 10*time.Millisecond, timedOut, 2)
+	if obj.Code != http.StatusGatewayTimeout {
+		t.Errorf("Getter.Get waiter exceeding timeout expected timedOut object, actual code %v", obj.Code)
+	}
+
+	close(release)
+	<-authorDone // the author must not block sending to the waiter which timed out
+}
+
+func TestGetterCollapsesWhileStreaming(t *testing.T) {
+	g := NewGetter()
+	gets := uint64(0)
+	done := make(chan struct{})
+	actualGet := func() (*cacheobj.CacheObj, <-chan struct{}) {
+		atomic.AddUint64(&gets, 1)
+		return &cacheobj.CacheObj{Code: http.StatusOK}, done
+	}
+	canUse := func(*cacheobj.CacheObj) bool { return true }
+	timedOut := func() *cacheobj.CacheObj { return &cacheobj.CacheObj{Code: http.StatusGatewayTimeout} }
+
+	authorObj, _ := g.Get("key", actualGet, canUse, 0, timedOut, 1)
+	// the author has its headers, but its body isn't complete, so later requests must join it
+	obj, getReqID := g.Get("key", actualGet, canUse, 0, timedOut, 2)
+	if obj != authorObj || getReqID != 1 {
+		t.Errorf("Getter.Get request while the body is being received expected the author object from request 1, actual %+v from request %v", obj, getReqID)
+	}
+	if gets := atomic.LoadUint64(&gets); gets != 1 {
+		t.Errorf("Getter.Get request while the body is being received expected 1 parent request, actual %v", gets)
+	}
+
+	close(done)
+	for i := 0; ; i++ {
+		g.Get("key", actualGet, canUse, 0, timedOut, 3)
+		if atomic.LoadUint64(&gets) > 1 {
+			break
+		}
+		if i > 100 {
+			t.Fatalf("Getter.Get request after the body is complete expected a new parent request, actual none")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestGetterDoesNotShareReleased(t *testing.T) {
+	g := NewGetter()
+	gets := uint64(0)
+	done := make(chan struct{})
+	defer close(done)
+	actualGet := func() (*cacheobj.CacheObj, <-chan struct{}) {
+		atomic.AddUint64(&gets, 1)
+		obj, stream := cacheobj.NewStreaming(nil, http.StatusOK, http.StatusOK, "", http.Header{}, time.Time{}, time.Time{}, time.Time{}, time.Time{})
+		stream.Release()
+		return obj, done
+	}
+	canUse := func(*cacheobj.CacheObj) bool { return true }
+	timedOut := func() *cacheobj.CacheObj { return &cacheobj.CacheObj{Code: http.StatusGatewayTimeout} }
+
+	authorObj, _ := g.Get("key", actualGet, canUse, 0, timedOut, 1)
+	// the author's body is freed as it's read, so later requests must make their own
+	if obj, _ := g.Get("key", actualGet, canUse, 0, timedOut, 2); obj == authorObj {
+		t.Errorf("Getter.Get request while a released body is being received expected its own object, actual the author's")
+	}
+	if gets := atomic.LoadUint64(&gets); gets != 2 {
+		t.Errorf("Getter.Get request while a released body is being received expected 2 parent requests, actual %v", gets)
+	}
+}
@@ -69,6 +69,13 @@ func (c *TierCache) Add(key string, val *cacheobj.CacheObj) bool {
 	return aevict || bevict
 }
 
+// Remove removes from both internal caches. Returns whether either contained the key.
+func (c *TierCache) Remove(key string) bool {
+	aremoved := c.first.Remove(key)
+	bremoved := c.second.Remove(key)
+	return aremoved || bremoved
+}
+
 // Size returns the size of the second cache. This is because, since all objects are added to both, they are presumed to have the same content, and the second is presumed to be larger.
 //
 // For example, if the first is a memory cache and the second is a disk cache, it's most useful to report the size used on disk.
@@ -86,5 +93,10 @@ func (c *TierCache) Keys() []string {
 	return c.second.Keys()
 }
 
+// DerivedKeys returns the derived keys of the second tier only, like Keys.
+func (c *TierCache) DerivedKeys(key string) []string {
+	return c.second.DerivedKeys(key)
+}
+
 // Capacity returns the maximum size in bytes of the cache
 func (c *TierCache) Capacity() uint64 { return c.second.Capacity() }
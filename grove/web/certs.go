@@ -0,0 +1,425 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+)
+
+// Certs is the certificates and TLS settings served by HTTPS listeners, by the client's requested server name (SNI). The certificates and settings may be replaced while serving, and new TLS handshakes will use the new ones, while existing connections are unaffected.
+//
+// Certs also staples OCSP responses to its certificates, refreshing them in the background, and sets the session ticket keys of its listeners, so sessions may be resumed across a fleet of servers sharing the keys.
+type Certs struct {
+	byName      map[string]*serverName
+	defaultName *serverName
+	certs       []*certEntry
+	m           sync.RWMutex
+
+	listenerConfigs map[*tls.Config]struct{}
+	ticketKeys      [][32]byte
+	ticketKeyFile   string
+	ticketReload    time.Duration
+	ticketKeysM     sync.Mutex
+	ticketSignal    chan struct{}
+	ticketOnce      sync.Once
+
+	ocspClient   *http.Client
+	ocspInterval time.Duration
+	ocspSignal   chan struct{}
+	ocspOnce     sync.Once
+}
+
+// CertConfig is a certificate, and the server names and TLS settings to serve it with.
+type CertConfig struct {
+	// Cert is the certificate. If nil, the certificate whose names match each of the Names is used, or the default certificate if none do.
+	Cert *tls.Certificate
+	// Names are server names to serve the certificate and settings for, in addition to the names in the certificate. Names may be wildcards, e.g. `*.example.net`. Names take precedence over the names of other certificates.
+	Names []string
+	// MinVersion and MaxVersion are the TLS versions clients may use. If 0, Go's defaults are used.
+	MinVersion uint16
+	MaxVersion uint16
+	// CipherSuites are the TLS 1.0-1.2 cipher suites clients may use. If empty, Go's defaults are used.
+	CipherSuites []uint16
+}
+
+// serverName is the certificate and TLS settings served for a server name.
+type serverName struct {
+	cert         *certEntry
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+}
+
+// hasSettings returns whether the server name has TLS settings which differ from the listener's.
+func (n *serverName) hasSettings() bool {
+	return n.minVersion != 0 || n.maxVersion != 0 || len(n.cipherSuites) != 0
+}
+
+// certEntry is a served certificate. The certificate is replaced when its OCSP response is refreshed.
+type certEntry struct {
+	stapled atomic.Value // stapledCert
+}
+
+// stapledCert is a certificate, with its stapled OCSP response, if any.
+type stapledCert struct {
+	cert *tls.Certificate
+	// ocspNextUpdate is the time the stapled OCSP response expires. If zero, the response doesn't expire, or there is no response.
+	ocspNextUpdate time.Time
+}
+
+func newCertEntry(cert *tls.Certificate) *certEntry {
+	e := &certEntry{}
+	e.stapled.Store(stapledCert{cert: cert})
+	return e
+}
+
+func (e *certEntry) get() stapledCert        { return e.stapled.Load().(stapledCert) }
+func (e *certEntry) set(stapled stapledCert) { e.stapled.Store(stapled) }
+func (e *certEntry) cert() *tls.Certificate  { return e.get().cert }
+func (e *certEntry) leafDER() string         { return string(e.cert().Certificate[0]) }
+func (e *certEntry) hasStaple() bool         { return e.cert().OCSPStaple != nil }
+func (e *certEntry) stapledFrom(old stapledCert) {
+	cert := *e.cert()
+	cert.OCSPStaple = old.cert.OCSPStaple
+	e.set(stapledCert{cert: &cert, ocspNextUpdate: old.ocspNextUpdate})
+}
+
+// NewCerts returns a Certs serving the given certificates, and the given default certificate to clients whose server name matches none of them.
+func NewCerts(certs []CertConfig, defaultCert tls.Certificate) (*Certs, error) {
+	c := &Certs{
+		listenerConfigs: map[*tls.Config]struct{}{},
+		ocspClient:      &http.Client{Timeout: OCSPRequestTimeout},
+		ocspSignal:      make(chan struct{}, 1),
+		ticketSignal:    make(chan struct{}, 1),
+	}
+	if err := c.Set(certs, defaultCert); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Set replaces the served certificates and settings. On error, the existing certificates are kept.
+// Certificates which were already served keep their OCSP responses, and new certificates are stapled in the background.
+func (c *Certs) Set(certs []CertConfig, defaultCert tls.Certificate) error {
+	defaultEntry := newCertEntry(&defaultCert)
+	entries := []*certEntry{defaultEntry}
+	certsByName := map[string]*certEntry{}
+	configEntries := make([]*certEntry, len(certs))
+	for i, cfg := range certs {
+		if cfg.Cert == nil {
+			continue
+		}
+		names, err := certNames(cfg.Cert)
+		if err != nil {
+			return err
+		}
+		entry := newCertEntry(cfg.Cert)
+		entries = append(entries, entry)
+		configEntries[i] = entry
+		for _, name := range names {
+			if _, ok := certsByName[name]; !ok {
+				certsByName[name] = entry
+			}
+		}
+	}
+
+	byName := map[string]*serverName{}
+	for i, cfg := range certs {
+		for _, name := range cfg.Names {
+			name = normalizeServerName(name)
+			if _, ok := byName[name]; ok {
+				continue
+			}
+			entry := configEntries[i]
+			if entry == nil {
+				if entry = matchServerName(certsByName, name); entry == nil {
+					entry = defaultEntry
+				}
+			}
+			byName[name] = &serverName{cert: entry, minVersion: cfg.MinVersion, maxVersion: cfg.MaxVersion, cipherSuites: cfg.CipherSuites}
+		}
+	}
+	for i, cfg := range certs {
+		if configEntries[i] == nil {
+			continue
+		}
+		names, _ := certNames(cfg.Cert) // already succeeded above
+		for _, name := range names {
+			if _, ok := byName[name]; !ok && certsByName[name] == configEntries[i] {
+				byName[name] = &serverName{cert: configEntries[i], minVersion: cfg.MinVersion, maxVersion: cfg.MaxVersion, cipherSuites: cfg.CipherSuites}
+			}
+		}
+	}
+
+	c.m.Lock()
+	oldStaples := map[string]stapledCert{}
+	for _, entry := range c.certs {
+		if entry.hasStaple() {
+			oldStaples[entry.leafDER()] = entry.get()
+		}
+	}
+	for _, entry := range entries {
+		if old, ok := oldStaples[entry.leafDER()]; ok {
+			entry.stapledFrom(old)
+		}
+	}
+	c.byName = byName
+	c.defaultName = &serverName{cert: defaultEntry}
+	c.certs = entries
+	c.m.Unlock()
+
+	signal(c.ocspSignal)
+	return nil
+}
+
+// GetCertificate returns the certificate for the client's requested server name, for use as the tls.Config GetCertificate. Names are matched exactly, then by wildcard names for the parent domain, like the tls.Config NameToCertificate.
+func (c *Certs) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.getServerName(hello.ServerName).cert.cert(), nil
+}
+
+// getServerName returns the certificate and settings for the given requested server name.
+func (c *Certs) getServerName(name string) *serverName {
+	name = normalizeServerName(name)
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if sn, ok := c.byName[name]; ok {
+		return sn
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		if sn, ok := c.byName["*"+name[i:]]; ok {
+			return sn
+		}
+	}
+	return c.defaultName
+}
+
+// TLSConfig returns a new tls.Config for an HTTPS listener, serving the certificates and settings of c, with the given ALPN protocols.
+// The config is given the current session ticket keys, and any keys set later, until it's released with ReleaseTLSConfig.
+func (c *Certs) TLSConfig(nextProtos []string) *tls.Config {
+	config := &tls.Config{NextProtos: nextProtos, GetCertificate: c.GetCertificate}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sn := c.getServerName(hello.ServerName)
+		if !sn.hasSettings() {
+			return nil, nil // use the listener config
+		}
+		clientConfig := config.Clone()
+		clientConfig.GetConfigForClient = nil
+		clientConfig.MinVersion = sn.minVersion
+		clientConfig.MaxVersion = sn.maxVersion
+		clientConfig.CipherSuites = sn.cipherSuites
+		return clientConfig, nil
+	}
+
+	c.ticketKeysM.Lock()
+	defer c.ticketKeysM.Unlock()
+	if len(c.ticketKeys) > 0 {
+		config.SetSessionTicketKeys(c.ticketKeys)
+	}
+	c.listenerConfigs[config] = struct{}{}
+	return config
+}
+
+// ReleaseTLSConfig stops setting session ticket keys on the given config from TLSConfig, and lets it be garbage collected. It should be called when the config's listener is closed.
+func (c *Certs) ReleaseTLSConfig(config *tls.Config) {
+	c.ticketKeysM.Lock()
+	defer c.ticketKeysM.Unlock()
+	delete(c.listenerConfigs, config)
+}
+
+// normalizeServerName returns the given server name lowercased, without any trailing period.
+func normalizeServerName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(name), ".")
+}
+
+// matchServerName returns the certificate for the given name, matched exactly or by wildcard, or nil if none match.
+func matchServerName(certsByName map[string]*certEntry, name string) *certEntry {
+	if entry, ok := certsByName[name]; ok {
+		return entry
+	}
+	if i := strings.Index(name, "."); i > 0 {
+		return certsByName["*"+name[i:]]
+	}
+	return nil
+}
+
+// certLeaf returns the parsed leaf of the given certificate.
+func certLeaf(cert *tls.Certificate) (*x509.Certificate, error) {
+	if cert.Leaf != nil {
+		return cert.Leaf, nil
+	}
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate has no data")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, errors.New("parsing certificate: " + err.Error())
+	}
+	return leaf, nil
+}
+
+// certNames returns the lowercase DNS names and common name of the given certificate's leaf.
+func certNames(cert *tls.Certificate) ([]string, error) {
+	leaf, err := certLeaf(cert)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	if leaf.Subject.CommonName != "" && len(leaf.DNSNames) == 0 {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	return names, nil
+}
+
+// SetOCSPRefresh sets how often OCSP responses are fetched and stapled to the certificates. If 0, no new responses are fetched, and existing responses are kept until they expire.
+func (c *Certs) SetOCSPRefresh(interval time.Duration) {
+	c.m.Lock()
+	c.ocspInterval = interval
+	c.m.Unlock()
+	c.ocspOnce.Do(func() {
+		go refreshLoop(c.ocspSignal, func() time.Duration {
+			c.m.RLock()
+			defer c.m.RUnlock()
+			return c.ocspInterval
+		}, c.refreshOCSP)
+	})
+	signal(c.ocspSignal)
+}
+
+// refreshOCSP fetches and staples the OCSP response of each certificate with an OCSP responder. If fetching fails, the existing response is kept until it expires.
+func (c *Certs) refreshOCSP() {
+	c.m.RLock()
+	interval := c.ocspInterval
+	entries := c.certs
+	c.m.RUnlock()
+	if interval <= 0 {
+		return
+	}
+
+	now := time.Now()
+	for _, entry := range entries {
+		current := entry.get()
+		if current.cert.OCSPStaple != nil && !current.ocspNextUpdate.IsZero() && current.ocspNextUpdate.After(now.Add(interval*2)) {
+			continue // the current response is still valid past the next refresh
+		}
+		staple, nextUpdate, err := FetchOCSPStaple(c.ocspClient, current.cert)
+		if err == ErrNoOCSPResponder {
+			continue
+		}
+		if err != nil {
+			log.Warnf("fetching OCSP response: %v\n", err)
+			if current.cert.OCSPStaple != nil && !current.ocspNextUpdate.IsZero() && current.ocspNextUpdate.Before(now) {
+				log.Warnf("OCSP response expired, removing staple\n")
+				cert := *current.cert
+				cert.OCSPStaple = nil
+				entry.set(stapledCert{cert: &cert})
+			}
+			continue
+		}
+		cert := *current.cert
+		cert.OCSPStaple = staple
+		entry.set(stapledCert{cert: &cert, ocspNextUpdate: nextUpdate})
+	}
+}
+
+// SetTicketKeyFile sets the file session ticket keys are loaded from, and how often it's reloaded, so keys may be rotated by replacing the file. The file is loaded immediately, and on error, the existing keys are kept. If the path is empty, Go's default automatically rotated keys are used, which aren't shared with other servers; however, keys which were already set can't be unset.
+// If reload is 0, the file is only loaded when this is called.
+func (c *Certs) SetTicketKeyFile(path string, reload time.Duration) error {
+	c.ticketKeysM.Lock()
+	c.ticketKeyFile = path
+	c.ticketReload = reload
+	c.ticketKeysM.Unlock()
+	c.ticketOnce.Do(func() {
+		go refreshLoop(c.ticketSignal, func() time.Duration {
+			c.ticketKeysM.Lock()
+			defer c.ticketKeysM.Unlock()
+			return c.ticketReload
+		}, func() {
+			if err := c.loadTicketKeys(); err != nil {
+				log.Errorln("reloading TLS session ticket keys, keeping existing keys: " + err.Error())
+			}
+		})
+	})
+	return c.loadTicketKeys()
+}
+
+// loadTicketKeys loads the ticket key file, and sets the keys of all listeners if they changed.
+func (c *Certs) loadTicketKeys() error {
+	c.ticketKeysM.Lock()
+	defer c.ticketKeysM.Unlock()
+	if c.ticketKeyFile == "" {
+		return nil
+	}
+	keys, err := LoadTicketKeys(c.ticketKeyFile)
+	if err != nil {
+		return err
+	}
+	if ticketKeysEqual(keys, c.ticketKeys) {
+		return nil
+	}
+	c.ticketKeys = keys
+	for config := range c.listenerConfigs {
+		config.SetSessionTicketKeys(keys)
+	}
+	log.Infof("loaded %v TLS session ticket keys from '%v'\n", len(keys), c.ticketKeyFile)
+	return nil
+}
+
+func ticketKeysEqual(a [][32]byte, b [][32]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshLoop calls refresh every interval, as returned by getInterval, and whenever sig is signalled. If the interval is 0, refresh is only called when signalled. It never returns.
+func refreshLoop(sig <-chan struct{}, getInterval func() time.Duration, refresh func()) {
+	for {
+		interval := getInterval()
+		if interval <= 0 {
+			<-sig
+		} else {
+			select {
+			case <-sig:
+			case <-time.After(interval):
+			}
+		}
+		refresh()
+	}
+}
+
+// signal sends on the given channel, without blocking if a signal is already pending.
+func signal(sig chan<- struct{}) {
+	select {
+	case sig <- struct{}{}:
+	default:
+	}
+}
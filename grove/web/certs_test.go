@@ -0,0 +1,205 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func makeTestCert(t *testing.T, cn string, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertsGetCertificate(t *testing.T) {
+	defaultCert := makeTestCert(t, "default.example.net")
+	cnCert := makeTestCert(t, "Foo.Example.net")
+	wildCert := makeTestCert(t, "wild", "*.bar.example.net", "bar.example.net")
+
+	certs, err := NewCerts([]CertConfig{{Cert: &cnCert}, {Cert: &wildCert}}, defaultCert)
+	if err != nil {
+		t.Fatalf("NewCerts expected nil error, actual %v", err)
+	}
+
+	expected := map[string]tls.Certificate{
+		"foo.example.net":      cnCert,
+		"FOO.example.net.":     cnCert,
+		"bar.example.net":      wildCert,
+		"a.bar.example.net":    wildCert,
+		"a.b.bar.example.net":  defaultCert,
+		"wild":                 defaultCert,
+		"other.example.net":    defaultCert,
+		"":                     defaultCert,
+		"a.foo.example.net":    defaultCert,
+		"default.example.net.": defaultCert,
+	}
+	for name, expectedCert := range expected {
+		cert, err := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Errorf("GetCertificate '%v' expected nil error, actual %v", name, err)
+			continue
+		}
+		if string(cert.Certificate[0]) != string(expectedCert.Certificate[0]) {
+			t.Errorf("GetCertificate '%v' returned the wrong certificate", name)
+		}
+	}
+
+	newCNCert := makeTestCert(t, "foo.example.net")
+	if err := certs.Set([]CertConfig{{Cert: &newCNCert}}, defaultCert); err != nil {
+		t.Fatalf("Set expected nil error, actual %v", err)
+	}
+	if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "foo.example.net"}); string(cert.Certificate[0]) != string(newCNCert.Certificate[0]) {
+		t.Errorf("GetCertificate after Set expected the new certificate, actual old")
+	}
+	if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "bar.example.net"}); string(cert.Certificate[0]) != string(defaultCert.Certificate[0]) {
+		t.Errorf("GetCertificate after Set of removed certificate expected the default, actual removed")
+	}
+
+	if err := certs.Set([]CertConfig{{Cert: &tls.Certificate{}}}, defaultCert); err == nil {
+		t.Errorf("Set of invalid certificate expected error, actual nil")
+	}
+	if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "foo.example.net"}); string(cert.Certificate[0]) != string(newCNCert.Certificate[0]) {
+		t.Errorf("GetCertificate after failed Set expected the existing certificate, actual changed")
+	}
+}
+
+func TestCertsServerNames(t *testing.T) {
+	defaultCert := makeTestCert(t, "default.example.net")
+	wildCert := makeTestCert(t, "wild", "*.bar.example.net")
+	fooCert := makeTestCert(t, "foo.example.net")
+
+	certs, err := NewCerts([]CertConfig{
+		{Cert: &wildCert, MinVersion: tls.VersionTLS12},
+		{Cert: &fooCert, Names: []string{"Alias.Example.net", "*.alias.example.net"}},
+		{Names: []string{"strict.bar.example.net"}, MinVersion: tls.VersionTLS13, MaxVersion: tls.VersionTLS13},
+		{Names: []string{"nocert.example.net"}, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+	}, defaultCert)
+	if err != nil {
+		t.Fatalf("NewCerts expected nil error, actual %v", err)
+	}
+
+	expected := map[string]tls.Certificate{
+		"foo.example.net":        fooCert,
+		"alias.example.net":      fooCert,
+		"a.alias.example.net":    fooCert,
+		"a.bar.example.net":      wildCert,
+		"strict.bar.example.net": wildCert,
+		"nocert.example.net":     defaultCert,
+	}
+	for name, expectedCert := range expected {
+		if cert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: name}); string(cert.Certificate[0]) != string(expectedCert.Certificate[0]) {
+			t.Errorf("GetCertificate '%v' returned the wrong certificate", name)
+		}
+	}
+
+	config := certs.TLSConfig([]string{"h2"})
+	expectedVersions := map[string][2]uint16{
+		"a.bar.example.net":      {tls.VersionTLS12, 0},
+		"strict.bar.example.net": {tls.VersionTLS13, tls.VersionTLS13},
+		"nocert.example.net":     {0, 0},
+	}
+	for name, versions := range expectedVersions {
+		clientConfig, err := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: name})
+		if err != nil {
+			t.Fatalf("GetConfigForClient '%v' expected nil error, actual %v", name, err)
+		}
+		if clientConfig.MinVersion != versions[0] || clientConfig.MaxVersion != versions[1] {
+			t.Errorf("GetConfigForClient '%v' expected versions %x-%x, actual %x-%x", name, versions[0], versions[1], clientConfig.MinVersion, clientConfig.MaxVersion)
+		}
+		if len(clientConfig.NextProtos) != 1 || clientConfig.NextProtos[0] != "h2" {
+			t.Errorf("GetConfigForClient '%v' expected listener NextProtos, actual %v", name, clientConfig.NextProtos)
+		}
+	}
+	if clientConfig, _ := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "nocert.example.net"}); len(clientConfig.CipherSuites) != 1 || clientConfig.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("GetConfigForClient expected cipher suites, actual %v", clientConfig.CipherSuites)
+	}
+	if clientConfig, _ := config.GetConfigForClient(&tls.ClientHelloInfo{ServerName: "foo.example.net"}); clientConfig != nil {
+		t.Errorf("GetConfigForClient with no settings expected nil config, actual %+v", clientConfig)
+	}
+}
+
+func TestCertsTLSHandshake(t *testing.T) {
+	defaultCert := makeTestCert(t, "default.example.net")
+	certs, err := NewCerts([]CertConfig{{Names: []string{"old.example.net"}, MaxVersion: tls.VersionTLS12}}, defaultCert)
+	if err != nil {
+		t.Fatalf("NewCerts expected nil error, actual %v", err)
+	}
+	serverConfig := certs.TLSConfig(nil)
+
+	handshake := func(serverName string) (uint16, error) {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+		defer serverConn.Close()
+		go tls.Server(serverConn, serverConfig).Handshake()
+		client := tls.Client(clientConn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err := client.Handshake(); err != nil {
+			return 0, err
+		}
+		return client.ConnectionState().Version, nil
+	}
+
+	if version, err := handshake("old.example.net"); err != nil {
+		t.Errorf("handshake expected nil error, actual %v", err)
+	} else if version != tls.VersionTLS12 {
+		t.Errorf("handshake with max version 1.2 expected version %x, actual %x", tls.VersionTLS12, version)
+	}
+	if version, err := handshake("new.example.net"); err != nil {
+		t.Errorf("handshake expected nil error, actual %v", err)
+	} else if version != tls.VersionTLS13 {
+		t.Errorf("handshake with default versions expected version %x, actual %x", tls.VersionTLS13, version)
+	}
+}
+
+func TestCertsReleaseTLSConfig(t *testing.T) {
+	certs, err := NewCerts(nil, makeTestCert(t, "default.example.net"))
+	if err != nil {
+		t.Fatalf("NewCerts expected nil error, actual %v", err)
+	}
+	oldConfig := certs.TLSConfig(nil)
+	newConfig := certs.TLSConfig(nil)
+	if len(certs.listenerConfigs) != 2 {
+		t.Fatalf("TLSConfig twice expected 2 listener configs, actual %v", len(certs.listenerConfigs))
+	}
+	certs.ReleaseTLSConfig(oldConfig)
+	if len(certs.listenerConfigs) != 1 {
+		t.Fatalf("ReleaseTLSConfig expected 1 listener config, actual %v", len(certs.listenerConfigs))
+	}
+	if _, ok := certs.listenerConfigs[newConfig]; !ok {
+		t.Errorf("ReleaseTLSConfig expected the unreleased config to remain, actual released")
+	}
+}
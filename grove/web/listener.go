@@ -67,18 +67,18 @@ func InterceptListen(network, laddr string) (net.Listener, *ConnMap, func(net.Co
 }
 
 // InterceptListenTLS is like InterceptListen but for serving HTTPS. It returns the tls.Config, which must be set on the http.Server using this listener for HTTP/2 to be set up.
-func InterceptListenTLS(network string, laddr string, certs []tls.Certificate, h2Disabled bool) (net.Listener, *ConnMap, func(net.Conn, http.ConnState), *tls.Config, error) {
-	config := &tls.Config{}
-	// HTTP2 is enabled if config.DisableHTTP2 is false
-	if !h2Disabled {
-		config.NextProtos = []string{"h2"}
-	}
-	config.Certificates = certs
-	config.BuildNameToCertificate()
+// Certificates and TLS settings are gotten from the given certs on each handshake, so they may be changed without creating a new listener.
+func InterceptListenTLS(network string, laddr string, certs *Certs, h2Disabled bool) (net.Listener, *ConnMap, func(net.Conn, http.ConnState), *tls.Config, error) {
 	l, err := net.Listen(network, laddr)
 	if err != nil {
 		return l, nil, nil, nil, err
 	}
+	nextProtos := []string(nil)
+	// HTTP2 is enabled if config.DisableHTTP2 is false
+	if !h2Disabled {
+		nextProtos = []string{"h2"}
+	}
+	config := certs.TLSConfig(nextProtos)
 	connMap := NewConnMap()
 
 	interceptListener := &InterceptListener{realListener: l, connMap: connMap}
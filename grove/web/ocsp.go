@@ -0,0 +1,99 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPRequestTimeout is the timeout of requests to OCSP responders.
+const OCSPRequestTimeout = 10 * time.Second
+
+// OCSPMaxResponseBytes is the maximum size of an OCSP response. Responses are typically under 2KB, so this is only to prevent a misbehaving responder from using unbounded memory.
+const OCSPMaxResponseBytes = 1024 * 1024
+
+// ErrNoOCSPResponder is returned when fetching the OCSP response of a certificate with no OCSP responder or no issuer certificate.
+var ErrNoOCSPResponder = errors.New("certificate has no OCSP responder or issuer")
+
+// FetchOCSPStaple requests the OCSP response of the given certificate's leaf from its OCSP responder, and returns the response to staple, and the time it expires, which is zero if the responder didn't give one.
+// The certificate chain must include the issuer certificate after the leaf. If the certificate has no OCSP responder or issuer, ErrNoOCSPResponder is returned.
+//
+// The response must be signed by the issuer, or by a responder certificate the issuer signed, and must say the certificate is good. Otherwise an error is returned, so forged responses and revoked certificates are never stapled.
+func FetchOCSPStaple(client *http.Client, cert *tls.Certificate) ([]byte, time.Time, error) {
+	leaf, err := certLeaf(cert)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	if len(leaf.OCSPServer) == 0 || len(cert.Certificate) < 2 {
+		return nil, time.Time{}, ErrNoOCSPResponder
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, time.Time{}, errors.New("parsing issuer certificate: " + err.Error())
+	}
+
+	reqBts, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, errors.New("making OCSP request for '" + leaf.Subject.CommonName + "': " + err.Error())
+	}
+
+	responder := leaf.OCSPServer[0]
+	resp, err := client.Post(responder, "application/ocsp-request", bytes.NewReader(reqBts))
+	if err != nil {
+		return nil, time.Time{}, errors.New("requesting OCSP response for '" + leaf.Subject.CommonName + "' from '" + responder + "': " + err.Error())
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("requesting OCSP response for '%v' from '%v': response code %v", leaf.Subject.CommonName, responder, resp.StatusCode)
+	}
+	respBts, err := ioutil.ReadAll(io.LimitReader(resp.Body, OCSPMaxResponseBytes))
+	if err != nil {
+		return nil, time.Time{}, errors.New("reading OCSP response for '" + leaf.Subject.CommonName + "' from '" + responder + "': " + err.Error())
+	}
+
+	ocspResp, err := ocsp.ParseResponseForCert(respBts, leaf, issuer)
+	if err != nil {
+		return nil, time.Time{}, errors.New("OCSP response for '" + leaf.Subject.CommonName + "' from '" + responder + "': " + err.Error())
+	}
+	if err := checkOCSPResponse(ocspResp, time.Now()); err != nil {
+		return nil, time.Time{}, errors.New("OCSP response for '" + leaf.Subject.CommonName + "' from '" + responder + "': " + err.Error())
+	}
+	return respBts, ocspResp.NextUpdate, nil
+}
+
+// checkOCSPResponse returns an error if the given parsed and verified OCSP response doesn't say the certificate is good, or has expired.
+func checkOCSPResponse(resp *ocsp.Response, now time.Time) error {
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return errors.New("certificate revoked at " + resp.RevokedAt.String())
+	default:
+		return errors.New("certificate status unknown")
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return errors.New("response expired at " + resp.NextUpdate.String())
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// makeTestChain returns a certificate for the given name, issued by a test CA, with the given OCSP responder. It also returns the CA certificate and key, to sign OCSP responses.
+func makeTestChain(t *testing.T, name string, ocspServer string) (tls.Certificate, *x509.Certificate, *ecdsa.PrivateKey) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating CA certificate: %v", err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf("parsing CA certificate: %v", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{ocspServer},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}, ca, caKey
+}
+
+// testOCSPResponder is an OCSP responder which responds with the given status for all requested certificates, signed by Issuer with Key.
+type testOCSPResponder struct {
+	t          *testing.T
+	Revoked    bool
+	NextUpdate time.Time
+	Issuer     *x509.Certificate
+	Key        crypto.Signer
+	Requests   int
+}
+
+func (re *testOCSPResponder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	re.Requests++
+	reqBts, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		re.t.Errorf("responder reading request: %v", err)
+		return
+	}
+	req, err := ocsp.ParseRequest(reqBts)
+	if err != nil {
+		re.t.Errorf("responder parsing request: %v", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   re.NextUpdate,
+	}
+	if re.Revoked {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = time.Now().Add(-time.Minute)
+	}
+	respBts, err := ocsp.CreateResponse(re.Issuer, re.Issuer, tmpl, re.Key)
+	if err != nil {
+		re.t.Errorf("responder creating response: %v", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(respBts)
+}
+
+func TestFetchOCSPStaple(t *testing.T) {
+	nextUpdate := time.Now().Add(time.Hour).Truncate(time.Second)
+	re := &testOCSPResponder{t: t, NextUpdate: nextUpdate}
+	responder := httptest.NewServer(re)
+	defer responder.Close()
+
+	cert, ca, caKey := makeTestChain(t, "ocsp.example.net", responder.URL)
+	re.Issuer, re.Key = ca, caKey
+	staple, actualNextUpdate, err := FetchOCSPStaple(responder.Client(), &cert)
+	if err != nil {
+		t.Fatalf("FetchOCSPStaple expected nil error, actual %v", err)
+	}
+	if len(staple) == 0 {
+		t.Errorf("FetchOCSPStaple expected response, actual empty")
+	}
+	if !actualNextUpdate.Equal(nextUpdate) {
+		t.Errorf("FetchOCSPStaple expected next update %v, actual %v", nextUpdate, actualNextUpdate)
+	}
+
+	noIssuer := cert
+	noIssuer.Certificate = cert.Certificate[:1]
+	if _, _, err := FetchOCSPStaple(responder.Client(), &noIssuer); err != ErrNoOCSPResponder {
+		t.Errorf("FetchOCSPStaple without issuer expected ErrNoOCSPResponder, actual %v", err)
+	}
+}
+
+func TestFetchOCSPStapleRevoked(t *testing.T) {
+	re := &testOCSPResponder{t: t, Revoked: true, NextUpdate: time.Now().Add(time.Hour)}
+	responder := httptest.NewServer(re)
+	defer responder.Close()
+
+	cert, ca, caKey := makeTestChain(t, "revoked.example.net", responder.URL)
+	re.Issuer, re.Key = ca, caKey
+	if _, _, err := FetchOCSPStaple(responder.Client(), &cert); err == nil {
+		t.Errorf("FetchOCSPStaple revoked expected error, actual nil")
+	}
+}
+
+func TestFetchOCSPStapleBadSignature(t *testing.T) {
+	re := &testOCSPResponder{t: t, NextUpdate: time.Now().Add(time.Hour)}
+	responder := httptest.NewServer(re)
+	defer responder.Close()
+
+	cert, _, _ := makeTestChain(t, "forged.example.net", responder.URL)
+	_, otherCA, otherKey := makeTestChain(t, "other.example.net", responder.URL)
+	re.Issuer, re.Key = otherCA, otherKey
+	if _, _, err := FetchOCSPStaple(responder.Client(), &cert); err == nil {
+		t.Errorf("FetchOCSPStaple with response signed by another CA expected error, actual nil")
+	}
+}
+
+func TestCertsRefreshOCSP(t *testing.T) {
+	re := &testOCSPResponder{t: t, NextUpdate: time.Now().Add(time.Hour)}
+	responder := httptest.NewServer(re)
+	defer responder.Close()
+
+	cert, ca, caKey := makeTestChain(t, "ocsp.example.net", responder.URL)
+	re.Issuer, re.Key = ca, caKey
+	certs, err := NewCerts([]CertConfig{{Cert: &cert}}, makeTestCert(t, "default.example.net"))
+	if err != nil {
+		t.Fatalf("NewCerts expected nil error, actual %v", err)
+	}
+	certs.ocspClient = responder.Client()
+	certs.ocspInterval = time.Minute
+	certs.refreshOCSP()
+
+	stapled, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "ocsp.example.net"})
+	if len(stapled.OCSPStaple) == 0 {
+		t.Fatalf("GetCertificate after refresh expected OCSP staple, actual none")
+	}
+	if defaultCert, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.net"}); len(defaultCert.OCSPStaple) != 0 {
+		t.Errorf("GetCertificate of certificate without OCSP responder expected no staple, actual staple")
+	}
+
+	certs.refreshOCSP()
+	if re.Requests != 1 {
+		t.Errorf("refresh of response valid past the next refresh expected 1 request, actual %v", re.Requests)
+	}
+
+	if err := certs.Set([]CertConfig{{Cert: &cert}}, makeTestCert(t, "default.example.net")); err != nil {
+		t.Fatalf("Set expected nil error, actual %v", err)
+	}
+	if reloaded, _ := certs.GetCertificate(&tls.ClientHelloInfo{ServerName: "ocsp.example.net"}); !bytes.Equal(reloaded.OCSPStaple, stapled.OCSPStaple) {
+		t.Errorf("GetCertificate after Set of the same certificate expected the existing staple, actual none")
+	}
+}
@@ -0,0 +1,89 @@
+package web
+
+/*
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+   http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// TicketKeyFileKeyLen is the length of each key in a session ticket key file. This is the same format as the ATS ssl_ticket_key_filename: 16 bytes of key name, 16 bytes of HMAC secret, and 16 bytes of AES key.
+const TicketKeyFileKeyLen = 48
+
+// tlsVersions is the TLS versions, by the names used by Delivery Services and remap rules.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersions returns the minimum and maximum of the given TLS versions, which must be "1.0", "1.1", "1.2", or "1.3". Go can't disable versions between the minimum and maximum, so those are also allowed.
+// If no versions are given, 0 is returned for both, which is Go's defaults.
+func ParseTLSVersions(versions []string) (uint16, uint16, error) {
+	min := uint16(0)
+	max := uint16(0)
+	for _, versionStr := range versions {
+		version, ok := tlsVersions[strings.TrimSpace(versionStr)]
+		if !ok {
+			return 0, 0, errors.New("unknown TLS version '" + versionStr + "'")
+		}
+		if min == 0 || version < min {
+			min = version
+		}
+		if version > max {
+			max = version
+		}
+	}
+	return min, max, nil
+}
+
+// ParseCipherSuites returns the IDs of the given cipher suites, by their Go or IANA name, e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Insecure cipher suites aren't allowed.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite.ID
+	}
+	ids := []uint16{}
+	for _, name := range names {
+		id, ok := suites[strings.TrimSpace(name)]
+		if !ok {
+			return nil, errors.New("unknown or insecure cipher suite '" + name + "'")
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadTicketKeys loads TLS session ticket keys from the given file, in the ATS ssl_ticket_key_filename format: concatenated 48-byte keys, with the first key used to encrypt new tickets, and all keys used to decrypt. Keys may be rotated by prepending a new key, and removing the oldest.
+// Each key is hashed into the 32 bytes Go uses, so the same file may be used by Grove and ATS servers, although sessions can't be resumed across them.
+func LoadTicketKeys(path string) ([][32]byte, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("reading ticket key file: " + err.Error())
+	}
+	if len(bts) == 0 || len(bts)%TicketKeyFileKeyLen != 0 {
+		return nil, errors.New("ticket key file length " + strconv.Itoa(len(bts)) + " is not a multiple of " + strconv.Itoa(TicketKeyFileKeyLen))
+	}
+	keys := [][32]byte{}
+	for i := 0; i < len(bts); i += TicketKeyFileKeyLen {
+		keys = append(keys, sha256.Sum256(bts[i:i+TicketKeyFileKeyLen]))
+	}
+	return keys, nil
+}
@@ -16,7 +16,7 @@ package web
 
 import (
 	"errors"
-	"io/ioutil"
+	"io"
 	"net"
 	"net/http"
 	"strings"
@@ -107,8 +107,9 @@ func TryFlush(w http.ResponseWriter) {
 	}
 }
 
-// request makes the given request and returns its response code, headers, body, the request time, response time, and any error.
-func Request(transport *http.Transport, r *http.Request) (int, http.Header, []byte, time.Time, time.Time, error) {
+// Request makes the given request and returns its response code, headers, body, the request time, response time, and any error.
+// The request returns as soon as the response headers are received. The body is not read, and the caller must close it.
+func Request(transport *http.Transport, r *http.Request) (int, http.Header, io.ReadCloser, time.Time, time.Time, error) {
 	log.Debugf("request requesting %v headers %v\n", r.RequestURI, r.Header)
 	rr := r
 
@@ -118,20 +119,13 @@ func Request(transport *http.Transport, r *http.Request) (int, http.Header, []by
 	if err != nil {
 		return 0, nil, nil, reqTime, respTime, errors.New("request error: " + err.Error())
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
-	// TODO determine if respTime should go here
-
-	if err != nil {
-		return 0, nil, nil, reqTime, respTime, errors.New("reading response body: " + err.Error())
-	}
-
-	return resp.StatusCode, resp.Header, body, reqTime, respTime, nil
+	// TODO determine if respTime should be after the body is read
+	return resp.StatusCode, resp.Header, resp.Body, reqTime, respTime, nil
 }
 
-// Respond writes the given code, header, and body to the ResponseWriter. If connectionClose, a Connection: Close header is also written. Returns the bytes written, and any error.
-func Respond(w http.ResponseWriter, code int, header http.Header, body []byte, connectionClose bool) (uint64, error) {
+// Respond writes the given code, header, and body to the ResponseWriter. If connectionClose, a Connection: Close header is also written. The body may be nil, in which case no body is written. Returns the bytes written, and any error.
+// The body is flushed to the client as it's written, so bodies still being received from a parent are streamed to the client as they arrive.
+func Respond(w http.ResponseWriter, code int, header http.Header, body io.WriterTo, connectionClose bool) (uint64, error) {
 	// TODO move connectionClose to modhdr plugin
 	dH := w.Header()
 	CopyHeaderTo(header, &dH)
@@ -139,12 +133,26 @@ func Respond(w http.ResponseWriter, code int, header http.Header, body []byte, c
 		dH.Add("Connection", "close")
 	}
 	w.WriteHeader(code)
-	bytesWritten, err := w.Write(body) // get the less-accurate body bytes written, in case we can't get the more accurate intercepted data
+	if body == nil {
+		return 0, nil
+	}
+	bytesWritten, err := body.WriteTo(flushWriter{w}) // get the less-accurate body bytes written, in case we can't get the more accurate intercepted data
 
 	// bytesWritten = int(WriteStats(stats, w, conn, reqFQDN, remoteAddr, code, uint64(bytesWritten))) // TODO write err to stats?
 	return uint64(bytesWritten), err
 }
 
+// flushWriter is an io.Writer which flushes the ResponseWriter after every write, if it's an http.Flusher.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	TryFlush(fw.w)
+	return n, err
+}
+
 // ServeReqErr writes the appropriate response to the client, via given writer, for a generic request error. Returns the code sent, the body bytes written, and any write error.
 func ServeReqErr(w http.ResponseWriter) (int, uint64, error) {
 	code := http.StatusBadRequest
@@ -81,6 +81,44 @@ type ParentConfigOpts struct {
 	HdrComment string
 }
 
+// ParentConfigLine is the data of a parent.config line, for users of a server's parents other than ATS, such as Grove, which would otherwise have to parse the parent.config text.
+type ParentConfigLine struct {
+	// DestDomain is the host of the origin the line applies to, or ParentConfigDestDomainDefault for the line applying to all other origins.
+	DestDomain string
+	// Port is the port of the origin the line applies to. It's empty for the default line.
+	Port string
+	// Parents are the parent= parents, in order.
+	Parents []ParentConfigParent
+	// SecondaryParents are the secondary_parent= parents, in order, used when all Parents are unavailable.
+	SecondaryParents []ParentConfigParent
+	// RoundRobin is the round_robin parent selection, e.g. "consistent_hash", "true", "strict", "false", or "latched". If empty, ATS uses "false".
+	RoundRobin string
+	// GoDirect is whether the origin may be requested directly, if all parents are unavailable.
+	GoDirect bool
+	// ParentIsProxy is false if the parents are origins, rather than caches.
+	ParentIsProxy bool
+}
+
+// ParentConfigDestDomainDefault is the DestDomain of the parent.config line for origins with no line of their own.
+const ParentConfigDestDomainDefault = "."
+
+// ParentConfigParent is a parent in a parent.config line.
+type ParentConfigParent struct {
+	// Host is the parent's host or IP, and port.
+	Host string
+	// Weight is the parent's weight. It's empty for origins which are the parent of the last cache tier.
+	Weight string
+}
+
+// String returns the parent as it appears in a parent.config list of parents, without a separator.
+func (p ParentConfigParent) String() string {
+	if p.Weight == "" {
+		return p.Host
+	}
+	return p.Host + "|" + p.Weight
+}
+
+// MakeParentDotConfig returns the parent.config for the given server.
 func MakeParentDotConfig(
 	dses []DeliveryService,
 	server *Server,
@@ -95,18 +133,56 @@ func MakeParentDotConfig(
 	cdn *tc.CDN,
 	opt ParentConfigOpts,
 ) (Cfg, error) {
+	cfg, _, err := makeParentDotConfig(dses, server, servers, topologies, tcServerParams, tcParentConfigParams, serverCapabilities, dsRequiredCapabilities, cacheGroupArr, dss, cdn, opt)
+	return cfg, err
+}
+
+// MakeParentDotConfigData returns the lines of the parent.config MakeParentDotConfig makes for the given server, and any warnings.
+// The lines are in the order of the Delivery Services they're for, sorted by name, followed by the default line, if any.
+func MakeParentDotConfigData(
+	dses []DeliveryService,
+	server *Server,
+	servers []Server,
+	topologies []tc.Topology,
+	tcServerParams []tc.Parameter,
+	tcParentConfigParams []tc.Parameter,
+	serverCapabilities map[int]map[ServerCapability]struct{},
+	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
+	cacheGroupArr []tc.CacheGroupNullable,
+	dss []DeliveryServiceServer,
+	cdn *tc.CDN,
+) ([]ParentConfigLine, []string, error) {
+	cfg, lines, err := makeParentDotConfig(dses, server, servers, topologies, tcServerParams, tcParentConfigParams, serverCapabilities, dsRequiredCapabilities, cacheGroupArr, dss, cdn, ParentConfigOpts{})
+	return lines, cfg.Warnings, err
+}
+
+// makeParentDotConfig returns the parent.config for the given server, and the data of its lines.
+func makeParentDotConfig(
+	dses []DeliveryService,
+	server *Server,
+	servers []Server,
+	topologies []tc.Topology,
+	tcServerParams []tc.Parameter,
+	tcParentConfigParams []tc.Parameter,
+	serverCapabilities map[int]map[ServerCapability]struct{},
+	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
+	cacheGroupArr []tc.CacheGroupNullable,
+	dss []DeliveryServiceServer,
+	cdn *tc.CDN,
+	opt ParentConfigOpts,
+) (Cfg, []ParentConfigLine, error) {
 	warnings := []string{}
 
 	if server.HostName == nil || *server.HostName == "" {
-		return Cfg{}, makeErr(warnings, "server HostName missing")
+		return Cfg{}, nil, makeErr(warnings, "server HostName missing")
 	} else if server.CDNName == nil || *server.CDNName == "" {
-		return Cfg{}, makeErr(warnings, "server CDNName missing")
+		return Cfg{}, nil, makeErr(warnings, "server CDNName missing")
 	} else if server.Cachegroup == nil || *server.Cachegroup == "" {
-		return Cfg{}, makeErr(warnings, "server Cachegroup missing")
+		return Cfg{}, nil, makeErr(warnings, "server Cachegroup missing")
 	} else if server.Profile == nil || *server.Profile == "" {
-		return Cfg{}, makeErr(warnings, "server Profile missing")
+		return Cfg{}, nil, makeErr(warnings, "server Profile missing")
 	} else if server.TCPPort == nil {
-		return Cfg{}, makeErr(warnings, "server TCPPort missing")
+		return Cfg{}, nil, makeErr(warnings, "server TCPPort missing")
 	}
 
 	atsMajorVer, verWarns := getATSMajorVersion(tcServerParams)
@@ -114,11 +190,11 @@ func MakeParentDotConfig(
 
 	cacheGroups, err := makeCGMap(cacheGroupArr)
 	if err != nil {
-		return Cfg{}, makeErr(warnings, "making CacheGroup map: "+err.Error())
+		return Cfg{}, nil, makeErr(warnings, "making CacheGroup map: "+err.Error())
 	}
 	serverParentCGData, err := getParentCacheGroupData(server, cacheGroups)
 	if err != nil {
-		return Cfg{}, makeErr(warnings, "getting server parent cachegroup data: "+err.Error())
+		return Cfg{}, nil, makeErr(warnings, "getting server parent cachegroup data: "+err.Error())
 	}
 	cacheIsTopLevel := isTopLevelCache(serverParentCGData)
 	serverCDNDomain := cdn.DomainName
@@ -131,6 +207,7 @@ func MakeParentDotConfig(
 	}
 
 	textArr := []string{}
+	lines := []ParentConfigLine{}
 	processedOriginsToDSNames := map[string]tc.DeliveryServiceName{}
 
 	parentConfigParamsWithProfiles, err := tcParamsToParamsWithProfiles(tcParentConfigParams)
@@ -167,10 +244,10 @@ func MakeParentDotConfig(
 	if cacheIsTopLevel {
 		for _, cg := range cacheGroups {
 			if cg.Type == nil {
-				return Cfg{}, makeErr(warnings, "cachegroup type is nil!")
+				return Cfg{}, nil, makeErr(warnings, "cachegroup type is nil!")
 			}
 			if cg.Name == nil {
-				return Cfg{}, makeErr(warnings, "cachegroup name is nil!")
+				return Cfg{}, nil, makeErr(warnings, "cachegroup name is nil!")
 			}
 
 			if *cg.Type != tc.CacheGroupOriginTypeName {
@@ -181,10 +258,10 @@ func MakeParentDotConfig(
 	} else {
 		for _, cg := range cacheGroups {
 			if cg.Type == nil {
-				return Cfg{}, makeErr(warnings, "cachegroup type is nil!")
+				return Cfg{}, nil, makeErr(warnings, "cachegroup type is nil!")
 			}
 			if cg.Name == nil {
-				return Cfg{}, makeErr(warnings, "cachegroup name is nil!")
+				return Cfg{}, nil, makeErr(warnings, "cachegroup name is nil!")
 			}
 
 			if *cg.Name == *server.Cachegroup {
@@ -254,7 +331,7 @@ func MakeParentDotConfig(
 	originServers, profileCaches, orgProfWarns, err := getOriginServersAndProfileCaches(cgServers, parentServerDSes, profileParentConfigParams, dses, serverCapabilities)
 	warnings = append(warnings, orgProfWarns...)
 	if err != nil {
-		return Cfg{}, makeErr(warnings, "getting origin servers and profile caches: "+err.Error())
+		return Cfg{}, nil, makeErr(warnings, "getting origin servers and profile caches: "+err.Error())
 	}
 
 	parentInfos := makeParentInfo(serverParentCGData, serverCDNDomain, profileCaches, originServers)
@@ -301,7 +378,7 @@ func MakeParentDotConfig(
 
 		// TODO put these in separate functions. No if-statement should be this long.
 		if ds.Topology != nil && *ds.Topology != "" {
-			txt, topoWarnings, err := getTopologyParentConfigLine(
+			txt, line, topoWarnings, err := getTopologyParentConfigLine(
 				server,
 				servers,
 				&ds,
@@ -325,6 +402,7 @@ func MakeParentDotConfig(
 
 			if txt != "" { // will be empty with no error if this server isn't in the Topology, or if it doesn't have the Required Capabilities
 				textArr = append(textArr, txt)
+				lines = append(lines, line)
 			}
 		} else if isTopLevelCache(serverParentCGData) {
 			parentQStr := "ignore"
@@ -343,11 +421,14 @@ func MakeParentDotConfig(
 
 			if ds.OriginShield != nil && *ds.OriginShield != "" {
 				algorithm := ""
+				line := ParentConfigLine{DestDomain: orgURI.Hostname(), Port: orgURI.Port(), Parents: parseParentList(*ds.OriginShield), GoDirect: true, ParentIsProxy: true}
 				if parentSelectAlg := serverParams[ParentConfigParamAlgorithm]; strings.TrimSpace(parentSelectAlg) != "" {
 					algorithm = "round_robin=" + parentSelectAlg
+					line.RoundRobin = parentSelectAlg
 				}
 				textLine += makeParentComment(opt.AddComments, *ds.XMLID, "")
 				textLine += "dest_domain=" + orgURI.Hostname() + " port=" + orgURI.Port() + " parent=" + *ds.OriginShield + " " + algorithm + " go_direct=true\n"
+				lines = append(lines, line)
 			} else if ds.MultiSiteOrigin != nil && *ds.MultiSiteOrigin {
 				textLine += makeParentComment(opt.AddComments, *ds.XMLID, "")
 				textLine += "dest_domain=" + orgURI.Hostname() + " port=" + orgURI.Port() + " "
@@ -359,7 +440,8 @@ func MakeParentDotConfig(
 					warnings = append(warnings, "DS "+*ds.XMLID+" has no parent servers")
 				}
 
-				parents, secondaryParents, parentWarns := getMSOParentStrs(&ds, parentInfos[OriginHost(orgURI.Hostname())], atsMajorVer, dsParams.Algorithm, dsParams.TryAllPrimariesBeforeSecondary)
+				parentList, secondaryParentList := getMSOParents(parentInfos[OriginHost(orgURI.Hostname())], atsMajorVer, dsParams.Algorithm)
+				parents, secondaryParents, parentWarns := getParentStrs(&ds, parentList, secondaryParentList, atsMajorVer, dsParams.TryAllPrimariesBeforeSecondary)
 				warnings = append(warnings, parentWarns...)
 
 				textLine += parents + secondaryParents + ` round_robin=` + dsParams.Algorithm + ` qstring=` + parentQStr + ` go_direct=false parent_is_proxy=false`
@@ -367,6 +449,7 @@ func MakeParentDotConfig(
 				textLine += "\n" // TODO remove, and join later on "\n" instead of ""?
 
 				textArr = append(textArr, textLine)
+				lines = append(lines, ParentConfigLine{DestDomain: orgURI.Hostname(), Port: orgURI.Port(), Parents: parentList, SecondaryParents: secondaryParentList, RoundRobin: dsParams.Algorithm})
 			}
 		} else {
 			queryStringHandling := serverParams[ParentConfigParamQStringHandling] // "qsh" in Perl
@@ -374,7 +457,8 @@ func MakeParentDotConfig(
 			roundRobin := `round_robin=consistent_hash`
 			goDirect := `go_direct=false`
 
-			parents, secondaryParents, parentWarns := getParentStrs(&ds, dsRequiredCapabilities, parentInfos[deliveryServicesAllParentsKey], atsMajorVer, dsParams.TryAllPrimariesBeforeSecondary)
+			parentList, secondaryParentList := getParents(&ds, dsRequiredCapabilities, parentInfos[deliveryServicesAllParentsKey], atsMajorVer)
+			parents, secondaryParents, parentWarns := getParentStrs(&ds, parentList, secondaryParentList, atsMajorVer, dsParams.TryAllPrimariesBeforeSecondary)
 			warnings = append(warnings, parentWarns...)
 
 			text := ""
@@ -389,6 +473,7 @@ func MakeParentDotConfig(
 			// TODO encode this in a DSType func, IsGoDirect() ?
 			if *ds.Type == tc.DSTypeHTTPNoCache || *ds.Type == tc.DSTypeHTTPLive || *ds.Type == tc.DSTypeDNSLive {
 				text += `dest_domain=` + orgURI.Hostname() + ` port=` + orgURI.Port() + ` go_direct=true` + "\n"
+				lines = append(lines, ParentConfigLine{DestDomain: orgURI.Hostname(), Port: orgURI.Port(), GoDirect: true, ParentIsProxy: true})
 			} else {
 
 				// check for profile psel.qstring_handling.  If this parameter is assigned to the server profile,
@@ -412,6 +497,7 @@ func MakeParentDotConfig(
 				}
 
 				text += `dest_domain=` + orgURI.Hostname() + ` port=` + orgURI.Port() + ` ` + parents + ` ` + secondaryParents + ` ` + roundRobin + ` ` + goDirect + ` qstring=` + parentQStr + "\n"
+				lines = append(lines, ParentConfigLine{DestDomain: orgURI.Hostname(), Port: orgURI.Port(), Parents: parentList, SecondaryParents: secondaryParentList, RoundRobin: tc.AlgorithmConsistentHash, ParentIsProxy: true})
 			}
 
 			textArr = append(textArr, text)
@@ -425,13 +511,17 @@ func MakeParentDotConfig(
 		invalidDS := &DeliveryService{}
 		invalidDS.ID = util.IntPtr(-1)
 		tryAllPrimariesBeforeSecondary := false
-		parents, secondaryParents, parentWarns := getParentStrs(invalidDS, dsRequiredCapabilities, parentInfos[deliveryServicesAllParentsKey], atsMajorVer, tryAllPrimariesBeforeSecondary)
+		parentList, secondaryParentList := getParents(invalidDS, dsRequiredCapabilities, parentInfos[deliveryServicesAllParentsKey], atsMajorVer)
+		parents, secondaryParents, parentWarns := getParentStrs(invalidDS, parentList, secondaryParentList, atsMajorVer, tryAllPrimariesBeforeSecondary)
 		warnings = append(warnings, parentWarns...)
-		defaultDestText = `dest_domain=. ` + parents
+		defaultDestText = `dest_domain=` + ParentConfigDestDomainDefault + ` ` + parents
 		if serverParams[ParentConfigParamAlgorithm] == tc.AlgorithmConsistentHash {
 			defaultDestText += secondaryParents
+		} else {
+			secondaryParentList = nil
 		}
 		defaultDestText += ` round_robin=consistent_hash go_direct=false`
+		lines = append(lines, ParentConfigLine{DestDomain: ParentConfigDestDomainDefault, Parents: parentList, SecondaryParents: secondaryParentList, RoundRobin: tc.AlgorithmConsistentHash, ParentIsProxy: true})
 
 		if qStr := serverParams[ParentConfigParamQString]; qStr != "" {
 			defaultDestText += ` qstring=` + qStr
@@ -449,7 +539,7 @@ func MakeParentDotConfig(
 		ContentType: ContentTypeParentDotConfig,
 		LineComment: LineCommentParentDotConfig,
 		Warnings:    warnings,
-	}, nil
+	}, lines, nil
 }
 
 // makeParentComment creates the parent line comment and returns it.
@@ -497,14 +587,15 @@ type parentInfo struct {
 	Capabilities    map[ServerCapability]struct{}
 }
 
-func (p parentInfo) Format() string {
+// Parent returns the parent.config parent of the parentInfo.
+func (p parentInfo) Parent() ParentConfigParent {
 	host := ""
 	if p.UseIP {
 		host = p.IP
 	} else {
 		host = p.Host + "." + p.Domain
 	}
-	return host + ":" + strconv.Itoa(p.Port) + "|" + p.Weight + ";"
+	return ParentConfigParent{Host: host + ":" + strconv.Itoa(p.Port), Weight: p.Weight}
 }
 
 type parentInfos map[OriginHost]parentInfo
@@ -746,23 +837,23 @@ func getTopologyParentConfigLine(
 	atsMajorVer int,
 	dsOrigins map[ServerID]struct{},
 	addComments bool,
-) (string, []string, error) {
+) (string, ParentConfigLine, []string, error) {
 	warnings := []string{}
 	txt := ""
 
 	if !hasRequiredCapabilities(serverCapabilities[*server.ID], dsRequiredCapabilities[*ds.ID]) {
-		return "", warnings, nil
+		return "", ParentConfigLine{}, warnings, nil
 	}
 
 	orgURI, orgWarns, err := getOriginURI(*ds.OrgServerFQDN)
 	warnings = append(warnings, orgWarns...)
 	if err != nil {
-		return "", warnings, errors.New("DS '" + *ds.XMLID + "' has malformed origin URI: '" + *ds.OrgServerFQDN + "': skipping!" + err.Error())
+		return "", ParentConfigLine{}, warnings, errors.New("DS '" + *ds.XMLID + "' has malformed origin URI: '" + *ds.OrgServerFQDN + "': skipping!" + err.Error())
 	}
 
 	topology := nameTopologies[TopologyName(*ds.Topology)]
 	if topology.Name == "" {
-		return "", warnings, errors.New("DS " + *ds.XMLID + " topology '" + *ds.Topology + "' not found in Topologies!")
+		return "", ParentConfigLine{}, warnings, errors.New("DS " + *ds.XMLID + " topology '" + *ds.Topology + "' not found in Topologies!")
 	}
 
 	txt += makeParentComment(addComments, *ds.XMLID, *ds.Topology)
@@ -770,38 +861,48 @@ func getTopologyParentConfigLine(
 
 	serverPlacement, err := getTopologyPlacement(tc.CacheGroupName(*server.Cachegroup), topology, cacheGroups, ds)
 	if err != nil {
-		return "", warnings, errors.New("getting topology placement: " + err.Error())
+		return "", ParentConfigLine{}, warnings, errors.New("getting topology placement: " + err.Error())
 	}
 	if !serverPlacement.InTopology {
-		return "", warnings, nil // server isn't in topology, no error
+		return "", ParentConfigLine{}, warnings, nil // server isn't in topology, no error
 	}
 	// TODO add Topology/Capabilities to remap.config
 
 	parents, secondaryParents, parentWarnings, err := getTopologyParents(server, ds, servers, parentConfigParams, topology, serverPlacement.IsLastTier, serverCapabilities, dsRequiredCapabilities, dsOrigins)
 	warnings = append(warnings, parentWarnings...)
 	if err != nil {
-		return "", warnings, errors.New("getting topology parents for '" + *ds.XMLID + "': skipping! " + err.Error())
+		return "", ParentConfigLine{}, warnings, errors.New("getting topology parents for '" + *ds.XMLID + "': skipping! " + err.Error())
 	}
 	if len(parents) == 0 {
-		return "", warnings, errors.New("getting topology parents for '" + *ds.XMLID + "': no parents found! skipping! (Does your Topology have a CacheGroup with no servers in it?)")
+		return "", ParentConfigLine{}, warnings, errors.New("getting topology parents for '" + *ds.XMLID + "': no parents found! skipping! (Does your Topology have a CacheGroup with no servers in it?)")
+	}
+
+	line := ParentConfigLine{
+		DestDomain:       orgURI.Hostname(),
+		Port:             orgURI.Port(),
+		Parents:          parents,
+		SecondaryParents: secondaryParents,
+		RoundRobin:       getTopologyRoundRobin(ds, serverParams, serverPlacement.IsLastCacheTier, dsParams.Algorithm),
+		GoDirect:         getTopologyGoDirect(ds, serverPlacement.IsLastTier) == "true",
+		ParentIsProxy:    !serverPlacement.IsLastCacheTier,
 	}
 
-	txt += ` parent="` + strings.Join(parents, `;`) + `"`
+	txt += ` parent="` + joinParents(parents, `;`) + `"`
 	if len(secondaryParents) > 0 {
-		txt += ` secondary_parent="` + strings.Join(secondaryParents, `;`) + `"`
+		txt += ` secondary_parent="` + joinParents(secondaryParents, `;`) + `"`
 
 		secondaryModeStr, secondaryModeWarnings := getSecondaryModeStr(dsParams.TryAllPrimariesBeforeSecondary, atsMajorVer, tc.DeliveryServiceName(*ds.XMLID))
 		warnings = append(warnings, secondaryModeWarnings...)
 		txt += secondaryModeStr
 	}
-	txt += ` round_robin=` + getTopologyRoundRobin(ds, serverParams, serverPlacement.IsLastCacheTier, dsParams.Algorithm)
+	txt += ` round_robin=` + line.RoundRobin
 	txt += ` go_direct=` + getTopologyGoDirect(ds, serverPlacement.IsLastTier)
 	txt += ` qstring=` + getTopologyQueryString(ds, serverParams, serverPlacement.IsLastCacheTier, dsParams.Algorithm, dsParams.QueryStringHandling)
 	txt += getTopologyParentIsProxyStr(serverPlacement.IsLastCacheTier)
 	txt += getParentRetryStr(serverPlacement.IsLastCacheTier, atsMajorVer, dsParams.ParentRetry, dsParams.UnavailableServerRetryResponses, dsParams.MaxSimpleRetries, dsParams.MaxUnavailableServerRetries)
 	txt += "\n"
 
-	return txt, warnings, nil
+	return txt, line, warnings, nil
 }
 
 // getParentRetryStr builds the parent retry directive(s).
@@ -950,22 +1051,23 @@ func serverParentageParams(sv *Server, params []parameterWithProfilesMap) (profi
 	return profileCache, warnings
 }
 
-func serverParentStr(sv *Server, svParams profileCache) (string, error) {
+// serverParent returns the server as a parent, and whether it may be a parent, which it may not if its Parameters say it's not_a_parent.
+func serverParent(sv *Server, svParams profileCache) (ParentConfigParent, bool, error) {
 	if svParams.NotAParent {
-		return "", nil
+		return ParentConfigParent{}, false, nil
 	}
 	host := ""
 	if svParams.UseIP {
 		// TODO get service interface here
 		ip := getServerIPAddress(sv)
 		if ip == nil {
-			return "", errors.New("server params Use IP, but has no valid IPv4 Service Address")
+			return ParentConfigParent{}, false, errors.New("server params Use IP, but has no valid IPv4 Service Address")
 		}
 		host = ip.String()
 	} else {
 		host = *sv.HostName + "." + *sv.DomainName
 	}
-	return host + ":" + strconv.Itoa(svParams.Port) + "|" + svParams.Weight, nil
+	return ParentConfigParent{Host: host + ":" + strconv.Itoa(svParams.Port), Weight: svParams.Weight}, true, nil
 }
 
 // GetTopologyParents returns the parents, secondary parents, any warnings, and any error.
@@ -979,7 +1081,7 @@ func getTopologyParents(
 	serverCapabilities map[int]map[ServerCapability]struct{},
 	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
 	dsOrigins map[ServerID]struct{}, // for Topology DSes, MSO still needs DeliveryServiceServer assignments.
-) ([]string, []string, []string, error) {
+) ([]ParentConfigParent, []ParentConfigParent, []string, error) {
 	warnings := []string{}
 	// If it's the last tier, then the parent is the origin.
 	// Note this doesn't include MSO, whose final tier cachegroup points to the origin cachegroup.
@@ -989,7 +1091,7 @@ func getTopologyParents(
 		if err != nil {
 			return nil, nil, warnings, err
 		}
-		return []string{orgURI.Host}, nil, warnings, nil
+		return []ParentConfigParent{{Host: orgURI.Host}}, nil, warnings, nil
 	}
 
 	svNode := tc.TopologyNode{}
@@ -1026,8 +1128,8 @@ func getTopologyParents(
 		return nil, nil, warnings, errors.New("Server '" + *server.HostName + "' DS " + *ds.XMLID + " topology '" + *ds.Topology + "' cachegroup '" + *server.Cachegroup + "' topology node parent " + strconv.Itoa(svNode.Parents[0]) + " is not in the topology!")
 	}
 
-	parentStrs := []string{}
-	secondaryParentStrs := []string{}
+	parents := []ParentConfigParent{}
+	secondaryParents := []ParentConfigParent{}
 
 	serversWithParams := []serverWithParams{}
 	for _, sv := range servers {
@@ -1072,24 +1174,26 @@ func getTopologyParents(
 			continue
 		}
 		if *sv.Cachegroup == parentCG {
-			parentStr, err := serverParentStr(&sv.Server, sv.Params)
+			parent, isParent, err := serverParent(&sv.Server, sv.Params)
 			if err != nil {
 				return nil, nil, warnings, errors.New("getting server parent string: " + err.Error())
 			}
-			if parentStr != "" { // will be empty if server is not_a_parent (possibly other reasons)
-				parentStrs = append(parentStrs, parentStr)
+			if isParent {
+				parents = append(parents, parent)
 			}
 		}
 		if *sv.Cachegroup == secondaryParentCG {
-			parentStr, err := serverParentStr(&sv.Server, sv.Params)
+			parent, isParent, err := serverParent(&sv.Server, sv.Params)
 			if err != nil {
 				return nil, nil, warnings, errors.New("getting server parent string: " + err.Error())
 			}
-			secondaryParentStrs = append(secondaryParentStrs, parentStr)
+			if isParent {
+				secondaryParents = append(secondaryParents, parent)
+			}
 		}
 	}
 
-	return parentStrs, secondaryParentStrs, warnings, nil
+	return parents, secondaryParents, warnings, nil
 }
 
 // getOriginURI returns the URL, any warnings, and any error.
@@ -1112,17 +1216,16 @@ func getOriginURI(fqdn string) (*url.URL, []string, error) {
 	return orgURI, warnings, nil
 }
 
-// getParentStrs returns the parents= and secondary_parents= strings for ATS parent.config lines, and any warnings.
-func getParentStrs(
+// getParents returns the parents and secondary parents of the given DS for ATS parent.config lines.
+// If there are no primary parents, the secondary parents are used as the parents. If the ATS version doesn't support secondary parents, they're appended to the parents.
+func getParents(
 	ds *DeliveryService,
 	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
 	parentInfos []parentInfo,
 	atsMajorVer int,
-	tryAllPrimariesBeforeSecondary bool,
-) (string, string, []string) {
-	warnings := []string{}
-	parentInfo := []string{}
-	secondaryParentInfo := []string{}
+) ([]ParentConfigParent, []ParentConfigParent) {
+	parents := []ParentConfigParent{}
+	secondaryParents := []ParentConfigParent{}
 
 	sort.Sort(parentInfoSortByRank(parentInfos))
 
@@ -1131,112 +1234,146 @@ func getParentStrs(
 			continue
 		}
 
-		pTxt := parent.Format()
 		if parent.PrimaryParent {
-			parentInfo = append(parentInfo, pTxt)
+			parents = append(parents, parent.Parent())
 		} else if parent.SecondaryParent {
-			secondaryParentInfo = append(secondaryParentInfo, pTxt)
+			secondaryParents = append(secondaryParents, parent.Parent())
 		}
 	}
 
-	if len(parentInfo) == 0 {
-		parentInfo = secondaryParentInfo
-		secondaryParentInfo = []string{}
+	if len(parents) == 0 {
+		parents = secondaryParents
+		secondaryParents = []ParentConfigParent{}
 	}
 
 	// TODO remove duplicate code with top level if block
-	seen := map[string]struct{}{} // TODO change to host+port? host isn't unique
-	parentInfo, seen = util.RemoveStrDuplicates(parentInfo, seen)
-	secondaryParentInfo, seen = util.RemoveStrDuplicates(secondaryParentInfo, seen)
+	seen := map[ParentConfigParent]struct{}{} // TODO change to host+port? host isn't unique
+	parents = removeParentDuplicates(parents, seen)
+	secondaryParents = removeParentDuplicates(secondaryParents, seen)
 
-	dsName := tc.DeliveryServiceName("")
-	if ds != nil && ds.XMLID != nil {
-		dsName = tc.DeliveryServiceName(*ds.XMLID)
-	}
-
-	parents := ""
-	secondaryParents := "" // "secparents" in Perl
-
-	if atsMajorVer >= 6 && len(secondaryParentInfo) > 0 {
-		parents = `parent="` + strings.Join(parentInfo, "") + `"`
-		secondaryParents = ` secondary_parent="` + strings.Join(secondaryParentInfo, "") + `"`
-		secondaryModeStr, secondaryModeWarnings := getSecondaryModeStr(tryAllPrimariesBeforeSecondary, atsMajorVer, dsName)
-		warnings = append(warnings, secondaryModeWarnings...)
-		secondaryParents += secondaryModeStr
-	} else {
-		parents = `parent="` + strings.Join(parentInfo, "") + strings.Join(secondaryParentInfo, "") + `"`
+	if atsMajorVer < 6 {
+		return append(parents, secondaryParents...), []ParentConfigParent{}
 	}
-
-	return parents, secondaryParents, warnings
+	return parents, secondaryParents
 }
 
-// getMSOParentStrs returns the parents= and secondary_parents= strings for ATS parent.config lines for MSO, and any warnings.
-func getMSOParentStrs(
-	ds *DeliveryService,
+// getMSOParents returns the parents and secondary parents for ATS parent.config lines for MSO.
+// Parents in neither the primary or secondary parent cachegroup are secondary parents. If the ATS version doesn't support secondary parents, or the algorithm isn't consistent hash, secondary parents are appended to the parents.
+func getMSOParents(
 	parentInfos []parentInfo,
 	atsMajorVer int,
 	msoAlgorithm string,
-	tryAllPrimariesBeforeSecondary bool,
-) (string, string, []string) {
-	warnings := []string{}
-	// TODO determine why MSO is different, and if possible, combine with getParentAndSecondaryParentStrs.
+) ([]ParentConfigParent, []ParentConfigParent) {
+	// TODO determine why MSO is different, and if possible, combine with getParents.
 
 	rankedParents := parentInfoSortByRank(parentInfos)
 	sort.Sort(rankedParents)
 
-	parentInfoTxt := []string{}
-	secondaryParentInfo := []string{}
-	nullParentInfo := []string{}
+	parents := []ParentConfigParent{}
+	secondaryParents := []ParentConfigParent{}
+	nullParents := []ParentConfigParent{}
 	for _, parent := range ([]parentInfo)(rankedParents) {
 		if parent.PrimaryParent {
-			parentInfoTxt = append(parentInfoTxt, parent.Format())
+			parents = append(parents, parent.Parent())
 		} else if parent.SecondaryParent {
-			secondaryParentInfo = append(secondaryParentInfo, parent.Format())
+			secondaryParents = append(secondaryParents, parent.Parent())
 		} else {
-			nullParentInfo = append(nullParentInfo, parent.Format())
+			nullParents = append(nullParents, parent.Parent())
 		}
 	}
 
-	if len(parentInfoTxt) == 0 {
+	if len(parents) == 0 {
 		// If no parents are found in the secondary parent either, then set the null parent list (parents in neither secondary or primary)
 		// as the secondary parent list and clear the null parent list.
-		if len(secondaryParentInfo) == 0 {
-			secondaryParentInfo = nullParentInfo
-			nullParentInfo = []string{}
+		if len(secondaryParents) == 0 {
+			secondaryParents = nullParents
+			nullParents = []ParentConfigParent{}
 		}
-		parentInfoTxt = secondaryParentInfo
-		secondaryParentInfo = []string{} // TODO should thi be '= secondary'? Currently emulates Perl
+		parents = secondaryParents
+		secondaryParents = []ParentConfigParent{} // TODO should thi be '= secondary'? Currently emulates Perl
 	}
 
 	// TODO benchmark, verify this isn't slow. if it is, it could easily be made faster
-	seen := map[string]struct{}{} // TODO change to host+port? host isn't unique
-	parentInfoTxt, seen = util.RemoveStrDuplicates(parentInfoTxt, seen)
-	secondaryParentInfo, seen = util.RemoveStrDuplicates(secondaryParentInfo, seen)
-	nullParentInfo, seen = util.RemoveStrDuplicates(nullParentInfo, seen)
+	seen := map[ParentConfigParent]struct{}{} // TODO change to host+port? host isn't unique
+	parents = removeParentDuplicates(parents, seen)
+	secondaryParents = removeParentDuplicates(secondaryParents, seen)
+	nullParents = removeParentDuplicates(nullParents, seen)
 
-	secondaryParentStr := strings.Join(secondaryParentInfo, "") + strings.Join(nullParentInfo, "")
+	secondaryParents = append(secondaryParents, nullParents...)
+
+	// If the ats version supports it and the algorithm is consistent hash, put secondary and non-primary parents into secondary parent group.
+	// This will ensure that secondary and tertiary parents will be unused unless all hosts in the primary group are unavailable.
+	if atsMajorVer < 6 || msoAlgorithm != "consistent_hash" {
+		return append(parents, secondaryParents...), []ParentConfigParent{}
+	}
+	return parents, secondaryParents
+}
+
+// getParentStrs returns the parents= and secondary_parents= strings for ATS parent.config lines, and any warnings.
+func getParentStrs(
+	ds *DeliveryService,
+	parents []ParentConfigParent,
+	secondaryParents []ParentConfigParent,
+	atsMajorVer int,
+	tryAllPrimariesBeforeSecondary bool,
+) (string, string, []string) {
+	warnings := []string{}
+	parentsStr := `parent="` + joinParents(parents, ";") + `;"`
+	if len(parents) == 0 {
+		parentsStr = `parent=""`
+	}
+	if len(secondaryParents) == 0 {
+		return parentsStr, "", warnings
+	}
 
 	dsName := tc.DeliveryServiceName("")
 	if ds != nil && ds.XMLID != nil {
 		dsName = tc.DeliveryServiceName(*ds.XMLID)
 	}
 
-	// If the ats version supports it and the algorithm is consistent hash, put secondary and non-primary parents into secondary parent group.
-	// This will ensure that secondary and tertiary parents will be unused unless all hosts in the primary group are unavailable.
+	secondaryParentsStr := ` secondary_parent="` + joinParents(secondaryParents, ";") + `;"`
+	secondaryModeStr, secondaryModeWarnings := getSecondaryModeStr(tryAllPrimariesBeforeSecondary, atsMajorVer, dsName)
+	warnings = append(warnings, secondaryModeWarnings...)
+	return parentsStr, secondaryParentsStr + secondaryModeStr, warnings
+}
+
+// joinParents returns the given parents as they appear in a parent.config list of parents, joined by the given separator.
+func joinParents(parents []ParentConfigParent, sep string) string {
+	strs := make([]string, 0, len(parents))
+	for _, parent := range parents {
+		strs = append(strs, parent.String())
+	}
+	return strings.Join(strs, sep)
+}
 
-	parents := ""
-	secondaryParents := ""
+// removeParentDuplicates returns the given parents without any in seen, or any duplicates, and adds them to seen.
+func removeParentDuplicates(parents []ParentConfigParent, seen map[ParentConfigParent]struct{}) []ParentConfigParent {
+	unique := []ParentConfigParent{}
+	for _, parent := range parents {
+		if _, ok := seen[parent]; ok {
+			continue
+		}
+		seen[parent] = struct{}{}
+		unique = append(unique, parent)
+	}
+	return unique
+}
 
-	if atsMajorVer >= 6 && msoAlgorithm == "consistent_hash" && len(secondaryParentStr) > 0 {
-		parents = `parent="` + strings.Join(parentInfoTxt, "") + `"`
-		secondaryParents = ` secondary_parent="` + secondaryParentStr + `"`
-		secondaryModeStr, secondaryModeWarnings := getSecondaryModeStr(tryAllPrimariesBeforeSecondary, atsMajorVer, dsName)
-		warnings = append(warnings, secondaryModeWarnings...)
-		secondaryParents += secondaryModeStr
-	} else {
-		parents = `parent="` + strings.Join(parentInfoTxt, "") + secondaryParentStr + `"`
+// parseParentList parses a parent.config list of parents, of the form `host:port|weight;host:port|weight`, such as a Delivery Service's Origin Shield.
+func parseParentList(s string) []ParentConfigParent {
+	parents := []ParentConfigParent{}
+	for _, parentStr := range strings.Split(s, ";") {
+		if parentStr = strings.TrimSpace(parentStr); parentStr == "" {
+			continue
+		}
+		parent := ParentConfigParent{Host: parentStr}
+		if i := strings.Index(parentStr, "|"); i >= 0 {
+			parent.Host = parentStr[:i]
+			parent.Weight = parentStr[i+1:]
+		}
+		parents = append(parents, parent)
 	}
-	return parents, secondaryParents, warnings
+	return parents
 }
 
 func makeParentInfo(
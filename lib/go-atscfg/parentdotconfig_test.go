@@ -2033,6 +2033,32 @@ func TestMakeParentDotConfigSecondaryMode(t *testing.T) {
 	if strings.Count(txt, "secondary_mode=2") != 2 {
 		t.Errorf("expected secondary_mode=2 for both Topology and DSS DSes with ParentConfigParamSecondaryMode parameter and secondary parents, actual: '%v'", txt)
 	}
+
+	lines, _, err := MakeParentDotConfigData(dses, server, servers, topologies, serverParams, parentConfigParams, serverCapabilities, dsRequiredCapabilities, cgs, dss, cdn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedDestDomains := []string{"ds0.example.net", "ds1.example.net", ParentConfigDestDomainDefault}
+	if len(lines) != len(expectedDestDomains) {
+		t.Fatalf("expected %v parent lines, actual: %+v", len(expectedDestDomains), lines)
+	}
+	for i, line := range lines {
+		if line.DestDomain != expectedDestDomains[i] {
+			t.Errorf("expected line %v dest_domain '%v', actual: '%v'", i, expectedDestDomains[i], line.DestDomain)
+		}
+		if len(line.Parents) != 1 || !strings.HasPrefix(line.Parents[0].Host, "mymid.") {
+			t.Errorf("expected line %v parents 'mymid', actual: %+v", i, line.Parents)
+		}
+		if len(line.SecondaryParents) != 1 || !strings.HasPrefix(line.SecondaryParents[0].Host, "mymid1.") {
+			t.Errorf("expected line %v secondary parents 'mymid1', actual: %+v", i, line.SecondaryParents)
+		}
+		if line.RoundRobin != tc.AlgorithmConsistentHash || line.GoDirect || !line.ParentIsProxy {
+			t.Errorf("expected line %v round_robin=consistent_hash go_direct=false parent_is_proxy=true, actual: %+v", i, line)
+		}
+		if !strings.Contains(txt, `parent="`+line.Parents[0].String()) {
+			t.Errorf("expected line %v parent '%v' in text, actual: '%v'", i, line.Parents[0], txt)
+		}
+	}
 }
 
 func TestMakeParentDotConfigNoSecondaryMode(t *testing.T) {
@@ -108,6 +108,84 @@ func MakeRemapDotConfig(
 	}, nil
 }
 
+// RemapDeliveryService is a Delivery Service mapped by a server's remap.config, with the request and origin URLs it's mapped from and to.
+type RemapDeliveryService struct {
+	DeliveryService DeliveryService
+	Lines           []RemapLine
+}
+
+// MakeRemapDeliveryServices returns the Delivery Services mapped by the given server's remap.config, with their remap lines, and any warnings.
+//
+// Delivery Services are selected exactly as MakeRemapDotConfig selects them, by assignment, Topology, Server Capabilities, and type, for caches other than ATS which need to serve the same Delivery Services.
+// Mid lines map each Delivery Service origin to itself, even if ATS wouldn't need a remap.config line for it. ANY_MAP Delivery Services are omitted, because their remap text is ATS-specific.
+func MakeRemapDeliveryServices(
+	server *Server,
+	unfilteredDSes []DeliveryService,
+	dss []DeliveryServiceServer,
+	dsRegexArr []tc.DeliveryServiceRegexes,
+	cdn *tc.CDN,
+	topologies []tc.Topology,
+	serverCapabilities map[int]map[ServerCapability]struct{},
+	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
+) ([]RemapDeliveryService, []string, error) {
+	warnings := []string{}
+	if server.HostName == nil {
+		return nil, warnings, errors.New("server HostName missing")
+	} else if server.ID == nil {
+		return nil, warnings, errors.New("server ID missing")
+	} else if server.Cachegroup == nil {
+		return nil, warnings, errors.New("server Cachegroup missing")
+	}
+
+	dsRegexes := makeDSRegexMap(dsRegexArr)
+	dses, dsWarns := remapFilterDSes(server, dss, unfilteredDSes, nil)
+	warnings = append(warnings, dsWarns...)
+	nameTopologies := makeTopologyNameMap(topologies)
+	isMid := tc.CacheTypeFromString(server.Type) == tc.CacheTypeMid
+
+	remapDSes := []RemapDeliveryService{}
+	for _, ds := range dses {
+		includesDS, err := remapIncludesDS(server, &ds, nameTopologies, serverCapabilities, dsRequiredCapabilities)
+		if err != nil {
+			return nil, warnings, err
+		}
+		if !includesDS || *ds.Type == tc.DSTypeAnyMap {
+			continue
+		}
+		if *ds.OrgServerFQDN == "" {
+			warnings = append(warnings, "ds '"+*ds.XMLID+"' has no origin fqdn, skipping!")
+			continue
+		}
+
+		if isMid {
+			remapDSes = append(remapDSes, RemapDeliveryService{DeliveryService: ds, Lines: []RemapLine{{From: *ds.OrgServerFQDN, To: *ds.OrgServerFQDN}}})
+			continue
+		}
+
+		requestFQDNs, err := getDSRequestFQDNs(&ds, dsRegexes[tc.DeliveryServiceName(*ds.XMLID)], server, cdn.DomainName)
+		if err != nil {
+			warnings = append(warnings, "error getting ds '"+*ds.XMLID+"' request fqdns, skipping! Error: "+err.Error())
+			continue
+		}
+		lines := []RemapLine{}
+		for _, requestFQDN := range requestFQDNs {
+			remapLines, err := makeEdgeDSDataRemapLines(ds, requestFQDN, server, cdn.DomainName)
+			if err != nil {
+				warnings = append(warnings, "DS '"+*ds.XMLID+"' - skipping! : "+err.Error())
+				continue
+			}
+			for _, line := range remapLines {
+				line.From = strings.Replace(line.From, `__http__`, *server.HostName, -1)
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) > 0 {
+			remapDSes = append(remapDSes, RemapDeliveryService{DeliveryService: ds, Lines: lines})
+		}
+	}
+	return remapDSes, warnings, nil
+}
+
 // getServerConfigRemapDotConfigForMid returns the remap lines, any warnings, and any error.
 func getServerConfigRemapDotConfigForMid(
 	atsMajorVersion int,
@@ -124,24 +202,14 @@ func getServerConfigRemapDotConfigForMid(
 	warnings := []string{}
 	midRemaps := map[string]string{}
 	for _, ds := range dses {
-		if !hasRequiredCapabilities(serverCapabilities[*server.ID], dsRequiredCapabilities[*ds.ID]) {
-			continue
-		}
-
-		topology, hasTopology := nameTopologies[TopologyName(*ds.Topology)]
-		if *ds.Topology != "" && hasTopology {
-			topoIncludesServer, err := topologyIncludesServerNullable(topology, server)
-			if err != nil {
-				return "", warnings, errors.New("getting Topology Server inclusion: " + err.Error())
-			}
-			if !topoIncludesServer {
-				continue
-			}
+		includesDS, err := remapIncludesDS(server, &ds, nameTopologies, serverCapabilities, dsRequiredCapabilities)
+		if err != nil {
+			return "", warnings, err
 		}
-
-		if !ds.Type.UsesMidCache() && (!hasTopology || *ds.Topology == "") {
-			continue // Live local delivery services skip mids (except Topologies ignore DS types)
+		if !includesDS {
+			continue
 		}
+		topology := nameTopologies[TopologyName(*ds.Topology)]
 
 		if ds.OrgServerFQDN == nil || *ds.OrgServerFQDN == "" {
 			warnings = append(warnings, "ds '"+*ds.XMLID+"' has no origin fqdn, skipping!") // TODO confirm - Perl uses without checking!
@@ -233,20 +301,15 @@ func getServerConfigRemapDotConfigForEdge(
 	textLines := []string{}
 
 	for _, ds := range dses {
-		if !hasRequiredCapabilities(serverCapabilities[*server.ID], dsRequiredCapabilities[*ds.ID]) {
+		includesDS, err := remapIncludesDS(server, &ds, nameTopologies, serverCapabilities, dsRequiredCapabilities)
+		if err != nil {
+			return "", warnings, err
+		}
+		if !includesDS {
 			continue
 		}
-
 		topology, hasTopology := nameTopologies[TopologyName(*ds.Topology)]
-		if *ds.Topology != "" && hasTopology {
-			topoIncludesServer, err := topologyIncludesServerNullable(topology, server)
-			if err != nil {
-				return "", warnings, errors.New("getting topology server inclusion: " + err.Error())
-			}
-			if !topoIncludesServer {
-				continue
-			}
-		}
+
 		remapText := ""
 		if *ds.Type == tc.DSTypeAnyMap {
 			if ds.RemapText == nil {
@@ -437,7 +500,8 @@ func makeDSTopologyHeaderRewriteTxt(ds DeliveryService, cg tc.CacheGroupName, to
 	return txt, nil
 }
 
-type remapLine struct {
+// RemapLine is a remap.config rule, mapping requests for the From URL to the To URL.
+type RemapLine struct {
 	From string
 	To   string
 }
@@ -450,12 +514,12 @@ func makeEdgeDSDataRemapLines(
 	//	dsRegex tc.DeliveryServiceRegex,
 	server *Server,
 	cdnDomain string,
-) ([]remapLine, error) {
+) ([]RemapLine, error) {
 	if ds.Protocol == nil {
 		return nil, errors.New("ds had nil protocol")
 	}
 
-	remapLines := []remapLine{}
+	remapLines := []RemapLine{}
 	mapTo := *ds.OrgServerFQDN + "/"
 
 	portStr := ""
@@ -472,10 +536,10 @@ func makeEdgeDSDataRemapLines(
 	mapFromHTTPS := "https://" + requestFQDN + httpsPortStr + "/"
 
 	if *ds.Protocol == tc.DSProtocolHTTP || *ds.Protocol == tc.DSProtocolHTTPAndHTTPS {
-		remapLines = append(remapLines, remapLine{From: mapFromHTTP, To: mapTo})
+		remapLines = append(remapLines, RemapLine{From: mapFromHTTP, To: mapTo})
 	}
 	if *ds.Protocol == tc.DSProtocolHTTPS || *ds.Protocol == tc.DSProtocolHTTPToHTTPS || *ds.Protocol == tc.DSProtocolHTTPAndHTTPS {
-		remapLines = append(remapLines, remapLine{From: mapFromHTTPS, To: mapTo})
+		remapLines = append(remapLines, RemapLine{From: mapFromHTTPS, To: mapTo})
 	}
 
 	return remapLines, nil
@@ -616,6 +680,36 @@ func remapFilterDSes(server *Server, dss []DeliveryServiceServer, dses []Deliver
 	return filteredDSes, warnings
 }
 
+// remapIncludesDS returns whether the given server's remap.config includes the given Delivery Service, per the server's Server Capabilities and the Delivery Service's Topology and type, and any error.
+// The ds must have been returned by remapFilterDSes.
+func remapIncludesDS(
+	server *Server,
+	ds *DeliveryService,
+	nameTopologies map[TopologyName]tc.Topology,
+	serverCapabilities map[int]map[ServerCapability]struct{},
+	dsRequiredCapabilities map[int]map[ServerCapability]struct{},
+) (bool, error) {
+	if !hasRequiredCapabilities(serverCapabilities[*server.ID], dsRequiredCapabilities[*ds.ID]) {
+		return false, nil
+	}
+
+	topology, hasTopology := nameTopologies[TopologyName(*ds.Topology)]
+	if *ds.Topology != "" && hasTopology {
+		topoIncludesServer, err := topologyIncludesServerNullable(topology, server)
+		if err != nil {
+			return false, errors.New("getting topology server inclusion: " + err.Error())
+		}
+		if !topoIncludesServer {
+			return false, nil
+		}
+	}
+
+	if tc.CacheTypeFromString(server.Type) == tc.CacheTypeMid && !ds.Type.UsesMidCache() && (!hasTopology || *ds.Topology == "") {
+		return false, nil // Live local delivery services skip mids (except Topologies ignore DS types)
+	}
+	return true, nil
+}
+
 // makeDSProfilesCacheKeyConfigParams returns a map[ProfileID][ParamName]ParamValue for the cache key params for each profile.
 // Returns the params, any warnings, and any error.
 func makeDSProfilesCacheKeyConfigParams(server *Server, dses []DeliveryService, cacheKeyParams []tc.Parameter) (map[int]map[string]string, []string, error) {
@@ -8159,3 +8159,93 @@ func TestMakeRemapDotConfigMidNoNoCacheRemapLine(t *testing.T) {
 		t.Errorf("expected remap line for HTTP_NO_CACHE to not exist on Mid server, regardless of Mid Header Rewrite, actual '%v'", txt)
 	}
 }
+
+func TestMakeRemapDeliveryServices(t *testing.T) {
+	server := makeTestRemapServer()
+	server.Type = "EDGE"
+
+	makeDS := func(id int, name string, topology string) DeliveryService {
+		ds := DeliveryService{}
+		ds.ID = util.IntPtr(id)
+		ds.XMLID = util.StrPtr(name)
+		dsType := tc.DSTypeHTTP
+		ds.Type = &dsType
+		ds.OrgServerFQDN = util.StrPtr("http://" + name + ".example.test")
+		ds.Protocol = util.IntPtr(int(tc.DSProtocolHTTPAndHTTPS))
+		ds.DSCP = util.IntPtr(0)
+		ds.Active = util.BoolPtr(true)
+		if topology != "" {
+			ds.Topology = util.StrPtr(topology)
+		}
+		return ds
+	}
+
+	dses := []DeliveryService{
+		makeDS(1, "assigned", ""),
+		makeDS(2, "unassigned", ""),
+		makeDS(3, "topo", "t0"),
+		makeDS(4, "othertopo", "t1"),
+		makeDS(5, "topocap", "t0"),
+	}
+
+	dss := []DeliveryServiceServer{{Server: *server.ID, DeliveryService: 1}}
+
+	dsRegexes := []tc.DeliveryServiceRegexes{}
+	for _, ds := range dses {
+		dsRegexes = append(dsRegexes, tc.DeliveryServiceRegexes{
+			DSName:  *ds.XMLID,
+			Regexes: []tc.DeliveryServiceRegex{{Type: string(tc.DSMatchTypeHostRegex), Pattern: `.*\.` + *ds.XMLID + `\..*`}},
+		})
+	}
+
+	topologies := []tc.Topology{
+		{Name: "t0", Nodes: []tc.TopologyNode{{Cachegroup: "cg0"}}},
+		{Name: "t1", Nodes: []tc.TopologyNode{{Cachegroup: "cg1"}}},
+	}
+
+	serverCapabilities := map[int]map[ServerCapability]struct{}{}
+	dsRequiredCapabilities := map[int]map[ServerCapability]struct{}{5: {"disk": {}}}
+
+	cdn := &tc.CDN{DomainName: "cdn.example.test", Name: "mycdn"}
+
+	remapDSes, _, err := MakeRemapDeliveryServices(server, dses, dss, dsRegexes, cdn, topologies, serverCapabilities, dsRequiredCapabilities)
+	if err != nil {
+		t.Fatalf("MakeRemapDeliveryServices expected nil error, actual %v", err)
+	}
+
+	names := map[string][]RemapLine{}
+	for _, remapDS := range remapDSes {
+		names[*remapDS.DeliveryService.XMLID] = remapDS.Lines
+	}
+	if len(names) != 2 || names["assigned"] == nil || names["topo"] == nil {
+		t.Fatalf("expected delivery services 'assigned' and 'topo', actual %+v", names)
+	}
+
+	lines := names["assigned"]
+	if len(lines) != 2 {
+		t.Fatalf("expected 'assigned' http and https lines, actual %+v", lines)
+	}
+	if expected := "http://server0.assigned.cdn.example.test:12080/"; lines[0].From != expected {
+		t.Errorf("expected from '%v', actual '%v'", expected, lines[0].From)
+	}
+	if expected := "https://server0.assigned.cdn.example.test:12443/"; lines[1].From != expected {
+		t.Errorf("expected from '%v', actual '%v'", expected, lines[1].From)
+	}
+	if expected := "http://assigned.example.test/"; lines[0].To != expected {
+		t.Errorf("expected to '%v', actual '%v'", expected, lines[0].To)
+	}
+
+	server.Type = "MID"
+	liveType := tc.DSTypeHTTPLive
+	dses[0].Type = &liveType
+	remapDSes, _, err = MakeRemapDeliveryServices(server, dses, dss, dsRegexes, cdn, topologies, serverCapabilities, dsRequiredCapabilities)
+	if err != nil {
+		t.Fatalf("MakeRemapDeliveryServices mid expected nil error, actual %v", err)
+	}
+	if len(remapDSes) != 1 || *remapDSes[0].DeliveryService.XMLID != "topo" {
+		t.Fatalf("mid expected delivery service 'topo', actual %+v", remapDSes)
+	}
+	if expected := (RemapLine{From: "http://topo.example.test", To: "http://topo.example.test"}); len(remapDSes[0].Lines) != 1 || remapDSes[0].Lines[0] != expected {
+		t.Errorf("mid expected lines %+v, actual %+v", expected, remapDSes[0].Lines)
+	}
+}
@@ -390,6 +390,16 @@ func FreshFor(respHeaders http.Header, respCC CacheControlMap, reqTime, respTime
 	return freshnessLifetime - currentAge
 }
 
+// StaleWhileRevalidate returns the stale-while-revalidate duration of the given response Cache-Control, per RFC5861§3, and whether it exists and is valid.
+func StaleWhileRevalidate(respCC CacheControlMap) (time.Duration, bool) {
+	return getHTTPDeltaSecondsCacheControl(respCC, "stale-while-revalidate")
+}
+
+// StaleIfError returns the stale-if-error duration of the given Cache-Control, per RFC5861§4, and whether it exists and is valid. The directive may appear in either requests or responses.
+func StaleIfError(cc CacheControlMap) (time.Duration, bool) {
+	return getHTTPDeltaSecondsCacheControl(cc, "stale-if-error")
+}
+
 // Reuse is an "enumerated" type describing the necessary behavior of a cache
 // with regard to its cached objects.
 type Reuse int
@@ -425,29 +435,38 @@ func (r Reuse) String() string {
 	return "INVALID"
 }
 
-// selectedHeadersMatch checks the constraints in RFC7234§4.1.
-// TODO: change caching to key on URL+headers, so multiple requests for the same URL with different vary headers can be cached?
-func selectedHeadersMatch(reqHeaders http.Header, respReqHeaders http.Header, strictRFC bool) bool {
-	varyHeaders, ok := reqHeaders["vary"]
-	if !strictRFC && !ok {
-		return true
-	}
-	if len(varyHeaders) == 0 {
-		return true
+// SelectedHeadersMatch checks the constraints in RFC7234§4.1: that every header named by the stored response's Vary has the same value in the new request as in the request which produced the stored response.
+// Callers which store multiple variants of the same URL, such as Grove, may check this before CanReuseStored, to verify the variant they looked up.
+func SelectedHeadersMatch(reqHeaders http.Header, respHeaders http.Header, respReqHeaders http.Header) bool {
+	for _, varyHeader := range respHeaders[Vary] {
+		for _, header := range strings.Split(varyHeader, ",") {
+			header = strings.TrimSpace(header)
+			if header == "" {
+				continue
+			}
+			if header == "*" {
+				return false
+			}
+			header = http.CanonicalHeaderKey(header)
+			if NormalizeHeaderList(reqHeaders[header]) != NormalizeHeaderList(respReqHeaders[header]) {
+				return false
+			}
+		}
 	}
-	varyHeader := varyHeaders[0]
+	return true
+}
 
-	if varyHeader == "*" {
-		return false
-	}
-	varyHeader = strings.ToLower(varyHeader)
-	varyHeaderHeaders := strings.Split(varyHeader, ",")
-	for _, header := range varyHeaderHeaders {
-		if _, ok := respReqHeaders[header]; !ok {
-			return false
+// NormalizeHeaderList combines the values of a header field into a single comma-separated value, removing whitespace around the separators, as RFC7234§4.1 permits when comparing the headers selected by Vary.
+func NormalizeHeaderList(vals []string) string {
+	parts := []string{}
+	for _, val := range vals {
+		for _, part := range strings.Split(val, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, part)
+			}
 		}
 	}
-	return true
+	return strings.Join(parts, ",")
 }
 
 // allowedStale checks the constraints in RFC7234§4 via RFC7234§4.2.4.
@@ -496,7 +515,7 @@ func CanReuseStored(
 ) Reuse {
 	// TODO: remove allowed_stale, check in cache manager after revalidate fails? (since RFC7234§4.2.4 prohibits serving stale response unless disconnected).
 
-	if !selectedHeadersMatch(reqHeaders, respReqHeaders, strictRFC) {
+	if !SelectedHeadersMatch(reqHeaders, respHeaders, respReqHeaders) {
 		return ReuseCannot
 	}
 
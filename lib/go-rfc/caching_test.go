@@ -401,6 +401,23 @@ func BenchmarkCanCache(b *testing.B) {
 	}
 }
 
+func ExampleStaleWhileRevalidate() {
+	hdrs := http.Header{}
+	hdrs.Set(CacheControl, "max-age=600, stale-while-revalidate=30, stale-if-error=86400")
+
+	ccm := ParseCacheControl(hdrs)
+	swr, ok := StaleWhileRevalidate(ccm)
+	fmt.Println(swr, ok)
+	sie, ok := StaleIfError(ccm)
+	fmt.Println(sie, ok)
+	_, ok = StaleWhileRevalidate(CacheControlMap{"stale-while-revalidate": "soon"})
+	fmt.Println(ok)
+
+	// Output: 30s true
+	// 24h0m0s true
+	// false
+}
+
 func TestCanReuseStored(t *testing.T) {
 
 	// tests RFC7234§5.2.1.4 violation to protect origins
@@ -468,6 +485,38 @@ func TestCanReuseStored(t *testing.T) {
 		}
 	})
 
+	t.Run("test Vary selected headers must match", func(t *testing.T) {
+		now := time.Now()
+		respHdr := http.Header{
+			"Vary":          {"Accept-Encoding, accept-language"},
+			"Cache-Control": {"max-age=600"},
+			"Date":          {now.Format(time.RFC1123)},
+		}
+		respCC := ParseCacheControl(respHdr)
+		respReqHdrs := http.Header{
+			"Accept-Encoding": {"gzip, br"},
+			"Accept-Language": {"en"},
+		}
+		matchReqHdr := http.Header{
+			"Accept-Encoding": {"gzip,br"},
+			"Accept-Language": {"en"},
+			"User-Agent":      {"ignored"},
+		}
+		if reuse := CanReuseStored(matchReqHdr, respHdr, CacheControlMap{}, respCC, respReqHdrs, now, now, false); reuse != ReuseCan {
+			t.Errorf("CanReuseStored request with matching Vary headers: expected ReuseCan, actual %v", reuse)
+		}
+		mismatchReqHdr := http.Header{
+			"Accept-Encoding": {"gzip, br"},
+		}
+		if reuse := CanReuseStored(mismatchReqHdr, respHdr, CacheControlMap{}, respCC, respReqHdrs, now, now, false); reuse != ReuseCannot {
+			t.Errorf("CanReuseStored request with different Vary headers: expected ReuseCannot, actual %v", reuse)
+		}
+		respHdr.Set(Vary, "*")
+		if reuse := CanReuseStored(matchReqHdr, respHdr, CacheControlMap{}, respCC, respReqHdrs, now, now, false); reuse != ReuseCannot {
+			t.Errorf("CanReuseStored response with Vary '*': expected ReuseCannot, actual %v", reuse)
+		}
+	})
+
 	t.Run("test parent Expires in future is reused", func(t *testing.T) {
 		now := time.Now()
 		tenMinsBeforeExpires := now.Add(time.Minute * -10)
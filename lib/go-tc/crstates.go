@@ -33,6 +33,10 @@ type CRStates struct {
 type CRStatesDeliveryService struct {
 	DisabledLocations []CacheGroupName `json:"disabledLocations"`
 	IsAvailable       bool             `json:"isAvailable"`
+	// DisabledCaches are the caches which are available, but failed the delivery service's synthetic health check, and shouldn't be sent its traffic.
+	DisabledCaches []CacheName `json:"disabledCaches,omitempty"`
+	// LimitedLocations are the cachegroups whose bandwidth crossed a Traffic Monitor limit for the delivery service. They are also in DisabledLocations.
+	LimitedLocations []CacheGroupName `json:"limitedLocations,omitempty"`
 }
 
 // IsAvailable contains whether the given cache or delivery service is available. It is designed for JSON serialization, namely in the Traffic Monitor 1.0 API.
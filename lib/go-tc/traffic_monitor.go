@@ -39,6 +39,16 @@ const (
 	StatNameBandwidth = "bandwidth"
 )
 
+// ThresholdSamplesPrefix is the prefix of all Names of Parameters used to
+// define how many of a stat's most recent samples must be outside its
+// threshold for the threshold to be exceeded, in the form "N/M".
+const ThresholdSamplesPrefix = "health.threshold_samples."
+
+// ThresholdMarkUpPrefix is the prefix of all Names of Parameters used to
+// define the threshold a stat must be within for a cache server made
+// unavailable by that stat's threshold to be made available again.
+const ThresholdMarkUpPrefix = "health.threshold_markup."
+
 // TMConfigResponse is the response to requests made to the
 // cdns/{{Name}}/configs/monitoring endpoint of the Traffic Ops API.
 type TMConfigResponse struct {
@@ -477,6 +487,17 @@ type HealthThreshold struct {
 	// Comparator is the comparator used to compare the Val to the monitored
 	// value. One of '=', '>', '<', '>=', or '<=' - other values are invalid.
 	Comparator string // TODO change to enum?
+	// MarkUp is the threshold the monitored value must be within for a cache
+	// server made unavailable by this threshold to be made available again.
+	// If nil, this threshold is used.
+	MarkUp *HealthThreshold `json:",omitempty"`
+	// Exceeded is how many of the Samples most recent monitored values must
+	// be outside the threshold for the threshold to be exceeded. If Samples
+	// is 0, the threshold is exceeded by the most recent value alone.
+	Exceeded int `json:",omitempty"`
+	// Samples is how many of the most recent monitored values are compared
+	// to the threshold.
+	Samples int `json:",omitempty"`
 }
 
 // String implements the fmt.Stringer interface.
@@ -509,6 +530,30 @@ func StrToThreshold(s string) (HealthThreshold, error) {
 	return HealthThreshold{Val: val, Comparator: DefaultHealthThresholdComparator}, nil
 }
 
+// StrToThresholdSamples takes a string like "3/5", meaning 3 of the 5 most
+// recent samples, and returns the number of samples which must exceed a
+// threshold (3), and the number of samples compared (5). A single number "N"
+// is the same as "N/N". An error is returned if either number is less than 1,
+// or the first is greater than the second.
+func StrToThresholdSamples(s string) (int, int, error) {
+	exceededStr, samplesStr := s, s
+	if i := strings.Index(s, "/"); i >= 0 {
+		exceededStr, samplesStr = s[:i], s[i+1:]
+	}
+	exceeded, err := strconv.Atoi(strings.TrimSpace(exceededStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid threshold samples: NaN (%v)", err)
+	}
+	samples, err := strconv.Atoi(strings.TrimSpace(samplesStr))
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid threshold samples: NaN (%v)", err)
+	}
+	if exceeded < 1 || exceeded > samples {
+		return 0, 0, fmt.Errorf("invalid threshold samples: must be N/M with 1 <= N <= M, was %v/%v", exceeded, samples)
+	}
+	return exceeded, samples, nil
+}
+
 // UnmarshalJSON implements the encoding/json.Unmarshaler interface.
 func (params *TMParameters) UnmarshalJSON(bytes []byte) (err error) {
 	raw := map[string]interface{}{}
@@ -568,6 +613,37 @@ func (params *TMParameters) UnmarshalJSON(bytes []byte) (err error) {
 			}
 		}
 	}
+
+	// Samples and mark-up thresholds modify thresholds, so they can only be set after all thresholds are.
+	for k, v := range raw {
+		switch {
+		case strings.HasPrefix(k, ThresholdSamplesPrefix):
+			stat := k[len(ThresholdSamplesPrefix):]
+			t, ok := params.Thresholds[stat]
+			if !ok {
+				return fmt.Errorf("Unmarshalling TMParameters `%s` parameter: stat '%s' has no `%s` parameter", ThresholdSamplesPrefix, stat, ThresholdPrefix)
+			}
+			exceeded, samples, err := StrToThresholdSamples(fmt.Sprintf("%v", v))
+			if err != nil {
+				return fmt.Errorf("Unmarshalling TMParameters `%s` parameter value not of the form `\\d+/\\d+`: stat '%s' value '%v': %v", ThresholdSamplesPrefix, k, v, err)
+			}
+			t.Exceeded = exceeded
+			t.Samples = samples
+			params.Thresholds[stat] = t
+		case strings.HasPrefix(k, ThresholdMarkUpPrefix):
+			stat := k[len(ThresholdMarkUpPrefix):]
+			t, ok := params.Thresholds[stat]
+			if !ok {
+				return fmt.Errorf("Unmarshalling TMParameters `%s` parameter: stat '%s' has no `%s` parameter", ThresholdMarkUpPrefix, stat, ThresholdPrefix)
+			}
+			markUp, err := StrToThreshold(fmt.Sprintf("%v", v))
+			if err != nil {
+				return fmt.Errorf("Unmarshalling TMParameters `%s` parameter value not of the form `(>|)(=|)\\d+`: stat '%s' value '%v': %v", ThresholdMarkUpPrefix, k, v, err)
+			}
+			t.MarkUp = &markUp
+			params.Thresholds[stat] = t
+		}
+	}
 	return nil
 }
 
@@ -612,3 +612,48 @@ func TestTrafficMonitorTransformToMap(t *testing.T) {
 		t.Errorf("Incorrect number of IP addresses on converted traffic server's interface; expected: 1, got: %d", len(converted.TrafficServer["testHostname"].Interfaces[0].IPAddresses))
 	}
 }
+
+func TestTMParametersUnmarshalJSONThresholdRules(t *testing.T) {
+	const data = `{
+		"health.threshold.loadavg": "25",
+		"health.threshold_samples.loadavg": "3/5",
+		"health.threshold_markup.loadavg": "<20",
+		"health.threshold.availableBandwidthInKbps": ">1000",
+		"health.threshold_samples.availableBandwidthInKbps": 2
+	}`
+
+	var params TMParameters
+	if err := json.Unmarshal([]byte(data), &params); err != nil {
+		t.Fatalf("unmarshalling threshold rules: %v", err)
+	}
+
+	loadavg := params.Thresholds["loadavg"]
+	if loadavg.Val != 25 || loadavg.Comparator != "<" || loadavg.Exceeded != 3 || loadavg.Samples != 5 {
+		t.Errorf("expected loadavg threshold <25 over 3 of 5 samples, actual %+v", loadavg)
+	}
+	if loadavg.MarkUp == nil || *loadavg.MarkUp != (HealthThreshold{Val: 20, Comparator: "<"}) {
+		t.Errorf("expected loadavg mark-up threshold <20, actual %+v", loadavg.MarkUp)
+	}
+	if loadavg.String() != "<25.000000" {
+		t.Errorf("expected threshold rules to not change the threshold string, actual '%s'", loadavg.String())
+	}
+
+	bw := params.Thresholds["availableBandwidthInKbps"]
+	if bw.Exceeded != 2 || bw.Samples != 2 || bw.MarkUp != nil {
+		t.Errorf("expected availableBandwidthInKbps threshold over 2 of 2 samples and no mark-up threshold, actual %+v", bw)
+	}
+
+	invalid := []string{
+		`{"health.threshold_samples.loadavg": "3/5"}`,
+		`{"health.threshold.loadavg": "25", "health.threshold_samples.loadavg": "5/3"}`,
+		`{"health.threshold.loadavg": "25", "health.threshold_samples.loadavg": "0/3"}`,
+		`{"health.threshold.loadavg": "25", "health.threshold_samples.loadavg": "three"}`,
+		`{"health.threshold.loadavg": "25", "health.threshold_markup.loadavg": "<twenty"}`,
+	}
+	for _, data := range invalid {
+		var params TMParameters
+		if err := json.Unmarshal([]byte(data), &params); err == nil {
+			t.Errorf("unmarshalling '%s' expected: error, actual: nil", data)
+		}
+	}
+}
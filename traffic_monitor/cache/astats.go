@@ -75,9 +75,7 @@ func astatsParse(cacheName string, rdr io.Reader, pollCTX interface{}) (Statisti
 		return stats, nil, errors.New("handler got nil reader")
 	}
 
-	ctx := pollCTX.(*poller.HTTPPollCtx)
-
-	ctype := ctx.HTTPHeader.Get("Content-Type")
+	ctype := poller.ContentType(pollCTX)
 
 	if ctype == "text/json" || ctype == "text/javascript" || ctype == "application/json" || ctype == "" {
 		var astats Astats
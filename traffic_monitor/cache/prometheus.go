@@ -0,0 +1,364 @@
+package cache
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+// The node_exporter metrics which system stats are read from. Network metrics are per interface, by the PrometheusDeviceLabel label.
+const (
+	PrometheusLoad1Metric         = "node_load1"
+	PrometheusLoad5Metric         = "node_load5"
+	PrometheusLoad15Metric        = "node_load15"
+	PrometheusReceiveBytesMetric  = "node_network_receive_bytes_total"
+	PrometheusTransmitBytesMetric = "node_network_transmit_bytes_total"
+	PrometheusSpeedBytesMetric    = "node_network_speed_bytes"
+	PrometheusDeviceLabel         = "device"
+)
+
+const prometheusMaxLineBytes = 1024 * 1024
+const prometheusBytesPerSecToMbps = 8.0 / 1000000.0
+const prometheusUint64Max = float64(math.MaxUint64)
+
+func init() {
+	registerDecoder("prometheus", prometheusParse, prometheusPrecompute)
+}
+
+// prometheusStatsConfig is the config.PrometheusStatsConfig of the metric names which Delivery Service stats are read from.
+var prometheusStatsConfig atomic.Value
+
+// SetPrometheusStatsConfig sets the metric and label names which the prometheus stats format reads Delivery Service stats from. It's safe to call while caches are being polled, and takes effect on the next poll.
+func SetPrometheusStatsConfig(cfg config.PrometheusStatsConfig) {
+	prometheusStatsConfig.Store(cfg)
+}
+
+func getPrometheusStatsConfig() config.PrometheusStatsConfig {
+	if cfg, ok := prometheusStatsConfig.Load().(config.PrometheusStatsConfig); ok {
+		return cfg
+	}
+	return config.DefaultConfig.PrometheusStats
+}
+
+// prometheusSample is a single sample of the Prometheus text exposition format.
+type prometheusSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// prometheusParse parses the Prometheus text exposition format, or the OpenMetrics text format, which is a superset of it for the samples used here.
+//
+// System stats are read from the standard node_exporter metrics. All other samples are returned in the misc stats, keyed by their series, i.e. the metric name and its labels sorted by name, for example `deliveryservice_out_bytes_total{deliveryservice="demo1",instance="a"}`.
+func prometheusParse(cacheName string, data io.Reader, pollCTX interface{}) (Statistics, map[string]interface{}, error) {
+	var stats Statistics
+	if data == nil {
+		log.Warnf("Cannot read stats data for cache '%s' - nil data reader", cacheName)
+		return stats, nil, errors.New("handler got nil reader")
+	}
+
+	samples, err := prometheusParseText(data)
+	if err != nil {
+		return stats, nil, err
+	}
+
+	hasLoad := false
+	stats.Interfaces = make(map[string]Interface)
+	miscStats := make(map[string]interface{}, len(samples))
+	for _, sample := range samples {
+		switch sample.Name {
+		case PrometheusLoad1Metric:
+			stats.Loadavg.One = sample.Value
+			hasLoad = true
+		case PrometheusLoad5Metric:
+			stats.Loadavg.Five = sample.Value
+		case PrometheusLoad15Metric:
+			stats.Loadavg.Fifteen = sample.Value
+		case PrometheusReceiveBytesMetric, PrometheusTransmitBytesMetric, PrometheusSpeedBytesMetric:
+			prometheusParseInterfaceSample(cacheName, sample, stats.Interfaces)
+		default:
+			miscStats[prometheusSeries(sample.Name, sample.Labels)] = sample.Value
+		}
+	}
+
+	if !hasLoad {
+		return stats, nil, errors.New("Data was missing '" + PrometheusLoad1Metric + "'")
+	}
+	if len(stats.Interfaces) == 0 {
+		return stats, nil, errors.New("Data contained no interfaces in '" + PrometheusTransmitBytesMetric + "'")
+	}
+	stats.NotAvailable = false
+	return stats, miscStats, nil
+}
+
+// prometheusParseInterfaceSample sets the interface stat of the given node_network sample in ifaces. Invalid samples are logged and ignored.
+func prometheusParseInterfaceSample(cacheName string, sample prometheusSample, ifaces map[string]Interface) {
+	device := sample.Labels[PrometheusDeviceLabel]
+	if device == "" {
+		log.Warnf("cache '%s' stat '%s' has no '%s' label", cacheName, sample.Name, PrometheusDeviceLabel)
+		return
+	}
+	if math.IsNaN(sample.Value) || sample.Value < 0 || sample.Value >= prometheusUint64Max {
+		log.Warnf("cache '%s' stat '%s' for interface '%s' out of range: %v", cacheName, sample.Name, device, sample.Value)
+		return
+	}
+	iface := ifaces[device]
+	switch sample.Name {
+	case PrometheusReceiveBytesMetric:
+		iface.BytesIn = uint64(sample.Value)
+	case PrometheusTransmitBytesMetric:
+		iface.BytesOut = uint64(sample.Value)
+	case PrometheusSpeedBytesMetric:
+		iface.Speed = int64(sample.Value * prometheusBytesPerSecToMbps)
+	}
+	ifaces[device] = iface
+}
+
+func prometheusPrecompute(cacheName string, data todata.TOData, stats Statistics, miscStats map[string]interface{}) PrecomputedData {
+	var precomputed PrecomputedData
+	precomputed.DeliveryServiceStats = make(map[string]*DSStat)
+
+	precomputed.OutBytes = 0
+	precomputed.MaxKbps = 0
+	for _, iface := range stats.Interfaces {
+		precomputed.OutBytes += iface.BytesOut
+		if iface.Speed > precomputed.MaxKbps {
+			precomputed.MaxKbps = iface.Speed
+		}
+	}
+	precomputed.MaxKbps *= 1000
+
+	cfg := getPrometheusStatsConfig()
+	for stat, value := range miscStats {
+		name, labels, rest, err := prometheusParseSeries(stat)
+		if err != nil || rest != "" {
+			continue // not a series from prometheusParse
+		}
+		if name != cfg.DSInBytesMetric && name != cfg.DSOutBytesMetric && name != cfg.DSResponsesMetric {
+			continue
+		}
+
+		dsLabel := labels[cfg.DSLabel]
+		if dsLabel == "" {
+			err := errors.New("stat has no '" + cfg.DSLabel + "' label")
+			log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+			precomputed.Errors = append(precomputed.Errors, err)
+			continue
+		}
+		ds, ok := prometheusDeliveryService(data, dsLabel)
+		if !ok {
+			err := errors.New("No Delivery Service match for stat")
+			log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+			precomputed.Errors = append(precomputed.Errors, err)
+			continue
+		}
+
+		floatVal, ok := value.(float64)
+		if !ok || math.IsNaN(floatVal) || floatVal < 0 || floatVal >= prometheusUint64Max {
+			err := fmt.Errorf("couldn't parse numeric stat: value '%v' out of range", value)
+			log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+			precomputed.Errors = append(precomputed.Errors, err)
+			continue
+		}
+		parsedStat := uint64(floatVal)
+
+		dsName := string(ds)
+		dsStat, ok := precomputed.DeliveryServiceStats[dsName]
+		if !ok || dsStat == nil {
+			dsStat = new(DSStat)
+		}
+
+		// Samples are summed, because a Delivery Service may have several series of the same metric, e.g. for each status code of a class, or by other labels.
+		switch name {
+		case cfg.DSInBytesMetric:
+			dsStat.InBytes += parsedStat
+		case cfg.DSOutBytesMetric:
+			dsStat.OutBytes += parsedStat
+		case cfg.DSResponsesMetric:
+			switch status := labels[cfg.StatusLabel]; {
+			case strings.HasPrefix(status, "2"):
+				dsStat.Status2xx += parsedStat
+			case strings.HasPrefix(status, "3"):
+				dsStat.Status3xx += parsedStat
+			case strings.HasPrefix(status, "4"):
+				dsStat.Status4xx += parsedStat
+			case strings.HasPrefix(status, "5"):
+				dsStat.Status5xx += parsedStat
+			default:
+				err := fmt.Errorf("Unknown status '%s'", status)
+				log.Infof("precomputing cache %s stat %s value %v error %v", cacheName, stat, value, err)
+				precomputed.Errors = append(precomputed.Errors, err)
+				continue
+			}
+		}
+		precomputed.DeliveryServiceStats[dsName] = dsStat
+	}
+	return precomputed
+}
+
+// prometheusDeliveryService returns the Delivery Service of the given Delivery Service label value, which may be a Delivery Service name, or a request FQDN matching one of its regexes.
+func prometheusDeliveryService(data todata.TOData, dsLabel string) (tc.DeliveryServiceName, bool) {
+	if _, ok := data.DeliveryServiceTypes[tc.DeliveryServiceName(dsLabel)]; ok {
+		return tc.DeliveryServiceName(dsLabel), true
+	}
+	fqdnParts := strings.Split(dsLabel, ".")
+	if len(fqdnParts) < 3 {
+		return "", false
+	}
+	ds, ok := data.DeliveryServiceRegexes.DeliveryService(strings.Join(fqdnParts[2:], "."), fqdnParts[1], fqdnParts[0])
+	if !ok || ds == "" {
+		return "", false
+	}
+	return ds, true
+}
+
+// prometheusParseText parses the samples of the given Prometheus or OpenMetrics text. Comments, including HELP and TYPE metadata, are ignored, as are timestamps and OpenMetrics exemplars.
+func prometheusParseText(data io.Reader) ([]prometheusSample, error) {
+	samples := []prometheusSample{}
+	scanner := bufio.NewScanner(data)
+	scanner.Buffer(make([]byte, 0, 64*1024), prometheusMaxLineBytes)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		name, labels, rest, err := prometheusParseSeries(line)
+		if err != nil {
+			return nil, fmt.Errorf("parsing prometheus line %d: %v", lineNum, err)
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("parsing prometheus line %d: metric '%s' has no value", lineNum, name)
+		}
+		value, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return nil, fmt.Errorf("parsing prometheus line %d: metric '%s' value '%s' is not a number", lineNum, name, fields[0])
+		}
+		samples = append(samples, prometheusSample{Name: name, Labels: labels, Value: value})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New("reading prometheus data: " + err.Error())
+	}
+	return samples, nil
+}
+
+// prometheusParseSeries parses the metric name and labels at the start of the given sample line or series, and returns the remainder of the line after them.
+func prometheusParseSeries(line string) (string, map[string]string, string, error) {
+	nameEnd := strings.IndexAny(line, "{ \t")
+	if nameEnd < 0 {
+		return line, nil, "", nil
+	}
+	name := line[:nameEnd]
+	if name == "" {
+		return "", nil, "", errors.New("missing metric name")
+	}
+	if line[nameEnd] != '{' {
+		return name, nil, line[nameEnd:], nil
+	}
+
+	labels := map[string]string{}
+	i := nameEnd + 1
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == ',') {
+			i++
+		}
+		if i >= len(line) {
+			return "", nil, "", errors.New("unterminated labels")
+		}
+		if line[i] == '}' {
+			return name, labels, line[i+1:], nil
+		}
+
+		eq := strings.IndexByte(line[i:], '=')
+		if eq < 0 {
+			return "", nil, "", errors.New("label missing '='")
+		}
+		labelName := strings.TrimSpace(line[i : i+eq])
+		i += eq + 1
+		if i >= len(line) || line[i] != '"' {
+			return "", nil, "", errors.New("label '" + labelName + "' value not quoted")
+		}
+		i++
+
+		value := strings.Builder{}
+		for ; i < len(line) && line[i] != '"'; i++ {
+			if line[i] != '\\' || i+1 >= len(line) {
+				value.WriteByte(line[i])
+				continue
+			}
+			i++
+			switch line[i] {
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				value.WriteByte(line[i]) // \\ and \"
+			}
+		}
+		if i >= len(line) {
+			return "", nil, "", errors.New("label '" + labelName + "' value unterminated")
+		}
+		i++
+		labels[labelName] = value.String()
+	}
+}
+
+// prometheusSeries returns the series string of the given metric and labels, with the labels sorted by name, which prometheusParseSeries parses.
+func prometheusSeries(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	labelNames := make([]string, 0, len(labels))
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+
+	series := strings.Builder{}
+	series.WriteString(name)
+	series.WriteByte('{')
+	for i, labelName := range labelNames {
+		if i > 0 {
+			series.WriteByte(',')
+		}
+		series.WriteString(labelName)
+		series.WriteString(`="`)
+		series.WriteString(prometheusLabelEscaper.Replace(labels[labelName]))
+		series.WriteByte('"')
+	}
+	series.WriteByte('}')
+	return series.String()
+}
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
@@ -0,0 +1,169 @@
+package cache
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestPrometheusParse(t *testing.T) {
+	fd, err := os.Open("prometheus.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+
+	stats, misc, err := prometheusParse("test", fd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Loadavg.One != 0.21 || stats.Loadavg.Five != 0.35 || stats.Loadavg.Fifteen != 0.5 {
+		t.Errorf("Incorrect loadavg, expected 0.21 0.35 0.5, got %v %v %v", stats.Loadavg.One, stats.Loadavg.Five, stats.Loadavg.Fifteen)
+	}
+	if len(stats.Interfaces) != 2 {
+		t.Fatalf("Expected 2 interfaces, got %d: %+v", len(stats.Interfaces), stats.Interfaces)
+	}
+	bond := stats.Interfaces["bond0"]
+	if bond.BytesIn != 12893476000 {
+		t.Errorf("Incorrect interface rx_bytes, expected 12893476000, got %d", bond.BytesIn)
+	}
+	if bond.BytesOut != 98214567000 {
+		t.Errorf("Incorrect interface tx_bytes, expected 98214567000, got %d", bond.BytesOut)
+	}
+	if bond.Speed != 10000 {
+		t.Errorf("Incorrect interface speed, expected 10000, got %d", bond.Speed)
+	}
+	if lo := stats.Interfaces["lo"]; lo.BytesOut != 4096 || lo.Speed != 0 {
+		t.Errorf("Incorrect interface lo, expected 4096 tx_bytes and no speed, got %+v", lo)
+	}
+
+	if val := misc[`deliveryservice_responses_total{class="3xx",deliveryservice="demo1"}`]; val != float64(30) {
+		t.Errorf("Expected labels sorted in misc stat, and value 30, got %v", val)
+	}
+	if val := misc[`deliveryservice_in_bytes_total{deliveryservice="video.demo2.mycdn.ciab.test"}`]; val != float64(1024) {
+		t.Errorf("Expected timestamp to be ignored, and value 1024, got %v", val)
+	}
+	if val := misc[`process_start_time_seconds{note="line\nbreak",path="C:\\trafficserver\\"}`]; val != float64(1634567890) {
+		t.Errorf("Expected escaped label values in misc stat, and value 1634567890, got %v", val)
+	}
+	if _, ok := misc["node_load1"]; ok {
+		t.Error("Expected system stats to not be in misc stats")
+	}
+}
+
+func TestPrometheusParseErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing load":         "node_network_transmit_bytes_total{device=\"eth0\"} 1\n",
+		"missing interfaces":   "node_load1 0.1\n",
+		"unterminated labels":  "node_load1 0.1\nfoo{a=\"b\" 1\n",
+		"unquoted label value": "node_load1 0.1\nfoo{a=b} 1\n",
+		"missing value":        "node_load1 0.1\nfoo{a=\"b\"}\n",
+		"bad value":            "node_load1 zero\n",
+	}
+	for name, text := range tests {
+		if _, _, err := prometheusParse("test", strings.NewReader(text), nil); err == nil {
+			t.Errorf("%s: expected error, actual nil", name)
+		}
+	}
+}
+
+func TestPrometheusPrecompute(t *testing.T) {
+	file, err := ioutil.ReadFile("prometheus.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, misc, err := prometheusParse("test", bytes.NewReader(file), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	toData := todata.New()
+	toData.DeliveryServiceTypes["demo1"] = tc.DSTypeCategoryHTTP
+	toData.DeliveryServiceRegexes.DotStartSlashDotFooSlashDotDotStar["demo2"] = "demo2"
+
+	precomputed := prometheusPrecompute("test", *toData, stats, misc)
+	if len(precomputed.Errors) != 0 {
+		t.Errorf("Expected no errors, got %v", precomputed.Errors)
+	}
+	if precomputed.OutBytes != 98214567000+4096 {
+		t.Errorf("Expected OutBytes %d, got %d", 98214567000+4096, precomputed.OutBytes)
+	}
+	if precomputed.MaxKbps != 10000000 {
+		t.Errorf("Expected MaxKbps 10000000, got %d", precomputed.MaxKbps)
+	}
+
+	demo1 := precomputed.DeliveryServiceStats["demo1"]
+	if demo1 == nil {
+		t.Fatal("Expected stats for Delivery Service 'demo1' by name")
+	}
+	if *demo1 != (DSStat{InBytes: 296727207, OutBytes: 5717222345, Status2xx: 1000, Status3xx: 30, Status4xx: 4, Status5xx: 5}) {
+		t.Errorf("Incorrect stats for Delivery Service 'demo1': %+v", *demo1)
+	}
+
+	demo2 := precomputed.DeliveryServiceStats["demo2"]
+	if demo2 == nil {
+		t.Fatal("Expected stats for Delivery Service 'demo2' by FQDN")
+	}
+	if *demo2 != (DSStat{InBytes: 1024, OutBytes: 2048, Status2xx: 10}) {
+		t.Errorf("Incorrect stats for Delivery Service 'demo2', expected status codes summed into 2xx: %+v", *demo2)
+	}
+}
+
+func TestPrometheusPrecomputeConfig(t *testing.T) {
+	defer SetPrometheusStatsConfig(config.DefaultConfig.PrometheusStats)
+	SetPrometheusStatsConfig(config.PrometheusStatsConfig{
+		DSLabel:           "remap",
+		DSInBytesMetric:   "remap_in_bytes_total",
+		DSOutBytesMetric:  "remap_out_bytes_total",
+		DSResponsesMetric: "remap_responses_total",
+		StatusLabel:       "code",
+	})
+
+	text := `node_load1 0.1
+node_network_transmit_bytes_total{device="eth0"} 1
+remap_out_bytes_total{remap="demo1"} 100
+remap_responses_total{remap="demo1",code="503"} 2
+remap_responses_total{remap="nonexistent",code="200"} 2
+deliveryservice_out_bytes_total{deliveryservice="demo1"} 5
+`
+	stats, misc, err := prometheusParse("test", strings.NewReader(text), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toData := todata.New()
+	toData.DeliveryServiceTypes["demo1"] = tc.DSTypeCategoryHTTP
+
+	precomputed := prometheusPrecompute("test", *toData, stats, misc)
+	if len(precomputed.Errors) != 1 {
+		t.Errorf("Expected 1 error for the unknown Delivery Service, got %v", precomputed.Errors)
+	}
+	if demo1 := precomputed.DeliveryServiceStats["demo1"]; demo1 == nil || *demo1 != (DSStat{OutBytes: 100, Status5xx: 2}) {
+		t.Errorf("Incorrect stats for Delivery Service 'demo1' with configured metric names: %+v", demo1)
+	}
+}
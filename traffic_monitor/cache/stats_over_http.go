@@ -70,9 +70,7 @@ func statsOverHTTPParse(cacheName string, data io.Reader, pollCTX interface{}) (
 	var sohData stats_over_httpData
 	var err error
 
-	ctx := pollCTX.(*poller.HTTPPollCtx)
-
-	ctype := ctx.HTTPHeader.Get("Content-Type")
+	ctype := poller.ContentType(pollCTX)
 
 	if ctype == "text/json" || ctype == "text/javascript" || ctype == "application/json" || ctype == "" {
 		json := jsoniter.ConfigFastest
@@ -22,7 +22,9 @@ package config
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/url"
 	"strings"
 	"time"
 
@@ -128,6 +130,99 @@ type Config struct {
 	CachePollingProtocol         PollingProtocol `json:"cache_polling_protocol"`
 	PeerPollingProtocol          PollingProtocol `json:"peer_polling_protocol"`
 	HTTPPollingFormat            string          `json:"http_polling_format"`
+	// PrometheusStats is the metric names the prometheus stats format reads Delivery Service stats from.
+	PrometheusStats PrometheusStatsConfig `json:"prometheus_stats"`
+	// PeerQuorum is the weighted peer quorum, which if enabled combines cache states by a vote of this and its peer monitors, rather than optimistically.
+	PeerQuorum PeerQuorumConfig `json:"peer_quorum"`
+	// History is the persistent event log and stat history.
+	History HistoryConfig `json:"history"`
+	// DSProbe is the synthetic health checks of Delivery Services, fetched through each of their caches.
+	DSProbe DSProbeConfig `json:"ds_probe"`
+	// BandwidthLimits is the bandwidth limits of cachegroups, beyond which they are disabled for Delivery Services.
+	BandwidthLimits BandwidthLimitsConfig `json:"bandwidth_limits"`
+	// AdditionalCDNs is the names of CDNs monitored in addition to this monitor's own CDN. Each is monitored independently, and its endpoints are served under its name.
+	AdditionalCDNs []string `json:"additional_cdns"`
+}
+
+// DSProbeConfig is the configuration of Delivery Service synthetic health checks. Each Delivery Service with a URL has it fetched through each of its caches, by connecting to the cache's IP rather than resolving the URL's host. A cache which fails FailureCount consecutive probes is disabled for the Delivery Service, until it passes SuccessCount consecutive probes.
+type DSProbeConfig struct {
+	// URLs is the URL to probe for each Delivery Service, by XMLID. Delivery Services without a URL aren't probed. Responses with a status of 200 to 399 pass.
+	URLs map[string]string `json:"urls"`
+	// IntervalMs is the time in milliseconds between probes of each Delivery Service and cache.
+	IntervalMs uint64 `json:"interval_ms"`
+	// TimeoutMs is the time in milliseconds after which a probe fails.
+	TimeoutMs uint64 `json:"timeout_ms"`
+	// FailureCount is the number of consecutive failed probes after which a cache is disabled for a Delivery Service.
+	FailureCount uint64 `json:"failure_count"`
+	// SuccessCount is the number of consecutive passed probes after which a disabled cache is enabled again.
+	SuccessCount uint64 `json:"success_count"`
+	// MaxConcurrent is the maximum number of probes in progress at once.
+	MaxConcurrent uint64 `json:"max_concurrent"`
+}
+
+// BandwidthLimitsConfig is the configuration of cachegroup bandwidth limits. A cachegroup crossing a limit is disabled for a Delivery Service, so Traffic Routers send its clients elsewhere before the caches saturate, and is enabled again once its bandwidth has been within the limit for HoldMs.
+type BandwidthLimitsConfig struct {
+	// CachegroupMaxUtilization is the fraction of the total bandwidth capacity of a cachegroup's available caches which their total bandwidth may use. A cachegroup over it is disabled for all its Delivery Services. Zero disables the limit.
+	CachegroupMaxUtilization float64 `json:"cachegroup_max_utilization"`
+	// DSCachegroupMaxFraction is the fraction of a Delivery Service's globalMaxMbps which its bandwidth in a single cachegroup may be. A cachegroup over it is disabled for that Delivery Service. Zero disables the limit, as does a Delivery Service without a globalMaxMbps.
+	DSCachegroupMaxFraction float64 `json:"ds_cachegroup_max_fraction"`
+	// HoldMs is the time in milliseconds a cachegroup's bandwidth must be within its limits before it's enabled again.
+	HoldMs uint64 `json:"hold_ms"`
+}
+
+// HistoryConfig is the configuration of the persistent event log and stat history, which is stored in a local database so it survives restarts.
+type HistoryConfig struct {
+	// Path is the file of the history database. If empty, history isn't persisted.
+	Path string `json:"path"`
+	// RetentionHours is how long events and stat samples are kept.
+	RetentionHours uint64 `json:"retention_hours"`
+	// StatIntervalMs is the minimum time in milliseconds between stored stat samples of each cache.
+	StatIntervalMs uint64 `json:"stat_interval_ms"`
+	// Stats is the polled stats to store in each sample, in addition to the stats computed by Traffic Monitor.
+	Stats []string `json:"stats"`
+}
+
+// PeerQuorumConfig is the configuration of the weighted peer quorum. When enabled, a cache is available in the combined states only if the monitors considering it available have more than Ratio of the total weight of this monitor and the counted peers. Peers are not counted if they are OFFLINE, their last poll failed or is older than MaxAgeMs, or the fraction of caches they consider available suddenly dropped by more than MaxReachabilityDrop.
+type PeerQuorumConfig struct {
+	// Ratio is the fraction of the total weight which must consider a cache available. Zero disables the quorum, and peer states are combined optimistically. For example, 0.5 requires a simple majority.
+	Ratio float64 `json:"ratio"`
+	// LocalWeight is the weight of this monitor's own states.
+	LocalWeight float64 `json:"local_weight"`
+	// Weights is the weight of each peer, by hostname. Peers not in Weights have a weight of 1.
+	Weights map[string]float64 `json:"weights"`
+	// MaxAgeMs is the age in milliseconds after which a peer's states are stale and not counted. Zero uses the peer timeout, which is twice the peer polling interval plus the HTTP timeout.
+	MaxAgeMs uint64 `json:"max_age_ms"`
+	// MaxReachabilityDrop is the largest drop in the fraction of caches a peer considers available, relative to both its previous fraction and this monitor's, before the peer is considered partitioned and not counted. Zero disables the check.
+	MaxReachabilityDrop float64 `json:"max_reachability_drop"`
+	// MinPeerWeight is the minimum total weight of the counted peers voting on a cache. With less, the cache keeps its last combined state, rather than taking this monitor's state alone. Zero lets this monitor's state alone decide when no peers are counted.
+	MinPeerWeight float64 `json:"min_peer_weight"`
+}
+
+// Enabled returns whether the weighted peer quorum is enabled.
+func (c PeerQuorumConfig) Enabled() bool {
+	return c.Ratio > 0
+}
+
+// Weight returns the weight of the given peer.
+func (c PeerQuorumConfig) Weight(peer string) float64 {
+	if w, ok := c.Weights[peer]; ok {
+		return w
+	}
+	return 1
+}
+
+// PrometheusStatsConfig is the names of the Prometheus metrics and labels which the prometheus stats format reads Delivery Service stats from. System stats are always read from the standard node_exporter metrics.
+type PrometheusStatsConfig struct {
+	// DSLabel is the label whose value is the Delivery Service of a sample, either its XMLID or a request FQDN matching one of its regexes.
+	DSLabel string `json:"ds_label"`
+	// DSInBytesMetric is the counter of bytes received from clients, per Delivery Service.
+	DSInBytesMetric string `json:"ds_in_bytes_metric"`
+	// DSOutBytesMetric is the counter of bytes sent to clients, per Delivery Service.
+	DSOutBytesMetric string `json:"ds_out_bytes_metric"`
+	// DSResponsesMetric is the counter of responses to clients, per Delivery Service and StatusLabel.
+	DSResponsesMetric string `json:"ds_responses_metric"`
+	// StatusLabel is the label of DSResponsesMetric whose value is the response status code, e.g. 200, or class, e.g. 2xx.
+	StatusLabel string `json:"status_label"`
 }
 
 func (c Config) ErrorLog() log.LogLocation   { return log.LogLocation(c.LogLocationError) }
@@ -169,6 +264,34 @@ var DefaultConfig = Config{
 	CachePollingProtocol:         Both,
 	PeerPollingProtocol:          Both,
 	HTTPPollingFormat:            HTTPPollingFormat,
+	PrometheusStats: PrometheusStatsConfig{
+		DSLabel:           "deliveryservice",
+		DSInBytesMetric:   "deliveryservice_in_bytes_total",
+		DSOutBytesMetric:  "deliveryservice_out_bytes_total",
+		DSResponsesMetric: "deliveryservice_responses_total",
+		StatusLabel:       "class",
+	},
+	PeerQuorum: PeerQuorumConfig{
+		Ratio:               0,
+		LocalWeight:         1,
+		MaxReachabilityDrop: 0.5,
+		MinPeerWeight:       1,
+	},
+	History: HistoryConfig{
+		Path:           "",
+		RetentionHours: 7 * 24,
+		StatIntervalMs: 60000,
+	},
+	DSProbe: DSProbeConfig{
+		IntervalMs:    10000,
+		TimeoutMs:     2000,
+		FailureCount:  2,
+		SuccessCount:  2,
+		MaxConcurrent: 20,
+	},
+	BandwidthLimits: BandwidthLimitsConfig{
+		HoldMs: 60000,
+	},
 }
 
 // MarshalJSON marshals custom millisecond durations. Aliasing inspired by http://choly.ca/post/go-json-marshalling/
@@ -309,6 +432,44 @@ func Load(fileName string) (Config, error) {
 func LoadBytes(bytes []byte) (Config, error) {
 	cfg := DefaultConfig
 	json := jsoniter.ConfigFastest // TODO make configurable?
-	err := json.Unmarshal(bytes, &cfg)
-	return cfg, err
+	if err := json.Unmarshal(bytes, &cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.PeerQuorum.Ratio < 0 || cfg.PeerQuorum.Ratio >= 1 {
+		return cfg, fmt.Errorf("peer_quorum ratio must be at least 0 and less than 1, was %v", cfg.PeerQuorum.Ratio)
+	}
+	for peer, weight := range cfg.PeerQuorum.Weights {
+		if weight < 0 {
+			return cfg, fmt.Errorf("peer_quorum weight of '%v' must not be negative, was %v", peer, weight)
+		}
+	}
+	if cfg.PeerQuorum.MinPeerWeight < 0 {
+		return cfg, fmt.Errorf("peer_quorum min_peer_weight must not be negative, was %v", cfg.PeerQuorum.MinPeerWeight)
+	}
+	for ds, probeURL := range cfg.DSProbe.URLs {
+		u, err := url.Parse(probeURL)
+		if err != nil {
+			return cfg, fmt.Errorf("ds_probe url of '%v' is malformed: %v", ds, err)
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return cfg, fmt.Errorf("ds_probe url of '%v' must be an absolute http or https URL, was '%v'", ds, probeURL)
+		}
+	}
+	additionalCDNs := map[string]struct{}{}
+	for _, cdn := range cfg.AdditionalCDNs {
+		if cdn == "" || strings.Contains(cdn, "/") {
+			return cfg, fmt.Errorf("additional_cdns name '%v' must be non-empty and not contain '/'", cdn)
+		}
+		if _, ok := additionalCDNs[cdn]; ok {
+			return cfg, fmt.Errorf("additional_cdns name '%v' is duplicated", cdn)
+		}
+		additionalCDNs[cdn] = struct{}{}
+	}
+	if cfg.DSProbe.IntervalMs == 0 || cfg.DSProbe.TimeoutMs == 0 || cfg.DSProbe.FailureCount == 0 || cfg.DSProbe.SuccessCount == 0 || cfg.DSProbe.MaxConcurrent == 0 {
+		return cfg, errors.New("ds_probe interval_ms, timeout_ms, failure_count, success_count, and max_concurrent must be greater than 0")
+	}
+	if cfg.BandwidthLimits.CachegroupMaxUtilization < 0 || cfg.BandwidthLimits.CachegroupMaxUtilization > 1 || cfg.BandwidthLimits.DSCachegroupMaxFraction < 0 || cfg.BandwidthLimits.DSCachegroupMaxFraction > 1 {
+		return cfg, errors.New("bandwidth_limits cachegroup_max_utilization and ds_cachegroup_max_fraction must be between 0 and 1")
+	}
+	return cfg, nil
 }
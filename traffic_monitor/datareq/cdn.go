@@ -0,0 +1,94 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+)
+
+// CDNPathPrefix is the path prefix of the endpoints of each monitored CDN, which is followed by the CDN name and the endpoint path, e.g. /cdn/my-cdn/publish/CrStates.
+const CDNPathPrefix = "/cdn/"
+
+// CDNEndpoints serves the endpoints of each monitored CDN under CDNPathPrefix and the CDN name. It is safe for multiple goroutines.
+type CDNEndpoints struct {
+	endpoints map[string]map[string]http.HandlerFunc
+	m         sync.RWMutex
+}
+
+// NewCDNEndpoints creates a new CDNEndpoints, without any CDNs.
+func NewCDNEndpoints() *CDNEndpoints {
+	return &CDNEndpoints{endpoints: map[string]map[string]http.HandlerFunc{}}
+}
+
+// Set sets the endpoints of the given CDN, as returned by MakeDispatchMap, replacing any it already had.
+func (c *CDNEndpoints) Set(cdn string, endpoints map[string]http.HandlerFunc) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.endpoints[cdn] = endpoints
+}
+
+// CDNs returns the names of the CDNs with endpoints, sorted.
+func (c *CDNEndpoints) CDNs() []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	cdns := make([]string, 0, len(c.endpoints))
+	for cdn := range c.endpoints {
+		cdns = append(cdns, cdn)
+	}
+	sort.Strings(cdns)
+	return cdns
+}
+
+// ServeHTTP serves the endpoint of the CDN named in the request path, or 404 if the CDN isn't monitored or has no such endpoint.
+func (c *CDNEndpoints) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cdnPath := strings.TrimPrefix(r.URL.Path, CDNPathPrefix)
+	slash := strings.Index(cdnPath, "/")
+	if slash < 0 {
+		http.NotFound(w, r)
+		return
+	}
+	cdn, endpointPath := cdnPath[:slash], cdnPath[slash:]
+
+	c.m.RLock()
+	f, ok := c.endpoints[cdn][endpointPath]
+	c.m.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	f(w, r)
+}
+
+// ServeCDNs serves the names of the monitored CDNs, as a JSON array.
+func (c *CDNEndpoints) ServeCDNs(w http.ResponseWriter, r *http.Request) {
+	bytes, err := json.Marshal(c.CDNs())
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(rfc.ContentType, rfc.ApplicationJSON)
+	w.Write(bytes)
+}
@@ -0,0 +1,58 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCDNEndpoints(t *testing.T) {
+	c := NewCDNEndpoints()
+	endpoint := func(body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) { w.Write([]byte(body)) }
+	}
+	c.Set("cdn1", map[string]http.HandlerFunc{"/publish/CrStates": endpoint("cdn1 states")})
+	c.Set("cdn0", map[string]http.HandlerFunc{"/publish/CrStates": endpoint("cdn0 states")})
+
+	get := func(path string) (int, string) {
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		body, _ := ioutil.ReadAll(w.Body)
+		return w.Code, string(body)
+	}
+	if code, body := get("/cdn/cdn0/publish/CrStates?raw"); code != http.StatusOK || body != "cdn0 states" {
+		t.Errorf("expected cdn0 states, actual %v %v", code, body)
+	}
+	if code, body := get("/cdn/cdn1/publish/CrStates"); code != http.StatusOK || body != "cdn1 states" {
+		t.Errorf("expected cdn1 states, actual %v %v", code, body)
+	}
+	for _, path := range []string{"/cdn/cdn2/publish/CrStates", "/cdn/cdn0/publish/CrConfig", "/cdn/cdn0"} {
+		if code, _ := get(path); code != http.StatusNotFound {
+			t.Errorf("expected %v not found, actual %v", path, code)
+		}
+	}
+
+	if cdns := c.CDNs(); len(cdns) != 2 || cdns[0] != "cdn0" || cdns[1] != "cdn1" {
+		t.Errorf("expected sorted CDNs cdn0 and cdn1, actual %v", cdns)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"github.com/apache/trafficcontrol/lib/go-rfc"
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
@@ -58,11 +59,14 @@ func MakeDispatchMap(
 	fetchCount threadsafe.Uint,
 	healthIteration threadsafe.Uint,
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	toData todata.TODataThreadsafe,
 	localCacheStatus threadsafe.CacheAvailableStatus,
 	lastStats threadsafe.LastStats,
 	unpolledCaches threadsafe.UnpolledCaches,
 	monitorConfig threadsafe.TrafficMonitorConfigMap,
+	historyStore *history.Store,
+	stateStream *StateStream,
 ) map[string]http.HandlerFunc {
 
 	// wrap composes all universal wrapper functions. Right now, it's only the UnpolledCheck, but there may be others later. For example, security headers.
@@ -132,6 +136,17 @@ func MakeDispatchMap(
 		"/api/crconfig-history": wrap(WrapErr(errorCount, func() ([]byte, error) {
 			return srvAPICRConfigHist(toSession)
 		}, rfc.ApplicationJSON)),
+		"/api/event-history": wrap(WrapParams(func(params url.Values, path string) ([]byte, int) {
+			return srvAPIEventHistory(params, errorCount, path, historyStore)
+		}, rfc.ApplicationJSON)),
+		"/api/stat-history": wrap(WrapParams(func(params url.Values, path string) ([]byte, int) {
+			return srvAPIStatHistory(params, errorCount, path, historyStore)
+		}, rfc.ApplicationJSON)),
+		"/api/state-stream": wrap(stateStream.ServeHTTP),
+		// not wrapped, so the monitor's own health can be scraped before all caches have been polled
+		"/metrics": WrapBytes(func() []byte {
+			return srvMetrics(toData, monitorConfig, localStates, combinedStates, peerStates, statInfoHistory, healthHistory, dsStats, toSession, errorCount, pollErrors)
+		}, MetricsContentType),
 	}
 	return addTrailingSlashEndpoints(dispatchMap)
 }
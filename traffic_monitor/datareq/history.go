@@ -0,0 +1,118 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+)
+
+// DefaultHistoryRange is the time range of history queries without a start.
+const DefaultHistoryRange = time.Hour
+
+// JSONStatHistory is the structure serialized to JSON for the stat history of a cache.
+type JSONStatHistory struct {
+	Cache   string               `json:"cache"`
+	Samples []history.StatSample `json:"samples"`
+}
+
+// parseHistoryTime parses the given time query parameter, which may be RFC3339, or seconds since the Unix epoch.
+func parseHistoryTime(s string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("time '" + s + "' is neither RFC3339 nor Unix seconds")
+	}
+	return t, nil
+}
+
+// parseHistoryRange returns the start and end query parameters. The end defaults to now, and the start to DefaultHistoryRange before the end.
+func parseHistoryRange(params url.Values) (time.Time, time.Time, error) {
+	end := time.Now()
+	if endStr := params.Get("end"); endStr != "" {
+		t, err := parseHistoryTime(endStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("malformed end: " + err.Error())
+		}
+		end = t
+	}
+	start := end.Add(-DefaultHistoryRange)
+	if startStr := params.Get("start"); startStr != "" {
+		t, err := parseHistoryTime(startStr)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("malformed start: " + err.Error())
+		}
+		start = t
+	}
+	if start.After(end) {
+		return time.Time{}, time.Time{}, errors.New("start is after end")
+	}
+	return start, end, nil
+}
+
+func srvAPIEventHistory(params url.Values, errorCount threadsafe.Uint, path string, store *history.Store) ([]byte, int) {
+	if store == nil {
+		return []byte("history is not enabled"), http.StatusNotFound
+	}
+	start, end, err := parseHistoryRange(params)
+	if err != nil {
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+	events, err := store.Events(start, end, params.Get("hostname"))
+	if err != nil {
+		return WrapErrCode(errorCount, path, nil, err)
+	}
+	bytes, err := json.Marshal(JSONEvents{Events: events})
+	return WrapErrCode(errorCount, path, bytes, err)
+}
+
+func srvAPIStatHistory(params url.Values, errorCount threadsafe.Uint, path string, store *history.Store) ([]byte, int) {
+	if store == nil {
+		return []byte("history is not enabled"), http.StatusNotFound
+	}
+	cacheName := params.Get("cache")
+	if cacheName == "" {
+		return []byte("missing required parameter 'cache'"), http.StatusBadRequest
+	}
+	start, end, err := parseHistoryRange(params)
+	if err != nil {
+		return []byte(err.Error()), http.StatusBadRequest
+	}
+	statNames := []string(nil)
+	if statsStr := params.Get("stats"); statsStr != "" {
+		statNames = strings.Split(statsStr, ",")
+	}
+	samples, err := store.Stats(cacheName, start, end, statNames)
+	if err != nil {
+		return WrapErrCode(errorCount, path, nil, err)
+	}
+	bytes, err := json.Marshal(JSONStatHistory{Cache: cacheName, Samples: samples})
+	return WrapErrCode(errorCount, path, bytes, err)
+}
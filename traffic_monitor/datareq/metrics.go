@@ -0,0 +1,229 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bytes"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsdata"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
+)
+
+// MetricsContentType is the Content-Type of the Prometheus text exposition format served by /metrics.
+const MetricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// MetricPrefix is the prefix of the names of all metrics served by /metrics.
+const MetricPrefix = "traffic_monitor_"
+
+// metric is a Prometheus metric and its samples.
+type metric struct {
+	name       string
+	help       string
+	metricType string
+	samples    []metricSample
+}
+
+type metricSample struct {
+	// labels are the names and values of the sample's labels, alternating.
+	labels []string
+	val    float64
+}
+
+func newMetric(name string, metricType string, help string) *metric {
+	return &metric{name: MetricPrefix + name, help: help, metricType: metricType}
+}
+
+// add adds a sample with the given value, and the given label names and values, alternating.
+func (m *metric) add(val float64, labels ...string) {
+	m.samples = append(m.samples, metricSample{labels: labels, val: val})
+}
+
+func boolMetricVal(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// labelValueEscaper escapes label values, as required by the text exposition format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeMetrics writes the given metrics in the Prometheus text exposition format. Metrics without samples are omitted.
+func writeMetrics(buf *bytes.Buffer, metrics []*metric) {
+	for _, m := range metrics {
+		if len(m.samples) == 0 {
+			continue
+		}
+		buf.WriteString("# HELP " + m.name + " " + m.help + "\n")
+		buf.WriteString("# TYPE " + m.name + " " + m.metricType + "\n")
+		for _, sample := range m.samples {
+			buf.WriteString(m.name)
+			if len(sample.labels) > 0 {
+				buf.WriteString("{")
+				for i := 0; i+1 < len(sample.labels); i += 2 {
+					if i > 0 {
+						buf.WriteString(",")
+					}
+					buf.WriteString(sample.labels[i] + `="` + labelValueEscaper.Replace(sample.labels[i+1]) + `"`)
+				}
+				buf.WriteString("}")
+			}
+			buf.WriteString(" " + strconv.FormatFloat(sample.val, 'g', -1, 64) + "\n")
+		}
+	}
+}
+
+func srvMetrics(
+	toData todata.TODataThreadsafe,
+	monitorConfig threadsafe.TrafficMonitorConfigMap,
+	localStates peer.CRStatesThreadsafe,
+	combinedStates peer.CRStatesThreadsafe,
+	peerStates peer.CRStatesPeersThreadsafe,
+	statInfoHistory threadsafe.ResultInfoHistory,
+	healthHistory threadsafe.ResultHistory,
+	dsStats threadsafe.DSStatsReader,
+	toSession towrap.TrafficOpsSessionThreadsafe,
+	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
+) []byte {
+	return createMetrics(
+		monitorConfig.Get().TrafficServer,
+		toData.Get(),
+		localStates.Get(),
+		combinedStates.Get(),
+		peerStates.GetPeersAvailable(),
+		peerStates.GetQueryTimes(),
+		statInfoHistory.Get(),
+		healthHistory.Get(),
+		dsStats.Get(),
+		toSession.CRConfigHistory(),
+		errorCount.Get(),
+		pollErrors.Get(),
+		time.Now(),
+	)
+}
+
+// createMetrics returns the metrics of the given caches, peers, Delivery Services, and CRConfig history, in the Prometheus text exposition format.
+func createMetrics(
+	servers map[string]tc.TrafficServer,
+	toData todata.TOData,
+	localStates tc.CRStates,
+	combinedStates tc.CRStates,
+	peersAvailable map[tc.TrafficMonitorName]bool,
+	peerQueryTimes map[tc.TrafficMonitorName]time.Time,
+	statInfoHistory cache.ResultInfoHistory,
+	healthHistory cache.ResultHistory,
+	dsStats dsdata.StatsReadonly,
+	crConfigHist []towrap.CRConfigStat,
+	errorCount uint64,
+	pollErrors map[string]map[tc.CacheName]uint64,
+	now time.Time,
+) []byte {
+	pollDuration := newMetric("cache_poll_duration_seconds", "gauge", "The time the latest poll of the cache took, by poller.")
+	pollError := newMetric("cache_poll_error", "gauge", "Whether the latest poll of the cache failed, by poller.")
+	pollErrorsTotal := newMetric("cache_poll_errors_total", "counter", "The number of failed polls of the cache, by poller.")
+	available := newMetric("cache_available", "gauge", "Whether the cache is available in the combined states served to Traffic Routers.")
+	localAvailable := newMetric("cache_local_available", "gauge", "Whether this Traffic Monitor considers the cache available, before combining states with peers.")
+
+	cacheNames := make([]string, 0, len(servers))
+	for cacheName := range servers {
+		cacheNames = append(cacheNames, cacheName)
+	}
+	sort.Strings(cacheNames)
+	for _, cacheName := range cacheNames {
+		name := tc.CacheName(cacheName)
+		labels := []string{"cache", cacheName, "cachegroup", string(toData.ServerCachegroups[name]), "type", string(toData.ServerTypes[name])}
+		if results := healthHistory[name]; len(results) > 0 {
+			pollDuration.add(results[0].RequestTime.Seconds(), append(labels, "poller", "health")...)
+			pollError.add(boolMetricVal(results[0].Error != nil), append(labels, "poller", "health")...)
+			pollErrorsTotal.add(float64(pollErrors["health"][name]), append(labels, "poller", "health")...)
+		}
+		if infos := statInfoHistory[name]; len(infos) > 0 {
+			pollDuration.add(infos[0].RequestTime.Seconds(), append(labels, "poller", "stat")...)
+			pollError.add(boolMetricVal(infos[0].Error != nil), append(labels, "poller", "stat")...)
+			pollErrorsTotal.add(float64(pollErrors["stat"][name]), append(labels, "poller", "stat")...)
+		}
+		if state, ok := combinedStates.Caches[name]; ok {
+			available.add(boolMetricVal(state.IsAvailable), labels...)
+		}
+		if state, ok := localStates.Caches[name]; ok {
+			localAvailable.add(boolMetricVal(state.IsAvailable), labels...)
+		}
+	}
+
+	peerAvailable := newMetric("peer_available", "gauge", "Whether the latest poll of the peer Traffic Monitor succeeded.")
+	peerPollAge := newMetric("peer_poll_age_seconds", "gauge", "The time since the peer Traffic Monitor was last polled.")
+	peerNames := make([]string, 0, len(peersAvailable))
+	for peerName := range peersAvailable {
+		peerNames = append(peerNames, string(peerName))
+	}
+	sort.Strings(peerNames)
+	for _, peerName := range peerNames {
+		peerAvailable.add(boolMetricVal(peersAvailable[tc.TrafficMonitorName(peerName)]), "peer", peerName)
+		if queryTime, ok := peerQueryTimes[tc.TrafficMonitorName(peerName)]; ok && !queryTime.IsZero() {
+			peerPollAge.add(now.Sub(queryTime).Seconds(), "peer", peerName)
+		}
+	}
+
+	dsKbps := newMetric("deliveryservice_kbps", "gauge", "The bandwidth of the Delivery Service, in kilobits per second.")
+	dsTPS := newMetric("deliveryservice_tps", "gauge", "The transactions per second of the Delivery Service.")
+	dsAvailable := newMetric("deliveryservice_available", "gauge", "Whether the Delivery Service is available in the combined states served to Traffic Routers.")
+	dsNames := make([]string, 0, len(toData.DeliveryServiceServers))
+	for dsName := range toData.DeliveryServiceServers {
+		dsNames = append(dsNames, string(dsName))
+	}
+	sort.Strings(dsNames)
+	for _, dsName := range dsNames {
+		if dsStats != nil {
+			if stat, ok := dsStats.Get(tc.DeliveryServiceName(dsName)); ok {
+				total := stat.Total()
+				dsKbps.add(total.Kbps.Value, "deliveryservice", dsName)
+				dsTPS.add(total.TpsTotal.Value, "deliveryservice", dsName)
+			}
+		}
+		if state, ok := combinedStates.DeliveryService[tc.DeliveryServiceName(dsName)]; ok {
+			dsAvailable.add(boolMetricVal(state.IsAvailable), "deliveryservice", dsName)
+		}
+	}
+
+	crConfigAge := newMetric("crconfig_age_seconds", "gauge", "The time since the latest valid CRConfig Snapshot fetched from Traffic Ops was taken.")
+	for i := len(crConfigHist) - 1; i >= 0; i-- {
+		if crConfigHist[i].Err == nil && crConfigHist[i].Stats.DateUnixSeconds != nil {
+			crConfigAge.add(now.Sub(time.Unix(*crConfigHist[i].Stats.DateUnixSeconds, 0)).Seconds())
+			break
+		}
+	}
+
+	errorsTotal := newMetric("errors_total", "counter", "The number of errors this Traffic Monitor has encountered, as in /publish/Stats.")
+	errorsTotal.add(float64(errorCount))
+
+	buf := &bytes.Buffer{}
+	writeMetrics(buf, []*metric{pollDuration, pollError, pollErrorsTotal, available, localAvailable, peerAvailable, peerPollAge, dsKbps, dsTPS, dsAvailable, crConfigAge, errorsTotal})
+	return buf.Bytes()
+}
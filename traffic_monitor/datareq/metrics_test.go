@@ -0,0 +1,114 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsdata"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
+)
+
+func TestCreateMetrics(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	servers := map[string]tc.TrafficServer{"cache0": {}, "cache1": {}}
+	toData := todata.TOData{
+		ServerCachegroups:      map[tc.CacheName]tc.CacheGroupName{"cache0": "cg0", "cache1": `cg"1`},
+		ServerTypes:            map[tc.CacheName]tc.CacheType{"cache0": tc.CacheTypeEdge, "cache1": tc.CacheTypeMid},
+		DeliveryServiceServers: map[tc.DeliveryServiceName][]tc.CacheName{"ds0": {"cache0"}},
+	}
+	localStates := tc.NewCRStates()
+	localStates.Caches["cache0"] = tc.IsAvailable{IsAvailable: true}
+	localStates.Caches["cache1"] = tc.IsAvailable{IsAvailable: false}
+	combinedStates := tc.NewCRStates()
+	combinedStates.Caches["cache0"] = tc.IsAvailable{IsAvailable: true}
+	combinedStates.Caches["cache1"] = tc.IsAvailable{IsAvailable: true}
+	combinedStates.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true}
+
+	healthHistory := cache.ResultHistory{
+		"cache0": {{RequestTime: 250 * time.Millisecond}},
+		"cache1": {{RequestTime: time.Second, Error: errors.New("timeout")}},
+	}
+	statInfoHistory := cache.ResultInfoHistory{"cache0": {{RequestTime: 500 * time.Millisecond}}}
+
+	dsStats := dsdata.NewStats(1)
+	dsStats.DeliveryService["ds0"] = dsdata.NewStat()
+	dsStats.DeliveryService["ds0"].TotalStats.Kbps.Value = 1500
+	dsStats.DeliveryService["ds0"].TotalStats.TpsTotal.Value = 20.5
+
+	snapshotDate := now.Add(-10 * time.Minute).Unix()
+	newerDate := now.Unix()
+	crConfigHist := []towrap.CRConfigStat{
+		{Stats: tc.CRConfigStats{DateUnixSeconds: &snapshotDate}},
+		{Stats: tc.CRConfigStats{DateUnixSeconds: &newerDate}, Err: errors.New("invalid CRConfig")},
+	}
+
+	metrics := string(createMetrics(
+		servers,
+		toData,
+		localStates,
+		combinedStates,
+		map[tc.TrafficMonitorName]bool{"tm0": true, "tm1": false},
+		map[tc.TrafficMonitorName]time.Time{"tm0": now.Add(-5 * time.Second)},
+		statInfoHistory,
+		healthHistory,
+		*dsStats,
+		crConfigHist,
+		3,
+		map[string]map[tc.CacheName]uint64{"health": {"cache1": 4}},
+		now,
+	))
+
+	expected := []string{
+		"# TYPE traffic_monitor_cache_poll_duration_seconds gauge\n",
+		`traffic_monitor_cache_poll_duration_seconds{cache="cache0",cachegroup="cg0",type="EDGE",poller="health"} 0.25` + "\n",
+		`traffic_monitor_cache_poll_duration_seconds{cache="cache0",cachegroup="cg0",type="EDGE",poller="stat"} 0.5` + "\n",
+		`traffic_monitor_cache_poll_error{cache="cache1",cachegroup="cg\"1",type="MID",poller="health"} 1` + "\n",
+		"# TYPE traffic_monitor_cache_poll_errors_total counter\n",
+		`traffic_monitor_cache_poll_errors_total{cache="cache0",cachegroup="cg0",type="EDGE",poller="health"} 0` + "\n",
+		`traffic_monitor_cache_poll_errors_total{cache="cache1",cachegroup="cg\"1",type="MID",poller="health"} 4` + "\n",
+		`traffic_monitor_cache_available{cache="cache1",cachegroup="cg\"1",type="MID"} 1` + "\n",
+		`traffic_monitor_cache_local_available{cache="cache1",cachegroup="cg\"1",type="MID"} 0` + "\n",
+		`traffic_monitor_peer_available{peer="tm1"} 0` + "\n",
+		`traffic_monitor_peer_poll_age_seconds{peer="tm0"} 5` + "\n",
+		`traffic_monitor_deliveryservice_kbps{deliveryservice="ds0"} 1500` + "\n",
+		`traffic_monitor_deliveryservice_tps{deliveryservice="ds0"} 20.5` + "\n",
+		`traffic_monitor_deliveryservice_available{deliveryservice="ds0"} 1` + "\n",
+		"traffic_monitor_crconfig_age_seconds 600\n",
+		"# TYPE traffic_monitor_errors_total counter\ntraffic_monitor_errors_total 3\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(metrics, line) {
+			t.Errorf("expected metrics to contain '%s', actual:\n%s", line, metrics)
+		}
+	}
+	if strings.Contains(metrics, `cache="cache1",cachegroup="cg\"1",type="MID",poller="stat"`) {
+		t.Errorf("expected no stat poll metrics of a cache without stat results, actual:\n%s", metrics)
+	}
+	if strings.Contains(metrics, `peer_poll_age_seconds{peer="tm1"}`) {
+		t.Errorf("expected no poll age of a peer never polled, actual:\n%s", metrics)
+	}
+}
@@ -33,9 +33,11 @@ import (
 )
 
 // APIPeerStates contains the data to be returned for an API call to get the peer states of a Traffic Monitor. This contains common API data returned by most endpoints, and a map of peers, to caches' states.
+// If the weighted peer quorum is enabled, it also contains whether each peer was counted in the last quorum, and if not, why not.
 type APIPeerStates struct {
 	tc.CommonAPIData
-	Peers map[tc.TrafficMonitorName]map[tc.CacheName][]CacheState `json:"peers"`
+	Peers  map[tc.TrafficMonitorName]map[tc.CacheName][]CacheState `json:"peers"`
+	Quorum map[tc.TrafficMonitorName]peer.QuorumPeer               `json:"quorum,omitempty"`
 }
 
 // CacheState represents the available state of a cache.
@@ -52,11 +54,11 @@ func srvPeerStates(params url.Values, errorCount threadsafe.Uint, path string, t
 		return []byte(err.Error()), http.StatusBadRequest
 	}
 	json := jsoniter.ConfigFastest
-	bytes, err := json.Marshal(createAPIPeerStates(peerStates.GetCrstates(), peerStates.GetPeersOnline(), filter, params))
+	bytes, err := json.Marshal(createAPIPeerStates(peerStates.GetCrstates(), peerStates.GetPeersOnline(), peerStates.GetQuorumPeers(), filter, params))
 	return WrapErrCode(errorCount, path, bytes, err)
 }
 
-func createAPIPeerStates(peerStates map[tc.TrafficMonitorName]tc.CRStates, peersOnline map[tc.TrafficMonitorName]bool, filter *PeerStateFilter, params url.Values) APIPeerStates {
+func createAPIPeerStates(peerStates map[tc.TrafficMonitorName]tc.CRStates, peersOnline map[tc.TrafficMonitorName]bool, quorumPeers map[tc.TrafficMonitorName]peer.QuorumPeer, filter *PeerStateFilter, params url.Values) APIPeerStates {
 	apiPeerStates := APIPeerStates{
 		CommonAPIData: srvhttp.GetCommonAPIData(params, time.Now()),
 		Peers:         map[tc.TrafficMonitorName]map[tc.CacheName][]CacheState{},
@@ -81,5 +83,14 @@ func createAPIPeerStates(peerStates map[tc.TrafficMonitorName]tc.CRStates, peers
 		}
 		apiPeerStates.Peers[peer] = peerState
 	}
+
+	if quorumPeers != nil {
+		apiPeerStates.Quorum = map[tc.TrafficMonitorName]peer.QuorumPeer{}
+		for peerName, quorumPeer := range quorumPeers {
+			if filter.UsePeer(peerName) {
+				apiPeerStates.Quorum[peerName] = quorumPeer
+			}
+		}
+	}
 	return apiPeerStates
 }
@@ -0,0 +1,353 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+// StateStreamBufferSize is the number of messages kept for consumers resuming a stream. Consumers which missed more are sent the full states.
+const StateStreamBufferSize = 10000
+
+// StateStreamKeepAlive is how often a comment is sent on idle streams, so proxies don't close them and dead consumers are detected.
+const StateStreamKeepAlive = 15 * time.Second
+
+// StateStreamWriteTimeout is the time allowed to write each message to a consumer, after which the consumer is disconnected.
+const StateStreamWriteTimeout = 10 * time.Second
+
+// The names of state stream events.
+const (
+	// StateStreamEventStates is the full combined states, sent when a stream starts, or can't be resumed.
+	StateStreamEventStates = "states"
+	// StateStreamEventDelta is the caches and delivery services whose combined states changed.
+	StateStreamEventDelta = "delta"
+	// StateStreamEventHealth is a health event, as in the event log.
+	StateStreamEventHealth = "event"
+)
+
+// CRStatesDelta is the changes between two CRStates.
+type CRStatesDelta struct {
+	Caches                  map[tc.CacheName]tc.IsAvailable                       `json:"caches,omitempty"`
+	DeliveryServices        map[tc.DeliveryServiceName]tc.CRStatesDeliveryService `json:"deliveryServices,omitempty"`
+	RemovedCaches           []tc.CacheName                                        `json:"removedCaches,omitempty"`
+	RemovedDeliveryServices []tc.DeliveryServiceName                              `json:"removedDeliveryServices,omitempty"`
+}
+
+// Empty returns whether the delta has no changes.
+func (d CRStatesDelta) Empty() bool {
+	return len(d.Caches) == 0 && len(d.DeliveryServices) == 0 && len(d.RemovedCaches) == 0 && len(d.RemovedDeliveryServices) == 0
+}
+
+// DiffCRStates returns the changes from oldStates to newStates.
+func DiffCRStates(oldStates tc.CRStates, newStates tc.CRStates) CRStatesDelta {
+	delta := CRStatesDelta{}
+	for cacheName, state := range newStates.Caches {
+		if oldState, ok := oldStates.Caches[cacheName]; !ok || oldState != state {
+			if delta.Caches == nil {
+				delta.Caches = map[tc.CacheName]tc.IsAvailable{}
+			}
+			delta.Caches[cacheName] = state
+		}
+	}
+	for cacheName := range oldStates.Caches {
+		if _, ok := newStates.Caches[cacheName]; !ok {
+			delta.RemovedCaches = append(delta.RemovedCaches, cacheName)
+		}
+	}
+	for dsName, state := range newStates.DeliveryService {
+		if oldState, ok := oldStates.DeliveryService[dsName]; !ok || !reflect.DeepEqual(oldState, state) {
+			if delta.DeliveryServices == nil {
+				delta.DeliveryServices = map[tc.DeliveryServiceName]tc.CRStatesDeliveryService{}
+			}
+			delta.DeliveryServices[dsName] = state
+		}
+	}
+	for dsName := range oldStates.DeliveryService {
+		if _, ok := newStates.DeliveryService[dsName]; !ok {
+			delta.RemovedDeliveryServices = append(delta.RemovedDeliveryServices, dsName)
+		}
+	}
+	return delta
+}
+
+// StateStreamMessage is a message sent to state stream consumers.
+type StateStreamMessage struct {
+	Seq   uint64
+	Event string
+	Data  []byte
+}
+
+// StateStream broadcasts changes to the combined states, and health events, to streaming consumers. It is safe for multiple goroutines.
+//
+// Each message has a sequence number, which with the stream's epoch is its resume token. Consumers reconnecting with the token of the last message they received are sent only the messages after it, if they are still buffered, or else the full states.
+type StateStream struct {
+	// epoch identifies this stream, so resume tokens from before a restart aren't mistaken for current ones.
+	epoch  string
+	seq    uint64
+	msgs   []StateStreamMessage
+	states tc.CRStates
+	// updated is closed and replaced when a message is added, to wake waiting consumers.
+	updated chan struct{}
+	m       sync.Mutex
+	// conns is the hijacked connections of consumers currently streaming. The HTTP server doesn't close hijacked connections when it's stopped, so CloseStreams must.
+	conns  map[net.Conn]struct{}
+	connsM sync.Mutex
+}
+
+// NewStateStream creates a new StateStream, with empty states.
+func NewStateStream() *StateStream {
+	return &StateStream{
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		states:  tc.NewCRStates(),
+		updated: make(chan struct{}),
+		conns:   map[net.Conn]struct{}{},
+	}
+}
+
+// CloseStreams closes the connections of all consumers currently streaming over hijacked connections. It must be called when the HTTP server is stopped, because the server doesn't close hijacked connections. Consumers may reconnect and resume their streams.
+func (s *StateStream) CloseStreams() {
+	s.connsM.Lock()
+	defer s.connsM.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
+	}
+}
+
+// token returns the resume token of the given sequence number.
+func (s *StateStream) token(seq uint64) string {
+	return s.epoch + "." + strconv.FormatUint(seq, 10)
+}
+
+// add adds a message with the given event and data. Callers must lock s.
+func (s *StateStream) add(event string, data []byte) {
+	s.seq++
+	s.msgs = append(s.msgs, StateStreamMessage{Seq: s.seq, Event: event, Data: data})
+	if len(s.msgs) > 2*StateStreamBufferSize {
+		s.msgs = append([]StateStreamMessage(nil), s.msgs[len(s.msgs)-StateStreamBufferSize:]...)
+	}
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+// PublishStates sends the changes from the last published states to the given states, if any. This MUST NOT be called by multiple goroutines, and the given states MUST NOT be modified afterward.
+func (s *StateStream) PublishStates(states tc.CRStates) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delta := DiffCRStates(s.states, states)
+	s.states = states
+	if delta.Empty() {
+		return
+	}
+	data, err := json.Marshal(delta)
+	if err != nil {
+		log.Errorf("state stream: serializing delta: %v\n", err)
+		return
+	}
+	s.add(StateStreamEventDelta, data)
+}
+
+// AddEvent sends the given health event. It implements health.EventStore.
+func (s *StateStream) AddEvent(e health.Event) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("state stream: serializing event for '%v': %v\n", e.Hostname, err)
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.add(StateStreamEventHealth, data)
+}
+
+// since returns the messages after the given resume token, and a channel closed when there are more. If the token is empty, from a previous epoch, or older than the buffered messages, the full states are returned as a message instead, whose sequence number is the latest.
+func (s *StateStream) since(token string) ([]StateStreamMessage, <-chan struct{}) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	seq, ok := uint64(0), false
+	if dot := strings.LastIndex(token, "."); dot >= 0 && token[:dot] == s.epoch {
+		if n, err := strconv.ParseUint(token[dot+1:], 10, 64); err == nil && n <= s.seq {
+			seq, ok = n, true
+		}
+	}
+	if ok && seq == s.seq {
+		return nil, s.updated
+	}
+	if !ok || len(s.msgs) == 0 || s.msgs[0].Seq > seq+1 {
+		data, err := json.Marshal(s.states)
+		if err != nil {
+			log.Errorf("state stream: serializing states: %v\n", err)
+			data = []byte("{}")
+		}
+		return []StateStreamMessage{{Seq: s.seq, Event: StateStreamEventStates, Data: data}}, s.updated
+	}
+	first := seq + 1 - s.msgs[0].Seq
+	return append([]StateStreamMessage(nil), s.msgs[first:]...), s.updated
+}
+
+// writeMessage writes the given message in the Server-Sent Events format.
+func (s *StateStream) writeMessage(w io.Writer, msg StateStreamMessage) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", s.token(msg.Seq), msg.Event, msg.Data)
+	return err
+}
+
+// eventStreamConn is a connection to a stream consumer.
+type eventStreamConn struct {
+	w io.Writer
+	// flush flushes written messages, setting the write deadline first if the connection has one.
+	flush func() error
+	// done is closed when the consumer disconnects.
+	done  <-chan struct{}
+	close func()
+	// conn is the hijacked connection, or nil if the connection wasn't hijacked.
+	conn net.Conn
+}
+
+// openEventStream starts a text/event-stream response, with any headers already set on w. HTTP/1 connections are hijacked, so the server's write timeout doesn't end the stream; other connections, e.g. HTTP/2, are streamed until the write timeout, after which consumers must resume.
+func openEventStream(w http.ResponseWriter, r *http.Request) (*eventStreamConn, error) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, errors.New("response doesn't support streaming")
+		}
+		w.WriteHeader(http.StatusOK)
+		return &eventStreamConn{
+			w:     w,
+			flush: func() error { flusher.Flush(); return nil },
+			done:  r.Context().Done(),
+			close: func() {},
+		}, nil
+	}
+
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, errors.New("hijacking connection: " + err.Error())
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, errors.New("clearing connection deadline: " + err.Error())
+	}
+	done := make(chan struct{})
+	go func() {
+		// consumers don't send anything, so this returns when the connection is closed
+		io.Copy(ioutil.Discard, rw.Reader)
+		close(done)
+	}()
+	// the response is written by hand after hijacking, so the headers set on w must be copied into it
+	hdr := w.Header().Clone()
+	hdr.Set("Connection", "close")
+	if err := writeResponseHeader(rw.Writer, hdr); err != nil {
+		conn.Close()
+		return nil, errors.New("writing headers: " + err.Error())
+	}
+	return &eventStreamConn{
+		w: rw.Writer,
+		flush: func() error {
+			if err := conn.SetWriteDeadline(time.Now().Add(StateStreamWriteTimeout)); err != nil {
+				return err
+			}
+			return rw.Writer.Flush()
+		},
+		done:  done,
+		close: func() { conn.Close() },
+		conn:  conn,
+	}, nil
+}
+
+// writeResponseHeader writes an HTTP/1.1 200 status line and the given headers.
+func writeResponseHeader(w io.Writer, hdr http.Header) error {
+	if _, err := io.WriteString(w, "HTTP/1.1 200 OK\r\n"); err != nil {
+		return err
+	}
+	if err := hdr.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// ServeHTTP streams messages to the consumer, in the Server-Sent Events format, until it disconnects. The stream is resumed from the token in the Last-Event-ID header, or the since query parameter.
+func (s *StateStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Last-Event-ID")
+	if token == "" {
+		token = r.URL.Query().Get("since")
+	}
+	conn, err := openEventStream(w, r)
+	if err != nil {
+		log.Errorf("state stream: opening stream to %v: %v\n", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer conn.close()
+	if conn.conn != nil {
+		s.connsM.Lock()
+		s.conns[conn.conn] = struct{}{}
+		s.connsM.Unlock()
+		defer func() {
+			s.connsM.Lock()
+			delete(s.conns, conn.conn)
+			s.connsM.Unlock()
+		}()
+	}
+
+	keepAlive := time.NewTicker(StateStreamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		msgs, updated := s.since(token)
+		for _, msg := range msgs {
+			if err := s.writeMessage(conn.w, msg); err != nil {
+				log.Infof("state stream: writing to %v: %v\n", r.RemoteAddr, err)
+				return
+			}
+			token = s.token(msg.Seq)
+		}
+		if err := conn.flush(); err != nil {
+			log.Infof("state stream: writing to %v: %v\n", r.RemoteAddr, err)
+			return
+		}
+
+		select {
+		case <-updated:
+		case <-keepAlive.C:
+			if _, err := io.WriteString(conn.w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
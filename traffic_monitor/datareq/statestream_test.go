@@ -0,0 +1,222 @@
+package datareq
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-rfc"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+func TestDiffCRStates(t *testing.T) {
+	oldStates := tc.NewCRStates()
+	oldStates.Caches["same"] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true}
+	oldStates.Caches["changed"] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true}
+	oldStates.Caches["removed"] = tc.IsAvailable{}
+	oldStates.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}}
+	oldStates.DeliveryService["ds1"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}}
+
+	newStates := tc.NewCRStates()
+	newStates.Caches["same"] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true}
+	newStates.Caches["changed"] = tc.IsAvailable{}
+	newStates.Caches["added"] = tc.IsAvailable{IsAvailable: true}
+	newStates.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{"cg0"}}
+
+	delta := DiffCRStates(oldStates, newStates)
+	if len(delta.Caches) != 2 || delta.Caches["changed"].IsAvailable || !delta.Caches["added"].IsAvailable {
+		t.Errorf("expected changed and added caches, actual %+v", delta.Caches)
+	}
+	if len(delta.RemovedCaches) != 1 || delta.RemovedCaches[0] != "removed" {
+		t.Errorf("expected removed cache, actual %+v", delta.RemovedCaches)
+	}
+	if len(delta.DeliveryServices) != 1 || len(delta.DeliveryServices["ds0"].DisabledLocations) != 1 {
+		t.Errorf("expected ds0 changed, actual %+v", delta.DeliveryServices)
+	}
+	if len(delta.RemovedDeliveryServices) != 1 || delta.RemovedDeliveryServices[0] != "ds1" {
+		t.Errorf("expected ds1 removed, actual %+v", delta.RemovedDeliveryServices)
+	}
+	if !DiffCRStates(newStates, newStates).Empty() {
+		t.Errorf("expected no changes between the same states")
+	}
+}
+
+func TestStateStreamSince(t *testing.T) {
+	s := NewStateStream()
+	states := tc.NewCRStates()
+	states.Caches["cache0"] = tc.IsAvailable{IsAvailable: true}
+	s.PublishStates(states)
+	s.AddEvent(health.Event{Hostname: "cache0", Description: "REPORTED - available"})
+
+	msgs, _ := s.since("")
+	if len(msgs) != 1 || msgs[0].Event != StateStreamEventStates || msgs[0].Seq != 2 {
+		t.Fatalf("expected full states at the latest seq without a token, actual %+v", msgs)
+	}
+
+	msgs, _ = s.since(s.token(1))
+	if len(msgs) != 1 || msgs[0].Event != StateStreamEventHealth {
+		t.Errorf("expected only the event after the token, actual %+v", msgs)
+	}
+
+	msgs, updated := s.since(s.token(2))
+	if len(msgs) != 0 {
+		t.Errorf("expected no messages after the latest token, actual %+v", msgs)
+	}
+	s.PublishStates(states) // unchanged, so nothing is sent
+	select {
+	case <-updated:
+		t.Errorf("expected no update for unchanged states")
+	default:
+	}
+
+	msgs, _ = s.since("oldepoch.1")
+	if len(msgs) != 1 || msgs[0].Event != StateStreamEventStates {
+		t.Errorf("expected full states for a token from another epoch, actual %+v", msgs)
+	}
+
+	for i := 0; i < 2*StateStreamBufferSize+1; i++ {
+		s.AddEvent(health.Event{Hostname: "cache0"})
+	}
+	msgs, _ = s.since(s.token(1))
+	if len(msgs) != 1 || msgs[0].Event != StateStreamEventStates {
+		t.Errorf("expected full states for a token older than the buffer, actual %d messages", len(msgs))
+	}
+}
+
+// readStreamMessage reads the id, event, and data of the next Server-Sent Event, skipping comments.
+func readStreamMessage(t *testing.T, rdr *bufio.Reader) (string, string, string) {
+	id, event, data := "", "", ""
+	for {
+		line, err := rdr.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && event != "":
+			return id, event, data
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestStateStreamServeHTTP(t *testing.T) {
+	s := NewStateStream()
+	states := tc.NewCRStates()
+	states.Caches["cache0"] = tc.IsAvailable{IsAvailable: true}
+	s.PublishStates(states)
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("requesting stream: %v", err)
+	}
+	rdr := bufio.NewReader(resp.Body)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("expected content type text/event-stream, actual %v", ct)
+	}
+
+	_, event, data := readStreamMessage(t, rdr)
+	fullStates := tc.CRStates{}
+	if err := json.Unmarshal([]byte(data), &fullStates); err != nil || event != StateStreamEventStates || !fullStates.Caches["cache0"].IsAvailable {
+		t.Fatalf("expected full states first, actual event %v data %v err %v", event, data, err)
+	}
+
+	downStates := tc.NewCRStates()
+	downStates.Caches["cache0"] = tc.IsAvailable{}
+	s.PublishStates(downStates)
+	id, event, data := readStreamMessage(t, rdr)
+	delta := CRStatesDelta{}
+	if err := json.Unmarshal([]byte(data), &delta); err != nil || event != StateStreamEventDelta || delta.Caches["cache0"].IsAvailable {
+		t.Fatalf("expected cache0 unavailable delta, actual event %v data %v err %v", event, data, err)
+	}
+	resp.Body.Close()
+
+	// changes while disconnected are sent on resume
+	s.AddEvent(health.Event{Hostname: "cache0", Description: "REPORTED - loadavg too high"})
+	s.PublishStates(states)
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Last-Event-ID", id)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("resuming stream: %v", err)
+	}
+	defer resp.Body.Close()
+	rdr = bufio.NewReader(resp.Body)
+	if _, event, data := readStreamMessage(t, rdr); event != StateStreamEventHealth || !strings.Contains(data, "loadavg too high") {
+		t.Errorf("expected missed event first on resume, actual event %v data %v", event, data)
+	}
+	if _, event, _ := readStreamMessage(t, rdr); event != StateStreamEventDelta {
+		t.Errorf("expected missed delta second on resume, actual event %v", event)
+	}
+}
+
+func TestStateStreamHijackedHeadersAndClose(t *testing.T) {
+	s := NewStateStream()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(rfc.PermissionsPolicy, "interest-cohort=()")
+		s.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL) // no client timeout, which would end the stream regardless
+	if err != nil {
+		t.Fatalf("requesting stream: %v", err)
+	}
+	defer resp.Body.Close()
+	if pp := resp.Header.Get(rfc.PermissionsPolicy); pp != "interest-cohort=()" {
+		t.Errorf("expected headers set before streaming kept on the hijacked response, actual %v '%v'", rfc.PermissionsPolicy, pp)
+	}
+	rdr := bufio.NewReader(resp.Body)
+	readStreamMessage(t, rdr)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := rdr.ReadString('\n')
+		readErr <- err
+	}()
+	s.CloseStreams()
+	select {
+	case err := <-readErr:
+		if err == nil {
+			t.Errorf("expected stream closed by CloseStreams, actual read succeeded")
+		}
+	case <-time.After(StateStreamKeepAlive / 2):
+		t.Errorf("expected stream closed by CloseStreams, actual still open")
+	}
+}
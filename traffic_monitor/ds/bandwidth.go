@@ -0,0 +1,170 @@
+package ds
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsdata"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+// BandwidthChange is a cachegroup being limited or no longer limited for a Delivery Service.
+type BandwidthChange struct {
+	DeliveryService tc.DeliveryServiceName
+	CacheGroup      tc.CacheGroupName
+	Limited         bool
+	// Reason is the limit which was crossed, if the cachegroup was limited.
+	Reason string
+}
+
+type limitKey struct {
+	ds tc.DeliveryServiceName
+	cg tc.CacheGroupName
+}
+
+// BandwidthLimiter tracks which cachegroups crossed a bandwidth limit for each Delivery Service. It is safe for multiple goroutines.
+type BandwidthLimiter struct {
+	cfg atomic.Value // config.BandwidthLimitsConfig
+	// limited is the last time each limited cachegroup was over its limit.
+	limited map[limitKey]time.Time
+	m       sync.Mutex
+}
+
+// NewBandwidthLimiter creates a new BandwidthLimiter with the given config.
+func NewBandwidthLimiter(cfg config.BandwidthLimitsConfig) *BandwidthLimiter {
+	l := &BandwidthLimiter{limited: map[limitKey]time.Time{}}
+	l.cfg.Store(cfg)
+	return l
+}
+
+// SetConfig sets the config, which takes effect on the next Update.
+func (l *BandwidthLimiter) SetConfig(cfg config.BandwidthLimitsConfig) {
+	l.cfg.Store(cfg)
+}
+
+// Config returns the current config.
+func (l *BandwidthLimiter) Config() config.BandwidthLimitsConfig {
+	return l.cfg.Load().(config.BandwidthLimitsConfig)
+}
+
+// Update checks the bandwidth of each cachegroup of each Delivery Service against the configured limits, and returns the cachegroups which were limited or are no longer limited, sorted. The bandwidth of caches is their last per-second bandwidth in lastStats, their capacity is their maxKbpses, and only caches available in crStates count toward a cachegroup's utilisation. A limited cachegroup stays limited until it has been within its limits for the config's HoldMs.
+func (l *BandwidthLimiter) Update(dsStats *dsdata.Stats, lastStats *dsdata.LastStats, maxKbpses cache.Kbpses, crStates tc.CRStates, toData todata.TOData, mc tc.TrafficMonitorConfigMap, now time.Time) []BandwidthChange {
+	cfg := l.Config()
+	over := map[limitKey]string{}
+
+	if cfg.CachegroupMaxUtilization > 0 {
+		cgKbps := map[tc.CacheGroupName]float64{}
+		cgCapacity := map[tc.CacheGroupName]float64{}
+		for cacheName, cg := range toData.ServerCachegroups {
+			maxKbps := maxKbpses[string(cacheName)]
+			if maxKbps == 0 || !crStates.Caches[cacheName].IsAvailable {
+				continue
+			}
+			cgCapacity[cg] += float64(maxKbps)
+			if last := lastStats.Caches[cacheName]; last != nil {
+				cgKbps[cg] += last.Bytes.PerSec / BytesPerKilobit
+			}
+		}
+		for ds, caches := range toData.DeliveryServiceServers {
+			for _, cacheName := range caches {
+				cg, ok := toData.ServerCachegroups[cacheName]
+				if !ok || cgCapacity[cg] == 0 {
+					continue
+				}
+				if utilization := cgKbps[cg] / cgCapacity[cg]; utilization > cfg.CachegroupMaxUtilization {
+					over[limitKey{ds: ds, cg: cg}] = fmt.Sprintf("cachegroup utilization too high (%.2f > %.2f of %.0f kbps)", utilization, cfg.CachegroupMaxUtilization, cgCapacity[cg])
+				}
+			}
+		}
+	}
+
+	if cfg.DSCachegroupMaxFraction > 0 {
+		for ds, stat := range dsStats.DeliveryService {
+			kbpsThreshold := mc.DeliveryService[ds.String()].TotalKbpsThreshold
+			if kbpsThreshold <= 0 || stat == nil {
+				continue
+			}
+			maxKbps := cfg.DSCachegroupMaxFraction * float64(kbpsThreshold)
+			for cg, cgStat := range stat.CacheGroups {
+				if cgStat == nil || cgStat.Kbps.Value <= maxKbps {
+					continue
+				}
+				key := limitKey{ds: ds, cg: cg}
+				if _, ok := over[key]; !ok {
+					over[key] = fmt.Sprintf("cachegroup kbps too high (%.2f > %.2f of globalMaxMbps %v kbps)", cgStat.Kbps.Value, cfg.DSCachegroupMaxFraction, kbpsThreshold)
+				}
+			}
+		}
+	}
+
+	hold := time.Duration(cfg.HoldMs) * time.Millisecond
+	l.m.Lock()
+	defer l.m.Unlock()
+	changes := []BandwidthChange{}
+	for key, reason := range over {
+		if _, ok := l.limited[key]; !ok {
+			changes = append(changes, BandwidthChange{DeliveryService: key.ds, CacheGroup: key.cg, Limited: true, Reason: reason})
+		}
+		l.limited[key] = now
+	}
+	for key, lastOver := range l.limited {
+		if _, ok := over[key]; ok {
+			continue
+		}
+		if _, ok := toData.DeliveryServiceServers[key.ds]; !ok {
+			delete(l.limited, key) // the Delivery Service was removed, so its state doesn't matter
+			continue
+		}
+		if now.Sub(lastOver) < hold {
+			continue
+		}
+		delete(l.limited, key)
+		changes = append(changes, BandwidthChange{DeliveryService: key.ds, CacheGroup: key.cg, Limited: false})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].DeliveryService != changes[j].DeliveryService {
+			return changes[i].DeliveryService < changes[j].DeliveryService
+		}
+		return changes[i].CacheGroup < changes[j].CacheGroup
+	})
+	return changes
+}
+
+// LimitedLocations returns the limited cachegroups of each Delivery Service, sorted. Delivery Services without limited cachegroups aren't included.
+func (l *BandwidthLimiter) LimitedLocations() map[tc.DeliveryServiceName][]tc.CacheGroupName {
+	l.m.Lock()
+	defer l.m.Unlock()
+	limited := map[tc.DeliveryServiceName][]tc.CacheGroupName{}
+	for key := range l.limited {
+		limited[key.ds] = append(limited[key.ds], key.cg)
+	}
+	for _, cgs := range limited {
+		sort.Slice(cgs, func(i, j int) bool { return cgs[i] < cgs[j] })
+	}
+	return limited
+}
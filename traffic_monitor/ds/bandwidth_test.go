@@ -0,0 +1,96 @@
+package ds
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsdata"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	cfg := config.BandwidthLimitsConfig{CachegroupMaxUtilization: 0.8, DSCachegroupMaxFraction: 0.5, HoldMs: 60000}
+	l := NewBandwidthLimiter(cfg)
+
+	toData := todata.TOData{
+		DeliveryServiceServers: map[tc.DeliveryServiceName][]tc.CacheName{"ds0": {"cache0", "cache1"}, "ds1": {"cache0", "cache2"}},
+		ServerCachegroups:      map[tc.CacheName]tc.CacheGroupName{"cache0": "cg0", "cache1": "cg1", "cache2": "cg2"},
+	}
+	mc := tc.TrafficMonitorConfigMap{DeliveryService: map[string]tc.TMDeliveryService{"ds0": {XMLID: "ds0", TotalKbpsThreshold: 1000}}}
+	crStates := tc.NewCRStates()
+	for cacheName := range toData.ServerCachegroups {
+		crStates.Caches[cacheName] = tc.IsAvailable{IsAvailable: true}
+	}
+	maxKbpses := cache.Kbpses{"cache0": 1000, "cache1": 1000, "cache2": 1000}
+
+	newStats := func(cacheKbps map[tc.CacheName]float64, dsCachegroupKbps map[tc.CacheGroupName]float64) (*dsdata.Stats, *dsdata.LastStats) {
+		dsStats := dsdata.NewStats(1)
+		dsStats.DeliveryService["ds0"] = dsdata.NewStat()
+		for cg, kbps := range dsCachegroupKbps {
+			dsStats.DeliveryService["ds0"].CacheGroups[cg] = &dsdata.StatCacheStats{Kbps: dsdata.StatFloat{Value: kbps}}
+		}
+		lastStats := dsdata.NewLastStats(0, len(cacheKbps))
+		for cacheName, kbps := range cacheKbps {
+			lastStats.Caches[cacheName] = &dsdata.LastStatsData{Bytes: dsdata.LastStatData{PerSec: kbps * BytesPerKilobit}}
+		}
+		return dsStats, lastStats
+	}
+
+	start := time.Now()
+	dsStats, lastStats := newStats(map[tc.CacheName]float64{"cache0": 900, "cache1": 100}, map[tc.CacheGroupName]float64{"cg0": 100, "cg1": 600})
+	changes := l.Update(dsStats, lastStats, maxKbpses, crStates, toData, mc, start)
+	if len(changes) != 3 {
+		t.Fatalf("expected 3 changes, actual %+v", changes)
+	}
+	if changes[0].DeliveryService != "ds0" || changes[0].CacheGroup != "cg0" || !changes[0].Limited || changes[0].Reason != "cachegroup utilization too high (0.90 > 0.80 of 1000 kbps)" {
+		t.Errorf("expected ds0 cg0 limited by utilization, actual %+v", changes[0])
+	}
+	if changes[1].DeliveryService != "ds0" || changes[1].CacheGroup != "cg1" || !changes[1].Limited || changes[1].Reason != "cachegroup kbps too high (600.00 > 0.50 of globalMaxMbps 1000 kbps)" {
+		t.Errorf("expected ds0 cg1 limited by globalMaxMbps fraction, actual %+v", changes[1])
+	}
+	if changes[2].DeliveryService != "ds1" || changes[2].CacheGroup != "cg0" || !changes[2].Limited {
+		t.Errorf("expected ds1 cg0 limited by utilization, actual %+v", changes[2])
+	}
+	if limited := l.LimitedLocations(); len(limited["ds0"]) != 2 || limited["ds0"][0] != "cg0" || limited["ds0"][1] != "cg1" || len(limited["ds1"]) != 1 {
+		t.Errorf("expected ds0 cg0 and cg1 and ds1 cg0 limited, actual %+v", limited)
+	}
+
+	// cg0 is still over its limit at 30s, so it's held for longer than cg1
+	dsStats, lastStats = newStats(map[tc.CacheName]float64{"cache0": 900}, nil)
+	if changes := l.Update(dsStats, lastStats, maxKbpses, crStates, toData, mc, start.Add(30*time.Second)); len(changes) != 0 {
+		t.Errorf("expected no changes while still over the limits, actual %+v", changes)
+	}
+	dsStats, lastStats = newStats(map[tc.CacheName]float64{"cache0": 100}, nil)
+	if changes := l.Update(dsStats, lastStats, maxKbpses, crStates, toData, mc, start.Add(61*time.Second)); len(changes) != 1 || changes[0].CacheGroup != "cg1" || changes[0].Limited {
+		t.Errorf("expected only ds0 cg1 no longer limited after the hold time, actual %+v", changes)
+	}
+	changes = l.Update(dsStats, lastStats, maxKbpses, crStates, toData, mc, start.Add(2*time.Minute))
+	if len(changes) != 2 || changes[0].Limited || changes[1].Limited {
+		t.Errorf("expected cg0 no longer limited after the hold time, actual %+v", changes)
+	}
+	if limited := l.LimitedLocations(); len(limited) != 0 {
+		t.Errorf("expected no limited cachegroups, actual %+v", limited)
+	}
+}
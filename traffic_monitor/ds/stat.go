@@ -318,10 +318,7 @@ func addDSPerSecStats(lastStats *dsdata.LastStats, dsStats *dsdata.Stats, dsName
 		stat.CommonStats.IsHealthy.Value = false
 		stat.CommonStats.ErrorStr.Value = dsErr.Error()
 	}
-	//it's ok to ignore the 'ok' return here.  If the DS doesn't exist, an empty struct will be returned and we can use it.
-	dsState, _ := states.GetDeliveryService(dsName)
-	dsState.IsAvailable = stat.CommonStats.IsAvailable.Value
-	states.SetDeliveryService(dsName, dsState) // TODO sync.Map? Determine if slow.
+	states.SetDeliveryServiceAvailable(dsName, stat.CommonStats.IsAvailable.Value) // TODO sync.Map? Determine if slow.
 
 	getEvent := func(desc string) health.Event {
 		// TODO sync.Pool?
@@ -0,0 +1,246 @@
+// Package dsprobe fetches synthetic health check URLs of Delivery Services through each of their caches, to find caches which are healthy but fail a particular Delivery Service, e.g. from a bad remap or a broken origin path.
+package dsprobe
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+)
+
+// MaxBodyBytes is the most of a probe response body which is read. The body isn't checked, but is read so the cache doesn't see the probe aborted.
+const MaxBodyBytes = 64 * 1024
+
+// Target is a Delivery Service URL to fetch through a cache.
+type Target struct {
+	DeliveryService tc.DeliveryServiceName
+	Cache           tc.CacheName
+	URL             string
+	// IP is the address of the cache, which is connected to instead of resolving the URL's host.
+	IP string
+}
+
+// Result is the result of probing a Target. Err is nil if the probe passed.
+type Result struct {
+	Target
+	Err error
+}
+
+// Change is a cache being disabled or enabled for a Delivery Service.
+type Change struct {
+	DeliveryService tc.DeliveryServiceName
+	Cache           tc.CacheName
+	Disabled        bool
+	// Reason is the error of the last failed probe, if the cache was disabled.
+	Reason string
+}
+
+type probeKey struct {
+	ds    tc.DeliveryServiceName
+	cache tc.CacheName
+}
+
+type probeState struct {
+	failures  uint64
+	successes uint64
+	disabled  bool
+}
+
+// Prober probes Delivery Services through their caches, and tracks which caches are disabled for each Delivery Service. It is safe for multiple goroutines.
+type Prober struct {
+	cfg       atomic.Value // config.DSProbeConfig
+	userAgent string
+	states    map[probeKey]*probeState
+	m         sync.Mutex
+}
+
+// New creates a new Prober with the given config, which sends the given User-Agent.
+func New(cfg config.DSProbeConfig, userAgent string) *Prober {
+	p := &Prober{userAgent: userAgent, states: map[probeKey]*probeState{}}
+	p.cfg.Store(cfg)
+	return p
+}
+
+// SetConfig sets the config, which takes effect on the next probes.
+func (p *Prober) SetConfig(cfg config.DSProbeConfig) {
+	p.cfg.Store(cfg)
+}
+
+// Config returns the current config.
+func (p *Prober) Config() config.DSProbeConfig {
+	return p.cfg.Load().(config.DSProbeConfig)
+}
+
+// Targets returns the Delivery Services with URLs in the current config, and each of their caches. Caches which are OFFLINE or ADMIN_DOWN, or have no IP address, aren't probed. IPv4 is used if the cache has it.
+func (p *Prober) Targets(dsServers map[tc.DeliveryServiceName][]tc.CacheName, mc tc.TrafficMonitorConfigMap) []Target {
+	targets := []Target{}
+	for ds, probeURL := range p.Config().URLs {
+		for _, cacheName := range dsServers[tc.DeliveryServiceName(ds)] {
+			server, ok := mc.TrafficServer[string(cacheName)]
+			if !ok {
+				continue
+			}
+			if status := tc.CacheStatusFromString(server.ServerStatus); status == tc.CacheStatusOffline || status == tc.CacheStatusAdminDown {
+				continue
+			}
+			ip := server.IPv4()
+			if ip == "" {
+				ip = server.IPv6()
+			}
+			if ip == "" {
+				continue
+			}
+			targets = append(targets, Target{DeliveryService: tc.DeliveryServiceName(ds), Cache: cacheName, URL: probeURL, IP: ip})
+		}
+	}
+	return targets
+}
+
+// Probe fetches all the given targets, at most the config's MaxConcurrent at a time, and returns their results.
+func (p *Prober) Probe(targets []Target) []Result {
+	cfg := p.Config()
+	client := newClient(time.Duration(cfg.TimeoutMs) * time.Millisecond)
+	results := make([]Result, len(targets))
+	sem := make(chan struct{}, cfg.MaxConcurrent)
+	wg := sync.WaitGroup{}
+	for i, target := range targets {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, target Target) {
+			defer wg.Done()
+			results[i] = Result{Target: target, Err: probe(client, target, p.userAgent)}
+			<-sem
+		}(i, target)
+	}
+	wg.Wait()
+	return results
+}
+
+// Update adds the given results, and returns the caches which were disabled or enabled for a Delivery Service. A cache is disabled after the config's FailureCount consecutive failures, and enabled after SuccessCount consecutive passes. Delivery Services and caches not in the results are forgotten, so they are enabled if probed again later.
+func (p *Prober) Update(results []Result) []Change {
+	cfg := p.Config()
+	p.m.Lock()
+	defer p.m.Unlock()
+	changes := []Change{}
+	newStates := make(map[probeKey]*probeState, len(results))
+	for _, result := range results {
+		key := probeKey{ds: result.DeliveryService, cache: result.Cache}
+		state, ok := p.states[key]
+		if !ok {
+			state = &probeState{}
+		}
+		newStates[key] = state
+		if result.Err == nil {
+			state.failures = 0
+			state.successes++
+			if state.disabled && state.successes >= cfg.SuccessCount {
+				state.disabled = false
+				changes = append(changes, Change{DeliveryService: key.ds, Cache: key.cache, Disabled: false})
+			}
+			continue
+		}
+		state.successes = 0
+		state.failures++
+		if !state.disabled && state.failures >= cfg.FailureCount {
+			state.disabled = true
+			changes = append(changes, Change{DeliveryService: key.ds, Cache: key.cache, Disabled: true, Reason: result.Err.Error()})
+		}
+	}
+	p.states = newStates
+	return changes
+}
+
+// DisabledCaches returns the caches disabled for each Delivery Service, sorted. Delivery Services without disabled caches aren't included.
+func (p *Prober) DisabledCaches() map[tc.DeliveryServiceName][]tc.CacheName {
+	p.m.Lock()
+	defer p.m.Unlock()
+	disabled := map[tc.DeliveryServiceName][]tc.CacheName{}
+	for key, state := range p.states {
+		if state.disabled {
+			disabled[key.ds] = append(disabled[key.ds], key.cache)
+		}
+	}
+	for _, caches := range disabled {
+		sort.Slice(caches, func(i, j int) bool { return caches[i] < caches[j] })
+	}
+	return disabled
+}
+
+type cacheIPKey struct{}
+
+// newClient creates a client which connects to the IP in each request's context, at the port of the request URL. The request URL, and thus the Host header and TLS server name, are unchanged.
+func newClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+				_, port, err := net.SplitHostPort(addr)
+				if err != nil {
+					return nil, err
+				}
+				ip, _ := ctx.Value(cacheIPKey{}).(string)
+				if ip == "" {
+					return nil, errors.New("no cache IP")
+				}
+				return dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			},
+			// connections are pooled by the URL host, but are to a particular cache, so they mustn't be reused
+			DisableKeepAlives:   true,
+			TLSHandshakeTimeout: timeout,
+		},
+		// redirects are a valid response from the cache, and following them would probe somewhere else
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// probe fetches the target URL through its cache, returning an error if the request failed or the response status wasn't 200 to 399.
+func probe(client *http.Client, target Target, userAgent string) error {
+	req, err := http.NewRequest(http.MethodGet, target.URL, nil)
+	if err != nil {
+		return errors.New("creating request: " + err.Error())
+	}
+	req = req.WithContext(context.WithValue(req.Context(), cacheIPKey{}, target.IP))
+	req.Header.Set("User-Agent", userAgent)
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.New("requesting: " + err.Error())
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, MaxBodyBytes))
+	if resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return errors.New("status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
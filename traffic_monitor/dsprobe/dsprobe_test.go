@@ -0,0 +1,142 @@
+package dsprobe
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+)
+
+func TestTargets(t *testing.T) {
+	cfg := config.DefaultConfig.DSProbe
+	cfg.URLs = map[string]string{"ds0": "http://edge.ds0.example.net/health"}
+	p := New(cfg, "test")
+
+	newServer := func(status string, ip string, ip6 string) tc.TrafficServer {
+		iface := tc.ServerInterfaceInfo{Name: "eth0"}
+		if ip != "" {
+			iface.IPAddresses = append(iface.IPAddresses, tc.ServerIPAddress{Address: ip, ServiceAddress: true})
+		}
+		if ip6 != "" {
+			iface.IPAddresses = append(iface.IPAddresses, tc.ServerIPAddress{Address: ip6, ServiceAddress: true})
+		}
+		return tc.TrafficServer{ServerStatus: status, Interfaces: []tc.ServerInterfaceInfo{iface}}
+	}
+	mc := tc.TrafficMonitorConfigMap{TrafficServer: map[string]tc.TrafficServer{
+		"reported":  newServer(string(tc.CacheStatusReported), "192.0.2.1", "2001:db8::1"),
+		"ipv6only":  newServer(string(tc.CacheStatusOnline), "", "2001:db8::2"),
+		"admindown": newServer(string(tc.CacheStatusAdminDown), "192.0.2.3", ""),
+		"noip":      newServer(string(tc.CacheStatusReported), "", ""),
+	}}
+	dsServers := map[tc.DeliveryServiceName][]tc.CacheName{
+		"ds0": {"reported", "ipv6only", "admindown", "noip", "unknown"},
+		"ds1": {"reported"},
+	}
+
+	targets := p.Targets(dsServers, mc)
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, actual %+v", targets)
+	}
+	if targets[0].Cache != "reported" || targets[0].IP != "192.0.2.1" || targets[0].URL != cfg.URLs["ds0"] {
+		t.Errorf("expected reported cache probed by IPv4, actual %+v", targets[0])
+	}
+	if targets[1].Cache != "ipv6only" || targets[1].IP != "2001:db8::2" {
+		t.Errorf("expected IPv6 only cache probed by IPv6, actual %+v", targets[1])
+	}
+}
+
+func TestProbe(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, _ := net.SplitHostPort(r.Host)
+		if host != "edge.ds0.example.net" && host != "edge.ds1.example.net" {
+			t.Errorf("expected the probe URL host, actual %v", r.Host)
+		}
+		if host == "edge.ds1.example.net" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer srv.Close()
+	_, port, err := net.SplitHostPort(srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("getting test server port: %v", err)
+	}
+
+	p := New(config.DefaultConfig.DSProbe, "test")
+	results := p.Probe([]Target{
+		{DeliveryService: "ds0", Cache: "cache0", URL: "http://edge.ds0.example.net:" + port + "/health", IP: "127.0.0.1"},
+		{DeliveryService: "ds1", Cache: "cache0", URL: "http://edge.ds1.example.net:" + port + "/health", IP: "127.0.0.1"},
+	})
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, actual %+v", results)
+	}
+	if results[0].Err != nil {
+		t.Errorf("expected ds0 probe to pass, actual %v", results[0].Err)
+	}
+	if results[1].Err == nil || results[1].Err.Error() != "status 502" {
+		t.Errorf("expected ds1 probe to fail with status 502, actual %v", results[1].Err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	cfg := config.DefaultConfig.DSProbe
+	cfg.FailureCount = 2
+	cfg.SuccessCount = 2
+	p := New(cfg, "test")
+
+	target := Target{DeliveryService: "ds0", Cache: "cache0"}
+	failed := []Result{{Target: target, Err: errors.New("status 503")}}
+	passed := []Result{{Target: target}}
+
+	if changes := p.Update(failed); len(changes) != 0 {
+		t.Errorf("expected no change after 1 failure, actual %+v", changes)
+	}
+	changes := p.Update(failed)
+	if len(changes) != 1 || !changes[0].Disabled || changes[0].Reason != "status 503" {
+		t.Fatalf("expected cache disabled after 2 failures, actual %+v", changes)
+	}
+	if disabled := p.DisabledCaches(); len(disabled["ds0"]) != 1 || disabled["ds0"][0] != "cache0" {
+		t.Errorf("expected cache0 disabled for ds0, actual %+v", disabled)
+	}
+
+	if changes := p.Update(passed); len(changes) != 0 {
+		t.Errorf("expected no change after 1 pass, actual %+v", changes)
+	}
+	if changes := p.Update(failed); len(changes) != 0 {
+		t.Errorf("expected no change for a failure while disabled, actual %+v", changes)
+	}
+	p.Update(passed)
+	changes = p.Update(passed)
+	if len(changes) != 1 || changes[0].Disabled {
+		t.Fatalf("expected cache enabled after 2 consecutive passes, actual %+v", changes)
+	}
+
+	p.Update(failed)
+	p.Update(failed)
+	p.Update(nil)
+	if disabled := p.DisabledCaches(); len(disabled) != 0 {
+		t.Errorf("expected caches no longer probed to be forgotten, actual %+v", disabled)
+	}
+}
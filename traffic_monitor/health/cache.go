@@ -183,7 +183,19 @@ func EvalInterface(infVitals map[string]cache.Vitals, inf tc.ServerInterfaceInfo
 
 // EvalAggregate calculates the availability of a cache server as an aggregate
 // of server metrics and metrics of its network interfaces.
-func EvalAggregate(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHistory, mc *tc.TrafficMonitorConfigMap) (bool, string, string) {
+//
+// The resultStats are the cache server's stat history, and may be nil for
+// pollers which don't poll stats, in which case thresholds on stats which
+// aren't computed aren't checked. The thresholdStats are the history of the
+// values of the cache server's threshold stats evaluated by this poller, which
+// this adds to, and are used for thresholds over multiple samples; they may be
+// nil, in which case thresholds are only checked against the latest value.
+//
+// The unavailableStat is the stat whose threshold made the cache server
+// unavailable, or the empty string if it isn't unavailable from a threshold.
+// That stat is checked against its mark-up threshold, if it has one, and the
+// cache server isn't made available until that stat is checked.
+func EvalAggregate(result cache.ResultInfo, resultStats *threadsafe.ResultStatValHistory, thresholdStats *threadsafe.ResultStatValHistory, unavailableStat string, mc *tc.TrafficMonitorConfigMap) (bool, string, string) {
 	serverInfo, ok := mc.TrafficServer[string(result.ID)]
 	if !ok {
 		log.Errorf("Cache %v missing from from Traffic Ops Monitor Config - treating as OFFLINE\n", result.ID)
@@ -208,20 +220,69 @@ func EvalAggregate(result cache.ResultInfo, resultStats *threadsafe.ResultStatVa
 
 	computedStats := cache.ComputedStats()
 
-	for stat, threshold := range profile.Parameters.Thresholds {
-		resultStat := interface{}(nil)
-		computedStatF, ok := computedStats[stat]
+	if _, ok := profile.Parameters.Thresholds[unavailableStat]; ok && resultStats == nil {
+		if _, ok := computedStats[unavailableStat]; !ok {
+			// This poller can't check the stat that made the cache unavailable, so it must stay unavailable until a poller which can does.
+			return false, eventDesc(status, unavailableStat+" exceeded threshold, not polled by this poller"), unavailableStat
+		}
+	}
+
+	statVal := func(stat string) (interface{}, bool) {
+		if computedStatF, ok := computedStats[stat]; ok {
+			return computedStatF(result, serverInfo, profile, dummyCombinedState), true
+		}
+		if resultStats == nil {
+			return nil, false
+		}
+		resultStatHistory := resultStats.Load(stat)
+		if len(resultStatHistory) == 0 {
+			return nil, false
+		}
+		return resultStatHistory[0].Val, true
+	}
+
+	thresholdAvail, thresholdMsg, thresholdStat := evalThresholds(profile.Parameters.Thresholds, statVal, result.Time, thresholdStats, unavailableStat)
+	if !thresholdAvail {
+		return false, eventDesc(status, thresholdMsg), thresholdStat
+	}
+	if thresholdMsg != "" {
+		eventDescVal = eventDesc(status, thresholdMsg)
+	}
+	return avail, eventDescVal, eventMsg
+}
+
+// EvalStats evaluates the given thresholds against the given stats of a cache
+// server taken at the given time, as EvalAggregate does against polled
+// results. This is for replaying recorded stats, such as those in the
+// Traffic Monitor history, for example to find which cache servers proposed
+// thresholds would have made unavailable. Stats missing from the given stats
+// aren't checked.
+//
+// The thresholdStats and unavailableStat are as for EvalAggregate. The
+// returned values are whether the cache server is available, a description of
+// why if it isn't or if it was made available again, and the stat whose
+// threshold made it unavailable.
+func EvalStats(stats map[string]interface{}, t time.Time, thresholds map[string]tc.HealthThreshold, thresholdStats *threadsafe.ResultStatValHistory, unavailableStat string) (bool, string, string) {
+	statVal := func(stat string) (interface{}, bool) {
+		val, ok := stats[stat]
+		return val, ok
+	}
+	return evalThresholds(thresholds, statVal, t, thresholdStats, unavailableStat)
+}
+
+// evalThresholds evaluates the given thresholds against the values of their
+// stats returned by statVal, which returns false for stats without a value.
+// It returns whether they're all within their thresholds, a description of
+// the threshold which was exceeded, or of the threshold of the unavailableStat
+// no longer being exceeded, or an empty string, and the stat whose threshold
+// was exceeded.
+func evalThresholds(thresholds map[string]tc.HealthThreshold, statVal func(stat string) (interface{}, bool), t time.Time, thresholdStats *threadsafe.ResultStatValHistory, unavailableStat string) (bool, string, string) {
+	// The values of all stats are read, and the samples of every multi-sample threshold recorded, before any are evaluated, so every poll is recorded in every history, even if another threshold is exceeded first.
+	statNums := make(map[string]float64, len(thresholds))
+	for stat, threshold := range thresholds {
+		resultStat, ok := statVal(stat)
 		if !ok {
-			if resultStats == nil {
-				continue
-			}
-			resultStatHistory := resultStats.Load(stat)
-			if len(resultStatHistory) == 0 {
-				continue
-			}
-			resultStat = resultStatHistory[0].Val
-		} else {
-			resultStat = computedStatF(result, serverInfo, profile, dummyCombinedState)
+			continue
 		}
 
 		resultStatNum, ok := util.ToNumeric(resultStat)
@@ -229,13 +290,49 @@ func EvalAggregate(result cache.ResultInfo, resultStats *threadsafe.ResultStatVa
 			log.Errorf("health.EvalCache threshold stat %s was not a number: %v", stat, resultStat)
 			continue
 		}
+		statNums[stat] = resultStatNum
 
-		if !inThreshold(threshold, resultStatNum) {
-			return false, eventDesc(status, exceedsThresholdMsg(stat, threshold, resultStatNum)), stat
+		if threshold.Samples != 0 && thresholdStats != nil {
+			if err := thresholdStats.AddStat(stat, resultStatNum, t, uint64(threshold.Samples)); err != nil {
+				log.Errorf("health.EvalCache adding threshold stat %s history: %v", stat, err)
+			}
 		}
 	}
 
-	return avail, eventDescVal, eventMsg
+	msg := ""
+	for stat, threshold := range thresholds {
+		resultStatNum, ok := statNums[stat]
+		if !ok {
+			continue
+		}
+
+		markingUp := stat == unavailableStat && threshold.MarkUp != nil
+		evalThreshold := threshold
+		if markingUp {
+			evalThreshold = *threshold.MarkUp
+		}
+
+		if threshold.Samples == 0 || thresholdStats == nil {
+			if !inThreshold(evalThreshold, resultStatNum) {
+				return false, exceedsThresholdMsg(stat, evalThreshold, resultStatNum) + thresholdRuleMsg(markingUp, 0, 0), stat
+			}
+		} else {
+			exceeded := samplesOutsideThreshold(thresholdStats.Load(stat), evalThreshold, threshold.Samples)
+			if exceeded >= threshold.Exceeded {
+				exceededMsg := fmt.Sprintf("%s exceeded threshold (latest %.2f)", stat, resultStatNum)
+				if !inThreshold(evalThreshold, resultStatNum) {
+					exceededMsg = exceedsThresholdMsg(stat, evalThreshold, resultStatNum)
+				}
+				return false, exceededMsg + thresholdRuleMsg(markingUp, exceeded, threshold.Samples), stat
+			}
+		}
+
+		if stat == unavailableStat && (threshold.MarkUp != nil || threshold.Samples != 0) {
+			// The reason the cache is now available is that this rule no longer applies, so say so.
+			msg = fmt.Sprintf("%s; %s within threshold (%.2f %s %.2f)%s", AvailableStr, stat, resultStatNum, evalThreshold.Comparator, evalThreshold.Val, thresholdRuleMsg(markingUp, 0, 0))
+		}
+	}
+	return true, msg, ""
 }
 
 // getProcessAvailableTuple gets a function to process an availability tuple
@@ -267,11 +364,15 @@ func getProcessAvailableTuple(protocol config.PollingProtocol) func(cache.Availa
 
 // CalcAvailability calculates the availability of each cache in results.
 // statResultHistory may be nil, in which case stats won't be used to calculate
-// availability.
+// availability. thresholdHistory is the history of threshold stat values
+// evaluated by this poller, used for thresholds over multiple samples; it must
+// not be shared with other pollers, and may be nil, in which case thresholds
+// are only checked against the latest value.
 func CalcAvailability(
 	results []cache.Result,
 	pollerName string,
 	statResultHistory *threadsafe.ResultStatHistory,
+	thresholdHistory *threadsafe.ResultStatHistory,
 	mc tc.TrafficMonitorConfigMap,
 	toData todata.TOData,
 	localCacheStatusThreadsafe threadsafe.CacheAvailableStatus,
@@ -334,10 +435,16 @@ func CalcAvailability(
 		var aggWhyAvailable string
 		var aggUnavailableStat string
 
+		var thresholdStats *threadsafe.ResultStatValHistory
+		if thresholdHistory != nil {
+			t := thresholdHistory.LoadOrStore(result.ID)
+			thresholdStats = &t.Stats
+		}
+
 		if statResultsVal != nil {
-			aggIsAvailable, aggWhyAvailable, aggUnavailableStat = EvalAggregate(cache.ToInfo(result), &statResultsVal.Stats, &mc)
+			aggIsAvailable, aggWhyAvailable, aggUnavailableStat = EvalAggregate(cache.ToInfo(result), &statResultsVal.Stats, thresholdStats, lastStatus.UnavailableStat, &mc)
 		} else {
-			aggIsAvailable, aggWhyAvailable, aggUnavailableStat = EvalAggregate(cache.ToInfo(result), nil, &mc)
+			aggIsAvailable, aggWhyAvailable, aggUnavailableStat = EvalAggregate(cache.ToInfo(result), nil, thresholdStats, lastStatus.UnavailableStat, &mc)
 		}
 
 		if result.UsingIPv4 {
@@ -412,6 +519,44 @@ func exceedsThresholdMsg(stat string, threshold tc.HealthThreshold, val float64)
 	}
 }
 
+// thresholdRuleMsg returns a description of the threshold rule which was checked, to append to the reason for a change in availability: whether the mark-up threshold was used, and, for thresholds over multiple samples, how many of them were outside the threshold.
+func thresholdRuleMsg(markUp bool, exceeded int, samples int) string {
+	msg := ""
+	if markUp {
+		msg += ", mark-up threshold"
+	}
+	if samples > 0 {
+		msg += fmt.Sprintf(", %d of last %d samples", exceeded, samples)
+	}
+	return msg
+}
+
+// samplesOutsideThreshold returns how many of the given number of most recent samples in the given stat history are outside the given threshold.
+func samplesOutsideThreshold(history []tc.ResultStatVal, threshold tc.HealthThreshold, samples int) int {
+	exceeded := 0
+	for _, val := range history {
+		if samples <= 0 {
+			break
+		}
+		span := int(val.Span)
+		if span < 1 {
+			span = 1
+		} else if span > samples {
+			span = samples
+		}
+		samples -= span
+
+		num, ok := util.ToNumeric(val.Val)
+		if !ok {
+			continue
+		}
+		if !inThreshold(threshold, num) {
+			exceeded += span
+		}
+	}
+	return exceeded
+}
+
 func inThreshold(threshold tc.HealthThreshold, val float64) bool {
 	switch threshold.Comparator {
 	case "=":
@@ -444,15 +589,26 @@ func calculateDeliveryServiceState(deliveryServiceServers map[tc.DeliveryService
 			log.Infof("CRConfig does not have delivery service %s, but traffic monitor poller does; skipping\n", deliveryServiceName)
 			continue
 		}
-		deliveryServiceState.DisabledLocations = getDisabledLocations(deliveryServiceName, toData.DeliveryServiceServers[deliveryServiceName], cacheStates, toData.ServerCachegroups)
-		states.SetDeliveryService(deliveryServiceName, deliveryServiceState)
+		disabledLocations := getDisabledLocations(deliveryServiceName, toData.DeliveryServiceServers[deliveryServiceName], cacheStates, deliveryServiceState.DisabledCaches, deliveryServiceState.LimitedLocations, toData.ServerCachegroups)
+		states.SetDeliveryServiceDisabledLocations(deliveryServiceName, disabledLocations)
 	}
 }
 
-func getDisabledLocations(deliveryService tc.DeliveryServiceName, deliveryServiceServers []tc.CacheName, cacheStates map[tc.CacheName]tc.IsAvailable, serverCacheGroups map[tc.CacheName]tc.CacheGroupName) []tc.CacheGroupName {
+// getDisabledLocations returns the cachegroups of the delivery service with no available caches, and the cachegroups in limitedLocations, whose bandwidth crossed a limit. Caches in disabledCaches, which failed the delivery service's probe, are unavailable for it.
+func getDisabledLocations(deliveryService tc.DeliveryServiceName, deliveryServiceServers []tc.CacheName, cacheStates map[tc.CacheName]tc.IsAvailable, disabledCaches []tc.CacheName, limitedLocations []tc.CacheGroupName, serverCacheGroups map[tc.CacheName]tc.CacheGroupName) []tc.CacheGroupName {
 	disabledLocations := []tc.CacheGroupName{} // it's important this isn't nil, so it serialises to the JSON `[]` instead of `null`
 	dsCacheStates := getDeliveryServiceCacheAvailability(cacheStates, deliveryServiceServers)
+	for _, cache := range disabledCaches {
+		if _, ok := dsCacheStates[cache]; ok {
+			dsCacheStates[cache] = tc.IsAvailable{}
+		}
+	}
 	dsCachegroupsAvailable := getDeliveryServiceCachegroupAvailability(dsCacheStates, serverCacheGroups)
+	for _, cg := range limitedLocations {
+		if _, ok := dsCachegroupsAvailable[cg]; ok {
+			dsCachegroupsAvailable[cg] = false
+		}
+	}
 	for cg, avail := range dsCachegroupsAvailable {
 		if avail {
 			continue
@@ -428,10 +428,10 @@ func TestCalcAvailabilityThresholds(t *testing.T) {
 	original := results[0].Statistics.Interfaces
 	statResultHistory := (*threadsafe.ResultStatHistory)(nil)
 	results[0].Statistics.Interfaces = make(map[string]cache.Interface)
-	CalcAvailability(results, pollerName, statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	CalcAvailability(results, pollerName, statResultHistory, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
 	results[0].Statistics.Interfaces = original
 
-	CalcAvailability(results, pollerName, statResultHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	CalcAvailability(results, pollerName, statResultHistory, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
 
 	localCacheStatuses := localCacheStatusThreadsafe.Get()
 	localCacheStatus, ok := localCacheStatuses[result.ID]
@@ -468,7 +468,7 @@ func TestCalcAvailabilityThresholds(t *testing.T) {
 	GetVitals(&healthResult, &result, nil)
 	healthPollerName := "health"
 	healthResults := []cache.Result{healthResult}
-	CalcAvailability(healthResults, healthPollerName, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	CalcAvailability(healthResults, healthPollerName, nil, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
 
 	localCacheStatuses = localCacheStatusThreadsafe.Get()
 	if _, ok := localCacheStatuses[result.ID]; !ok {
@@ -565,3 +565,221 @@ func TestEvalInterface(t *testing.T) {
 		t.Errorf("Incorrect reason for interface exceeding threshold to be unavailable; expected: 'maximum bandwidth exceeded', got: '%s'", why)
 	}
 }
+
+func TestCalcAvailabilityThresholdRules(t *testing.T) {
+	cacheName := "myCacheName"
+	markUp := tc.HealthThreshold{Val: 5, Comparator: "<"}
+	mc := tc.TrafficMonitorConfigMap{
+		TrafficServer: map[string]tc.TrafficServer{
+			cacheName: {
+				ServerStatus: string(tc.CacheStatusReported),
+				Profile:      "myProfileName",
+				Interfaces: []tc.ServerInterfaceInfo{
+					{
+						Name: "bond0",
+						IPAddresses: []tc.ServerIPAddress{
+							{
+								Address:        "192.0.2.1",
+								ServiceAddress: true,
+							},
+						},
+					},
+				},
+			},
+		},
+		Profile: map[string]tc.TMProfile{
+			"myProfileName": {
+				Name: "myProfileName",
+				Parameters: tc.TMParameters{
+					Thresholds: map[string]tc.HealthThreshold{
+						"loadavg": {
+							Val:        10,
+							Comparator: "<",
+							MarkUp:     &markUp,
+							Exceeded:   2,
+							Samples:    3,
+						},
+					},
+				},
+			},
+		},
+	}
+	toData := todata.TOData{
+		ServerTypes:            map[tc.CacheName]tc.CacheType{tc.CacheName(cacheName): tc.CacheTypeEdge},
+		DeliveryServiceServers: map[tc.DeliveryServiceName][]tc.CacheName{},
+		ServerCachegroups:      map[tc.CacheName]tc.CacheGroupName{},
+	}
+
+	localCacheStatusThreadsafe := threadsafe.NewCacheAvailableStatus()
+	localStates := peer.NewCRStatesThreadsafe()
+	events := NewThreadsafeEvents(200)
+	thresholdHistory := threadsafe.NewResultStatHistory()
+	start := time.Now()
+
+	polls := []struct {
+		loadavg   float64
+		available bool
+		why       string
+	}{
+		{loadavg: 1, available: false}, // a cache's first poll is never available, because it has no previous status
+		{loadavg: 12, available: true},
+		{loadavg: 4, available: true},
+		{loadavg: 12, available: false, why: "loadavg too high (12.00 > 10.00), 2 of last 3 samples"},
+		{loadavg: 8, available: false, why: "loadavg too high (8.00 > 5.00), mark-up threshold, 2 of last 3 samples"},
+		{loadavg: 4, available: false, why: "loadavg exceeded threshold (latest 4.00), mark-up threshold, 2 of last 3 samples"},
+		{loadavg: 4.5, available: true, why: "loadavg within threshold (4.50 < 5.00), mark-up threshold"},
+		{loadavg: 9, available: true},
+	}
+	for i, poll := range polls {
+		result := cache.Result{
+			ID:            cacheName,
+			Miscellaneous: map[string]interface{}{},
+			Time:          start.Add(time.Duration(i) * time.Second),
+			Vitals:        cache.Vitals{LoadAvg: poll.loadavg},
+			PollFinished:  make(chan uint64, 1),
+			Available:     true,
+			UsingIPv4:     true,
+		}
+		CalcAvailability([]cache.Result{result}, "health", nil, &thresholdHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+
+		status := localCacheStatusThreadsafe.Get()[cacheName]
+		if status.ProcessedAvailable != poll.available {
+			t.Errorf("poll %d loadavg %v: expected available %v, actual %v: %s", i, poll.loadavg, poll.available, status.ProcessedAvailable, status.Why)
+		}
+		if poll.why != "" && !strings.Contains(status.Why, poll.why) {
+			t.Errorf("poll %d loadavg %v: expected reason containing '%s', actual '%s'", i, poll.loadavg, poll.why, status.Why)
+		}
+		if !poll.available && i > 0 && status.UnavailableStat != "loadavg" {
+			t.Errorf("poll %d loadavg %v: expected unavailable stat 'loadavg', actual '%s'", i, poll.loadavg, status.UnavailableStat)
+		}
+	}
+}
+
+func TestCalcAvailabilityThresholdUnpolledStat(t *testing.T) {
+	cacheName := "myCacheName"
+	mc := tc.TrafficMonitorConfigMap{
+		TrafficServer: map[string]tc.TrafficServer{
+			cacheName: {
+				ServerStatus: string(tc.CacheStatusReported),
+				Profile:      "myProfileName",
+				Interfaces: []tc.ServerInterfaceInfo{
+					{
+						Name: "bond0",
+						IPAddresses: []tc.ServerIPAddress{
+							{
+								Address:        "192.0.2.1",
+								ServiceAddress: true,
+							},
+						},
+					},
+				},
+			},
+		},
+		Profile: map[string]tc.TMProfile{
+			"myProfileName": {
+				Name: "myProfileName",
+				Parameters: tc.TMParameters{
+					Thresholds: map[string]tc.HealthThreshold{
+						"proxy.process.http.current_client_connections": {Val: 100, Comparator: "<"},
+					},
+				},
+			},
+		},
+	}
+	toData := todata.TOData{
+		ServerTypes:            map[tc.CacheName]tc.CacheType{tc.CacheName(cacheName): tc.CacheTypeEdge},
+		DeliveryServiceServers: map[tc.DeliveryServiceName][]tc.CacheName{},
+		ServerCachegroups:      map[tc.CacheName]tc.CacheGroupName{},
+	}
+
+	localCacheStatusThreadsafe := threadsafe.NewCacheAvailableStatus()
+	localStates := peer.NewCRStatesThreadsafe()
+	events := NewThreadsafeEvents(200)
+	statResultHistory := threadsafe.NewResultStatHistory()
+
+	newResult := func(connections float64) cache.Result {
+		return cache.Result{
+			ID:            cacheName,
+			Miscellaneous: map[string]interface{}{"proxy.process.http.current_client_connections": connections},
+			Time:          time.Now(),
+			PollFinished:  make(chan uint64, 1),
+			Available:     true,
+			UsingIPv4:     true,
+		}
+	}
+
+	for _, connections := range []float64{10, 500} {
+		result := newResult(connections)
+		if err := statResultHistory.Add(result, 1); err != nil {
+			t.Fatal(err)
+		}
+		CalcAvailability([]cache.Result{result}, "stat", &statResultHistory, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	}
+	if status := localCacheStatusThreadsafe.Get()[cacheName]; status.ProcessedAvailable {
+		t.Fatalf("expected stat poll over threshold to mark unavailable, actual available: %s", status.Why)
+	}
+
+	// The health poller doesn't poll the stat, so it must not mark the cache available.
+	CalcAvailability([]cache.Result{newResult(0)}, "health", nil, nil, mc, toData, localCacheStatusThreadsafe, localStates, events, config.Both)
+	status := localCacheStatusThreadsafe.Get()[cacheName]
+	if status.ProcessedAvailable {
+		t.Errorf("expected health poll to leave cache unavailable from unpolled stat, actual available: %s", status.Why)
+	}
+	if status.UnavailableStat != "proxy.process.http.current_client_connections" {
+		t.Errorf("expected unavailable stat to be kept, actual '%s'", status.UnavailableStat)
+	}
+}
+
+func TestEvalStats(t *testing.T) {
+	markUp := tc.HealthThreshold{Val: 5, Comparator: "<"}
+	thresholds := map[string]tc.HealthThreshold{
+		"loadavg":  {Val: 10, Comparator: "<", MarkUp: &markUp, Exceeded: 2, Samples: 3},
+		"ats.conn": {Val: 100, Comparator: "<"},
+	}
+	thresholdStats := threadsafe.NewResultStatValHistory()
+	start := time.Now()
+
+	samples := []struct {
+		stats     map[string]interface{}
+		available bool
+		why       string
+	}{
+		{stats: map[string]interface{}{"loadavg": 12.0}, available: true},
+		{stats: map[string]interface{}{"ats.conn": 150.0}, available: false, why: "ats.conn too high (150.00 > 100.00)"},
+		{stats: map[string]interface{}{"loadavg": 12.0}, available: false, why: "loadavg too high (12.00 > 10.00), 2 of last 3 samples"},
+		{stats: map[string]interface{}{"loadavg": 4.0}, available: false, why: "loadavg exceeded threshold (latest 4.00), mark-up threshold, 2 of last 3 samples"},
+		{stats: map[string]interface{}{"loadavg": 4.5}, available: true, why: "loadavg within threshold (4.50 < 5.00), mark-up threshold"},
+		{stats: map[string]interface{}{}, available: true},
+	}
+	unavailableStat := ""
+	for i, sample := range samples {
+		available, why, stat := EvalStats(sample.stats, start.Add(time.Duration(i)*time.Second), thresholds, &thresholdStats, unavailableStat)
+		if available != sample.available {
+			t.Errorf("sample %d %+v: expected available %v, actual %v: %s", i, sample.stats, sample.available, available, why)
+		}
+		if !strings.Contains(why, sample.why) {
+			t.Errorf("sample %d %+v: expected reason containing '%s', actual '%s'", i, sample.stats, sample.why, why)
+		}
+		unavailableStat = stat
+	}
+}
+
+func TestEvalStatsRecordsAllSamples(t *testing.T) {
+	thresholds := map[string]tc.HealthThreshold{
+		"loadavg":  {Val: 10, Comparator: "<", Exceeded: 3, Samples: 5},
+		"ats.conn": {Val: 100, Comparator: "<"},
+	}
+	thresholdStats := threadsafe.NewResultStatValHistory()
+	start := time.Now()
+
+	// ats.conn is exceeded in every sample, which must not keep loadavg samples from being recorded, whichever threshold is evaluated first
+	for i := 0; i < 5; i++ {
+		stats := map[string]interface{}{"loadavg": float64(i), "ats.conn": 150.0}
+		if available, why, _ := EvalStats(stats, start.Add(time.Duration(i)*time.Second), thresholds, &thresholdStats, ""); available {
+			t.Fatalf("sample %d: expected unavailable, actual available: %s", i, why)
+		}
+		if history := thresholdStats.Load("loadavg"); len(history) != i+1 {
+			t.Errorf("sample %d: expected %d loadavg samples recorded, actual %d", i, i+1, len(history))
+		}
+	}
+}
@@ -21,6 +21,7 @@ package health
 
 import (
 	"fmt"
+	"strconv"
 	"sync"
 	"time"
 
@@ -33,6 +34,15 @@ func (t Time) MarshalJSON() ([]byte, error) {
 	return []byte(fmt.Sprintf("%d", time.Time(t).Unix())), nil
 }
 
+func (t *Time) UnmarshalJSON(b []byte) error {
+	secs, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return fmt.Errorf("parsing event time: %v", err)
+	}
+	*t = Time(time.Unix(secs, 0))
+	return nil
+}
+
 // Event represents an event change in aggregated data. For example, a cache being marked as unavailable.
 type Event struct {
 	Time          Time   `json:"time"`
@@ -46,12 +56,18 @@ type Event struct {
 	IPv6Available bool   `json:"ipv6Available"`
 }
 
+// EventStore receives all added events, e.g. to persist them beyond the in-memory maximum, or stream them. AddEvent must not block.
+type EventStore interface {
+	AddEvent(e Event)
+}
+
 // Events provides safe access for multiple goroutines readers and a single writer to a stored Events slice.
 type ThreadsafeEvents struct {
 	events    *[]Event
 	m         *sync.RWMutex
 	nextIndex *uint64
 	max       uint64
+	stores    *[]EventStore
 }
 
 func copyEvents(a []Event) []Event {
@@ -63,7 +79,14 @@ func copyEvents(a []Event) []Event {
 // NewEvents creates a new single-writer-multiple-reader Threadsafe object
 func NewThreadsafeEvents(maxEvents uint64) ThreadsafeEvents {
 	i := uint64(0)
-	return ThreadsafeEvents{m: &sync.RWMutex{}, events: &[]Event{}, nextIndex: &i, max: maxEvents}
+	return ThreadsafeEvents{m: &sync.RWMutex{}, events: &[]Event{}, nextIndex: &i, max: maxEvents, stores: &[]EventStore{}}
+}
+
+// AddStore adds a store to which all subsequently added events are also added.
+func (o *ThreadsafeEvents) AddStore(store EventStore) {
+	o.m.Lock()
+	defer o.m.Unlock()
+	*o.stores = append(*o.stores, store)
 }
 
 // Get returns the internal slice of Events for reading. This MUST NOT be modified. If modification is necessary, copy the slice.
@@ -87,5 +110,8 @@ func (o *ThreadsafeEvents) Add(e Event) {
 	// o.m.Lock()
 	*o.events = events
 	*o.nextIndex++
+	for _, store := range *o.stores {
+		store.AddEvent(e)
+	}
 	o.m.Unlock()
 }
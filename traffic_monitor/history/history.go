@@ -0,0 +1,400 @@
+// Package history persists the Traffic Monitor event log and downsampled cache stats to a local database, so they survive restarts and may be queried by time range.
+package history
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// EventBucketName is the name of the bucket holding events, keyed by eventKey.
+const EventBucketName = "events"
+
+// StatBucketName is the name of the bucket holding a bucket of stat samples for each cache, keyed by timeKey.
+const StatBucketName = "stats"
+
+// WriteQueueSize is the number of writes which may be waiting to be committed. Writes beyond this are dropped with an error, rather than blocking the caller.
+const WriteQueueSize = 10000
+
+// PruneInterval is how often data older than the retention is deleted.
+const PruneInterval = 10 * time.Minute
+
+// MaxQueryResults is the maximum number of events or stat samples returned by a single query. Queries with more results return the oldest MaxQueryResults.
+const MaxQueryResults = 100000
+
+// StatSample is the stats of a cache at a point in time.
+type StatSample struct {
+	Time  time.Time              `json:"time"`
+	Stats map[string]interface{} `json:"stats"`
+}
+
+// Store is a persistent history of events and stat samples. It is safe for multiple goroutines.
+type Store struct {
+	db           *bolt.DB
+	retention    time.Duration
+	statInterval time.Duration
+	writes       chan func(tx *bolt.Tx) error
+	done         chan struct{}
+	// lastStatTimes is the time of the last stat sample added for each cache, to downsample.
+	lastStatTimes map[string]time.Time
+	// closed is whether Close was called, after which writes are dropped rather than queued on the closed channel.
+	closed bool
+	m      sync.Mutex
+}
+
+// Open opens or creates the history database at the given path, and prunes it. Events and stat samples older than retention are deleted, and stat samples are added at most once per statInterval per cache.
+func Open(path string, retention time.Duration, statInterval time.Duration) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.New("opening database '" + path + "': " + err.Error())
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(EventBucketName)); err != nil {
+			return errors.New("creating event bucket: " + err.Error())
+		}
+		if _, err := tx.CreateBucketIfNotExists([]byte(StatBucketName)); err != nil {
+			return errors.New("creating stat bucket: " + err.Error())
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.New("creating buckets for database '" + path + "': " + err.Error())
+	}
+
+	s := &Store{
+		db:            db,
+		retention:     retention,
+		statInterval:  statInterval,
+		writes:        make(chan func(tx *bolt.Tx) error, WriteQueueSize),
+		done:          make(chan struct{}),
+		lastStatTimes: map[string]time.Time{},
+	}
+	s.prune(time.Now())
+	go s.write()
+	return s, nil
+}
+
+// OpenReadOnly opens the existing history database at the given path for querying, e.g. by tools replaying the history of a Traffic Monitor. Nothing is pruned, and the store must not be added to. The database is locked by a running Traffic Monitor, so it must be a copy, or the Traffic Monitor must be stopped.
+func OpenReadOnly(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second, ReadOnly: true})
+	if err != nil {
+		return nil, errors.New("opening database '" + path + "': " + err.Error())
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(EventBucketName)) == nil || tx.Bucket([]byte(StatBucketName)) == nil {
+			return errors.New("not a history database")
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.New("opening database '" + path + "': " + err.Error())
+	}
+	return &Store{db: db}, nil
+}
+
+// Close stops writing, commits any queued writes, and closes the database. Writes added after Close are dropped, and the store must not be queried after Close.
+func (s *Store) Close() error {
+	if s.writes != nil {
+		s.m.Lock()
+		if s.closed {
+			s.m.Unlock()
+			return nil
+		}
+		s.closed = true
+		close(s.writes)
+		s.m.Unlock()
+		<-s.done
+	}
+	return s.db.Close()
+}
+
+// write commits queued writes, batching all the writes queued at once into a single transaction, and prunes old data every PruneInterval, until the store is closed.
+func (s *Store) write() {
+	defer close(s.done)
+	pruneTicker := time.NewTicker(PruneInterval)
+	defer pruneTicker.Stop()
+	for {
+		select {
+		case <-pruneTicker.C:
+			s.prune(time.Now())
+		case w, ok := <-s.writes:
+			if !ok {
+				return
+			}
+			batch := []func(tx *bolt.Tx) error{w}
+		drain:
+			for len(batch) < WriteQueueSize {
+				select {
+				case w, ok := <-s.writes:
+					if !ok {
+						break drain
+					}
+					batch = append(batch, w)
+				default:
+					break drain
+				}
+			}
+			err := s.db.Update(func(tx *bolt.Tx) error {
+				for _, w := range batch {
+					if err := w(tx); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				log.Errorf("history: writing %v records: %v\n", len(batch), err)
+			}
+		}
+	}
+}
+
+// queue queues the given write, or logs an error and drops it if the queue is full or the store is closed.
+func (s *Store) queue(w func(tx *bolt.Tx) error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.closed {
+		log.Errorln("history: store closed, dropping record")
+		return
+	}
+	select {
+	case s.writes <- w:
+	default:
+		log.Errorln("history: write queue full, dropping record")
+	}
+}
+
+// timeKey returns the key of the given time, which sorts in time order.
+func timeKey(t time.Time) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return k
+}
+
+// eventKey returns the key of the given event. The event index is appended to the time, so events at the same time don't overwrite each other.
+func eventKey(e health.Event) []byte {
+	k := timeKey(time.Time(e.Time))
+	idx := make([]byte, 8)
+	binary.BigEndian.PutUint64(idx, e.Index)
+	return append(k, idx...)
+}
+
+// keyTime returns the time of the given key created by timeKey or eventKey.
+func keyTime(k []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(k[:8])))
+}
+
+// AddEvent queues the given event to be stored. It doesn't block, and implements health.EventStore.
+func (s *Store) AddEvent(e health.Event) {
+	val, err := json.Marshal(e)
+	if err != nil {
+		log.Errorf("history: serializing event for '%v': %v\n", e.Hostname, err)
+		return
+	}
+	key := eventKey(e)
+	s.queue(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(EventBucketName)).Put(key, val)
+	})
+}
+
+// StatsDue returns whether a stat sample for the given cache at the given time would be stored, that is, whether the stat interval has passed since its last sample. This lets callers avoid building samples which would be dropped.
+func (s *Store) StatsDue(cacheName string, t time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	last, ok := s.lastStatTimes[cacheName]
+	return !ok || t.Sub(last) >= s.statInterval
+}
+
+// AddStats queues the given stats of the given cache to be stored, unless the stat interval hasn't passed since the cache's last sample. It doesn't block.
+func (s *Store) AddStats(cacheName string, t time.Time, stats map[string]interface{}) {
+	s.m.Lock()
+	if last, ok := s.lastStatTimes[cacheName]; ok && t.Sub(last) < s.statInterval {
+		s.m.Unlock()
+		return
+	}
+	s.lastStatTimes[cacheName] = t
+	s.m.Unlock()
+
+	val, err := json.Marshal(stats)
+	if err != nil {
+		log.Errorf("history: serializing stats for '%v': %v\n", cacheName, err)
+		return
+	}
+	key := timeKey(t)
+	s.queue(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket([]byte(StatBucketName)).CreateBucketIfNotExists([]byte(cacheName))
+		if err != nil {
+			return errors.New("creating stat bucket for '" + cacheName + "': " + err.Error())
+		}
+		return b.Put(key, val)
+	})
+}
+
+// Events returns the stored events from start to end, inclusive, oldest first. If hostname isn't empty, only events of that cache are returned.
+func (s *Store) Events(start time.Time, end time.Time, hostname string) ([]health.Event, error) {
+	events := []health.Event{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(EventBucketName)).Cursor()
+		endNs := end.UnixNano()
+		for k, v := c.Seek(timeKey(start)); k != nil && keyTime(k).UnixNano() <= endNs && len(events) < MaxQueryResults; k, v = c.Next() {
+			e := health.Event{}
+			if err := json.Unmarshal(v, &e); err != nil {
+				log.Errorf("history: skipping malformed event at %v: %v\n", keyTime(k), err)
+				continue
+			}
+			if hostname != "" && e.Hostname != hostname {
+				continue
+			}
+			e.Time = health.Time(keyTime(k)) // the serialized time only has seconds
+			events = append(events, e)
+		}
+		return nil
+	})
+	return events, err
+}
+
+// Stats returns the stored stat samples of the given cache from start to end, inclusive, oldest first. If statNames isn't empty, only those stats are returned.
+func (s *Store) Stats(cacheName string, start time.Time, end time.Time, statNames []string) ([]StatSample, error) {
+	samples := []StatSample{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(StatBucketName)).Bucket([]byte(cacheName))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		endNs := end.UnixNano()
+		for k, v := c.Seek(timeKey(start)); k != nil && keyTime(k).UnixNano() <= endNs && len(samples) < MaxQueryResults; k, v = c.Next() {
+			stats := map[string]interface{}{}
+			if err := json.Unmarshal(v, &stats); err != nil {
+				log.Errorf("history: skipping malformed stats of '%v' at %v: %v\n", cacheName, keyTime(k), err)
+				continue
+			}
+			if len(statNames) > 0 {
+				filtered := make(map[string]interface{}, len(statNames))
+				for _, statName := range statNames {
+					if val, ok := stats[statName]; ok {
+						filtered[statName] = val
+					}
+				}
+				stats = filtered
+			}
+			samples = append(samples, StatSample{Time: keyTime(k), Stats: stats})
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// Caches returns the names of the caches with stored stat samples, sorted.
+func (s *Store) Caches() ([]string, error) {
+	caches := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(StatBucketName)).ForEach(func(cacheName []byte, _ []byte) error {
+			caches = append(caches, string(cacheName))
+			return nil
+		})
+	})
+	return caches, err
+}
+
+// prune deletes events and stat samples older than the retention, and the stat buckets of caches with no remaining samples.
+func (s *Store) prune(now time.Time) {
+	oldest := now.Add(-s.retention).UnixNano()
+	deleted := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		deleteOld := func(b *bolt.Bucket) error {
+			c := b.Cursor()
+			for k, _ := c.First(); k != nil && keyTime(k).UnixNano() < oldest; k, _ = c.First() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+				deleted++
+			}
+			return nil
+		}
+		if err := deleteOld(tx.Bucket([]byte(EventBucketName))); err != nil {
+			return errors.New("pruning events: " + err.Error())
+		}
+
+		statBucket := tx.Bucket([]byte(StatBucketName))
+		emptyCaches := [][]byte{}
+		err := statBucket.ForEach(func(cacheName []byte, _ []byte) error {
+			b := statBucket.Bucket(cacheName)
+			if b == nil {
+				return nil
+			}
+			if err := deleteOld(b); err != nil {
+				return errors.New("pruning stats of '" + string(cacheName) + "': " + err.Error())
+			}
+			if k, _ := b.Cursor().First(); k == nil {
+				emptyCaches = append(emptyCaches, append([]byte(nil), cacheName...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, cacheName := range emptyCaches {
+			if err := statBucket.DeleteBucket(cacheName); err != nil {
+				return errors.New("deleting empty stat bucket of '" + string(cacheName) + "': " + err.Error())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("history: pruning: %v\n", err)
+		return
+	}
+	if deleted > 0 {
+		log.Infof("history: pruned %v records older than %v\n", deleted, s.retention)
+	}
+}
+
+// ResultStats returns the stats of the given result to store as a sample: all the stats computed by Traffic Monitor, and the given polled stats, if the result has them. The cache's combined state is used for its isAvailable stat.
+func ResultStats(result cache.Result, mc tc.TrafficMonitorConfigMap, combinedState tc.IsAvailable, statNames []string) map[string]interface{} {
+	serverInfo := mc.TrafficServer[result.ID]
+	profile := mc.Profile[serverInfo.Profile]
+	info := cache.ToInfo(result)
+
+	computedStats := cache.ComputedStats()
+	stats := make(map[string]interface{}, len(computedStats)+len(statNames))
+	for statName, computeStat := range computedStats {
+		stats[statName] = computeStat(info, serverInfo, profile, combinedState)
+	}
+	for _, statName := range statNames {
+		if val, ok := result.Miscellaneous[statName]; ok {
+			stats[statName] = val
+		}
+	}
+	return stats
+}
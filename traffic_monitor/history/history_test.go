@@ -0,0 +1,148 @@
+package history
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+)
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tm-history")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	store, err := Open(path, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	now := time.Now()
+	store.AddEvent(health.Event{Time: health.Time(now.Add(-2 * time.Hour)), Index: 0, Hostname: "cache0", Description: "REPORTED - expired"})
+	store.AddEvent(health.Event{Time: health.Time(now.Add(-10 * time.Minute)), Index: 1, Hostname: "cache0", Description: "REPORTED - loadavg too high"})
+	store.AddEvent(health.Event{Time: health.Time(now.Add(-10 * time.Minute)), Index: 2, Hostname: "cache1", Description: "REPORTED - available"})
+	store.AddStats("cache0", now.Add(-3*time.Minute), map[string]interface{}{"loadavg": 5.0, "kbps": 10.0})
+	if store.StatsDue("cache0", now.Add(-150*time.Second)) {
+		t.Errorf("expected stats not due within the stat interval")
+	}
+	store.AddStats("cache0", now.Add(-150*time.Second), map[string]interface{}{"loadavg": 6.0}) // downsampled away
+	store.AddStats("cache0", now.Add(-1*time.Minute), map[string]interface{}{"loadavg": 7.0, "kbps": 20.0})
+	if err := store.Close(); err != nil {
+		t.Fatalf("closing store: %v", err)
+	}
+	// events from pollers still running while shutting down must be dropped, not panic
+	store.AddEvent(health.Event{Time: health.Time(now), Index: 3, Hostname: "cache0", Description: "REPORTED - after close"})
+	if err := store.Close(); err != nil {
+		t.Errorf("closing store twice expected nil error, actual %v", err)
+	}
+
+	// reopening prunes, and must return everything written before the close
+	store, err = Open(path, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("reopening store: %v", err)
+	}
+	defer store.Close()
+
+	events, err := store.Events(now.Add(-3*time.Hour), now, "")
+	if err != nil {
+		t.Fatalf("getting events: %v", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("expected 2 events after pruning, actual %+v", events)
+	}
+	if events[0].Index != 1 || events[1].Index != 2 || !time.Time(events[0].Time).Equal(time.Unix(0, now.Add(-10*time.Minute).UnixNano())) {
+		t.Errorf("expected events 1 and 2 with nanosecond times, actual %+v", events)
+	}
+
+	events, err = store.Events(now.Add(-3*time.Hour), now, "cache1")
+	if err != nil {
+		t.Fatalf("getting events: %v", err)
+	}
+	if len(events) != 1 || events[0].Description != "REPORTED - available" {
+		t.Errorf("expected only the cache1 event, actual %+v", events)
+	}
+
+	samples, err := store.Stats("cache0", now.Add(-5*time.Minute), now.Add(-2*time.Minute), nil)
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	if len(samples) != 1 || samples[0].Stats["loadavg"] != 5.0 {
+		t.Errorf("expected the first sample only, actual %+v", samples)
+	}
+
+	samples, err = store.Stats("cache0", now.Add(-5*time.Minute), now, []string{"kbps"})
+	if err != nil {
+		t.Fatalf("getting stats: %v", err)
+	}
+	if len(samples) != 2 || len(samples[1].Stats) != 1 || samples[1].Stats["kbps"] != 20.0 {
+		t.Errorf("expected 2 samples with only kbps, actual %+v", samples)
+	}
+
+	if samples, err := store.Stats("nonexistent", now.Add(-5*time.Minute), now, nil); err != nil || len(samples) != 0 {
+		t.Errorf("expected no samples for an unknown cache, actual %+v error %v", samples, err)
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tm-history")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	if _, err := OpenReadOnly(path); err == nil {
+		t.Errorf("expected error opening a nonexistent database read-only")
+	}
+
+	store, err := Open(path, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	now := time.Now()
+	store.AddStats("cache1", now.Add(-2*time.Minute), map[string]interface{}{"loadavg": 1.0})
+	store.AddStats("cache0", now.Add(-1*time.Minute), map[string]interface{}{"loadavg": 2.0})
+	if err := store.Close(); err != nil {
+		t.Fatalf("closing store: %v", err)
+	}
+
+	store, err = OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("opening store read-only: %v", err)
+	}
+	defer store.Close()
+	caches, err := store.Caches()
+	if err != nil {
+		t.Fatalf("getting caches: %v", err)
+	}
+	if len(caches) != 2 || caches[0] != "cache0" || caches[1] != "cache1" {
+		t.Errorf("expected caches cache0 and cache1, actual %+v", caches)
+	}
+	if samples, err := store.Stats("cache1", now.Add(-5*time.Minute), now, nil); err != nil || len(samples) != 1 {
+		t.Errorf("expected 1 sample of cache1, actual %+v error %v", samples, err)
+	}
+}
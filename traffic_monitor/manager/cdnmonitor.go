@@ -0,0 +1,232 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/cache"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
+	"github.com/apache/trafficcontrol/traffic_monitor/ds"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsprobe"
+	"github.com/apache/trafficcontrol/traffic_monitor/handler"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/poller"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
+)
+
+// cdnMonitor is the pollers, managers, and data monitoring a single CDN. Each CDN has its own CRConfig, states, peers, stat history, and events.
+type cdnMonitor struct {
+	// cdn is the name of the CDN, or empty for this monitor's own CDN, whose name is from Traffic Ops or the ops config.
+	cdn string
+	// crConfigHist is the CRConfig history of an additional CDN, kept separately from the history of this monitor's own CDN.
+	crConfigHist         towrap.CRConfigHistoryThreadsafe
+	opsConfig            threadsafe.OpsConfig
+	toData               todata.TODataThreadsafe
+	opsConfigSubscribers []chan<- handler.OpsConfig
+	toSubscribers        []chan<- towrap.TrafficOpsSessionThreadsafe
+	errorCount           threadsafe.Uint
+	healthTick           <-chan uint64
+	healthIteration      threadsafe.Uint
+	dsProber             *dsprobe.Prober
+	bandwidthLimiter     *ds.BandwidthLimiter
+	// historyStore is the CDN's persistent history, or nil if history isn't enabled.
+	historyStore *history.Store
+	// stateStream is the CDN's state stream, whose hijacked connections must be closed when the HTTP server stops.
+	stateStream *datareq.StateStream
+	// endpoints returns the API endpoints of the CDN, using the given Traffic Ops session.
+	endpoints func(toSession towrap.TrafficOpsSessionThreadsafe) map[string]http.HandlerFunc
+}
+
+// session returns the given Traffic Ops session, or for an additional CDN, the session for it.
+func (m *cdnMonitor) session(toSession towrap.TrafficOpsSessionThreadsafe) towrap.TrafficOpsSessionThreadsafe {
+	if m.cdn == "" {
+		return toSession
+	}
+	return toSession.ForCDN(m.cdn, m.crConfigHist)
+}
+
+// cdnOpsConfig returns the given ops config, with the CDN name of an additional CDN.
+func (m *cdnMonitor) cdnOpsConfig(opsConfig handler.OpsConfig) handler.OpsConfig {
+	if m.cdn != "" {
+		opsConfig.CdnName = m.cdn
+	}
+	return opsConfig
+}
+
+// startCDNMonitor starts the pollers and managers monitoring the given CDN, or this monitor's own CDN if cdn is empty, with the given Traffic Ops session. They wait for the ops config manager to send the ops config and session to the returned monitor's subscribers.
+func startCDNMonitor(cdn string, toSession towrap.TrafficOpsSessionThreadsafe, cfg config.Config, appData config.StaticAppData) (*cdnMonitor, error) {
+	m := &cdnMonitor{cdn: cdn, crConfigHist: towrap.NewCRConfigHistoryThreadsafe(cfg.CRConfigHistoryCount)}
+	toSession = m.session(toSession)
+
+	localStates := peer.NewCRStatesThreadsafe() // this is the local state as discoverer by this traffic_monitor
+	fetchCount := threadsafe.NewUint()          // note this is the number of individual caches fetched from, not the number of times all the caches were polled.
+	healthIteration := threadsafe.NewUint()
+	errorCount := threadsafe.NewUint()
+	pollErrors := threadsafe.NewPollErrorCounts()
+
+	toData := todata.NewThreadsafe()
+
+	cacheHealthHandler := cache.NewHandler()
+	cacheHealthPoller := poller.NewCache(cfg.CacheHealthPollingInterval, true, cacheHealthHandler, cfg, appData, cfg.CachePollingProtocol)
+	cacheStatHandler := cache.NewPrecomputeHandler(toData)
+	cacheStatPoller := poller.NewCache(cfg.CacheStatPollingInterval, false, cacheStatHandler, cfg, appData, cfg.CachePollingProtocol)
+	monitorConfigPoller := poller.NewMonitorConfig(cfg.MonitorConfigPollingInterval)
+	peerHandler := peer.NewHandler()
+	peerPoller := poller.NewCache(cfg.PeerPollingInterval, false, peerHandler, cfg, appData, cfg.PeerPollingProtocol)
+
+	go monitorConfigPoller.Poll()
+	go cacheHealthPoller.Poll()
+	go cacheStatPoller.Poll()
+	go peerPoller.Poll()
+
+	events := health.NewThreadsafeEvents(cfg.MaxEvents)
+
+	historyStore := (*history.Store)(nil)
+	if cfg.History.Path != "" {
+		historyPath := cfg.History.Path
+		if cdn != "" {
+			historyPath += "." + cdn
+		}
+		store, err := history.Open(historyPath, time.Duration(cfg.History.RetentionHours)*time.Hour, time.Duration(cfg.History.StatIntervalMs)*time.Millisecond)
+		if err != nil {
+			return nil, fmt.Errorf("opening history: %v", err)
+		}
+		historyStore = store
+		events.AddStore(historyStore)
+	}
+
+	cachesChanged := make(chan struct{})
+	peerStates := peer.NewCRStatesPeersThreadsafe(cfg.PeerOptimisticQuorumMin) // each peer's last state is saved in this map
+
+	monitorConfig := StartMonitorConfigManager(
+		monitorConfigPoller.ConfigChannel,
+		localStates,
+		peerStates,
+		cacheStatPoller.ConfigChannel,
+		cacheHealthPoller.ConfigChannel,
+		peerPoller.ConfigChannel,
+		monitorConfigPoller.IntervalChan,
+		cachesChanged,
+		cfg,
+		appData,
+		toSession,
+		toData,
+		cdn,
+	)
+
+	stateStream := datareq.NewStateStream()
+	events.AddStore(stateStream)
+	m.stateStream = stateStream
+
+	combinedStates, combineStateFunc, combineStateAndWaitFunc := StartStateCombiner(events, peerStates, localStates, toData, cfg.PeerQuorum, stateStream)
+
+	dsProber := dsprobe.New(cfg.DSProbe, appData.UserAgent)
+	StartDSProbeManager(dsProber, toData, monitorConfig, localStates, events, combineStateFunc)
+
+	StartPeerManager(
+		peerHandler.ResultChannel,
+		peerStates,
+		events,
+		combineStateFunc,
+	)
+
+	bandwidthLimiter := ds.NewBandwidthLimiter(cfg.BandwidthLimits)
+	statInfoHistory, statResultHistory, statMaxKbpses, _, lastKbpsStats, dsStats, unpolledCaches, localCacheStatus := StartStatHistoryManager(
+		cacheStatHandler.ResultChan(),
+		localStates,
+		combinedStates,
+		toData,
+		cachesChanged,
+		errorCount,
+		pollErrors,
+		cfg,
+		monitorConfig,
+		events,
+		combineStateFunc,
+		combineStateAndWaitFunc,
+		historyStore,
+		bandwidthLimiter,
+	)
+
+	lastHealthDurations, healthHistory := StartHealthResultManager(
+		cacheHealthHandler.ResultChan(),
+		toData,
+		localStates,
+		monitorConfig,
+		combinedStates,
+		fetchCount,
+		errorCount,
+		pollErrors,
+		cfg,
+		events,
+		localCacheStatus,
+	)
+
+	opsConfig := threadsafe.NewOpsConfig()
+	healthPollInterval := cacheHealthPoller.Config.Interval
+	m.opsConfig = opsConfig
+	m.toData = toData
+	m.opsConfigSubscribers = []chan<- handler.OpsConfig{monitorConfigPoller.OpsConfigChannel}
+	m.toSubscribers = []chan<- towrap.TrafficOpsSessionThreadsafe{monitorConfigPoller.SessionChannel}
+	m.errorCount = errorCount
+	m.healthTick = cacheHealthPoller.TickChan
+	m.healthIteration = healthIteration
+	m.dsProber = dsProber
+	m.bandwidthLimiter = bandwidthLimiter
+	m.historyStore = historyStore
+	m.endpoints = func(toSession towrap.TrafficOpsSessionThreadsafe) map[string]http.HandlerFunc {
+		return datareq.MakeDispatchMap(
+			opsConfig,
+			toSession,
+			localStates,
+			peerStates,
+			combinedStates,
+			statInfoHistory,
+			statResultHistory,
+			statMaxKbpses,
+			healthHistory,
+			dsStats,
+			events,
+			appData,
+			healthPollInterval,
+			lastHealthDurations,
+			fetchCount,
+			healthIteration,
+			errorCount,
+			pollErrors,
+			toData,
+			localCacheStatus,
+			lastKbpsStats,
+			unpolledCaches,
+			monitorConfig,
+			historyStore,
+			stateStream,
+		)
+	}
+	return m, nil
+}
@@ -0,0 +1,77 @@
+package manager
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/dsprobe"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/peer"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+	"github.com/apache/trafficcontrol/traffic_monitor/todata"
+)
+
+// StartDSProbeManager starts probing the Delivery Services with URLs in the prober's config through each of their caches, every config interval. Caches disabled for a Delivery Service are set in its localStates DisabledCaches, and the states are combined if they changed.
+func StartDSProbeManager(
+	prober *dsprobe.Prober,
+	toData todata.TODataThreadsafe,
+	monitorConfig threadsafe.TrafficMonitorConfigMap,
+	localStates peer.CRStatesThreadsafe,
+	events health.ThreadsafeEvents,
+	combineState func(),
+) {
+	go func() {
+		for {
+			start := time.Now()
+			toDataCopy := toData.Get()
+			results := prober.Probe(prober.Targets(toDataCopy.DeliveryServiceServers, monitorConfig.Get()))
+			for _, change := range prober.Update(results) {
+				events.Add(dsProbeEvent(change, toDataCopy.ServerTypes[change.Cache]))
+			}
+			if setDisabledCaches(localStates, prober.DisabledCaches()) {
+				combineState()
+			}
+			log.Infof("probed %v delivery service caches in %v\n", len(results), time.Since(start))
+			time.Sleep(time.Duration(prober.Config().IntervalMs)*time.Millisecond - time.Since(start))
+		}
+	}()
+}
+
+func dsProbeEvent(change dsprobe.Change, cacheType tc.CacheType) health.Event {
+	description := "Delivery Service " + string(change.DeliveryService) + " probe passed"
+	if change.Disabled {
+		description = "Delivery Service " + string(change.DeliveryService) + " probe failed: " + change.Reason
+	}
+	return health.Event{Time: health.Time(time.Now()), Description: description, Name: change.Cache.String(), Hostname: change.Cache.String(), Type: cacheType.String(), Available: !change.Disabled}
+}
+
+// setDisabledCaches sets the DisabledCaches of each delivery service in localStates to the given disabled caches, and returns whether any changed.
+func setDisabledCaches(localStates peer.CRStatesThreadsafe, disabled map[tc.DeliveryServiceName][]tc.CacheName) bool {
+	changed := false
+	for dsName := range localStates.GetDeliveryServices() {
+		if localStates.SetDeliveryServiceDisabledCaches(dsName, disabled[dsName]) {
+			changed = true
+		}
+	}
+	return changed
+}
@@ -45,22 +45,26 @@ func StartHealthResultManager(
 	combinedStates peer.CRStatesThreadsafe,
 	fetchCount threadsafe.Uint,
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	cfg config.Config,
 	events health.ThreadsafeEvents,
 	localCacheStatus threadsafe.CacheAvailableStatus,
 ) (threadsafe.DurationMap, threadsafe.ResultHistory) {
 	lastHealthDurations := threadsafe.NewDurationMap()
 	healthHistory := threadsafe.NewResultHistory()
+	thresholdHistory := threadsafe.NewResultStatHistory()
 	go healthResultManagerListen(
 		cacheHealthChan,
 		toData,
 		localStates,
 		lastHealthDurations,
 		healthHistory,
+		thresholdHistory,
 		monitorConfig,
 		combinedStates,
 		fetchCount,
 		errorCount,
+		pollErrors,
 		events,
 		localCacheStatus,
 		cfg,
@@ -74,10 +78,12 @@ func healthResultManagerListen(
 	localStates peer.CRStatesThreadsafe,
 	lastHealthDurations threadsafe.DurationMap,
 	healthHistory threadsafe.ResultHistory,
+	thresholdHistory threadsafe.ResultStatHistory,
 	monitorConfig threadsafe.TrafficMonitorConfigMap,
 	combinedStates peer.CRStatesThreadsafe,
 	fetchCount threadsafe.Uint,
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	events health.ThreadsafeEvents,
 	localCacheStatus threadsafe.CacheAvailableStatus,
 	cfg config.Config,
@@ -96,10 +102,12 @@ func healthResultManagerListen(
 			combinedStates,
 			fetchCount,
 			errorCount,
+			pollErrors,
 			events,
 			localCacheStatus,
 			lastHealthEndTimes,
 			healthHistory,
+			thresholdHistory,
 			results,
 			cfg,
 		)
@@ -142,10 +150,12 @@ func processHealthResult(
 	combinedStates peer.CRStatesThreadsafe,
 	fetchCount threadsafe.Uint,
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	events health.ThreadsafeEvents,
 	localCacheStatusThreadsafe threadsafe.CacheAvailableStatus,
 	lastHealthEndTimes map[tc.CacheName]time.Time,
 	healthHistory threadsafe.ResultHistory,
+	thresholdHistory threadsafe.ResultStatHistory,
 	results []cache.Result,
 	cfg config.Config,
 ) {
@@ -174,6 +184,9 @@ func processHealthResult(
 			health.GetVitals(&healthResult, &prevResult, &monitorConfigCopy)
 			results[i] = healthResult
 		}
+		if healthResult.Error != nil {
+			pollErrors.Inc("health", tc.CacheName(healthResult.ID))
+		}
 
 		maxHistory := uint64(monitorConfigCopy.Profile[monitorConfigCopy.TrafficServer[string(healthResult.ID)].Profile].Parameters.HistoryCount)
 		if maxHistory < 1 {
@@ -186,7 +199,7 @@ func processHealthResult(
 
 	pollerName := "health"
 	statResultHistoryNil := (*threadsafe.ResultStatHistory)(nil) // health poller doesn't have stats
-	health.CalcAvailability(results, pollerName, statResultHistoryNil, monitorConfigCopy, toDataCopy, localCacheStatusThreadsafe, localStates, events, cfg.CachePollingProtocol)
+	health.CalcAvailability(results, pollerName, statResultHistoryNil, &thresholdHistory, monitorConfigCopy, toDataCopy, localCacheStatusThreadsafe, localStates, events, cfg.CachePollingProtocol)
 
 	healthHistory.Set(healthHistoryCopy)
 	// TODO determine if we should combineCrStates() here
@@ -31,12 +31,7 @@ import (
 	"github.com/apache/trafficcontrol/lib/go-log"
 	"github.com/apache/trafficcontrol/traffic_monitor/cache"
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
-	"github.com/apache/trafficcontrol/traffic_monitor/handler"
-	"github.com/apache/trafficcontrol/traffic_monitor/health"
-	"github.com/apache/trafficcontrol/traffic_monitor/peer"
-	"github.com/apache/trafficcontrol/traffic_monitor/poller"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
-	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
 )
 
@@ -46,114 +41,34 @@ import (
 func Start(opsConfigFile string, cfg config.Config, appData config.StaticAppData, trafficMonitorConfigFileName string) error {
 	toSession := towrap.NewTrafficOpsSessionThreadsafe(nil, nil, cfg.CRConfigHistoryCount, cfg)
 
-	localStates := peer.NewCRStatesThreadsafe() // this is the local state as discoverer by this traffic_monitor
-	fetchCount := threadsafe.NewUint()          // note this is the number of individual caches fetched from, not the number of times all the caches were polled.
-	healthIteration := threadsafe.NewUint()
-	errorCount := threadsafe.NewUint()
-
-	toData := todata.NewThreadsafe()
-
-	cacheHealthHandler := cache.NewHandler()
-	cacheHealthPoller := poller.NewCache(cfg.CacheHealthPollingInterval, true, cacheHealthHandler, cfg, appData, cfg.CachePollingProtocol)
-	cacheStatHandler := cache.NewPrecomputeHandler(toData)
-	cacheStatPoller := poller.NewCache(cfg.CacheStatPollingInterval, false, cacheStatHandler, cfg, appData, cfg.CachePollingProtocol)
-	monitorConfigPoller := poller.NewMonitorConfig(cfg.MonitorConfigPollingInterval)
-	peerHandler := peer.NewHandler()
-	peerPoller := poller.NewCache(cfg.PeerPollingInterval, false, peerHandler, cfg, appData, cfg.PeerPollingProtocol)
-
-	go monitorConfigPoller.Poll()
-	go cacheHealthPoller.Poll()
-	go cacheStatPoller.Poll()
-	go peerPoller.Poll()
-
-	events := health.NewThreadsafeEvents(cfg.MaxEvents)
-
-	cachesChanged := make(chan struct{})
-	peerStates := peer.NewCRStatesPeersThreadsafe(cfg.PeerOptimisticQuorumMin) // each peer's last state is saved in this map
-
-	monitorConfig := StartMonitorConfigManager(
-		monitorConfigPoller.ConfigChannel,
-		localStates,
-		peerStates,
-		cacheStatPoller.ConfigChannel,
-		cacheHealthPoller.ConfigChannel,
-		peerPoller.ConfigChannel,
-		monitorConfigPoller.IntervalChan,
-		cachesChanged,
-		cfg,
-		appData,
-		toSession,
-		toData,
-	)
-
-	combinedStates, combineStateFunc := StartStateCombiner(events, peerStates, localStates, toData)
-
-	StartPeerManager(
-		peerHandler.ResultChannel,
-		peerStates,
-		events,
-		combineStateFunc,
-	)
-
-	statInfoHistory, statResultHistory, statMaxKbpses, _, lastKbpsStats, dsStats, unpolledCaches, localCacheStatus := StartStatHistoryManager(
-		cacheStatHandler.ResultChan(),
-		localStates,
-		combinedStates,
-		toData,
-		cachesChanged,
-		errorCount,
-		cfg,
-		monitorConfig,
-		events,
-		combineStateFunc,
-	)
-
-	lastHealthDurations, healthHistory := StartHealthResultManager(
-		cacheHealthHandler.ResultChan(),
-		toData,
-		localStates,
-		monitorConfig,
-		combinedStates,
-		fetchCount,
-		errorCount,
-		cfg,
-		events,
-		localCacheStatus,
-	)
+	monitor, err := startCDNMonitor("", toSession, cfg, appData)
+	if err != nil {
+		return err
+	}
+	monitors := []*cdnMonitor{monitor}
+	for _, cdn := range cfg.AdditionalCDNs {
+		cdnMonitor, err := startCDNMonitor(cdn, toSession, cfg, appData)
+		if err != nil {
+			return fmt.Errorf("starting monitor of CDN '%v': %v", cdn, err)
+		}
+		monitors = append(monitors, cdnMonitor)
+		go healthTickListener(cdnMonitor.healthTick, cdnMonitor.healthIteration)
+	}
 
 	StartOpsConfigManager(
 		opsConfigFile,
 		toSession,
-		toData,
-		[]chan<- handler.OpsConfig{monitorConfigPoller.OpsConfigChannel},
-		[]chan<- towrap.TrafficOpsSessionThreadsafe{monitorConfigPoller.SessionChannel},
-		localStates,
-		peerStates,
-		combinedStates,
-		statInfoHistory,
-		statResultHistory,
-		statMaxKbpses,
-		healthHistory,
-		lastKbpsStats,
-		dsStats,
-		events,
+		monitors,
 		appData,
-		cacheHealthPoller.Config.Interval,
-		lastHealthDurations,
-		fetchCount,
-		healthIteration,
-		errorCount,
-		localCacheStatus,
-		unpolledCaches,
-		monitorConfig,
 		cfg,
 	)
 
-	if err := startMonitorConfigFilePoller(trafficMonitorConfigFileName); err != nil {
+	if err := startMonitorConfigFilePoller(trafficMonitorConfigFileName, monitors); err != nil {
 		return fmt.Errorf("starting monitor config file poller: %v", err)
 	}
+	startShutdownHandler(monitors)
 
-	healthTickListener(cacheHealthPoller.TickChan, healthIteration)
+	healthTickListener(monitor.healthTick, monitor.healthIteration)
 	return nil
 }
 
@@ -164,7 +79,7 @@ func healthTickListener(cacheHealthTick <-chan uint64, healthIteration threadsaf
 	}
 }
 
-func startMonitorConfigFilePoller(filename string) error {
+func startMonitorConfigFilePoller(filename string, monitors []*cdnMonitor) error {
 	onChange := func(bytes []byte, err error) {
 		if err != nil {
 			log.Errorf("monitor config file poll, polling file '%v': %v", filename, err)
@@ -179,6 +94,11 @@ func startMonitorConfigFilePoller(filename string) error {
 			log.Errorf("monitor config file poll, getting log writers '%v': %v", filename, err)
 			return
 		}
+		cache.SetPrometheusStatsConfig(cfg.PrometheusStats)
+		for _, m := range monitors {
+			m.dsProber.SetConfig(cfg.DSProbe)
+			m.bandwidthLimiter.SetConfig(cfg.BandwidthLimits)
+		}
 	}
 
 	bytes, err := ioutil.ReadFile(filename)
@@ -202,6 +122,26 @@ func startSignalFileReloader(filename string, sig os.Signal, f func([]byte, erro
 	}()
 }
 
+// startShutdownHandler starts a goroutine which, when SIGINT or SIGTERM is received, closes the state streams of each monitor, and its history, so queued events and stats are committed, and exits.
+func startShutdownHandler(monitors []*cdnMonitor) {
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, unix.SIGINT, unix.SIGTERM)
+		sig := <-c
+		log.Infof("received %v, shutting down\n", sig)
+		for _, m := range monitors {
+			m.stateStream.CloseStreams()
+			if m.historyStore == nil {
+				continue
+			}
+			if err := m.historyStore.Close(); err != nil {
+				log.Errorf("closing history of CDN '%v': %v\n", m.cdn, err)
+			}
+		}
+		os.Exit(0)
+	}()
+}
+
 // ipv6CIDRStrToAddr takes an IPv6 CIDR string, e.g. `2001:DB8::1/32` returns `2001:DB8::1`.
 // It does not verify cidr is a valid CIDR or IPv6. It only removes the first slash and everything after it, for performance.
 func ipv6CIDRStrToAddr(cidr string) string {
@@ -31,6 +31,7 @@ import (
 	"github.com/apache/trafficcontrol/lib/go-tc"
 	"github.com/apache/trafficcontrol/traffic_monitor/cache"
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/poller"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
@@ -117,7 +118,7 @@ func getIntervals(monitorConfig tc.TrafficMonitorConfigMap, cfg config.Config, l
 	return intervals, nil
 }
 
-// StartMonitorConfigManager runs the monitor config manager goroutine, and returns the threadsafe data which it sets.
+// StartMonitorConfigManager runs the monitor config manager goroutine, and returns the threadsafe data which it sets. The cdn is the name of an additional CDN, or empty for this monitor's own CDN.
 func StartMonitorConfigManager(
 	monitorConfigPollChan <-chan poller.MonitorCfg,
 	localStates peer.CRStatesThreadsafe,
@@ -131,6 +132,7 @@ func StartMonitorConfigManager(
 	staticAppData config.StaticAppData,
 	toSession towrap.TrafficOpsSessionThreadsafe,
 	toData todata.TODataThreadsafe,
+	cdn string,
 ) threadsafe.TrafficMonitorConfigMap {
 	monitorConfig := threadsafe.NewTrafficMonitorConfigMap()
 	go monitorConfigListen(monitorConfig,
@@ -146,10 +148,19 @@ func StartMonitorConfigManager(
 		staticAppData,
 		toSession,
 		toData,
+		cdn,
 	)
 	return monitorConfig
 }
 
+// peerCRStatesPath returns the path of the CRStates of the given CDN on its peer Traffic Monitors, or of this monitor's own CDN if cdn is empty. The states of an additional CDN are polled under its CDN path, so a peer which monitors it as one of its own additional CDNs returns that CDN's states, not its own CDN's.
+func peerCRStatesPath(cdn string) string {
+	if cdn == "" {
+		return "/publish/CrStates?raw"
+	}
+	return datareq.CDNPathPrefix + cdn + "/publish/CrStates?raw"
+}
+
 const DefaultHealthConnectionTimeout = time.Second * 2
 
 // trafficOpsHealthConnectionTimeoutToDuration takes the int from Traffic Ops, which is in milliseconds, and returns a time.Duration
@@ -201,6 +212,7 @@ func monitorConfigListen(
 	staticAppData config.StaticAppData,
 	toSession towrap.TrafficOpsSessionThreadsafe,
 	toData todata.TODataThreadsafe,
+	cdn string,
 ) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -293,8 +305,8 @@ func monitorConfigListen(
 				continue
 			}
 			// TODO: the URL should be config driven. -jse
-			url4 := fmt.Sprintf("http://%s:%d/publish/CrStates?raw", srv.IP, srv.Port)
-			url6 := fmt.Sprintf("http://[%s]:%d/publish/CrStates?raw", ipv6CIDRStrToAddr(srv.IP6), srv.Port)
+			url4 := fmt.Sprintf("http://%s:%d%s", srv.IP, srv.Port, peerCRStatesPath(cdn))
+			url6 := fmt.Sprintf("http://[%s]:%d%s", ipv6CIDRStrToAddr(srv.IP6), srv.Port, peerCRStatesPath(cdn))
 			peerURLs[srv.HostName] = poller.PollConfig{URL: url4, URLv6: url6, Host: srv.FQDN} // TODO determine timeout.
 			peerSet[tc.TrafficMonitorName(srv.HostName)] = struct{}{}
 		}
@@ -380,7 +392,11 @@ func createServerHealthPollURLs(pollingURLStr string, srv tc.TrafficServer) (str
 }
 
 func insertPorts(pollingURLStr string, srv tc.TrafficServer) string {
-	if strings.HasPrefix(strings.ToLower(pollingURLStr), "https") {
+	lowerURLStr := strings.ToLower(pollingURLStr)
+	if strings.HasPrefix(lowerURLStr, "file:") || !strings.Contains(lowerURLStr, "://") {
+		return pollingURLStr // file poller URLs and paths have no port
+	}
+	if strings.HasPrefix(lowerURLStr, "https") || strings.HasPrefix(lowerURLStr, "wss") {
 		if srv.HTTPSPort != 0 {
 			pollURL, err := url.Parse(pollingURLStr)
 			if err != nil {
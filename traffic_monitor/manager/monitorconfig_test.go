@@ -266,3 +266,30 @@ func TestCreateServerStatPollURL(t *testing.T) {
 		t.Errorf("incorrect IPv6 polling URL; expected: '%s', actual: '%s'", expectedV6, actualV6)
 	}
 }
+
+func TestInsertPortsPollerSchemes(t *testing.T) {
+	srv := tc.TrafficServer{Port: 8080, HTTPSPort: 8443}
+	expected := map[string]string{
+		"http://192.0.2.42/_astats":        "http://192.0.2.42:8080/_astats",
+		"ws://192.0.2.42/_astats":          "ws://192.0.2.42:8080/_astats",
+		"https://192.0.2.42/_astats":       "https://192.0.2.42:8443/_astats",
+		"wss://192.0.2.42/_astats":         "wss://192.0.2.42:8443/_astats",
+		"file:///var/run/stats/192.0.2.42": "file:///var/run/stats/192.0.2.42",
+		"/var/run/stats/192.0.2.42.json":   "/var/run/stats/192.0.2.42.json",
+		"https://192.0.2.42:9443/_astats":  "https://192.0.2.42:9443/_astats",
+	}
+	for tmpl, expectedURL := range expected {
+		if actual := insertPorts(tmpl, srv); actual != expectedURL {
+			t.Errorf("insertPorts '%s' expected '%s', actual '%s'", tmpl, expectedURL, actual)
+		}
+	}
+}
+
+func TestPeerCRStatesPath(t *testing.T) {
+	if path := peerCRStatesPath(""); path != "/publish/CrStates?raw" {
+		t.Errorf("peerCRStatesPath of this monitor's own CDN expected '/publish/CrStates?raw', actual '%v'", path)
+	}
+	if path := peerCRStatesPath("my-cdn"); path != "/cdn/my-cdn/publish/CrStates?raw" {
+		t.Errorf("peerCRStatesPath of an additional CDN expected '/cdn/my-cdn/publish/CrStates?raw', actual '%v'", path)
+	}
+}
@@ -32,54 +32,30 @@ import (
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
 	"github.com/apache/trafficcontrol/traffic_monitor/handler"
-	"github.com/apache/trafficcontrol/traffic_monitor/health"
-	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/srvhttp"
-	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
-	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 	"github.com/apache/trafficcontrol/traffic_monitor/towrap"
 
 	"github.com/json-iterator/go"
 )
 
-// StartOpsConfigManager starts the ops config manager goroutine, returning the (threadsafe) variables which it sets.
+// StartOpsConfigManager starts the ops config manager goroutine, which sends the ops config and Traffic Ops session to the given CDN monitors. The first monitor is this monitor's own CDN, whose endpoints are served at the root, and every monitor's endpoints are also served under datareq.CDNPathPrefix and its CDN name.
 // Note the OpsConfigManager is in charge of the httpServer, because ops config changes trigger server changes. If other things needed to trigger server restarts, the server could be put in its own goroutine with signal channels
 func StartOpsConfigManager(
 	opsConfigFile string,
 	toSession towrap.TrafficOpsSessionThreadsafe,
-	toData todata.TODataThreadsafe,
-	opsConfigChangeSubscribers []chan<- handler.OpsConfig,
-	toChangeSubscribers []chan<- towrap.TrafficOpsSessionThreadsafe,
-	localStates peer.CRStatesThreadsafe,
-	peerStates peer.CRStatesPeersThreadsafe,
-	combinedStates peer.CRStatesThreadsafe,
-	statInfoHistory threadsafe.ResultInfoHistory,
-	statResultHistory threadsafe.ResultStatHistory,
-	statMaxKbpses threadsafe.CacheKbpses,
-	healthHistory threadsafe.ResultHistory,
-	lastStats threadsafe.LastStats,
-	dsStats threadsafe.DSStatsReader,
-	events health.ThreadsafeEvents,
+	monitors []*cdnMonitor,
 	staticAppData config.StaticAppData,
-	healthPollInterval time.Duration,
-	lastHealthDurations threadsafe.DurationMap,
-	fetchCount threadsafe.Uint,
-	healthIteration threadsafe.Uint,
-	errorCount threadsafe.Uint,
-	localCacheStatus threadsafe.CacheAvailableStatus,
-	unpolledCaches threadsafe.UnpolledCaches,
-	monitorConfig threadsafe.TrafficMonitorConfigMap,
 	cfg config.Config,
-) (threadsafe.OpsConfig, error) {
-
+) error {
+	monitor := monitors[0]
 	handleErr := func(err error) {
-		errorCount.Inc()
+		monitor.errorCount.Inc()
 		log.Errorf("OpsConfigManager: %v\n", err)
 	}
 
 	httpServer := srvhttp.Server{}
 	httpsServer := srvhttp.Server{}
-	opsConfig := threadsafe.NewOpsConfig()
+	cdnEndpoints := datareq.NewCDNEndpoints()
 
 	// TODO remove change subscribers, give Threadsafes directly to the things that need them. If they only set vars, and don't actually do work on change.
 	onChange := func(bytes []byte, err error) {
@@ -95,7 +71,9 @@ func StartOpsConfigManager(
 			return
 		}
 
-		opsConfig.Set(newOpsConfig)
+		for _, m := range monitors {
+			m.opsConfig.Set(m.cdnOpsConfig(newOpsConfig))
+		}
 
 		listenAddress := ":80" // default
 
@@ -103,31 +81,14 @@ func StartOpsConfigManager(
 			listenAddress = newOpsConfig.HttpListener
 		}
 
-		endpoints := datareq.MakeDispatchMap(
-			opsConfig,
-			toSession,
-			localStates,
-			peerStates,
-			combinedStates,
-			statInfoHistory,
-			statResultHistory,
-			statMaxKbpses,
-			healthHistory,
-			dsStats,
-			events,
-			staticAppData,
-			healthPollInterval,
-			lastHealthDurations,
-			fetchCount,
-			healthIteration,
-			errorCount,
-			toData,
-			localCacheStatus,
-			lastStats,
-			unpolledCaches,
-			monitorConfig,
-		)
+		// the servers are restarted below, which doesn't close hijacked connections, so state streams are closed first; consumers resume on the new server
+		for _, m := range monitors {
+			m.stateStream.CloseStreams()
+		}
 
+		endpoints := monitor.endpoints(toSession)
+		endpoints[datareq.CDNPathPrefix] = cdnEndpoints.ServeHTTP
+		endpoints["/api/cdns"] = cdnEndpoints.ServeCDNs
 		// If the HTTPS Listener is defined in the traffic_ops.cfg file then it creates the HTTPS endpoint and the corresponding HTTP endpoint as a redirect
 		if newOpsConfig.HttpsListener != "" {
 			httpsListenAddress := newOpsConfig.HttpsListener
@@ -184,8 +145,6 @@ func StartOpsConfigManager(
 				break
 			}
 		}
-		opsConfig.Set(newOpsConfig)
-
 		if cdn, err := toSession.MonitorCDN(staticAppData.Hostname); err != nil {
 			handleErr(fmt.Errorf("getting CDN name from Traffic Ops, using config CDN '%s': %s\n", newOpsConfig.CdnName, err))
 		} else {
@@ -195,37 +154,62 @@ func StartOpsConfigManager(
 			newOpsConfig.CdnName = cdn
 		}
 
-		// fixed an issue when traffic_monitor receives corrupt data, CRConfig, from traffic_ops.
-		// Will loop and retry until a good CRConfig is received from traffic_ops
-		backoff.Reset()
-		for {
-			if err := toData.Fetch(toSession, newOpsConfig.CdnName); err != nil {
-				handleErr(fmt.Errorf("Error getting Traffic Ops data: %v\n", err))
-				duration := backoff.BackoffDuration()
-				log.Errorf("retrying in %v\n", duration)
-				time.Sleep(duration)
+		for _, m := range monitors {
+			cdnOpsConfig := m.cdnOpsConfig(newOpsConfig)
+			if m != monitor && cdnOpsConfig.CdnName == newOpsConfig.CdnName {
+				handleErr(fmt.Errorf("additional CDN '%s' is this monitor's own CDN, not monitoring it twice\n", m.cdn))
 				continue
 			}
-			break
-		}
-
-		// These must be in a goroutine, because the monitorConfigPoller tick sends to a channel this select listens for. Thus, if we block on sends to the monitorConfigPoller, we have a livelock race condition.
-		// More generically, we're using goroutines as an infinite chan buffer, to avoid potential livelocks
-		for _, subscriber := range opsConfigChangeSubscribers {
-			go func(s chan<- handler.OpsConfig) { s <- newOpsConfig }(subscriber)
-		}
-		for _, subscriber := range toChangeSubscribers {
-			go func(s chan<- towrap.TrafficOpsSessionThreadsafe) { s <- toSession }(subscriber)
+			m.opsConfig.Set(cdnOpsConfig)
+			if m == monitor {
+				startCDNMonitoring(m, cdnOpsConfig, m.session(toSession), cdnEndpoints, cfg, handleErr)
+				continue
+			}
+			// additional CDNs are started concurrently, so one whose CRConfig can't be fetched doesn't block the others
+			go startCDNMonitoring(m, cdnOpsConfig, m.session(toSession), cdnEndpoints, cfg, handleErr)
 		}
 	}
 
 	bytes, err := ioutil.ReadFile(opsConfigFile)
 	if err != nil {
-		return opsConfig, err
+		return err
 	}
 	onChange(bytes, err)
 
 	startSignalFileReloader(opsConfigFile, unix.SIGHUP, onChange)
 
-	return opsConfig, nil
+	return nil
+}
+
+// startCDNMonitoring fetches the Traffic Ops data of the given monitor's CDN, retrying until it succeeds, then serves its endpoints under its CDN name, and sends the ops config and session to its subscribers.
+func startCDNMonitoring(m *cdnMonitor, opsConfig handler.OpsConfig, toSession towrap.TrafficOpsSessionThreadsafe, cdnEndpoints *datareq.CDNEndpoints, cfg config.Config, handleErr func(error)) {
+	backoff, err := util.NewBackoff(cfg.TrafficOpsMinRetryInterval, cfg.TrafficOpsMaxRetryInterval, util.DefaultFactor)
+	if err != nil {
+		log.Errorf("possible invalid backoff arguments, will use a fixed sleep interval: %v, will use a fallback duration: %v", err, util.ConstantBackoffDuration)
+		backoff = util.NewConstantBackoff(util.ConstantBackoffDuration)
+	}
+
+	// fixed an issue when traffic_monitor receives corrupt data, CRConfig, from traffic_ops.
+	// Will loop and retry until a good CRConfig is received from traffic_ops
+	for {
+		if err := m.toData.Fetch(toSession, opsConfig.CdnName); err != nil {
+			handleErr(fmt.Errorf("Error getting Traffic Ops data for CDN '%s': %v\n", opsConfig.CdnName, err))
+			duration := backoff.BackoffDuration()
+			log.Errorf("retrying in %v\n", duration)
+			time.Sleep(duration)
+			continue
+		}
+		break
+	}
+
+	cdnEndpoints.Set(opsConfig.CdnName, m.endpoints(toSession))
+
+	// These must be in a goroutine, because the monitorConfigPoller tick sends to a channel this select listens for. Thus, if we block on sends to the monitorConfigPoller, we have a livelock race condition.
+	// More generically, we're using goroutines as an infinite chan buffer, to avoid potential livelocks
+	for _, subscriber := range m.opsConfigSubscribers {
+		go func(s chan<- handler.OpsConfig) { s <- opsConfig }(subscriber)
+	}
+	for _, subscriber := range m.toSubscribers {
+		go func(s chan<- towrap.TrafficOpsSessionThreadsafe) { s <- toSession }(subscriber)
+	}
 }
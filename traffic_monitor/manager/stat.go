@@ -30,6 +30,7 @@ import (
 	"github.com/apache/trafficcontrol/traffic_monitor/config"
 	"github.com/apache/trafficcontrol/traffic_monitor/ds"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
@@ -65,13 +66,18 @@ func StartStatHistoryManager(
 	toData todata.TODataThreadsafe,
 	cachesChanged <-chan struct{},
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	cfg config.Config,
 	monitorConfig threadsafe.TrafficMonitorConfigMap,
 	events health.ThreadsafeEvents,
 	combineState func(),
+	combineStateAndWait func(),
+	historyStore *history.Store,
+	bandwidthLimiter *ds.BandwidthLimiter,
 ) (threadsafe.ResultInfoHistory, threadsafe.ResultStatHistory, threadsafe.CacheKbpses, threadsafe.DurationMap, threadsafe.LastStats, threadsafe.DSStatsReader, threadsafe.UnpolledCaches, threadsafe.CacheAvailableStatus) {
 	statInfoHistory := threadsafe.NewResultInfoHistory()
 	statResultHistory := threadsafe.NewResultStatHistory()
+	thresholdHistory := threadsafe.NewResultStatHistory()
 	statMaxKbpses := threadsafe.NewCacheKbpses()
 	lastStatDurations := threadsafe.NewDurationMap()
 	lastStatEndTimes := map[tc.CacheName]time.Time{}
@@ -98,7 +104,7 @@ func StartStatHistoryManager(
 		if haveCachesChanged() {
 			unpolledCaches.SetNewCaches(getNewCaches(localStates, monitorConfig))
 		}
-		processStatResults(results, statInfoHistory, statResultHistory, statMaxKbpses, combinedStates, lastStats, toData.Get(), errorCount, dsStats, lastStatEndTimes, lastStatDurations, unpolledCaches, monitorConfig.Get(), precomputedData, lastResults, localStates, events, localCacheStatus, overrideMap, combineState, cfg.CachePollingProtocol)
+		processStatResults(results, statInfoHistory, statResultHistory, thresholdHistory, statMaxKbpses, combinedStates, lastStats, toData.Get(), errorCount, pollErrors, dsStats, lastStatEndTimes, lastStatDurations, unpolledCaches, monitorConfig.Get(), precomputedData, lastResults, localStates, events, localCacheStatus, overrideMap, combineState, combineStateAndWait, cfg.CachePollingProtocol, historyStore, cfg.History.Stats, bandwidthLimiter)
 	}
 
 	go func() {
@@ -237,11 +243,13 @@ func processStatResults(
 	results []cache.Result,
 	statInfoHistoryThreadsafe threadsafe.ResultInfoHistory,
 	statResultHistoryThreadsafe threadsafe.ResultStatHistory,
+	thresholdHistory threadsafe.ResultStatHistory,
 	statMaxKbpsesThreadsafe threadsafe.CacheKbpses,
 	combinedStatesThreadsafe peer.CRStatesThreadsafe,
 	lastStats threadsafe.LastStats,
 	toData todata.TOData,
 	errorCount threadsafe.Uint,
+	pollErrors threadsafe.PollErrorCounts,
 	dsStats threadsafe.DSStats,
 	lastStatEndTimes map[tc.CacheName]time.Time,
 	lastStatDurationsThreadsafe threadsafe.DurationMap,
@@ -254,7 +262,11 @@ func processStatResults(
 	localCacheStatusThreadsafe threadsafe.CacheAvailableStatus,
 	overrideMap map[tc.CacheName]bool,
 	combineState func(),
+	combineStateAndWait func(),
 	pollingProtocol config.PollingProtocol,
+	historyStore *history.Store,
+	historyStats []string,
+	bandwidthLimiter *ds.BandwidthLimiter,
 ) {
 	if len(results) == 0 {
 		return
@@ -287,6 +299,9 @@ func processStatResults(
 				log.Errorf("stat poll getting vitals for %v: %v\n", result.ID, result.Error)
 			}
 		}
+		if result.Error != nil {
+			pollErrors.Inc("stat", tc.CacheName(result.ID))
+		}
 		statInfoHistory.Add(result, maxStats)
 		if err := statResultHistoryThreadsafe.Add(result, maxStats); err != nil {
 			log.Errorf("Adding result from %v: %v\n", result.ID, err)
@@ -317,11 +332,33 @@ func processStatResults(
 	} else {
 		dsStats.Set(*newDsStats)
 		lastStats.Set(*lastStatsCopy)
+		for _, change := range bandwidthLimiter.Update(newDsStats, lastStatsCopy, statMaxKbpses, combinedStates, toData, mc, time.Now()) {
+			events.Add(bandwidthLimitEvent(change))
+		}
+		setLimitedLocations(localStates, bandwidthLimiter.LimitedLocations())
 	}
 
 	pollerName := "stat"
-	health.CalcAvailability(results, pollerName, &statResultHistoryThreadsafe, mc, toData, localCacheStatusThreadsafe, localStates, events, pollingProtocol)
-	combineState()
+	health.CalcAvailability(results, pollerName, &statResultHistoryThreadsafe, &thresholdHistory, mc, toData, localCacheStatusThreadsafe, localStates, events, pollingProtocol)
+
+	historyResults := []cache.Result{}
+	if historyStore != nil {
+		for _, result := range results {
+			if historyStore.StatsDue(result.ID, result.Time) {
+				historyResults = append(historyResults, result)
+			}
+		}
+	}
+	if len(historyResults) == 0 {
+		combineState()
+	} else {
+		// Wait for the states to be combined, so history samples have the combined states from these results, not the previous ones.
+		combineStateAndWait()
+		newCombinedStates := combinedStatesThreadsafe.Get()
+		for _, result := range historyResults {
+			historyStore.AddStats(result.ID, result.Time, history.ResultStats(result, mc, newCombinedStates.Caches[tc.CacheName(result.ID)], historyStats))
+		}
+	}
 
 	endTime := time.Now()
 	lastStatDurations := threadsafe.CopyDurationMap(lastStatDurationsThreadsafe.Get())
@@ -335,3 +372,18 @@ func processStatResults(
 	lastStatDurationsThreadsafe.Set(lastStatDurations)
 	unpolledCaches.SetPolled(results, lastStats.Get())
 }
+
+func bandwidthLimitEvent(change ds.BandwidthChange) health.Event {
+	description := "cachegroup " + string(change.CacheGroup) + " within bandwidth limits"
+	if change.Limited {
+		description = "cachegroup " + string(change.CacheGroup) + " limited: " + change.Reason
+	}
+	return health.Event{Time: health.Time(time.Now()), Description: description, Name: change.DeliveryService.String(), Hostname: change.DeliveryService.String(), Type: "DELIVERYSERVICE", Available: !change.Limited}
+}
+
+// setLimitedLocations sets the LimitedLocations of each delivery service in localStates to the given limited cachegroups. Their DisabledLocations are set from them when the delivery service states are next calculated.
+func setLimitedLocations(localStates peer.CRStatesThreadsafe, limited map[tc.DeliveryServiceName][]tc.CacheGroupName) {
+	for dsName := range localStates.GetDeliveryServices() {
+		localStates.SetDeliveryServiceLimitedLocations(dsName, limited[dsName])
+	}
+}
@@ -27,13 +27,16 @@ import (
 
 	"github.com/apache/trafficcontrol/lib/go-log"
 	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 )
 
-// StartStateCombiner starts the State Combiner goroutine, and returns the threadsafe CombinedStates, and a func to signal to combine states.
-func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStatesPeersThreadsafe, localStates peer.CRStatesThreadsafe, toData todata.TODataThreadsafe) (peer.CRStatesThreadsafe, func()) {
+// StartStateCombiner starts the State Combiner goroutine, and returns the threadsafe CombinedStates, a func to signal to combine states, and a func to combine states and wait until they're combined.
+// If the given peer quorum is enabled, cache states are combined by a weighted vote of this monitor and its counted peers, rather than optimistically. The combined states are published to the given state stream after each combine.
+func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStatesPeersThreadsafe, localStates peer.CRStatesThreadsafe, toData todata.TODataThreadsafe, quorumCfg config.PeerQuorumConfig, stateStream *datareq.StateStream) (peer.CRStatesThreadsafe, func(), func()) {
 	combinedStates := peer.NewCRStatesThreadsafe()
 
 	// the chan buffer just reduces the number of goroutines on our infinite buffer hack in combineState(), no real writer will block, since combineState() writes in a goroutine.
@@ -42,6 +45,14 @@ func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStates
 		go func() { combineStateChan <- struct{}{} }()
 	}
 
+	// combineStateWaitChan receives a chan for each waiting combineStateAndWait(), which is closed after the next combine.
+	combineStateWaitChan := make(chan chan struct{})
+	combineStateAndWait := func() {
+		done := make(chan struct{})
+		combineStateWaitChan <- done
+		<-done
+	}
+
 	drain := func(c <-chan struct{}) {
 	outer:
 		for {
@@ -56,13 +67,28 @@ func StartStateCombiner(events health.ThreadsafeEvents, peerStates peer.CRStates
 
 	go func() {
 		overrideMap := map[tc.CacheName]bool{}
-		for range combineStateChan {
+		quorum := newPeerQuorum(quorumCfg)
+		for {
+			waiting := []chan struct{}{}
+			select {
+			case <-combineStateChan:
+			case done := <-combineStateWaitChan:
+				waiting = append(waiting, done)
+			}
 			drain(combineStateChan)
-			combineCrStates(events, true, peerStates, localStates.Get(), combinedStates, overrideMap, toData.Get())
+			if quorumCfg.Enabled() {
+				combineCrStatesQuorum(events, quorum, peerStates, localStates.Get(), combinedStates, overrideMap, toData.Get(), time.Now())
+			} else {
+				combineCrStates(events, true, peerStates, localStates.Get(), combinedStates, overrideMap, toData.Get())
+			}
+			stateStream.PublishStates(combinedStates.Get())
+			for _, done := range waiting {
+				close(done)
+			}
 		}
 	}()
 
-	return combinedStates, combineState
+	return combinedStates, combineState, combineStateAndWait
 }
 
 func combineCacheState(
@@ -138,10 +164,11 @@ func combineCacheState(
 	combinedStates.AddCache(cacheName, tc.IsAvailable{IsAvailable: available, Ipv4Available: ipv4Available, Ipv6Available: ipv6Available})
 }
 
+// combineDSState sets the combined state of the given delivery service to the local state combined with the given peers' states.
 func combineDSState(
 	deliveryServiceName tc.DeliveryServiceName,
 	localDeliveryService tc.CRStatesDeliveryService,
-	peerStates peer.CRStatesPeersThreadsafe,
+	peerCrStates map[tc.TrafficMonitorName]tc.CRStates,
 	combinedStates peer.CRStatesThreadsafe,
 ) {
 	deliveryService := tc.CRStatesDeliveryService{IsAvailable: false, DisabledLocations: []tc.CacheGroupName{}} // important to initialize DisabledLocations, so JSON is `[]` not `null`
@@ -149,8 +176,10 @@ func combineDSState(
 		deliveryService.IsAvailable = true
 	}
 	deliveryService.DisabledLocations = localDeliveryService.DisabledLocations
+	deliveryService.DisabledCaches = localDeliveryService.DisabledCaches
+	deliveryService.LimitedLocations = localDeliveryService.LimitedLocations
 
-	for peerName, iPeerStates := range peerStates.GetCrstates() {
+	for peerName, iPeerStates := range peerCrStates {
 		peerDeliveryService, ok := iPeerStates.DeliveryService[deliveryServiceName]
 		if !ok {
 			log.Infof("local delivery service %s not found in peer %s\n", deliveryServiceName, peerName)
@@ -160,19 +189,21 @@ func combineDSState(
 			deliveryService.IsAvailable = true
 		}
 		deliveryService.DisabledLocations = intersection(deliveryService.DisabledLocations, peerDeliveryService.DisabledLocations)
+		deliveryService.DisabledCaches = cacheIntersection(deliveryService.DisabledCaches, peerDeliveryService.DisabledCaches)
+		deliveryService.LimitedLocations = limitedIntersection(deliveryService.LimitedLocations, peerDeliveryService.LimitedLocations)
 	}
 	combinedStates.SetDeliveryService(deliveryServiceName, deliveryService)
 }
 
-// pruneCombinedDSState deletes delivery services in combined states which have been removed from localStates and peerStates
-func pruneCombinedDSState(combinedStates peer.CRStatesThreadsafe, localStates tc.CRStates, peerStates peer.CRStatesPeersThreadsafe) {
+// pruneCombinedDSState deletes delivery services in combined states which have been removed from localStates and peerCrStates
+func pruneCombinedDSState(combinedStates peer.CRStatesThreadsafe, localStates tc.CRStates, peerCrStates map[tc.TrafficMonitorName]tc.CRStates) {
 	combinedCRStates := combinedStates.Get()
 
 	// remove any DS in combinedStates NOT in local states or peer states
 	for deliveryServiceName := range combinedCRStates.DeliveryService {
 		inPeer := false
 		inLocal := false
-		for _, iPeerStates := range peerStates.GetCrstates() {
+		for _, iPeerStates := range peerCrStates {
 			if _, ok := iPeerStates.DeliveryService[deliveryServiceName]; ok {
 				inPeer = true
 				break
@@ -204,11 +235,227 @@ func combineCrStates(events health.ThreadsafeEvents, peerOptimistic bool, peerSt
 		combineCacheState(cacheName, localCacheState, events, peerOptimistic, peerStates, combinedStates, overrideMap, toData)
 	}
 
+	peerCrStates := peerStates.GetCrstates()
 	for deliveryServiceName, localDeliveryService := range localStates.DeliveryService {
-		combineDSState(deliveryServiceName, localDeliveryService, peerStates, combinedStates)
+		combineDSState(deliveryServiceName, localDeliveryService, peerCrStates, combinedStates)
 	}
 
-	pruneCombinedDSState(combinedStates, localStates, peerStates)
+	pruneCombinedDSState(combinedStates, localStates, peerCrStates)
+	pruneCombinedCaches(combinedStates, localStates)
+}
+
+// peerQuorum is the state of the weighted peer quorum, kept across combines by the state combiner goroutine.
+type peerQuorum struct {
+	cfg config.PeerQuorumConfig
+	// baselines is the reachability of each peer before any sudden drop, which a peer's current reachability is compared to.
+	baselines map[tc.TrafficMonitorName]float64
+	// reasons is why each peer wasn't counted in the last combine, to log when it changes.
+	reasons map[tc.TrafficMonitorName]string
+}
+
+func newPeerQuorum(cfg config.PeerQuorumConfig) *peerQuorum {
+	return &peerQuorum{
+		cfg:       cfg,
+		baselines: map[tc.TrafficMonitorName]float64{},
+		reasons:   map[tc.TrafficMonitorName]string{},
+	}
+}
+
+// isAvailable returns whether the given cache state is available on either protocol. This is the availability peers publish in their combined states, so it's used for both this monitor's and the peers' states in the quorum, whose IsAvailable may differ, e.g. for local states not yet processed by the health check.
+func isAvailable(state tc.IsAvailable) bool {
+	return state.Ipv4Available || state.Ipv6Available
+}
+
+// reachability returns the fraction of the caches in the given states which are available.
+func reachability(states tc.CRStates) float64 {
+	if len(states.Caches) == 0 {
+		return 0
+	}
+	available := 0
+	for _, state := range states.Caches {
+		if isAvailable(state) {
+			available++
+		}
+	}
+	return float64(available) / float64(len(states.Caches))
+}
+
+// countPeers returns the states of the peers counted in the quorum, and each peer's part in the quorum. Peers are excluded if they are OFFLINE, their last poll failed, their states are older than the maximum age, or their reachability dropped by more than the maximum drop below both their baseline and the local reachability, which indicates the peer rather than the caches lost its network.
+func (q *peerQuorum) countPeers(peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, now time.Time) (map[tc.TrafficMonitorName]tc.CRStates, map[tc.TrafficMonitorName]peer.QuorumPeer) {
+	maxAge := time.Duration(q.cfg.MaxAgeMs) * time.Millisecond
+	if maxAge == 0 {
+		maxAge = peerStates.GetTimeout()
+	}
+	localReachability := reachability(localStates)
+	online := peerStates.GetPeersOnline()
+	available := peerStates.GetPeersAvailable()
+	queryTimes := peerStates.GetQueryTimes()
+
+	counted := map[tc.TrafficMonitorName]tc.CRStates{}
+	quorumPeers := map[tc.TrafficMonitorName]peer.QuorumPeer{}
+	for peerName, states := range peerStates.GetCrstates() {
+		r := reachability(states)
+		reason := ""
+		switch {
+		case !online[peerName]:
+			reason = "offline"
+		case !available[peerName]:
+			reason = "unreachable"
+		case now.Sub(queryTimes[peerName]) > maxAge:
+			reason = fmt.Sprintf("stale; last polled %v ago", now.Sub(queryTimes[peerName]).Round(time.Millisecond))
+		case len(states.Caches) == 0:
+			reason = "no cache states"
+		}
+		if reason == "" && q.cfg.MaxReachabilityDrop > 0 {
+			if baseline, ok := q.baselines[peerName]; ok && r < baseline-q.cfg.MaxReachabilityDrop && r < localReachability-q.cfg.MaxReachabilityDrop {
+				reason = fmt.Sprintf("reachability dropped from %.2f to %.2f, local is %.2f", baseline, r, localReachability)
+			} else {
+				q.baselines[peerName] = r // the baseline isn't moved during a drop, so the peer stays excluded until it recovers
+			}
+		}
+
+		if reason != q.reasons[peerName] {
+			if reason == "" {
+				log.Infof("peer quorum: counting peer %v\n", peerName)
+			} else {
+				log.Warnf("peer quorum: not counting peer %v: %v\n", peerName, reason)
+			}
+			q.reasons[peerName] = reason
+		}
+
+		quorumPeers[peerName] = peer.QuorumPeer{Counted: reason == "", Weight: q.cfg.Weight(string(peerName)), Reachability: r, Reason: reason}
+		if reason == "" {
+			counted[peerName] = states
+		}
+	}
+
+	for peerName := range q.baselines {
+		if _, ok := quorumPeers[peerName]; !ok {
+			delete(q.baselines, peerName)
+			delete(q.reasons, peerName)
+		}
+	}
+	return counted, quorumPeers
+}
+
+// quorumVote is the result of a weighted vote on a cache's availability.
+type quorumVote struct {
+	available     bool
+	ipv4Available bool
+	ipv6Available bool
+	// availableWeight and totalWeight are the weight of the monitors which considered the cache available, and of all monitors which voted.
+	availableWeight float64
+	totalWeight     float64
+	// peerWeight is the weight of the peers which voted, without this monitor.
+	peerWeight float64
+	// availableOn is the monitors which considered the cache available.
+	availableOn []string
+}
+
+// voteCacheState returns the weighted vote of this monitor and the counted peers on the given cache's state. Peers without a state for the cache, e.g. because they haven't yet gotten a new cache from Traffic Ops, don't vote.
+func (q *peerQuorum) voteCacheState(cacheName tc.CacheName, localCacheState tc.IsAvailable, counted map[tc.TrafficMonitorName]tc.CRStates) quorumVote {
+	vote := quorumVote{totalWeight: q.cfg.LocalWeight, availableOn: []string{}}
+	ipv4Weight := 0.0
+	ipv6Weight := 0.0
+	if isAvailable(localCacheState) {
+		vote.availableWeight += q.cfg.LocalWeight
+		vote.availableOn = append(vote.availableOn, "local")
+	}
+	if localCacheState.Ipv4Available {
+		ipv4Weight += q.cfg.LocalWeight
+	}
+	if localCacheState.Ipv6Available {
+		ipv6Weight += q.cfg.LocalWeight
+	}
+
+	for peerName, states := range counted {
+		state, ok := states.Caches[cacheName]
+		if !ok {
+			continue
+		}
+		weight := q.cfg.Weight(string(peerName))
+		vote.totalWeight += weight
+		vote.peerWeight += weight
+		if isAvailable(state) {
+			vote.availableWeight += weight
+			vote.availableOn = append(vote.availableOn, peerName.String())
+		}
+		if state.Ipv4Available {
+			ipv4Weight += weight
+		}
+		if state.Ipv6Available {
+			ipv6Weight += weight
+		}
+	}
+	sort.Strings(vote.availableOn)
+
+	if vote.totalWeight <= 0 {
+		// nobody with any weight voted, so there's nothing to overrule the local state
+		vote.available = isAvailable(localCacheState)
+		vote.ipv4Available = localCacheState.Ipv4Available
+		vote.ipv6Available = localCacheState.Ipv6Available
+		return vote
+	}
+	quorumWeight := q.cfg.Ratio * vote.totalWeight
+	vote.available = vote.availableWeight > quorumWeight
+	vote.ipv4Available = ipv4Weight > quorumWeight
+	vote.ipv6Available = ipv6Weight > quorumWeight
+	return vote
+}
+
+// combineCacheStateQuorum sets the combined state of the given cache to the weighted vote of this monitor and the counted peers, adding an event when the vote starts or stops overriding the local state. If the counted peers voting on the cache have less than the minimum peer weight, the cache keeps its last combined state, or if it has none, the vote is used.
+func combineCacheStateQuorum(
+	cacheName tc.CacheName,
+	localCacheState tc.IsAvailable,
+	events health.ThreadsafeEvents,
+	quorum *peerQuorum,
+	counted map[tc.TrafficMonitorName]tc.CRStates,
+	combinedStates peer.CRStatesThreadsafe,
+	overrideMap map[tc.CacheName]bool,
+	toData todata.TOData,
+) {
+	vote := quorum.voteCacheState(cacheName, localCacheState, counted)
+	if vote.peerWeight < quorum.cfg.MinPeerWeight {
+		if _, ok := combinedStates.GetCache(cacheName); ok {
+			// Too few peers voted to confirm or overrule the local state, e.g. because this monitor lost its network, so the local state alone isn't trusted, and the last combined state is kept.
+			return
+		}
+	}
+	override := vote.available != isAvailable(localCacheState)
+
+	overrideCondition := ""
+	if override && !overrideMap[cacheName] {
+		state := "unavailable"
+		if vote.available {
+			state = "available"
+		}
+		overrideCondition = fmt.Sprintf("detected; quorum %s, available on %.2f of %.2f weight (%s)", state, vote.availableWeight, vote.totalWeight, strings.Join(vote.availableOn, ", "))
+	} else if !override && overrideMap[cacheName] {
+		overrideCondition = "cleared; quorum agrees with local state"
+	}
+	overrideMap[cacheName] = override
+
+	if overrideCondition != "" {
+		events.Add(health.Event{Time: health.Time(time.Now()), Description: fmt.Sprintf("Health protocol override condition %s", overrideCondition), Name: cacheName.String(), Hostname: cacheName.String(), Type: toData.ServerTypes[cacheName].String(), Available: vote.available, IPv4Available: vote.ipv4Available, IPv6Available: vote.ipv6Available})
+	}
+
+	combinedStates.AddCache(cacheName, tc.IsAvailable{IsAvailable: vote.available, Ipv4Available: vote.ipv4Available, Ipv6Available: vote.ipv6Available})
+}
+
+// combineCrStatesQuorum is like combineCrStates, but combines cache states by the weighted peer quorum, and records the counted peers for the PeerStates endpoint. Delivery service states are combined as they are without the quorum, but only with the counted peers.
+func combineCrStatesQuorum(events health.ThreadsafeEvents, quorum *peerQuorum, peerStates peer.CRStatesPeersThreadsafe, localStates tc.CRStates, combinedStates peer.CRStatesThreadsafe, overrideMap map[tc.CacheName]bool, toData todata.TOData, now time.Time) {
+	counted, quorumPeers := quorum.countPeers(peerStates, localStates, now)
+	peerStates.SetQuorumPeers(quorumPeers)
+
+	for cacheName, localCacheState := range localStates.Caches {
+		combineCacheStateQuorum(cacheName, localCacheState, events, quorum, counted, combinedStates, overrideMap, toData)
+	}
+
+	for deliveryServiceName, localDeliveryService := range localStates.DeliveryService {
+		combineDSState(deliveryServiceName, localDeliveryService, counted, combinedStates)
+	}
+
+	pruneCombinedDSState(combinedStates, localStates, counted)
 	pruneCombinedCaches(combinedStates, localStates)
 }
 
@@ -233,3 +480,36 @@ func intersection(a []tc.CacheGroupName, b []tc.CacheGroupName) []tc.CacheGroupN
 	}
 	return c
 }
+
+// cacheIntersection returns the caches in both a and b, in the order of a, or nil if there are none. Unlike intersection, it doesn't modify a or b.
+func cacheIntersection(a []tc.CacheName, b []tc.CacheName) []tc.CacheName {
+	c := []tc.CacheName(nil) // nil, so DisabledCaches is omitted from JSON
+	for _, i := range orderedIntersection(len(a), len(b), func(i int) string { return string(a[i]) }, func(i int) string { return string(b[i]) }) {
+		c = append(c, a[i])
+	}
+	return c
+}
+
+// limitedIntersection returns the cachegroups in both a and b, in the order of a, or nil if there are none. Unlike intersection, it doesn't modify a or b.
+func limitedIntersection(a []tc.CacheGroupName, b []tc.CacheGroupName) []tc.CacheGroupName {
+	c := []tc.CacheGroupName(nil) // nil, so LimitedLocations is omitted from JSON
+	for _, i := range orderedIntersection(len(a), len(b), func(i int) string { return string(a[i]) }, func(i int) string { return string(b[i]) }) {
+		c = append(c, a[i])
+	}
+	return c
+}
+
+// orderedIntersection returns the indexes of the names in a which are also in b, in order. The a and b are slices of names of any type, of lengths aLen and bLen, whose names at index i are returned by aName and bName.
+func orderedIntersection(aLen int, bLen int, aName func(i int) string, bName func(i int) string) []int {
+	inB := make(map[string]struct{}, bLen)
+	for i := 0; i < bLen; i++ {
+		inB[bName(i)] = struct{}{}
+	}
+	indexes := []int{}
+	for i := 0; i < aLen; i++ {
+		if _, ok := inB[aName(i)]; ok {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
@@ -21,10 +21,13 @@ package manager
 
 import (
 	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+	"github.com/apache/trafficcontrol/traffic_monitor/datareq"
 	"github.com/apache/trafficcontrol/traffic_monitor/health"
 	"github.com/apache/trafficcontrol/traffic_monitor/peer"
 	"github.com/apache/trafficcontrol/traffic_monitor/todata"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -154,3 +157,235 @@ func TestCombineCacheStateCacheDown(t *testing.T) {
 		t.Fatalf("cache IPv6 is unavailable and should be available")
 	}
 }
+
+// quorumTestStates returns CRStates with the given caches available, and the rest of cacheNames unavailable.
+func quorumTestStates(cacheNames []tc.CacheName, available ...tc.CacheName) tc.CRStates {
+	states := tc.NewCRStates()
+	for _, cacheName := range cacheNames {
+		states.Caches[cacheName] = tc.IsAvailable{}
+	}
+	for _, cacheName := range available {
+		states.Caches[cacheName] = tc.IsAvailable{IsAvailable: true, Ipv4Available: true, Ipv6Available: true}
+	}
+	return states
+}
+
+func TestCombineCrStatesQuorum(t *testing.T) {
+	cacheNames := []tc.CacheName{"cache0", "cache1", "cache2", "cache3"}
+	now := time.Now()
+
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	peerStates.SetTimeout(time.Minute)
+	peerStates.Set(peer.Result{ID: "tm1", Available: true, PeerStates: quorumTestStates(cacheNames, "cache0", "cache1", "cache2"), Time: now})
+	peerStates.Set(peer.Result{ID: "tm2", Available: true, PeerStates: quorumTestStates(cacheNames, "cache0", "cache2", "cache3"), Time: now})
+	peerStates.Set(peer.Result{ID: "tm3", Available: true, PeerStates: quorumTestStates(cacheNames, "cache0", "cache1", "cache2", "cache3"), Time: now.Add(-2 * time.Minute)})
+	peerStates.Set(peer.Result{ID: "tm4", Available: false, PeerStates: tc.NewCRStates(), Time: now})
+	peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"tm1": {}, "tm2": {}, "tm3": {}, "tm4": {}})
+
+	quorum := newPeerQuorum(config.PeerQuorumConfig{Ratio: 0.5, LocalWeight: 1, MaxReachabilityDrop: 0.5})
+	events := health.NewThreadsafeEvents(10)
+	combinedStates := peer.NewCRStatesThreadsafe()
+	overrideMap := map[tc.CacheName]bool{}
+	localStates := quorumTestStates(cacheNames, "cache0", "cache1")
+
+	combineCrStatesQuorum(events, quorum, peerStates, localStates, combinedStates, overrideMap, todata.TOData{}, now)
+
+	// tm3 is stale and tm4 unreachable, so local, tm1, and tm2 vote, and 2 of 3 is a majority.
+	expected := map[tc.CacheName]bool{"cache0": true, "cache1": true, "cache2": true, "cache3": false}
+	for cacheName, expectedAvailable := range expected {
+		if actual := combinedStates.Get().Caches[cacheName].IsAvailable; actual != expectedAvailable {
+			t.Errorf("cache %v expected available %v, actual %v", cacheName, expectedAvailable, actual)
+		}
+	}
+	if !overrideMap["cache2"] || overrideMap["cache1"] {
+		t.Errorf("expected override of cache2 only, actual %+v", overrideMap)
+	}
+
+	quorumPeers := peerStates.GetQuorumPeers()
+	if !quorumPeers["tm1"].Counted || !quorumPeers["tm2"].Counted {
+		t.Errorf("expected tm1 and tm2 counted, actual %+v", quorumPeers)
+	}
+	if quorumPeers["tm3"].Counted || quorumPeers["tm3"].Reason == "" {
+		t.Errorf("expected stale tm3 not counted with a reason, actual %+v", quorumPeers["tm3"])
+	}
+	if quorumPeers["tm4"].Reason != "unreachable" {
+		t.Errorf("expected tm4 not counted as unreachable, actual %+v", quorumPeers["tm4"])
+	}
+}
+
+func TestCombineCrStatesQuorumReachabilityDrop(t *testing.T) {
+	cacheNames := []tc.CacheName{"cache0", "cache1", "cache2", "cache3"}
+	now := time.Now()
+
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	peerStates.SetTimeout(time.Minute)
+	setPeers := func(tm1Available ...tc.CacheName) {
+		peerStates.Set(peer.Result{ID: "tm1", Available: true, PeerStates: quorumTestStates(cacheNames, tm1Available...), Time: now})
+		peerStates.Set(peer.Result{ID: "tm2", Available: true, PeerStates: quorumTestStates(cacheNames, cacheNames...), Time: now})
+		peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"tm1": {}, "tm2": {}})
+	}
+
+	quorum := newPeerQuorum(config.PeerQuorumConfig{Ratio: 0.5, LocalWeight: 1, MaxReachabilityDrop: 0.5})
+	events := health.NewThreadsafeEvents(10)
+	combinedStates := peer.NewCRStatesThreadsafe()
+	overrideMap := map[tc.CacheName]bool{}
+	localStates := quorumTestStates(cacheNames, cacheNames...)
+
+	setPeers(cacheNames...)
+	combineCrStatesQuorum(events, quorum, peerStates, localStates, combinedStates, overrideMap, todata.TOData{}, now)
+	if !peerStates.GetQuorumPeers()["tm1"].Counted {
+		t.Fatalf("expected tm1 counted before its reachability dropped, actual %+v", peerStates.GetQuorumPeers()["tm1"])
+	}
+
+	// tm1 suddenly sees almost nothing, while local and tm2 see everything, so tm1 is partitioned, and its states aren't counted.
+	setPeers()
+	combineCrStatesQuorum(events, quorum, peerStates, localStates, combinedStates, overrideMap, todata.TOData{}, now)
+	if tm1 := peerStates.GetQuorumPeers()["tm1"]; tm1.Counted || tm1.Reachability != 0 {
+		t.Errorf("expected tm1 not counted after its reachability dropped, actual %+v", tm1)
+	}
+	for _, cacheName := range cacheNames {
+		if !combinedStates.Get().Caches[cacheName].IsAvailable {
+			t.Errorf("cache %v expected available, actual unavailable", cacheName)
+		}
+	}
+
+	// if this monitor sees the same drop, it's the caches, not tm1, so tm1 is counted.
+	localStates = quorumTestStates(cacheNames)
+	combineCrStatesQuorum(events, quorum, peerStates, localStates, combinedStates, overrideMap, todata.TOData{}, now)
+	if !peerStates.GetQuorumPeers()["tm1"].Counted {
+		t.Errorf("expected tm1 counted when local reachability also dropped, actual %+v", peerStates.GetQuorumPeers()["tm1"])
+	}
+	for _, cacheName := range cacheNames {
+		if combinedStates.Get().Caches[cacheName].IsAvailable {
+			t.Errorf("cache %v expected unavailable by 2 of 3 monitors, actual available", cacheName)
+		}
+	}
+}
+
+func TestCombineCrStatesQuorumMinPeerWeight(t *testing.T) {
+	cacheNames := []tc.CacheName{"cache0", "cache1"}
+	now := time.Now()
+
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	peerStates.SetTimeout(time.Minute)
+	setPeers := func(available bool) {
+		peerStates.Set(peer.Result{ID: "tm1", Available: available, PeerStates: quorumTestStates(cacheNames, cacheNames...), Time: now})
+		peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"tm1": {}})
+	}
+
+	quorum := newPeerQuorum(config.PeerQuorumConfig{Ratio: 0.5, LocalWeight: 1, MinPeerWeight: 1})
+	events := health.NewThreadsafeEvents(10)
+	combinedStates := peer.NewCRStatesThreadsafe()
+	overrideMap := map[tc.CacheName]bool{}
+
+	setPeers(true)
+	combineCrStatesQuorum(events, quorum, peerStates, quorumTestStates(cacheNames, cacheNames...), combinedStates, overrideMap, todata.TOData{}, now)
+
+	// tm1 is unreachable, so this monitor alone voted, which is below the minimum peer weight, and cache0 keeps its last combined state.
+	setPeers(false)
+	localStates := quorumTestStates(append(cacheNames, "cache2"), "cache1", "cache2")
+	combineCrStatesQuorum(events, quorum, peerStates, localStates, combinedStates, overrideMap, todata.TOData{}, now)
+	if !combinedStates.Get().Caches["cache0"].IsAvailable {
+		t.Errorf("cache0 expected to keep its last combined state available without a peer quorum, actual unavailable")
+	}
+	// cache2 has no last combined state, so the local vote is used.
+	if !combinedStates.Get().Caches["cache2"].IsAvailable {
+		t.Errorf("new cache2 expected local state available without a peer quorum, actual unavailable")
+	}
+}
+
+func TestVoteCacheStateAvailability(t *testing.T) {
+	quorum := newPeerQuorum(config.PeerQuorumConfig{Ratio: 0.5, LocalWeight: 1})
+	// the local state is available on IPv4 but not processed as available, and the peer's IsAvailable disagrees with its protocols, so both must be counted by their protocols
+	local := tc.IsAvailable{IsAvailable: false, Ipv4Available: true}
+	counted := map[tc.TrafficMonitorName]tc.CRStates{"tm1": tc.NewCRStates(), "tm2": tc.NewCRStates()}
+	counted["tm1"].Caches["cache0"] = tc.IsAvailable{IsAvailable: true}
+	counted["tm2"].Caches["cache0"] = tc.IsAvailable{IsAvailable: false, Ipv6Available: true}
+
+	vote := quorum.voteCacheState("cache0", local, counted)
+	if expected := []string{"local", "tm2"}; !reflect.DeepEqual(vote.availableOn, expected) {
+		t.Errorf("voteCacheState expected available on %v, actual %v", expected, vote.availableOn)
+	}
+	if !vote.available || vote.availableWeight != 2 || vote.totalWeight != 3 {
+		t.Errorf("voteCacheState expected available on 2 of 3 weight, actual available %v on %v of %v", vote.available, vote.availableWeight, vote.totalWeight)
+	}
+}
+
+func TestCombineCrStatesQuorumDSExcludedPeers(t *testing.T) {
+	cacheNames := []tc.CacheName{"cache0"}
+	now := time.Now()
+
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	peerStates.SetTimeout(time.Minute)
+	for peerName, polled := range map[tc.TrafficMonitorName]time.Time{"tm1": now, "tm2": now.Add(-2 * time.Minute)} {
+		states := quorumTestStates(cacheNames, cacheNames...)
+		states.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: []tc.CacheName{}}
+		states.DeliveryService["ds1"] = tc.CRStatesDeliveryService{IsAvailable: peerName == "tm2", DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: []tc.CacheName{}}
+		peerStates.Set(peer.Result{ID: peerName, Available: true, PeerStates: states, Time: polled})
+	}
+	peerStates.SetPeers(map[tc.TrafficMonitorName]struct{}{"tm1": {}, "tm2": {}})
+
+	quorum := newPeerQuorum(config.PeerQuorumConfig{Ratio: 0.5, LocalWeight: 1})
+	combinedStates := peer.NewCRStatesThreadsafe()
+	localStates := quorumTestStates(cacheNames, cacheNames...)
+	localStates.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: []tc.CacheName{}}
+	localStates.DeliveryService["ds1"] = tc.CRStatesDeliveryService{IsAvailable: false, DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: []tc.CacheName{}}
+
+	combineCrStatesQuorum(health.NewThreadsafeEvents(10), quorum, peerStates, localStates, combinedStates, map[tc.CacheName]bool{}, todata.TOData{}, now)
+
+	// tm2 is stale, so its ds1 state isn't combined.
+	if ds1, _ := combinedStates.GetDeliveryService("ds1"); ds1.IsAvailable {
+		t.Errorf("ds1 expected unavailable on this monitor and counted peers, actual available from stale peer")
+	}
+	if ds0, _ := combinedStates.GetDeliveryService("ds0"); !ds0.IsAvailable {
+		t.Errorf("ds0 expected available, actual unavailable")
+	}
+}
+
+func TestCombineDSStateDisabledCaches(t *testing.T) {
+	peerStates := peer.NewCRStatesPeersThreadsafe(0)
+	peerStates.SetTimeout(time.Minute)
+	for peerName, disabledCaches := range map[tc.TrafficMonitorName][]tc.CacheName{"tm1": {"cache0", "cache1"}, "tm2": {"cache2", "cache1"}} {
+		states := tc.NewCRStates()
+		states.DeliveryService["ds0"] = tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: disabledCaches}
+		peerStates.Set(peer.Result{ID: peerName, Available: true, PeerStates: states, Time: time.Now()})
+	}
+	combinedStates := peer.NewCRStatesThreadsafe()
+	local := tc.CRStatesDeliveryService{IsAvailable: true, DisabledLocations: []tc.CacheGroupName{}, DisabledCaches: []tc.CacheName{"cache0", "cache1", "cache2"}}
+
+	combineDSState("ds0", local, peerStates.GetCrstates(), combinedStates)
+
+	// a cache is only disabled for a delivery service if every monitor's probe failed
+	actual, _ := combinedStates.GetDeliveryService("ds0")
+	if len(actual.DisabledCaches) != 1 || actual.DisabledCaches[0] != "cache1" {
+		t.Errorf("expected only cache1 disabled, actual %+v", actual.DisabledCaches)
+	}
+	if len(local.DisabledCaches) != 3 {
+		t.Errorf("expected local disabled caches unmodified, actual %+v", local.DisabledCaches)
+	}
+}
+
+func TestStartStateCombinerWait(t *testing.T) {
+	localStates := peer.NewCRStatesThreadsafe()
+	combinedStates, _, combineStateAndWait := StartStateCombiner(health.NewThreadsafeEvents(1), peer.NewCRStatesPeersThreadsafe(0), localStates, todata.NewThreadsafe(), config.PeerQuorumConfig{}, datareq.NewStateStream())
+
+	localStates.AddCache("cache0", tc.IsAvailable{IsAvailable: true, Ipv4Available: true})
+	combineStateAndWait()
+	if state, ok := combinedStates.GetCache("cache0"); !ok || !state.IsAvailable {
+		t.Errorf("expected the local state combined when combineStateAndWait returns, actual %+v exists %v", state, ok)
+	}
+}
+
+func TestOrderedIntersections(t *testing.T) {
+	caches := cacheIntersection([]tc.CacheName{"c", "a", "b"}, []tc.CacheName{"b", "c", "d"})
+	if !reflect.DeepEqual(caches, []tc.CacheName{"c", "b"}) {
+		t.Errorf("cacheIntersection expected [c b], actual %v", caches)
+	}
+	if caches := cacheIntersection([]tc.CacheName{"a"}, []tc.CacheName{"b"}); caches != nil {
+		t.Errorf("cacheIntersection without common caches expected nil, actual %v", caches)
+	}
+	cachegroups := limitedIntersection([]tc.CacheGroupName{"cg1", "cg0"}, []tc.CacheGroupName{"cg0", "cg1"})
+	if !reflect.DeepEqual(cachegroups, []tc.CacheGroupName{"cg1", "cg0"}) {
+		t.Errorf("limitedIntersection expected [cg1 cg0], actual %v", cachegroups)
+	}
+}
@@ -107,6 +107,67 @@ func (t *CRStatesThreadsafe) SetDeliveryService(name tc.DeliveryServiceName, ds
 	t.m.Unlock()
 }
 
+// The SetDeliveryService field setters set a single field of a delivery service under the lock, without modifying its other fields. Delivery service states are written by multiple goroutines, each of which owns different fields, so writing whole structs read earlier would overwrite other goroutines' concurrent changes. They do nothing if the delivery service doesn't exist.
+
+// SetDeliveryServiceAvailable sets whether the given delivery service is available.
+func (t *CRStatesThreadsafe) SetDeliveryServiceAvailable(name tc.DeliveryServiceName, available bool) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if ds, ok := t.crStates.DeliveryService[name]; ok {
+		ds.IsAvailable = available
+		t.crStates.DeliveryService[name] = ds
+	}
+}
+
+// SetDeliveryServiceDisabledLocations sets the DisabledLocations of the given delivery service.
+func (t *CRStatesThreadsafe) SetDeliveryServiceDisabledLocations(name tc.DeliveryServiceName, disabledLocations []tc.CacheGroupName) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	if ds, ok := t.crStates.DeliveryService[name]; ok {
+		ds.DisabledLocations = disabledLocations
+		t.crStates.DeliveryService[name] = ds
+	}
+}
+
+// SetDeliveryServiceDisabledCaches sets the DisabledCaches of the given delivery service, and returns whether they changed.
+func (t *CRStatesThreadsafe) SetDeliveryServiceDisabledCaches(name tc.DeliveryServiceName, disabledCaches []tc.CacheName) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	ds, ok := t.crStates.DeliveryService[name]
+	if !ok || namesEqual(len(ds.DisabledCaches), len(disabledCaches), func(i int) bool { return ds.DisabledCaches[i] == disabledCaches[i] }) {
+		return false
+	}
+	ds.DisabledCaches = disabledCaches
+	t.crStates.DeliveryService[name] = ds
+	return true
+}
+
+// SetDeliveryServiceLimitedLocations sets the LimitedLocations of the given delivery service, and returns whether they changed.
+func (t *CRStatesThreadsafe) SetDeliveryServiceLimitedLocations(name tc.DeliveryServiceName, limitedLocations []tc.CacheGroupName) bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	ds, ok := t.crStates.DeliveryService[name]
+	if !ok || namesEqual(len(ds.LimitedLocations), len(limitedLocations), func(i int) bool { return ds.LimitedLocations[i] == limitedLocations[i] }) {
+		return false
+	}
+	ds.LimitedLocations = limitedLocations
+	t.crStates.DeliveryService[name] = ds
+	return true
+}
+
+// namesEqual returns whether two slices of names, of lengths aLen and bLen, are equal, where equal returns whether their names at index i are equal. It compares slices of any name type, e.g. caches and cachegroups.
+func namesEqual(aLen int, bLen int, equal func(i int) bool) bool {
+	if aLen != bLen {
+		return false
+	}
+	for i := 0; i < aLen; i++ {
+		if !equal(i) {
+			return false
+		}
+	}
+	return true
+}
+
 // DeleteDeliveryService deletes the given delivery service from the internal data. This MUST NOT be called by multiple goroutines.
 func (t *CRStatesThreadsafe) DeleteDeliveryService(name tc.DeliveryServiceName) {
 	t.m.Lock()
@@ -124,25 +185,46 @@ type CRStatesPeersThreadsafe struct {
 	peerCount  *int
 	quorumMin  *int
 	timeout    *time.Duration
-	m          *sync.RWMutex
+	// quorumPeers is whether each peer was counted in the last weighted peer quorum, or nil if the quorum isn't enabled.
+	quorumPeers *map[tc.TrafficMonitorName]QuorumPeer
+	m           *sync.RWMutex
+}
+
+// QuorumPeer is a peer's part in the last weighted peer quorum: whether its cache states were counted, and if not, why not.
+type QuorumPeer struct {
+	Counted bool    `json:"counted"`
+	Weight  float64 `json:"weight"`
+	// Reachability is the fraction of the peer's caches which it considers available.
+	Reachability float64 `json:"reachability"`
+	// Reason is why the peer wasn't counted, or empty if it was.
+	Reason string `json:"reason,omitempty"`
 }
 
 // NewCRStatesPeersThreadsafe creates a new CRStatesPeers object safe for multiple goroutine readers and a single writer.
 func NewCRStatesPeersThreadsafe(quorumMin int) CRStatesPeersThreadsafe {
 	count := 0
 	timeout := time.Hour // default to a large timeout
+	quorumPeers := map[tc.TrafficMonitorName]QuorumPeer(nil)
 	return CRStatesPeersThreadsafe{
-		m:          &sync.RWMutex{},
-		timeout:    &timeout,
-		peerOnline: map[tc.TrafficMonitorName]bool{},
-		crStates:   map[tc.TrafficMonitorName]tc.CRStates{},
-		peerStates: map[tc.TrafficMonitorName]bool{},
-		peerTimes:  map[tc.TrafficMonitorName]time.Time{},
-		peerCount:  &count,
-		quorumMin:  &quorumMin,
+		m:           &sync.RWMutex{},
+		timeout:     &timeout,
+		peerOnline:  map[tc.TrafficMonitorName]bool{},
+		crStates:    map[tc.TrafficMonitorName]tc.CRStates{},
+		peerStates:  map[tc.TrafficMonitorName]bool{},
+		peerTimes:   map[tc.TrafficMonitorName]time.Time{},
+		peerCount:   &count,
+		quorumMin:   &quorumMin,
+		quorumPeers: &quorumPeers,
 	}
 }
 
+// GetTimeout returns the time after its last poll that a peer is considered unavailable.
+func (t *CRStatesPeersThreadsafe) GetTimeout() time.Duration {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return *t.timeout
+}
+
 func (t *CRStatesPeersThreadsafe) SetTimeout(timeout time.Duration) {
 	t.m.Lock()
 	defer t.m.Unlock()
@@ -202,6 +284,27 @@ func (t *CRStatesPeersThreadsafe) GetPeerAvailability(peer tc.TrafficMonitorName
 	return availability
 }
 
+// GetPeersAvailable returns whether the last poll of each peer succeeded. Unlike GetPeerAvailability, this doesn't consider whether peers are ONLINE, or when they were last polled.
+func (t *CRStatesPeersThreadsafe) GetPeersAvailable() map[tc.TrafficMonitorName]bool {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return copyPeerAvailable(t.peerStates)
+}
+
+// SetQuorumPeers sets the peers counted and excluded by the last weighted peer quorum. This MUST NOT be called by multiple goroutines.
+func (t *CRStatesPeersThreadsafe) SetQuorumPeers(quorumPeers map[tc.TrafficMonitorName]QuorumPeer) {
+	t.m.Lock()
+	defer t.m.Unlock()
+	*t.quorumPeers = quorumPeers
+}
+
+// GetQuorumPeers returns the peers counted and excluded by the last weighted peer quorum, or nil if the quorum isn't enabled. This MUST NOT be modified.
+func (t *CRStatesPeersThreadsafe) GetQuorumPeers() map[tc.TrafficMonitorName]QuorumPeer {
+	t.m.RLock()
+	defer t.m.RUnlock()
+	return *t.quorumPeers
+}
+
 // GetPeersOnline return a map of peers which are marked ONLINE in the latest CRConfig from Traffic Ops. This is NOT guaranteed to actually _contain_ all OFFLINE monitors returned by other functions, such as `GetPeerAvailability` and `GetQueryTimes`, but bool defaults to false, so the value of any key is guaranteed to be correct.
 func (t *CRStatesPeersThreadsafe) GetPeersOnline() map[tc.TrafficMonitorName]bool {
 	t.m.RLock()
@@ -49,3 +49,43 @@ func TestCrStates(t *testing.T) {
 	}
 
 }
+
+func TestCRStatesThreadsafeDeliveryServiceFields(t *testing.T) {
+	states := NewCRStatesThreadsafe()
+	states.SetDeliveryService("ds0", tc.CRStatesDeliveryService{DisabledLocations: []tc.CacheGroupName{}})
+	staleDS, _ := states.GetDeliveryService("ds0")
+
+	if !states.SetDeliveryServiceDisabledCaches("ds0", []tc.CacheName{"cache0"}) {
+		t.Errorf("SetDeliveryServiceDisabledCaches expected changed, actual unchanged")
+	}
+	if states.SetDeliveryServiceDisabledCaches("ds0", []tc.CacheName{"cache0"}) {
+		t.Errorf("SetDeliveryServiceDisabledCaches with the same caches expected unchanged, actual changed")
+	}
+	if !states.SetDeliveryServiceLimitedLocations("ds0", []tc.CacheGroupName{"cg1"}) {
+		t.Errorf("SetDeliveryServiceLimitedLocations expected changed, actual unchanged")
+	}
+	// a writer which read the delivery service before the caches were disabled must not overwrite them
+	states.SetDeliveryServiceDisabledLocations("ds0", append(staleDS.DisabledLocations, "cg0"))
+	states.SetDeliveryServiceAvailable("ds0", true)
+
+	ds, _ := states.GetDeliveryService("ds0")
+	if len(ds.DisabledCaches) != 1 || ds.DisabledCaches[0] != "cache0" {
+		t.Errorf("expected disabled caches [cache0], actual %v", ds.DisabledCaches)
+	}
+	if len(ds.DisabledLocations) != 1 || ds.DisabledLocations[0] != "cg0" {
+		t.Errorf("expected disabled locations [cg0], actual %v", ds.DisabledLocations)
+	}
+	if len(ds.LimitedLocations) != 1 || ds.LimitedLocations[0] != "cg1" {
+		t.Errorf("expected limited locations [cg1], actual %v", ds.LimitedLocations)
+	}
+	if !ds.IsAvailable {
+		t.Errorf("expected available, actual unavailable")
+	}
+
+	if states.SetDeliveryServiceDisabledCaches("nonexistent", []tc.CacheName{"cache0"}) {
+		t.Errorf("SetDeliveryServiceDisabledCaches of a nonexistent delivery service expected unchanged, actual changed")
+	}
+	if _, ok := states.GetDeliveryService("nonexistent"); ok {
+		t.Errorf("field setters expected not to add delivery services, actual added")
+	}
+}
@@ -95,12 +95,16 @@ type CachePollInfo struct {
 
 func (p CachePoller) Poll() {
 	killChans := map[string]chan<- struct{}{}
+	pollerCtxs := map[string]interface{}{}
 	for newConfig := range p.ConfigChannel {
 		deletions, additions := diffConfigs(p.Config, newConfig)
 		for _, id := range deletions {
 			killChan := killChans[id]
 			go func() { killChan <- struct{}{} }() // go - we don't want to wait for old polls to die.
 			delete(killChans, id)
+			// The old poller only sees the kill after its current poll, so its context is closed now, to stop e.g. streams from URLs no longer in the config.
+			closePollCtx(id, pollerCtxs[id])
+			delete(pollerCtxs, id)
 		}
 		for _, info := range additions {
 			kill := make(chan struct{})
@@ -126,6 +130,7 @@ func (p CachePoller) Poll() {
 			if pollerObj.Init != nil {
 				pollerCtx = pollerObj.Init(pollerCfg, p.GlobalContexts[info.PollType])
 			}
+			pollerCtxs[info.ID] = pollerCtx
 			go poller(info.Interval, info.ID, info.PollingProtocol, info.URL, info.URLv6, info.Host, info.Format, p.Handler, pollerObj.Poll, pollerCtx, kill)
 		}
 		p.Config = newConfig
@@ -202,11 +207,21 @@ func poller(
 			<-pollFinishedChan
 		case <-die:
 			tick.Stop()
+			closePollCtx(id, pollCtx)
 			return
 		}
 	}
 }
 
+// closePollCtx closes the given poller context, if it holds resources to close.
+func closePollCtx(id string, pollCtx interface{}) {
+	if closer, ok := pollCtx.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			log.Errorf("poller %v closing: %v\n", id, err)
+		}
+	}
+}
+
 // diffConfigs takes the old and new configs, and returns a list of deleted IDs, and a list of new polls to do
 func diffConfigs(old CachePollerConfig, new CachePollerConfig) ([]string, []CachePollInfo) {
 	deletions := []string{}
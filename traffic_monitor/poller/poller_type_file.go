@@ -0,0 +1,92 @@
+package poller
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PollerTypeFile is the poller type which reads stats from files, rather than requesting them from the cache. The polling URL is a file:// URL or a path.
+// This is useful for testing, and for sidecars which export a cache's stats to a file.
+const PollerTypeFile = "file"
+
+func init() {
+	AddPollerType(PollerTypeFile, nil, fileInit, filePoll)
+}
+
+// FilePollCtx is the context of a file poller.
+type FilePollCtx struct {
+	PollerID string
+	// FileContentType is the media type of the most recently read file, per its extension.
+	FileContentType string
+}
+
+// ContentType returns the media type of the most recently read file: text/csv for .csv files, application/json for .json files, and otherwise empty, which stat parsers treat as JSON.
+func (ctx *FilePollCtx) ContentType() string {
+	return ctx.FileContentType
+}
+
+func fileInit(cfg PollerConfig, globalCtx interface{}) interface{} {
+	return &FilePollCtx{PollerID: cfg.PollerID}
+}
+
+func filePoll(ctxI interface{}, pollURL string, host string, pollID uint64) ([]byte, time.Time, time.Duration, error) {
+	ctx := (ctxI).(*FilePollCtx)
+	start := time.Now()
+	path, err := filePollPath(pollURL)
+	if err != nil {
+		return nil, time.Now(), time.Since(start), fmt.Errorf("id %v url %v read error: %v", ctx.PollerID, pollURL, err)
+	}
+	bts, err := ioutil.ReadFile(path)
+	end := time.Now()
+	if err != nil {
+		return nil, end, end.Sub(start), fmt.Errorf("id %v url %v read error: %v", ctx.PollerID, pollURL, err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		ctx.FileContentType = "text/csv"
+	case ".json":
+		ctx.FileContentType = "application/json"
+	default:
+		ctx.FileContentType = ""
+	}
+	return bts, end, end.Sub(start), nil
+}
+
+// filePollPath returns the path of the given file polling URL, which may be a file:// URL, or a path.
+func filePollPath(pollURL string) (string, error) {
+	if !strings.HasPrefix(strings.ToLower(pollURL), "file:") {
+		return pollURL, nil
+	}
+	u, err := url.Parse(pollURL)
+	if err != nil {
+		return "", fmt.Errorf("parsing file URL: %v", err)
+	}
+	if u.Host != "" && u.Host != "localhost" {
+		return "", fmt.Errorf("file URL host must be empty or localhost, was '%v'", u.Host)
+	}
+	return u.Path, nil
+}
@@ -101,6 +101,11 @@ type HTTPPollCtx struct {
 	FormatAccept string
 }
 
+// ContentType returns the Content-Type header of the most recent poll response.
+func (ctx *HTTPPollCtx) ContentType() string {
+	return ctx.HTTPHeader.Get("Content-Type")
+}
+
 func httpPoll(ctxI interface{}, url string, host string, pollID uint64) ([]byte, time.Time, time.Duration, error) {
 	ctx := (ctxI).(*HTTPPollCtx)
 	req, err := http.NewRequest("GET", url, nil)
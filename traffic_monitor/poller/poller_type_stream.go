@@ -0,0 +1,372 @@
+package poller
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-log"
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+
+	"golang.org/x/net/websocket"
+)
+
+// PollerTypeStream is the poller type which holds one long-lived connection to each cache, over which the cache pushes its stats, rather than making a request for each poll. This avoids the cost of a TCP and TLS handshake per poll, for CDNs with many caches.
+//
+// For http:// and https:// polling URLs, the cache responds to a single GET with a text/event-stream (Server-Sent Events) body, each event's data being a complete stats payload. HTTPS connections use HTTP/2 if the cache supports it. For ws:// and wss:// polling URLs, each WebSocket message is a complete stats payload.
+//
+// Each poll returns the newest payload received since the previous poll, waiting up to the poll timeout for one. Caches must therefore push stats at least as often as the Monitor's poll interval.
+const PollerTypeStream = "stream"
+
+// StreamMaxMessageBytes is the maximum size of a single streamed stats payload. Larger payloads are an error, and the connection is reestablished.
+const StreamMaxMessageBytes = 64 * 1024 * 1024
+
+// StreamReconnectMin and StreamReconnectMax are the minimum and maximum time to wait before reconnecting a failed stream. The wait doubles after each consecutive failure.
+const StreamReconnectMin = 500 * time.Millisecond
+const StreamReconnectMax = 30 * time.Second
+
+func init() {
+	AddPollerType(PollerTypeStream, streamGlobalInit, streamInit, streamPoll)
+}
+
+type StreamPollGlobalCtx struct {
+	Client       *http.Client
+	UserAgent    string
+	FormatAccept string
+	Timeout      time.Duration
+}
+
+func streamGlobalInit(cfg config.Config, appData config.StaticAppData) interface{} {
+	return &StreamPollGlobalCtx{
+		// The client has no timeout, because responses last as long as the connection. Connecting is limited by the dialer and TLS timeouts.
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+				DialContext:         (&net.Dialer{Timeout: cfg.HTTPTimeout}).DialContext,
+				TLSHandshakeTimeout: cfg.HTTPTimeout,
+				ForceAttemptHTTP2:   true,
+			},
+		},
+		UserAgent:    appData.UserAgent,
+		FormatAccept: cfg.HTTPPollingFormat,
+		Timeout:      cfg.HTTPTimeout,
+	}
+}
+
+func streamInit(cfg PollerConfig, globalCtxI interface{}) interface{} {
+	gctx := (globalCtxI).(*StreamPollGlobalCtx)
+	timeout := gctx.Timeout
+	if cfg.Timeout != 0 {
+		timeout = cfg.Timeout
+	}
+	urls := map[string]struct{}{}
+	for _, url := range []string{cfg.URL, cfg.URLv6} {
+		if url != "" {
+			urls[url] = struct{}{}
+		}
+	}
+	return &StreamPollCtx{
+		Client:       gctx.Client,
+		UserAgent:    gctx.UserAgent,
+		FormatAccept: gctx.FormatAccept,
+		Timeout:      timeout,
+		PollerID:     cfg.PollerID,
+		urls:         urls,
+		streams:      map[string]*stream{},
+	}
+}
+
+// StreamPollCtx is the context of a streaming poller. It holds a stream for each URL polled, which for pollers alternating between IPv4 and IPv6 is two streams.
+type StreamPollCtx struct {
+	Client       *http.Client
+	UserAgent    string
+	FormatAccept string
+	Timeout      time.Duration
+	PollerID     string
+
+	// urls is the cache's configured URLs. Streams are only started for them, so a poller whose cache's URLs changed can't keep streaming from the old ones.
+	urls    map[string]struct{}
+	streams map[string]*stream
+	closed  bool
+	m       sync.Mutex
+}
+
+// ContentType returns the media type of streamed stats, which is the polling format the Monitor requested. Caches which stream must send stats in that format.
+func (ctx *StreamPollCtx) ContentType() string {
+	return ctx.FormatAccept
+}
+
+// Close closes all the poller's streams. The poller's context is closed as soon as its cache is removed from the config or its URLs change, so Close may be called more than once.
+func (ctx *StreamPollCtx) Close() error {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+	for _, s := range ctx.streams {
+		close(s.die)
+	}
+	ctx.streams = map[string]*stream{}
+	ctx.closed = true
+	return nil
+}
+
+// getStream returns the stream for the given URL, starting it if it isn't already running.
+func (ctx *StreamPollCtx) getStream(url string, host string) (*stream, error) {
+	ctx.m.Lock()
+	defer ctx.m.Unlock()
+	if ctx.closed {
+		return nil, errors.New("poller closed")
+	}
+	if _, ok := ctx.urls[url]; !ok {
+		return nil, errors.New("url not in the poller config")
+	}
+	if s, ok := ctx.streams[url]; ok {
+		return s, nil
+	}
+	s := &stream{updated: make(chan struct{}), die: make(chan struct{})}
+	ctx.streams[url] = s
+	go s.run(ctx, url, host)
+	return s, nil
+}
+
+// stream is a connection to a cache, and the newest payload it pushed.
+type stream struct {
+	msg     []byte
+	msgTime time.Time
+	// seq is incremented for each payload received, and polledSeq is the seq of the payload last returned by a poll.
+	seq       uint64
+	polledSeq uint64
+	// err is the error of the last failed connection, or nil if the stream is connected.
+	err error
+	// updated is closed and replaced when a payload is received, to wake waiting polls.
+	updated chan struct{}
+	die     chan struct{}
+	m       sync.Mutex
+}
+
+func streamPoll(ctxI interface{}, url string, host string, pollID uint64) ([]byte, time.Time, time.Duration, error) {
+	ctx := (ctxI).(*StreamPollCtx)
+	start := time.Now()
+	s, err := ctx.getStream(url, host)
+	if err != nil {
+		return nil, time.Now(), 0, fmt.Errorf("id %v url %v stream error: %v", ctx.PollerID, url, err)
+	}
+
+	timeout := time.NewTimer(ctx.Timeout)
+	defer timeout.Stop()
+	for {
+		s.m.Lock()
+		if s.seq != s.polledSeq {
+			s.polledSeq = s.seq
+			msg, msgTime := s.msg, s.msgTime
+			s.m.Unlock()
+			return msg, msgTime, time.Since(start), nil
+		}
+		updated := s.updated
+		streamErr := s.err
+		s.m.Unlock()
+
+		select {
+		case <-updated:
+		case <-s.die:
+			end := time.Now()
+			return nil, end, end.Sub(start), fmt.Errorf("id %v url %v stream error: poller closed", ctx.PollerID, url)
+		case <-timeout.C:
+			end := time.Now()
+			if streamErr != nil {
+				return nil, end, end.Sub(start), fmt.Errorf("id %v url %v stream error: no stats received in %v: %v", ctx.PollerID, url, ctx.Timeout, streamErr)
+			}
+			return nil, end, end.Sub(start), fmt.Errorf("id %v url %v stream error: no stats received in %v", ctx.PollerID, url, ctx.Timeout)
+		}
+	}
+}
+
+// setMsg stores a received payload, and wakes waiting polls.
+func (s *stream) setMsg(msg []byte) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.msg = msg
+	s.msgTime = time.Now()
+	s.seq++
+	s.err = nil
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *stream) setErr(err error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.err = err
+}
+
+// run connects and reads payloads until the stream is closed, reconnecting with backoff when the connection fails.
+func (s *stream) run(ctx *StreamPollCtx, url string, host string) {
+	backoff := StreamReconnectMin
+	for {
+		received := false
+		onMsg := func(msg []byte) {
+			received = true
+			s.setMsg(msg)
+		}
+
+		err := error(nil)
+		if lowerURL := strings.ToLower(url); strings.HasPrefix(lowerURL, "ws://") || strings.HasPrefix(lowerURL, "wss://") {
+			err = readWebSocketStream(ctx, url, s.die, onMsg)
+		} else {
+			err = readEventStream(ctx, url, host, s.die, onMsg)
+		}
+
+		select {
+		case <-s.die:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("stream closed by cache")
+		}
+		s.setErr(err)
+		log.Warnf("poller %v stream %v: %v, reconnecting in %v\n", ctx.PollerID, url, err, backoff)
+
+		if received {
+			backoff = StreamReconnectMin
+		}
+		select {
+		case <-s.die:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > StreamReconnectMax {
+			backoff = StreamReconnectMax
+		}
+	}
+}
+
+// readEventStream requests the given URL, and calls onMsg with the data of each Server-Sent Event in the response, until the response ends, fails, or die is closed.
+func readEventStream(ctx *StreamPollCtx, url string, host string, die <-chan struct{}, onMsg func([]byte)) error {
+	reqCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-die:
+			cancel()
+		case <-reqCtx.Done():
+		}
+	}()
+
+	req, err := http.NewRequestWithContext(reqCtx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.New("creating HTTP request: " + err.Error())
+	}
+	req.Header.Set("User-Agent", ctx.UserAgent)
+	req.Header.Set("Accept", "text/event-stream, "+ctx.FormatAccept)
+	req.Host = host
+	resp, err := ctx.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("bad HTTP status: %v", resp.StatusCode)
+	}
+	return readEvents(bufio.NewReader(resp.Body), onMsg)
+}
+
+// readEvents reads Server-Sent Events from the given reader, and calls onMsg with the data of each event, until the reader ends or fails. Data lines of an event are joined with newlines, per the event stream spec; other fields and comments are ignored.
+func readEvents(rdr *bufio.Reader, onMsg func([]byte)) error {
+	data := bytes.Buffer{}
+	hasData := false
+	for {
+		line, err := rdr.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+
+		if len(line) == 0 {
+			if hasData {
+				onMsg(append([]byte(nil), data.Bytes()...))
+			}
+			data.Reset()
+			hasData = false
+			continue
+		}
+		if !bytes.HasPrefix(line, []byte("data:")) {
+			continue // comments, event names, ids, and retries aren't used
+		}
+		if hasData {
+			data.WriteByte('\n')
+		}
+		data.Write(bytes.TrimPrefix(line[len("data:"):], []byte(" ")))
+		hasData = true
+		if data.Len() > StreamMaxMessageBytes {
+			return fmt.Errorf("stats event larger than %v bytes", StreamMaxMessageBytes)
+		}
+	}
+}
+
+// readWebSocketStream connects to the given WebSocket URL, and calls onMsg with each message received, until the connection fails or die is closed.
+func readWebSocketStream(ctx *StreamPollCtx, url string, die <-chan struct{}, onMsg func([]byte)) error {
+	wsCfg, err := websocket.NewConfig(url, "http://localhost/")
+	if err != nil {
+		return errors.New("creating WebSocket config: " + err.Error())
+	}
+	wsCfg.TlsConfig = &tls.Config{InsecureSkipVerify: true}
+	wsCfg.Dialer = &net.Dialer{Timeout: ctx.Timeout}
+	wsCfg.Header.Set("User-Agent", ctx.UserAgent)
+	wsCfg.Header.Set("Accept", ctx.FormatAccept)
+	conn, err := websocket.DialConfig(wsCfg)
+	if err != nil {
+		return err
+	}
+	conn.MaxPayloadBytes = StreamMaxMessageBytes
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-die:
+		case <-done:
+		}
+		conn.Close()
+	}()
+
+	for {
+		msg := []byte(nil)
+		if err := websocket.Message.Receive(conn, &msg); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		onMsg(msg)
+	}
+}
@@ -57,8 +57,23 @@ var pollers = map[string]PollerType{}
 
 // PollerFunc polls a cache. It takes the global context created by this Poller's GlobalInit, and the poller-specific context created by this poller's Init. It returns the response bytes, the time the request finished, the length of time the request took, and any error.
 // If the PollerFunc needs the global context object, the Init func should embed it in the context object it returns. If Init is nil, the global context will be given to the poller.
+// If the context object returned by Init implements io.Closer, it's closed when the poller is stopped, so pollers may hold resources such as persistent connections. It may be closed while a poll is in progress, and more than once.
 type PollerFunc func(ctx interface{}, url string, host string, pollID uint64) ([]byte, time.Time, time.Duration, error)
 
+// ContentTyper is implemented by poller contexts which know the media type of the bytes they polled, such as the Content-Type header of an HTTP response. Stat parsers which accept multiple formats use it to decide how to parse.
+type ContentTyper interface {
+	// ContentType returns the media type of the most recently polled bytes, or an empty string if it isn't known.
+	ContentType() string
+}
+
+// ContentType returns the media type of the bytes most recently polled with the given poller context, or an empty string if the poller doesn't know it.
+func ContentType(pollCtx interface{}) string {
+	if ctx, ok := pollCtx.(ContentTyper); ok {
+		return ctx.ContentType()
+	}
+	return ""
+}
+
 // AddPollerType adds a poller with the given name, and the given init and poll funcs. The globalInit and init funcs may be nil; poller MUST NOT be nil.
 func AddPollerType(name string, globalInit PollerGlobalInitFunc, init PollerInitFunc, poller PollerFunc) {
 	pollers[name] = PollerType{GlobalInit: globalInit, Init: init, Poll: poller}
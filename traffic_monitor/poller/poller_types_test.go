@@ -0,0 +1,212 @@
+package poller
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/traffic_monitor/config"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestFilePoll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tm-file-poller")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache0.csv")
+	if err := ioutil.WriteFile(path, []byte("proxy.process.http.completed_requests,42\n"), 0644); err != nil {
+		t.Fatalf("writing stats file: %v", err)
+	}
+
+	ctx := fileInit(PollerConfig{PollerID: "cache0"}, nil)
+	for _, pollURL := range []string{"file://" + path, path} {
+		bts, _, _, err := filePoll(ctx, pollURL, "cache0.example.net", 1)
+		if err != nil {
+			t.Errorf("filePoll '%v' expected nil error, actual %v", pollURL, err)
+		} else if string(bts) != "proxy.process.http.completed_requests,42\n" {
+			t.Errorf("filePoll '%v' expected file contents, actual '%v'", pollURL, string(bts))
+		}
+		if ctype := ContentType(ctx); ctype != "text/csv" {
+			t.Errorf("filePoll '%v' expected content type text/csv, actual '%v'", pollURL, ctype)
+		}
+	}
+
+	if _, _, _, err := filePoll(ctx, "file://"+filepath.Join(dir, "nonexistent.json"), "cache0.example.net", 2); err == nil {
+		t.Errorf("filePoll nonexistent file expected error, actual nil")
+	}
+	if _, _, _, err := filePoll(ctx, "file://remote.example.net"+path, "cache0.example.net", 3); err == nil {
+		t.Errorf("filePoll remote host expected error, actual nil")
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	stream := ": comment\nevent: stats\ndata: {\"a\":\ndata:1}\n\ndata: second\r\n\r\n\nid: 3\n\ndata: incomplete"
+	msgs := []string{}
+	if err := readEvents(bufio.NewReader(strings.NewReader(stream)), func(msg []byte) { msgs = append(msgs, string(msg)) }); err != nil {
+		t.Fatalf("readEvents expected nil error, actual %v", err)
+	}
+	expected := []string{"{\"a\":\n1}", "second"}
+	if len(msgs) != len(expected) || msgs[0] != expected[0] || msgs[1] != expected[1] {
+		t.Errorf("readEvents expected %q, actual %q", expected, msgs)
+	}
+}
+
+func newTestStreamCtx(timeout time.Duration, url string) *StreamPollCtx {
+	gctx := streamGlobalInit(config.Config{HTTPTimeout: timeout, HTTPPollingFormat: "text/json"}, config.StaticAppData{UserAgent: "tm-test"})
+	return streamInit(PollerConfig{PollerID: "cache0", URL: url}, gctx).(*StreamPollCtx)
+}
+
+func TestStreamPollEventStream(t *testing.T) {
+	push := make(chan string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host != "cache0.example.net" {
+			t.Errorf("stream request expected host cache0.example.net, actual '%v'", r.Host)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case msg := <-push:
+				fmt.Fprintf(w, "data: %s\n\n", msg)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	defer server.Close()
+
+	ctx := newTestStreamCtx(2*time.Second, server.URL)
+	defer ctx.Close()
+
+	if _, _, _, err := streamPoll(ctx, server.URL+"/other", "cache0.example.net", 0); err == nil {
+		t.Errorf("streamPoll of a url not in the config expected error, actual nil")
+	}
+
+	go func() { push <- `{"n":1}` }()
+	bts, _, _, err := streamPoll(ctx, server.URL, "cache0.example.net", 1)
+	if err != nil {
+		t.Fatalf("streamPoll expected nil error, actual %v", err)
+	} else if string(bts) != `{"n":1}` {
+		t.Errorf("streamPoll expected first payload, actual '%v'", string(bts))
+	}
+
+	push <- `{"n":2}`
+	push <- `{"n":3}`
+	time.Sleep(100 * time.Millisecond) // let the stream read both payloads
+	if bts, _, _, err = streamPoll(ctx, server.URL, "cache0.example.net", 2); err != nil {
+		t.Fatalf("streamPoll expected nil error, actual %v", err)
+	} else if string(bts) != `{"n":3}` {
+		t.Errorf("streamPoll expected newest payload, actual '%v'", string(bts))
+	}
+
+	ctx.Timeout = 50 * time.Millisecond
+	if _, _, _, err := streamPoll(ctx, server.URL, "cache0.example.net", 3); err == nil {
+		t.Errorf("streamPoll with no new payload expected error, actual nil")
+	}
+
+	ctx.Close()
+	if _, _, _, err := streamPoll(ctx, server.URL, "cache0.example.net", 4); err == nil {
+		t.Errorf("streamPoll after Close expected error, actual nil")
+	}
+}
+
+func TestStreamPollWebSocket(t *testing.T) {
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		for i := 0; i < 3; i++ {
+			if err := websocket.Message.Send(conn, fmt.Sprintf(`{"n":%d}`, i)); err != nil {
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		ioutil.ReadAll(conn) // hold the connection open until the poller closes it
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http")
+	ctx := newTestStreamCtx(2*time.Second, wsURL)
+	defer ctx.Close()
+
+	bts, _, _, err := streamPoll(ctx, wsURL, "cache0.example.net", 1)
+	if err != nil {
+		t.Fatalf("streamPoll expected nil error, actual %v", err)
+	} else if !strings.HasPrefix(string(bts), `{"n":`) {
+		t.Errorf("streamPoll expected payload, actual '%v'", string(bts))
+	}
+	if ctype := ContentType(ctx); ctype != "text/json" {
+		t.Errorf("streamPoll expected content type text/json, actual '%v'", ctype)
+	}
+}
+
+// testPollHandler is a handler which discards results.
+type testPollHandler struct{}
+
+func (testPollHandler) Handle(id string, r io.Reader, format string, reqTime time.Duration, reqEnd time.Time, reqErr error, pollID uint64, usingIPv4 bool, pollCtx interface{}, pollFinished chan<- uint64) {
+	pollFinished <- pollID
+}
+
+func TestCachePollerStopsRemovedStreams(t *testing.T) {
+	connected := make(chan struct{}, 1)
+	disconnected := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush()
+		connected <- struct{}{}
+		<-r.Context().Done()
+		disconnected <- struct{}{}
+	}))
+	defer server.Close()
+
+	p := NewCache(time.Second, false, testPollHandler{}, config.Config{HTTPTimeout: time.Hour, HTTPPollingFormat: "text/json"}, config.StaticAppData{}, config.IPv4Only)
+	go p.Poll()
+	p.ConfigChannel <- CachePollerConfig{
+		Urls:            map[string]PollConfig{"cache0": {URL: server.URL, PollType: PollerTypeStream}},
+		Interval:        10 * time.Millisecond,
+		PollingProtocol: config.IPv4Only,
+	}
+	select {
+	case <-connected:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the poller to connect a stream")
+	}
+
+	// the poll is still waiting for stats, so the poller can't see the kill until it times out.
+	p.ConfigChannel <- CachePollerConfig{Urls: map[string]PollConfig{}, Interval: 10 * time.Millisecond, PollingProtocol: config.IPv4Only}
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the stream of a cache removed from the config to be stopped")
+		server.CloseClientConnections()
+	}
+	close(p.ConfigChannel)
+}
@@ -0,0 +1,61 @@
+package threadsafe
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"sync"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+)
+
+// PollErrorCounts is the number of failed polls of each cache, by poller, since this Traffic Monitor started. It is safe for multiple goroutines.
+type PollErrorCounts struct {
+	counts map[string]map[tc.CacheName]uint64
+	m      *sync.RWMutex
+}
+
+// NewPollErrorCounts returns a new PollErrorCounts safe for multiple goroutines.
+func NewPollErrorCounts() PollErrorCounts {
+	return PollErrorCounts{counts: map[string]map[tc.CacheName]uint64{}, m: &sync.RWMutex{}}
+}
+
+// Inc increments the number of failed polls of the given cache by the given poller.
+func (c PollErrorCounts) Inc(poller string, cacheName tc.CacheName) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.counts[poller] == nil {
+		c.counts[poller] = map[tc.CacheName]uint64{}
+	}
+	c.counts[poller][cacheName]++
+}
+
+// Get returns a copy of the number of failed polls of each cache, by poller.
+func (c PollErrorCounts) Get() map[string]map[tc.CacheName]uint64 {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	counts := make(map[string]map[tc.CacheName]uint64, len(c.counts))
+	for poller, pollerCounts := range c.counts {
+		counts[poller] = make(map[tc.CacheName]uint64, len(pollerCounts))
+		for cacheName, count := range pollerCounts {
+			counts[poller][cacheName] = count
+		}
+	}
+	return counts
+}
@@ -297,6 +297,41 @@ func (h ResultStatValHistory) Store(stat string, vals []tc.ResultStatVal) {
 	h.Map.Store(stat, vals)
 }
 
+// AddStat adds the given value of the given stat, taken at the given time, to
+// the history, keeping only up to `limit` records for the stat. As with
+// ResultStatHistory.Add, if the value is the same as the most recent one, the
+// most recent record's Span is incremented rather than adding a record, so the
+// records may span more than `limit` polls.
+//
+// If `limit` is zero, it will be treated as though it were one instead.
+func (h ResultStatValHistory) AddStat(stat string, val interface{}, t time.Time, limit uint64) error {
+	if limit == 0 {
+		limit = 1
+	}
+	history := h.Load(stat)
+	ok, err := newStatEqual(history, val)
+	if err != nil {
+		return errors.New("cannot add stat " + stat + ": " + err.Error())
+	}
+	if ok {
+		history[0].Time = t
+		history[0].Span++
+		h.Store(stat, history)
+		return nil
+	}
+
+	newHistory := make([]tc.ResultStatVal, 0, limit)
+	newHistory = append(newHistory, tc.ResultStatVal{Val: val, Time: t, Span: 1})
+	for _, old := range history {
+		if uint64(len(newHistory)) >= limit {
+			break
+		}
+		newHistory = append(newHistory, old)
+	}
+	h.Store(stat, newHistory)
+	return nil
+}
+
 // CacheStatHistory is the type of a single record in a ResultStatHistory map.
 // It contains interface statistics as well as historical statistics for each
 // of a cache server's polled interfaces.
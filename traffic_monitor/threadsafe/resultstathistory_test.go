@@ -309,3 +309,34 @@ func TestCompareAndAppendStatForInterface(t *testing.T) {
 		t.Errorf("Incorrect value from comparing previously non-existent interface stat; want: %d, got: %d", stat.Stat, v)
 	}
 }
+
+func TestResultStatValHistoryAddStat(t *testing.T) {
+	hist := NewResultStatValHistory()
+	start := time.Now()
+	for i, val := range []float64{1, 2, 2, 3, 4} {
+		if err := hist.AddStat("loadavg", val, start.Add(time.Duration(i)*time.Second), 3); err != nil {
+			t.Fatalf("adding stat: %v", err)
+		}
+	}
+
+	vals := hist.Load("loadavg")
+	if len(vals) != 3 {
+		t.Fatalf("expected 3 records, actual %d: %+v", len(vals), vals)
+	}
+	expected := []struct {
+		val  float64
+		span uint64
+	}{{4, 1}, {3, 1}, {2, 2}}
+	for i, exp := range expected {
+		if vals[i].Val != exp.val || vals[i].Span != exp.span {
+			t.Errorf("record %d expected value %v span %v, actual value %v span %v", i, exp.val, exp.span, vals[i].Val, vals[i].Span)
+		}
+	}
+	if !vals[2].Time.Equal(start.Add(2 * time.Second)) {
+		t.Errorf("expected repeated value's time to be updated to its latest sample %v, actual %v", start.Add(2*time.Second), vals[2].Time)
+	}
+
+	if err := hist.AddStat("loadavg", []string{"not comparable"}, start, 3); err == nil {
+		t.Error("adding incomparable stat expected: error, actual: nil")
+	}
+}
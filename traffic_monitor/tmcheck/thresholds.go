@@ -0,0 +1,166 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+package tmcheck
+
+import (
+	"sort"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/health"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
+	"github.com/apache/trafficcontrol/traffic_monitor/threadsafe"
+)
+
+// Downtime is a period a cache would have been marked unavailable by its health thresholds.
+type Downtime struct {
+	Cache tc.CacheName `json:"cache"`
+	Start time.Time    `json:"start"`
+	// End is the time of the first sample the cache was available again, or of its last sample if it never was.
+	End time.Time `json:"end"`
+	// Ongoing is whether the cache was still unavailable at its last sample.
+	Ongoing bool `json:"ongoing"`
+	// Reason is why the cache was marked unavailable, as it would have been in the Traffic Monitor event log.
+	Reason string `json:"reason"`
+	// SampleInterval is the median time between the cache's samples. The start and end are only as precise as it, because the cache's state between samples is unknown.
+	SampleInterval time.Duration `json:"sampleInterval"`
+}
+
+// Replay is the result of replaying a Traffic Monitor history against thresholds.
+type Replay struct {
+	// Downtimes is the periods each cache would have been unavailable, sorted by cache and then time.
+	Downtimes []Downtime `json:"downtimes"`
+	// Caches is the number of caches whose samples were evaluated against their thresholds.
+	Caches int `json:"caches"`
+	// Samples is the number of samples evaluated.
+	Samples int `json:"samples"`
+	// MissingStats is the caches of each threshold stat which wasn't in any of their samples, so its threshold was never evaluated for them, sorted by cache.
+	MissingStats map[string][]tc.CacheName `json:"missingStats"`
+}
+
+// Duration returns how long the cache would have been unavailable.
+func (d Downtime) Duration() time.Duration {
+	return d.End.Sub(d.Start)
+}
+
+// ReplayThresholds evaluates the given thresholds against the given stat samples of a cache, oldest first, as Traffic Monitor evaluates polled stats, and returns the periods the cache would have been unavailable, oldest first. Thresholds over multiple samples count the given samples, so if they were downsampled, as the Traffic Monitor history is, they span more time than they would when polled.
+func ReplayThresholds(cacheName tc.CacheName, samples []history.StatSample, thresholds map[string]tc.HealthThreshold) []Downtime {
+	downtimes := []Downtime{}
+	thresholdStats := threadsafe.NewResultStatValHistory()
+	unavailableStat := ""
+	downtime := (*Downtime)(nil)
+	interval := sampleInterval(samples)
+	for _, sample := range samples {
+		available, reason, stat := health.EvalStats(sample.Stats, sample.Time, thresholds, &thresholdStats, unavailableStat)
+		unavailableStat = stat
+		if !available && downtime == nil {
+			downtime = &Downtime{Cache: cacheName, Start: sample.Time, Reason: reason, SampleInterval: interval}
+		} else if available && downtime != nil {
+			downtime.End = sample.Time
+			downtimes = append(downtimes, *downtime)
+			downtime = nil
+		}
+	}
+	if downtime != nil {
+		downtime.End = samples[len(samples)-1].Time
+		downtime.Ongoing = true
+		downtimes = append(downtimes, *downtime)
+	}
+	return downtimes
+}
+
+// sampleInterval returns the median time between the given samples, oldest first, or 0 if there are fewer than 2.
+func sampleInterval(samples []history.StatSample) time.Duration {
+	if len(samples) < 2 {
+		return 0
+	}
+	intervals := make([]time.Duration, 0, len(samples)-1)
+	for i := 1; i < len(samples); i++ {
+		intervals = append(intervals, samples[i].Time.Sub(samples[i-1].Time))
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i] < intervals[j] })
+	return intervals[len(intervals)/2]
+}
+
+// missingStats returns the stats of the given thresholds which aren't in any of the given samples, sorted.
+func missingStats(samples []history.StatSample, thresholds map[string]tc.HealthThreshold) []string {
+	missing := []string{}
+	for stat := range thresholds {
+		found := false
+		for _, sample := range samples {
+			if _, ok := sample.Stats[stat]; ok {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, stat)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+// ReplayHistory replays the stat samples from start to end of each cache in the given Traffic Monitor history, using the thresholds of the cache's profile in the given monitoring config, or the thresholds of the profile in the given proposed parameters if it has them. It returns the periods each cache would have been unavailable, and how much was evaluated.
+//
+// Only the thresholds are replayed. Caches which aren't REPORTED in the monitoring config, whose thresholds aren't used, or aren't in it at all, or which have no samples, are skipped. Thresholds on stats which weren't recorded can't be evaluated, and are returned in the replay's MissingStats.
+func ReplayHistory(store *history.Store, monitoringConfig tc.TrafficMonitorConfig, proposed map[string]tc.TMParameters, start time.Time, end time.Time) (Replay, error) {
+	servers := make(map[string]tc.TrafficServer, len(monitoringConfig.TrafficServers))
+	for _, server := range monitoringConfig.TrafficServers {
+		servers[server.HostName] = server
+	}
+	profileThresholds := make(map[string]map[string]tc.HealthThreshold, len(monitoringConfig.Profiles))
+	for _, profile := range monitoringConfig.Profiles {
+		profileThresholds[profile.Name] = profile.Parameters.Thresholds
+	}
+	for profileName, params := range proposed {
+		profileThresholds[profileName] = params.Thresholds
+	}
+
+	caches, err := store.Caches()
+	if err != nil {
+		return Replay{}, err
+	}
+	replay := Replay{Downtimes: []Downtime{}, MissingStats: map[string][]tc.CacheName{}}
+	for _, cacheName := range caches {
+		server, ok := servers[cacheName]
+		if !ok || tc.CacheStatusFromString(server.ServerStatus) != tc.CacheStatusReported {
+			continue
+		}
+		thresholds := profileThresholds[server.Profile]
+		if len(thresholds) == 0 {
+			continue
+		}
+		samples, err := store.Stats(cacheName, start, end, nil)
+		if err != nil {
+			return Replay{}, err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		replay.Caches++
+		replay.Samples += len(samples)
+		for _, stat := range missingStats(samples, thresholds) {
+			replay.MissingStats[stat] = append(replay.MissingStats[stat], tc.CacheName(cacheName))
+		}
+		replay.Downtimes = append(replay.Downtimes, ReplayThresholds(tc.CacheName(cacheName), samples, thresholds)...)
+	}
+	return replay, nil
+}
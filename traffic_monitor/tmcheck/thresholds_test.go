@@ -0,0 +1,124 @@
+package tmcheck
+
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
+)
+
+func TestReplayThresholds(t *testing.T) {
+	thresholds := map[string]tc.HealthThreshold{"loadavg": {Val: 10, Comparator: "<"}}
+	start := time.Now()
+	loadavgs := []float64{1, 12, 15, 2, 3, 11}
+	samples := []history.StatSample{}
+	for i, loadavg := range loadavgs {
+		samples = append(samples, history.StatSample{Time: start.Add(time.Duration(i) * time.Minute), Stats: map[string]interface{}{"loadavg": loadavg}})
+	}
+
+	downtimes := ReplayThresholds("cache0", samples, thresholds)
+	if len(downtimes) != 2 {
+		t.Fatalf("expected 2 downtimes, actual %+v", downtimes)
+	}
+	if downtimes[0].Cache != "cache0" || !downtimes[0].Start.Equal(samples[1].Time) || downtimes[0].Duration() != 2*time.Minute || downtimes[0].Ongoing {
+		t.Errorf("expected a finished 2 minute downtime from the second sample, actual %+v", downtimes[0])
+	}
+	if downtimes[0].SampleInterval != time.Minute {
+		t.Errorf("expected the 1 minute interval between samples, actual %v", downtimes[0].SampleInterval)
+	}
+	if downtimes[0].Reason != "loadavg too high (12.00 > 10.00)" {
+		t.Errorf("expected the reason of the first sample outside the threshold, actual '%s'", downtimes[0].Reason)
+	}
+	if !downtimes[1].Start.Equal(samples[5].Time) || downtimes[1].Duration() != 0 || !downtimes[1].Ongoing {
+		t.Errorf("expected an ongoing downtime at the last sample, actual %+v", downtimes[1])
+	}
+
+	if downtimes := ReplayThresholds("cache0", nil, thresholds); len(downtimes) != 0 {
+		t.Errorf("expected no downtimes without samples, actual %+v", downtimes)
+	}
+}
+
+func TestReplayHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tm-replay")
+	if err != nil {
+		t.Fatalf("creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	start := time.Now().Add(-10 * time.Minute)
+	store, err := history.Open(path, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("opening store: %v", err)
+	}
+	for i, loadavg := range []float64{1, 12, 2} {
+		store.AddStats("cache0", start.Add(time.Duration(i)*time.Minute), map[string]interface{}{"loadavg": loadavg})
+		store.AddStats("cache1", start.Add(time.Duration(i)*time.Minute), map[string]interface{}{"loadavg": loadavg})
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("closing store: %v", err)
+	}
+	store, err = history.OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("opening read-only store: %v", err)
+	}
+	defer store.Close()
+
+	monitoringConfig := tc.TrafficMonitorConfig{
+		TrafficServers: []tc.TrafficServer{
+			{HostName: "cache0", Profile: "EDGE", ServerStatus: string(tc.CacheStatusReported)},
+			{HostName: "cache1", Profile: "EDGE", ServerStatus: string(tc.CacheStatusAdminDown)},
+		},
+		Profiles: []tc.TMProfile{{Name: "EDGE", Parameters: tc.TMParameters{Thresholds: map[string]tc.HealthThreshold{"loadavg": {Val: 100, Comparator: "<"}}}}},
+	}
+	proposed := map[string]tc.TMParameters{"EDGE": {Thresholds: map[string]tc.HealthThreshold{
+		"loadavg":   {Val: 10, Comparator: "<"},
+		"queryTime": {Val: 1000, Comparator: "<"},
+	}}}
+
+	replay, err := ReplayHistory(store, monitoringConfig, proposed, start, time.Now())
+	if err != nil {
+		t.Fatalf("replaying history: %v", err)
+	}
+	if replay.Caches != 1 || replay.Samples != 3 {
+		t.Errorf("expected 3 samples of the REPORTED cache evaluated, actual %v samples of %v caches", replay.Samples, replay.Caches)
+	}
+	if len(replay.Downtimes) != 1 || replay.Downtimes[0].Cache != "cache0" {
+		t.Errorf("expected 1 downtime of cache0 by the proposed threshold, actual %+v", replay.Downtimes)
+	}
+	if expected := map[string][]tc.CacheName{"queryTime": {"cache0"}}; !reflect.DeepEqual(replay.MissingStats, expected) {
+		t.Errorf("expected missing stats %+v, actual %+v", expected, replay.MissingStats)
+	}
+
+	replay, err = ReplayHistory(store, monitoringConfig, proposed, start.Add(-time.Hour), start.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("replaying history: %v", err)
+	}
+	if replay.Caches != 0 || len(replay.Downtimes) != 0 {
+		t.Errorf("expected nothing evaluated before the first sample, actual %+v", replay)
+	}
+}
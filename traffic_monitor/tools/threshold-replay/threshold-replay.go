@@ -0,0 +1,207 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *   http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ */
+
+// threshold-replay replays the stats recorded in a Traffic Monitor history database against proposed health threshold parameters, and reports which caches would have been marked unavailable, when, and for how long.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/apache/trafficcontrol/lib/go-tc"
+	"github.com/apache/trafficcontrol/traffic_monitor/history"
+	"github.com/apache/trafficcontrol/traffic_monitor/tmcheck"
+)
+
+// DefaultPeriod is how long before the end time the replay starts, if no start is given.
+const DefaultPeriod = 7 * 24 * time.Hour
+
+func main() {
+	dbPath := flag.String("db", "", "The Traffic Monitor history database, a copy of the history.path file of a Traffic Monitor")
+	monitoringPath := flag.String("monitoring", "", "The Traffic Ops monitoring config of the CDN, from /api/{version}/cdns/{name}/configs/monitoring, with the current profile parameters")
+	thresholdsPath := flag.String("thresholds", "", "A JSON object of profile names and their proposed health.threshold parameters, which replace the profile's current thresholds. If empty, the current thresholds are replayed")
+	startStr := flag.String("start", "", "The RFC3339 time to start the replay. Defaults to a week before the end")
+	endStr := flag.String("end", "", "The RFC3339 time to end the replay. Defaults to now")
+	cacheName := flag.String("cache", "", "The cache to replay. Defaults to all caches in the history")
+	jsonOutput := flag.Bool("json", false, "Whether to output the downtimes as JSON")
+	help := flag.Bool("help", false, "Usage info")
+	helpBrief := flag.Bool("h", false, "Usage info")
+	flag.Parse()
+	if *help || *helpBrief || *dbPath == "" || *monitoringPath == "" {
+		fmt.Printf("Usage: ./threshold-replay -db history.db -monitoring monitoring.json -thresholds proposed.json -start 2020-06-01T00:00:00Z -end 2020-06-08T00:00:00Z\n")
+		return
+	}
+
+	end := time.Now()
+	if *endStr != "" {
+		t, err := time.Parse(time.RFC3339, *endStr)
+		if err != nil {
+			exit("Error parsing end: " + err.Error())
+		}
+		end = t
+	}
+	start := end.Add(-DefaultPeriod)
+	if *startStr != "" {
+		t, err := time.Parse(time.RFC3339, *startStr)
+		if err != nil {
+			exit("Error parsing start: " + err.Error())
+		}
+		start = t
+	}
+
+	monitoringConfig, err := loadMonitoringConfig(*monitoringPath)
+	if err != nil {
+		exit("Error loading monitoring config: " + err.Error())
+	}
+	if *cacheName != "" {
+		servers := []tc.TrafficServer{}
+		for _, server := range monitoringConfig.TrafficServers {
+			if server.HostName == *cacheName {
+				servers = append(servers, server)
+			}
+		}
+		monitoringConfig.TrafficServers = servers
+	}
+
+	proposed := map[string]tc.TMParameters{}
+	if *thresholdsPath != "" {
+		bts, err := ioutil.ReadFile(*thresholdsPath)
+		if err != nil {
+			exit("Error reading thresholds: " + err.Error())
+		}
+		if err := json.Unmarshal(bts, &proposed); err != nil {
+			exit("Error parsing thresholds: " + err.Error())
+		}
+	}
+
+	store, err := history.OpenReadOnly(*dbPath)
+	if err != nil {
+		exit("Error opening history: " + err.Error())
+	}
+	replay, err := tmcheck.ReplayHistory(store, monitoringConfig, proposed, start, end)
+	store.Close()
+	if err != nil {
+		exit("Error replaying history: " + err.Error())
+	}
+	if replay.Caches == 0 {
+		exit("No samples of REPORTED caches with thresholds were recorded from " + start.Format(time.RFC3339) + " to " + end.Format(time.RFC3339) + ", so nothing was evaluated.")
+	}
+	printMissingStats(replay.MissingStats)
+
+	if *jsonOutput {
+		bts, err := json.MarshalIndent(replay, "", "  ")
+		if err != nil {
+			exit("Error encoding replay: " + err.Error())
+		}
+		fmt.Println(string(bts))
+		return
+	}
+	fmt.Printf("Replayed %d samples of %d caches.\n\n", replay.Samples, replay.Caches)
+	printDowntimes(replay.Downtimes)
+}
+
+// printMissingStats prints a warning to stderr for each threshold stat which wasn't recorded for some caches, and so was never evaluated for them.
+func printMissingStats(missingStats map[string][]tc.CacheName) {
+	stats := make([]string, 0, len(missingStats))
+	for stat := range missingStats {
+		stats = append(stats, stat)
+	}
+	sort.Strings(stats)
+	for _, stat := range stats {
+		caches := missingStats[stat]
+		names := make([]string, 0, len(caches))
+		for _, cache := range caches {
+			names = append(names, string(cache))
+		}
+		fmt.Fprintf(os.Stderr, "Warning: threshold stat '%s' wasn't recorded for %d caches (%s), so its threshold wasn't evaluated for them. Recorded stats are configured by the Traffic Monitor history stats.\n", stat, len(caches), strings.Join(names, ", "))
+	}
+}
+
+// loadMonitoringConfig loads the Traffic Ops monitoring config in the given file, which may be the Traffic Ops API response or only its response object.
+func loadMonitoringConfig(path string) (tc.TrafficMonitorConfig, error) {
+	bts, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tc.TrafficMonitorConfig{}, err
+	}
+	resp := tc.TMConfigResponse{}
+	if err := json.Unmarshal(bts, &resp); err != nil {
+		return tc.TrafficMonitorConfig{}, err
+	}
+	if len(resp.Response.TrafficServers) > 0 {
+		return resp.Response, nil
+	}
+	cfg := tc.TrafficMonitorConfig{}
+	if err := json.Unmarshal(bts, &cfg); err != nil {
+		return tc.TrafficMonitorConfig{}, err
+	}
+	if len(cfg.TrafficServers) == 0 {
+		return tc.TrafficMonitorConfig{}, errors.New("no trafficServers")
+	}
+	return cfg, nil
+}
+
+// printDowntimes prints each downtime, followed by the total of each cache. Durations are printed with the cache's sample interval, which is their precision.
+func printDowntimes(downtimes []tmcheck.Downtime) {
+	if len(downtimes) == 0 {
+		fmt.Println("No caches would have been marked unavailable.")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CACHE\tSTART\tEND\tDURATION\tSAMPLE INTERVAL\tREASON")
+	totals := map[tc.CacheName]time.Duration{}
+	counts := map[tc.CacheName]int{}
+	intervals := map[tc.CacheName]time.Duration{}
+	for _, downtime := range downtimes {
+		endStr := downtime.End.Format(time.RFC3339)
+		if downtime.Ongoing {
+			endStr += " (ongoing)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", downtime.Cache, downtime.Start.Format(time.RFC3339), endStr, downtime.Duration(), downtime.SampleInterval, downtime.Reason)
+		totals[downtime.Cache] += downtime.Duration()
+		counts[downtime.Cache]++
+		intervals[downtime.Cache] = downtime.SampleInterval
+	}
+	w.Flush()
+
+	caches := make([]tc.CacheName, 0, len(totals))
+	for cache := range totals {
+		caches = append(caches, cache)
+	}
+	sort.Slice(caches, func(i, j int) bool { return caches[i] < caches[j] })
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CACHE\tTIMES\tTOTAL\tSAMPLE INTERVAL")
+	for _, cache := range caches {
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", cache, counts[cache], totals[cache], intervals[cache])
+	}
+	w.Flush()
+}
+
+func exit(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(1)
+}
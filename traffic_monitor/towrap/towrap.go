@@ -213,6 +213,17 @@ func NewTrafficOpsSessionThreadsafe(s *client.Session, ls *legacyClient.Session,
 	}
 }
 
+// ForCDN returns a session for monitoring an additional CDN. It shares this
+// session's Traffic Ops connection, but stores its CRConfig history in hist,
+// and appends the CDN name to its backup file names, so they don't overwrite
+// the files of this session's CDN.
+func (s TrafficOpsSessionThreadsafe) ForCDN(cdn string, hist CRConfigHistoryThreadsafe) TrafficOpsSessionThreadsafe {
+	s.crConfigHist = hist
+	s.CRConfigBackupFile += "." + cdn
+	s.TMConfigBackupFile += "." + cdn
+	return s
+}
+
 // Initialized tells whether or not the TrafficOpsSessionThreadsafe has been
 // properly initialized (by calling 'Update').
 func (s TrafficOpsSessionThreadsafe) Initialized() bool {